@@ -1,9 +1,11 @@
 package benchmark
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -52,3 +54,117 @@ func BenchmarkSDBGet(b *testing.B) {
 		assert.Nil(b, err)
 	}
 }
+
+// 每次写都刷盘，并发写的协程组提交，一次刷盘持久化一批写入
+func BenchmarkSDBSetSyncParallel(b *testing.B) {
+	syncDB, closeDB := openBenchDB(b, "test/benchmark-sync", func(opts *options.Options) {
+		opts.SyncPolicy = options.SyncAlways
+	})
+	defer closeDB()
+
+	var n int64
+	b.SetParallelism(64)
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			err := syncDB.Set(getKey32Bytes(int(atomic.AddInt64(&n, 1))), getValue128Bytes())
+			assert.Nil(b, err)
+		}
+	})
+}
+
+// 带写缓冲的标准IO，和BenchmarkSDBSet对比
+func BenchmarkSDBSetBufferedIO(b *testing.B) {
+	bufferedDB, closeDB := openBenchDB(b, "test/benchmark-buffered", func(opts *options.Options) {
+		opts.IoType = options.BufferedIO
+	})
+	defer closeDB()
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		err := bufferedDB.Set(getKey32Bytes(i), getValue128Bytes())
+		assert.Nil(b, err)
+	}
+}
+
+// 不经过page cache的direct IO，每次写都要整块写，和BenchmarkSDBSet对比
+func BenchmarkSDBSetDirectIO(b *testing.B) {
+	directDB, closeDB := openBenchDB(b, "test/benchmark-direct", func(opts *options.Options) {
+		opts.IoType = options.DirectIO
+	})
+	defer closeDB()
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		err := directDB.Set(getKey32Bytes(i), getValue128Bytes())
+		assert.Nil(b, err)
+	}
+}
+
+// 反复读少量热点key，开启value缓存之后不用每次读文件
+func BenchmarkSDBGetValueCache(b *testing.B) {
+	cacheDB, closeDB := openBenchDB(b, "test/benchmark-value-cache", func(opts *options.Options) {
+		opts.ValueCacheSize = 16 << 20
+	})
+	defer closeDB()
+
+	hotKeys := 100
+	for i := 0; i < hotKeys; i++ {
+		err := cacheDB.Set(getKey32Bytes(i), getValue128Bytes())
+		assert.Nil(b, err)
+	}
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, err := cacheDB.Get(getKey32Bytes(i % hotKeys))
+		assert.Nil(b, err)
+	}
+}
+
+// mmap方式读非活跃文件中的大value，GetView不拷贝，对比Get
+func BenchmarkSDBGetView(b *testing.B) {
+	viewDB, closeDB := openBenchDB(b, "test/benchmark-view", func(opts *options.Options) {
+		opts.IoType = options.MMap
+		opts.LogFileSizeThreshold = 1 << 20
+	})
+	defer closeDB()
+
+	keys := 1000
+	value := bytes.Repeat(getValue128Bytes(), 32)
+	for i := 0; i < keys; i++ {
+		err := viewDB.Set(getKey32Bytes(i), value)
+		assert.Nil(b, err)
+	}
+	b.Run("Get", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := viewDB.Get(getKey32Bytes(i % keys))
+			assert.Nil(b, err)
+		}
+	})
+	b.Run("GetView", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, release, err := viewDB.GetView(getKey32Bytes(i % keys))
+			assert.Nil(b, err)
+			release()
+		}
+	})
+}
+
+// 单独打开一个db，不影响其他benchmark用的db，返回关闭并删除它的函数
+func openBenchDB(b *testing.B, dir string, setOpts func(opts *options.Options)) (*sdb.SDB, func()) {
+	pwd, _ := os.Getwd()
+	opts := options.NewDefaultOptions(filepath.Join(pwd, dir))
+	setOpts(&opts)
+	benchDB, err := sdb.OpenDB(opts)
+	assert.Nil(b, err)
+	return benchDB, func() {
+		b.StopTimer()
+		_ = benchDB.CloseDB()
+		_ = os.RemoveAll(opts.DBPath)
+	}
+}
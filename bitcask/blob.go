@@ -0,0 +1,111 @@
+package bitcask
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// 键值分离：大value单独写到blob文件，日志文件中的record只保存指向blob文件的指针，
+// merge日志文件时只需要搬指针，不用把大value重写一遍
+// blob文件的格式和日志文件一样，每种数据类型一组，文件名 blob.<type>.<fid>，
+// 其中的record是完整的原始record（key、value、过期时间），merge blob文件时用key查索引判断是否有效
+// 日志文件中的指针record：type置TypeBlob位，value是 file_id | offset | size，varint编码
+
+// TypeBlob record type字节的次高位，置位表示value是指向blob文件的指针
+const TypeBlob RecordType = 1 << 6
+
+// BlobFilePrefix blob文件统一前缀，不能用log.，否则会被当成日志文件
+const BlobFilePrefix = "blob."
+
+// ErrInvalidBlobPointer blob指针解码失败
+var ErrInvalidBlobPointer = errors.New("invalid blob pointer")
+
+// BlobPointer 大value所在的blob record在blob文件中的位置
+type BlobPointer struct {
+	FileID uint32
+	Offset int64
+	Size   int64
+}
+
+// EncodeBlobPointer 编码blob指针，作为日志文件中record的value
+func EncodeBlobPointer(p *BlobPointer) []byte {
+	buf := make([]byte, binary.MaxVarintLen32+binary.MaxVarintLen64*2)
+	var index int
+	index += binary.PutUvarint(buf[index:], uint64(p.FileID))
+	index += binary.PutVarint(buf[index:], p.Offset)
+	index += binary.PutVarint(buf[index:], p.Size)
+	return buf[:index]
+}
+
+// DecodeBlobPointer 解码blob指针，返回指针和占用的字节数
+func DecodeBlobPointer(buf []byte) (*BlobPointer, int, error) {
+	var index int
+	fileID, n := binary.Uvarint(buf[index:])
+	if n <= 0 || fileID > uint64(^uint32(0)) {
+		return nil, 0, ErrInvalidBlobPointer
+	}
+	index += n
+	offset, n := binary.Varint(buf[index:])
+	if n <= 0 {
+		return nil, 0, ErrInvalidBlobPointer
+	}
+	index += n
+	size, n := binary.Varint(buf[index:])
+	if n <= 0 || offset < 0 || size <= 0 {
+		return nil, 0, ErrInvalidBlobPointer
+	}
+	index += n
+	return &BlobPointer{FileID: uint32(fileID), Offset: offset, Size: size}, index, nil
+}
+
+// BlobFileName 拼接blob文件全路径，example: path/blob.string.0000000001
+func BlobFileName(path string, fID uint32, fType FileType) (string, error) {
+	logName, ok := FileNameMap[fType]
+	if !ok {
+		return "", ErrUnsupportedLogFileType
+	}
+	fName := BlobFilePrefix + logName[len(FilePrefix):] + fmt.Sprintf("%010d", fID)
+	return filepath.Join(path, fName), nil
+}
+
+// ParseBlobFileName 从blob文件名解析出文件类型和id，example: blob.string.0000000001
+func ParseBlobFileName(name string) (FileType, uint32, error) {
+	if !strings.HasPrefix(name, BlobFilePrefix) {
+		return 0, 0, ErrInvalidLogFileName
+	}
+	splitNames := strings.Split(name[len(BlobFilePrefix):], ".")
+	if len(splitNames) != 2 {
+		return 0, 0, ErrInvalidLogFileName
+	}
+	fType, ok := FileTypesMap[splitNames[0]]
+	if !ok {
+		return 0, 0, ErrUnsupportedLogFileType
+	}
+	id, err := strconv.ParseUint(splitNames[1], 10, 32)
+	if err != nil {
+		return 0, 0, ErrInvalidLogFileName
+	}
+	return fType, uint32(id), nil
+}
+
+// OpenBlobFile 打开或者新建blob文件，加密和日志文件一样
+func OpenBlobFile(path string, fID uint32, fSize int64, fType FileType, ioType IOType, keyring *Keyring) (*LogFile, error) {
+	fileName, err := BlobFileName(path, fID, fType)
+	if err != nil {
+		return nil, err
+	}
+	return openLogFile(fileName, fID, fSize, fType, ioType, keyring)
+}
+
+// OpenReadOnlyBlobFile 只读打开已有的非活跃blob文件，和OpenReadOnlyLogFile一样读的时候才打开
+func OpenReadOnlyBlobFile(path string, fID uint32, fType FileType, ioType IOType, keyring *Keyring, cache *FileCache) (*LogFile, error) {
+	fileName, err := BlobFileName(path, fID, fType)
+	if err != nil {
+		return nil, err
+	}
+	return openReadOnlyLogFile(fileName, fID, fType, ioType, keyring, cache)
+}
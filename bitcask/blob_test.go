@@ -0,0 +1,59 @@
+package bitcask
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlobPointer(t *testing.T) {
+	p := &BlobPointer{FileID: 7, Offset: LogFileHeaderSize, Size: 1 << 20}
+	buf := EncodeBlobPointer(p)
+	got, n, err := DecodeBlobPointer(append(buf, "tail"...))
+	assert.Nil(t, err)
+	assert.Equal(t, p, got)
+	assert.Equal(t, len(buf), n)
+
+	for _, bad := range [][]byte{nil, buf[:1], EncodeBlobPointer(&BlobPointer{FileID: 1, Offset: 32})} {
+		_, _, err = DecodeBlobPointer(bad)
+		assert.Equal(t, ErrInvalidBlobPointer, err)
+	}
+}
+
+func TestBlobFileName(t *testing.T) {
+	name, err := BlobFileName("/tmp", 12, Hash)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join("/tmp", "blob.hash.0000000012"), name)
+
+	fType, fID, err := ParseBlobFileName(filepath.Base(name))
+	assert.Nil(t, err)
+	assert.Equal(t, Hash, fType)
+	assert.Equal(t, uint32(12), fID)
+
+	// 日志文件和hint文件不是blob文件，blob文件也不会被当成日志文件
+	for _, name := range []string{"log.hash.0000000012", "hint.hash.0000000012", "blob.hash", "blob.str.0000000001"} {
+		_, _, err = ParseBlobFileName(name)
+		assert.NotNil(t, err, name)
+	}
+	_, _, err = ParseLogFileName("blob.hash.0000000012")
+	assert.NotNil(t, err)
+}
+
+func TestOpenBlobFile(t *testing.T) {
+	path := t.TempDir()
+	lf, err := OpenBlobFile(path, 1, 4096, List, FileIO, nil)
+	assert.Nil(t, err)
+	buf, size := lf.EncodeRecord(&LogRecord{Key: []byte("key"), Value: []byte("big value")})
+	assert.Nil(t, lf.Write(buf))
+	assert.Nil(t, lf.Close())
+
+	lf, err = OpenBlobFile(path, 1, 4096, List, MMap, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, List, lf.Header.FileType)
+	lr, n, err := lf.ReadLogRecord(lf.DataOffset)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(size), n)
+	assert.Equal(t, []byte("big value"), lr.Value)
+	assert.Nil(t, lf.Close())
+}
@@ -0,0 +1,78 @@
+package bitcask
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+)
+
+// TypeCompressed record type字节的最高位，置位表示value用flate压缩过，低位还是原来的type
+// v1和v2 record都能用，老的没压缩的record最高位都是0，照常读取
+const TypeCompressed RecordType = 1 << 7
+
+// ErrInvalidCompressedValue 压缩过的value解压失败
+var ErrInvalidCompressedValue = errors.New("invalid compressed value")
+
+// flate的writer和reader创建时分配的内存很大，复用
+var (
+	flateWriterPool = sync.Pool{
+		New: func() interface{} {
+			w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+			return w
+		},
+	}
+	flateReaderPool = sync.Pool{
+		New: func() interface{} {
+			return flate.NewReader(nil)
+		},
+	}
+)
+
+// CompressRecord 压缩record的value，返回新的record，不修改传入的record
+// 只压缩普通的record，value小于minSize或者压缩后没有变小时原样返回
+func CompressRecord(lr *LogRecord, minSize int) *LogRecord {
+	if lr.Type != TypeDefault || len(lr.Value) == 0 || len(lr.Value) < minSize {
+		return lr
+	}
+
+	var buf bytes.Buffer
+	w := flateWriterPool.Get().(*flate.Writer)
+	defer flateWriterPool.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(lr.Value); err != nil {
+		return lr
+	}
+	if err := w.Close(); err != nil {
+		return lr
+	}
+	if buf.Len() >= len(lr.Value) {
+		return lr
+	}
+
+	compressed := *lr
+	compressed.Value = buf.Bytes()
+	compressed.Type |= TypeCompressed
+	return &compressed
+}
+
+// DecompressRecord 解压被压缩过的value，并清掉type中的压缩位，没压缩过的record不处理
+func DecompressRecord(lr *LogRecord) error {
+	if lr.Type&TypeCompressed == 0 {
+		return nil
+	}
+
+	r := flateReaderPool.Get().(io.ReadCloser)
+	defer flateReaderPool.Put(r)
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(lr.Value), nil); err != nil {
+		return ErrInvalidCompressedValue
+	}
+	value, err := io.ReadAll(r)
+	if err != nil {
+		return ErrInvalidCompressedValue
+	}
+	lr.Value = value
+	lr.Type &^= TypeCompressed
+	return nil
+}
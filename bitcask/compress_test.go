@@ -0,0 +1,60 @@
+package bitcask
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressRecord(t *testing.T) {
+	value := bytes.Repeat([]byte(`{"name":"sdb","tags":["a","b"]}`), 20)
+	record := &LogRecord{Key: []byte("key"), Value: value, ExpiredAt: 100}
+
+	compressed := CompressRecord(record, 64)
+	assert.Equal(t, TypeDefault|TypeCompressed, compressed.Type)
+	assert.Less(t, len(compressed.Value), len(value))
+	// 不修改传入的record
+	assert.Equal(t, value, record.Value)
+	assert.Equal(t, TypeDefault, record.Type)
+
+	assert.Nil(t, DecompressRecord(compressed))
+	assert.Equal(t, record, compressed)
+
+	// 太小、压缩后没变小、不是普通record的都不压缩
+	assert.Equal(t, record, CompressRecord(record, len(value)+1))
+	random := &LogRecord{Key: []byte("key"), Value: []byte{0x8f, 0x13, 0x5a, 0xc1, 0x07, 0xee}}
+	assert.Equal(t, random, CompressRecord(random, 0))
+	seq := &LogRecord{Key: []byte("key"), Value: value, Type: TypeListSeq}
+	assert.Equal(t, seq, CompressRecord(seq, 0))
+
+	// 没压缩过的不处理
+	plain := &LogRecord{Key: []byte("key"), Value: []byte("value")}
+	assert.Nil(t, DecompressRecord(plain))
+	assert.Equal(t, []byte("value"), plain.Value)
+
+	bad := &LogRecord{Key: []byte("key"), Value: []byte("not flate"), Type: TypeCompressed}
+	assert.Equal(t, ErrInvalidCompressedValue, DecompressRecord(bad))
+}
+
+func TestLogFile_ReadCompressedRecord(t *testing.T) {
+	value := bytes.Repeat([]byte("compressible "), 50)
+	for _, ioType := range []IOType{FileIO, MMap} {
+		lf, err := OpenLogFile(t.TempDir(), 1, 4096, Hash, ioType)
+		assert.Nil(t, err)
+		buf, _ := lf.EncodeRecord(CompressRecord(&LogRecord{Key: []byte("key"), Value: value}, 0))
+		assert.Nil(t, lf.Write(buf))
+		plain, _ := lf.EncodeRecord(&LogRecord{Key: []byte("old"), Value: value})
+		assert.Nil(t, lf.Write(plain))
+
+		lr, size, err := lf.ReadLogRecord(lf.DataOffset)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(buf)), size)
+		assert.Equal(t, value, lr.Value)
+		assert.Equal(t, TypeDefault, lr.Type)
+		lr, _, err = lf.ReadLogRecord(lf.DataOffset + size)
+		assert.Nil(t, err)
+		assert.Equal(t, value, lr.Value)
+		assert.Nil(t, lf.Close())
+	}
+}
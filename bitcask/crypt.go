@@ -0,0 +1,168 @@
+package bitcask
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// 静态加密：v2日志文件的文件头中记录加密用的key id和密钥校验值，文件中每条record的key和value一起用AES-GCM加密
+// 加密后的record：key是 nonce | 密文(key_size | key | value) | tag，value为空，record头部不加密
+// nonce随机生成，同一个密钥加密的record超过2^32条之后应该换密钥
+// 密钥校验值是用密钥加密全0的block得到的前8个字节，打开文件时用它判断密钥对不对，不用等到解密record失败
+
+const (
+	// KeyCheckSize 文件头中密钥校验值的大小
+	KeyCheckSize = 8
+	// SealOverhead 加密之后增加的字节数：nonce和tag
+	SealOverhead = 12 + 16
+)
+
+var (
+	// ErrEncryptionKeyNotFound 文件是加密的，但是找不到文件头中key id对应的密钥
+	ErrEncryptionKeyNotFound = errors.New("encryption key not found")
+
+	// ErrWrongEncryptionKey 密钥和文件加密时用的不一样
+	ErrWrongEncryptionKey = errors.New("wrong encryption key")
+
+	// ErrInvalidEncryptionKey 密钥长度不是AES-128/192/256的
+	ErrInvalidEncryptionKey = errors.New("invalid encryption key, must be 16, 24 or 32 bytes")
+
+	// ErrDecryptFailed 密文损坏，解密失败
+	ErrDecryptFailed = errors.New("decrypt failed")
+)
+
+// Cipher 一个密钥对应的AES-GCM
+type Cipher struct {
+	KeyID    uint32
+	KeyCheck []byte
+	aead     cipher.AEAD
+}
+
+// NewCipher keyID不能是0，0表示不加密
+func NewCipher(keyID uint32, key []byte) (*Cipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ErrInvalidEncryptionKey
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	check := make([]byte, aes.BlockSize)
+	block.Encrypt(check, make([]byte, aes.BlockSize))
+	return &Cipher{KeyID: keyID, KeyCheck: check[:KeyCheckSize], aead: aead}, nil
+}
+
+// Seal 加密，返回 nonce | 密文 | tag
+func (c *Cipher) Seal(plaintext []byte) []byte {
+	nonceSize := c.aead.NonceSize()
+	buf := make([]byte, nonceSize, nonceSize+len(plaintext)+c.aead.Overhead())
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return c.aead.Seal(buf, buf[:nonceSize], plaintext, nil)
+}
+
+// Open 解密Seal的结果
+func (c *Cipher) Open(buf []byte) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
+	if len(buf) < nonceSize+c.aead.Overhead() {
+		return nil, ErrDecryptFailed
+	}
+	plaintext, err := c.aead.Open(nil, buf[:nonceSize], buf[nonceSize:], nil)
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	return plaintext, nil
+}
+
+// Keyring 加密设置，新文件用KeyID对应的密钥加密，KeyID为0时新文件不加密；
+// 读文件时按文件头中的key id通过Lookup找密钥，轮换密钥后老文件还能读
+type Keyring struct {
+	KeyID  uint32
+	Lookup func(keyID uint32) ([]byte, error)
+
+	mu      sync.Mutex
+	ciphers map[uint32]*Cipher
+}
+
+// Cipher 获取keyID对应的Cipher，创建过的复用
+func (k *Keyring) Cipher(keyID uint32) (*Cipher, error) {
+	if k == nil || k.Lookup == nil || keyID == 0 {
+		return nil, ErrEncryptionKeyNotFound
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if c, ok := k.ciphers[keyID]; ok {
+		return c, nil
+	}
+
+	key, err := k.Lookup(keyID)
+	if err != nil || key == nil {
+		return nil, ErrEncryptionKeyNotFound
+	}
+	c, err := NewCipher(keyID, key)
+	if err != nil {
+		return nil, err
+	}
+	if k.ciphers == nil {
+		k.ciphers = make(map[uint32]*Cipher)
+	}
+	k.ciphers[keyID] = c
+	return c, nil
+}
+
+// CurrentKeyID 新文件用的key id，nil表示不加密
+func (k *Keyring) CurrentKeyID() uint32 {
+	if k == nil {
+		return 0
+	}
+	return k.KeyID
+}
+
+// OpenCipher 按文件头中的key id和密钥校验值找到解密用的Cipher，keyID为0说明文件没加密，返回nil
+func (k *Keyring) OpenCipher(keyID uint32, keyCheck []byte) (*Cipher, error) {
+	if keyID == 0 {
+		return nil, nil
+	}
+	c, err := k.Cipher(keyID)
+	if err != nil {
+		return nil, err
+	}
+	if string(c.KeyCheck) != string(keyCheck) {
+		return nil, ErrWrongEncryptionKey
+	}
+	return c, nil
+}
+
+// EncryptRecord 加密record的key和value，返回新的record，不修改传入的record
+func EncryptRecord(c *Cipher, lr *LogRecord) *LogRecord {
+	plaintext := make([]byte, binary.MaxVarintLen32+len(lr.Key)+len(lr.Value))
+	n := binary.PutUvarint(plaintext, uint64(len(lr.Key)))
+	n += copy(plaintext[n:], lr.Key)
+	n += copy(plaintext[n:], lr.Value)
+
+	encrypted := *lr
+	encrypted.Key = c.Seal(plaintext[:n])
+	encrypted.Value = nil
+	return &encrypted
+}
+
+// DecryptRecord 解密EncryptRecord加密的record
+func DecryptRecord(c *Cipher, lr *LogRecord) error {
+	plaintext, err := c.Open(lr.Key)
+	if err != nil {
+		return err
+	}
+	kSize, n := binary.Uvarint(plaintext)
+	if n <= 0 || uint64(len(plaintext)-n) < kSize {
+		return ErrDecryptFailed
+	}
+	lr.Key = plaintext[n : n+int(kSize)]
+	lr.Value = plaintext[n+int(kSize):]
+	return nil
+}
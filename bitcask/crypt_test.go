@@ -0,0 +1,76 @@
+package bitcask
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testKeyring(keyID uint32, keys map[uint32][]byte) *Keyring {
+	return &Keyring{KeyID: keyID, Lookup: func(keyID uint32) ([]byte, error) {
+		return keys[keyID], nil
+	}}
+}
+
+func TestEncryptRecord(t *testing.T) {
+	c, err := NewCipher(1, []byte("0123456789abcdef0123456789abcdef"))
+	assert.Nil(t, err)
+	record := &LogRecord{Key: []byte("key"), Value: []byte("value"), ExpiredAt: 100, Type: TypeDelete}
+
+	encrypted := EncryptRecord(c, record)
+	assert.Len(t, encrypted.Key, SealOverhead+1+len("key")+len("value"))
+	assert.Nil(t, encrypted.Value)
+	assert.False(t, bytes.Contains(encrypted.Key, []byte("value")))
+	// 不修改传入的record
+	assert.Equal(t, []byte("value"), record.Value)
+
+	assert.Nil(t, DecryptRecord(c, encrypted))
+	assert.Equal(t, record, encrypted)
+
+	// 同一个id换了密钥，解密失败
+	other, err := NewCipher(1, []byte("fedcba9876543210fedcba9876543210"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, c.KeyCheck, other.KeyCheck)
+	assert.Equal(t, ErrDecryptFailed, DecryptRecord(other, EncryptRecord(c, record)))
+
+	_, err = NewCipher(1, []byte("short"))
+	assert.Equal(t, ErrInvalidEncryptionKey, err)
+}
+
+func TestLogFile_Encrypted(t *testing.T) {
+	path := t.TempDir()
+	keys := map[uint32][]byte{1: []byte("0123456789abcdef")}
+	lf, err := OpenEncryptedLogFile(path, 1, 4096, Str, FileIO, testKeyring(1, keys))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), lf.Header.KeyID)
+	value := bytes.Repeat([]byte("secret "), 50)
+	buf, _ := lf.EncodeRecord(CompressRecord(&LogRecord{Key: []byte("pii"), Value: value}, 0))
+	assert.Nil(t, lf.Write(buf))
+	assert.Nil(t, lf.Close())
+
+	name, _ := LogFileName(path, 1, Str)
+	raw, err := os.ReadFile(name)
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(raw, []byte("pii")))
+
+	// 当前密钥换了，老文件还是按文件头中的key id解密
+	keys[2] = []byte("fedcba9876543210")
+	for _, ioType := range []IOType{FileIO, MMap} {
+		lf, err = OpenEncryptedLogFile(path, 1, 4096, Str, ioType, testKeyring(2, keys))
+		assert.Nil(t, err)
+		lr, _, err := lf.ReadLogRecord(lf.DataOffset)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("pii"), lr.Key)
+		assert.Equal(t, value, lr.Value)
+		assert.Nil(t, lf.Close())
+	}
+
+	// 没有密钥或者密钥不对时打开就报错，不会等到读record时报crc错误
+	_, err = OpenLogFile(path, 1, 4096, Str, FileIO)
+	assert.Equal(t, ErrEncryptionKeyNotFound, err)
+	keys[1] = []byte("0000000000000000")
+	_, err = OpenEncryptedLogFile(path, 1, 4096, Str, FileIO, testKeyring(2, keys))
+	assert.Equal(t, ErrWrongEncryptionKey, err)
+}
@@ -0,0 +1,122 @@
+package bitcask
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"sdb/ioselector"
+)
+
+// ErrLogFileClosed 文件已经关闭或者删除
+var ErrLogFileClosed = errors.New("log file is closed")
+
+// FileCache 非活跃文件打开句柄的缓存：非活跃文件只读，第一次读的时候才打开（mmap方式这时才映射），
+// 打开的文件数超过maxOpen时按LRU关闭最久没读过的，之后再读时重新打开
+// 读文件时持有LogFile的读锁，关闭要拿写锁，等正在进行的读结束，读的一方不会看到关闭的文件
+type FileCache struct {
+	mu      sync.Mutex
+	maxOpen int        // 小于等于0表示不限制
+	lru     *list.List // 打开着的文件，front是最近读过的
+}
+
+// NewFileCache maxOpen小于等于0时不限制打开的文件数
+func NewFileCache(maxOpen int) *FileCache {
+	return &FileCache{maxOpen: maxOpen, lru: list.New()}
+}
+
+// Len 当前打开着的文件数
+func (c *FileCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// open 只读打开lf，打开之后超出上限的话关闭最久没读过的文件
+// 持有c.mu时会拿其他文件的写锁，调用方不能持有任何文件的读锁
+func (c *FileCache) open(lf *LogFile) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	lf.Lock()
+	if lf.closed {
+		lf.Unlock()
+		return ErrLogFileClosed
+	}
+	if lf.IoSelector == nil {
+		selector, err := openReadOnlySelector(lf.fileName, lf.ioType)
+		if err != nil {
+			lf.Unlock()
+			return err
+		}
+		lf.IoSelector = selector
+	}
+	lf.Unlock()
+
+	if lf.elem == nil {
+		lf.elem = c.lru.PushFront(lf)
+	} else {
+		c.lru.MoveToFront(lf.elem)
+	}
+	// pin住的文件不能关闭，跳过它们，都pin住了的话暂时超出上限
+	for elem := c.lru.Back(); c.maxOpen > 0 && c.lru.Len() > c.maxOpen && elem != lf.elem; {
+		prev := elem.Prev()
+		if victim := elem.Value.(*LogFile); c.evict(victim) {
+			c.lru.Remove(elem)
+		}
+		elem = prev
+	}
+	return nil
+}
+
+// touch 读过的文件移到LRU头部，不限制打开数时不用维护顺序
+func (c *FileCache) touch(lf *LogFile) {
+	if c.maxOpen <= 0 {
+		return
+	}
+	c.mu.Lock()
+	if lf.elem != nil {
+		c.lru.MoveToFront(lf.elem)
+	}
+	c.mu.Unlock()
+}
+
+// remove 文件关闭或者删除后从LRU中移除
+func (c *FileCache) remove(lf *LogFile) {
+	c.mu.Lock()
+	if lf.elem != nil {
+		c.lru.Remove(lf.elem)
+		lf.elem = nil
+	}
+	c.mu.Unlock()
+}
+
+// 关闭被淘汰的文件，等正在读它的协程读完，文件被pin住时不关闭，返回false，调用方需要持有c.mu
+func (c *FileCache) evict(lf *LogFile) bool {
+	lf.Lock()
+	defer lf.Unlock()
+	if atomic.LoadInt32(&lf.pins) > 0 {
+		return false
+	}
+	lf.elem = nil
+	if lf.IoSelector != nil {
+		_ = lf.IoSelector.Close()
+		lf.IoSelector = nil
+	}
+	return true
+}
+
+// 按IO类型只读打开文件，带写缓冲的标准IO只读时不需要缓冲
+func openReadOnlySelector(fileName string, ioType IOType) (ioselector.IOSelector, error) {
+	switch ioType {
+	case FileIO, BufferedIO:
+		return ioselector.NewReadOnlyStandardIOSelector(fileName)
+	case MMap:
+		return ioselector.NewReadOnlyMMapSelector(fileName)
+	case DirectIO:
+		return ioselector.NewReadOnlyDirectIOSelector(fileName)
+	default:
+		return nil, ErrUnsupportedIOType
+	}
+}
@@ -0,0 +1,112 @@
+package bitcask
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileCache(t *testing.T) {
+	for _, ioType := range []IOType{FileIO, MMap, BufferedIO, DirectIO} {
+		t.Run(fmt.Sprint(ioType), func(t *testing.T) {
+			testFileCache(t, ioType)
+		})
+	}
+}
+
+func testFileCache(t *testing.T, ioType IOType) {
+	path := t.TempDir()
+	record := func(fID uint32, i int) *LogRecord {
+		return &LogRecord{Key: []byte(fmt.Sprintf("key-%d-%d", fID, i)), Value: []byte("value")}
+	}
+	fileNum, recordNum := 6, 20
+	var offsets []int64
+	for fID := uint32(1); fID <= uint32(fileNum); fID++ {
+		lf, err := OpenLogFile(path, fID, 1<<20, Str, ioType)
+		assert.Nil(t, err)
+		offsets = offsets[:0]
+		for i := 0; i < recordNum; i++ {
+			buf, _ := lf.EncodeRecord(record(fID, i))
+			offsets = append(offsets, lf.WriteOffSet)
+			assert.Nil(t, lf.Write(buf))
+		}
+		assert.Nil(t, lf.Trim())
+		assert.Nil(t, lf.Close())
+	}
+
+	// 打开时只读文件头，不占用打开数
+	cache := NewFileCache(2)
+	files := make([]*LogFile, fileNum)
+	for i := range files {
+		lf, err := OpenReadOnlyLogFile(path, uint32(i+1), Str, ioType, nil, cache)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(LogFileHeaderSize), lf.DataOffset)
+		assert.Nil(t, lf.IoSelector)
+		files[i] = lf
+	}
+	assert.Equal(t, 0, cache.Len())
+
+	// 并发读所有文件，打开的文件数不超过上限，读的过程中被淘汰也能读到
+	wg := new(sync.WaitGroup)
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for round := 0; round < 10; round++ {
+				for i, lf := range files {
+					idx := (g + round + i) % recordNum
+					lr, _, err := lf.ReadLogRecord(offsets[idx])
+					assert.Nil(t, err)
+					assert.Equal(t, record(uint32(i+1), idx).Key, lr.Key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.Equal(t, 2, cache.Len())
+
+	// 只读文件不能写
+	assert.NotNil(t, files[0].Write([]byte("x")))
+	assert.Nil(t, files[0].Sync())
+
+	// 关闭、删除之后不再打开
+	assert.Nil(t, files[fileNum-1].Close())
+	_, _, err := files[fileNum-1].ReadLogRecord(offsets[0])
+	assert.Equal(t, ErrLogFileClosed, err)
+	assert.Nil(t, files[0].Delete())
+	_, err = os.Stat(files[0].fileName)
+	assert.True(t, os.IsNotExist(err))
+	_, _, err = files[0].ReadLogRecord(offsets[0])
+	assert.Equal(t, ErrLogFileClosed, err)
+	assert.LessOrEqual(t, cache.Len(), 2)
+	for _, lf := range files[1 : fileNum-1] {
+		assert.Nil(t, lf.Close())
+	}
+	assert.Equal(t, 0, cache.Len())
+}
+
+func TestLogFile_SetReadOnly(t *testing.T) {
+	path := t.TempDir()
+	lf, err := OpenLogFile(path, 1, 1<<20, Str, MMap)
+	assert.Nil(t, err)
+	record := &LogRecord{Key: []byte("key"), Value: []byte("value")}
+	buf, _ := lf.EncodeRecord(record)
+	assert.Nil(t, lf.Write(buf))
+	assert.Nil(t, lf.Trim())
+
+	// 转为只读之后关闭读写句柄，读的时候由cache只读打开
+	cache := NewFileCache(1)
+	assert.Nil(t, lf.SetReadOnly(cache))
+	assert.Nil(t, lf.IoSelector)
+	assert.Equal(t, int64(0), lf.UnsyncedBytes())
+	lr, _, err := lf.ReadLogRecord(lf.DataOffset)
+	assert.Nil(t, err)
+	assert.Equal(t, record.Value, lr.Value)
+	assert.Equal(t, 1, cache.Len())
+	assert.NotNil(t, lf.Write(buf))
+	assert.Nil(t, lf.Close())
+	assert.Equal(t, 0, cache.Len())
+}
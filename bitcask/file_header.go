@@ -0,0 +1,95 @@
+package bitcask
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// 日志文件头：v2开始每个日志文件开头有一个固定大小的文件头，之后才是record
+// v1文件没有文件头，第一条record从offset 0开始，靠开头有没有magic区分
+// +-------+---------+-----------+----------+------------+--------+-----------+--------+
+// | magic | version | file_type | reserved | created_at | key_id | key_check | crc32c |
+// +-------+---------+-----------+----------+------------+--------+-----------+--------+
+// 0-------4---------5-----------6----------8-----------16-------20----------28-------32
+// key_id为0表示文件没有加密，否则key_check是密钥校验值，见crypt.go
+
+const (
+	// LogFileV1 没有文件头，record是EncodeRecord的格式
+	LogFileV1 byte = 1
+	// LogFileV2 有文件头，record是EncodeRecordV2的格式
+	LogFileV2 byte = 2
+	// CurrentLogFileVersion 新建的日志文件都用这个版本
+	CurrentLogFileVersion = LogFileV2
+
+	// LogFileHeaderSize v2文件头大小
+	LogFileHeaderSize = 32
+)
+
+var (
+	logFileMagic = []byte("SDBL")
+
+	// ErrInvalidLogFileHeader 文件头损坏
+	ErrInvalidLogFileHeader = errors.New("invalid log file header")
+
+	// ErrUnsupportedLogFileVersion 文件版本比当前程序新
+	ErrUnsupportedLogFileVersion = errors.New("unsupported log file version")
+
+	// ErrLogFileTypeMismatch 文件头中的数据类型和文件名不一致
+	ErrLogFileTypeMismatch = errors.New("log file type mismatch")
+)
+
+// LogFileHeader 日志文件头
+type LogFileHeader struct {
+	Version   byte
+	FileType  FileType
+	CreatedAt int64  // 创建时间，unix纳秒
+	KeyID     uint32 // 加密用的key id，0表示没加密
+	KeyCheck  []byte // 密钥校验值
+}
+
+// EncodeLogFileHeader 编码v2文件头
+func EncodeLogFileHeader(h *LogFileHeader) []byte {
+	buf := make([]byte, LogFileHeaderSize)
+	copy(buf[:4], logFileMagic)
+	buf[4] = h.Version
+	buf[5] = byte(h.FileType)
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(h.CreatedAt))
+	binary.LittleEndian.PutUint32(buf[16:20], h.KeyID)
+	copy(buf[20:28], h.KeyCheck)
+	crc := crc32.Checksum(buf[:LogFileHeaderSize-4], castagnoliTable)
+	binary.LittleEndian.PutUint32(buf[LogFileHeaderSize-4:], crc)
+	return buf
+}
+
+// DecodeLogFileHeader 解析日志文件开头的字节，返回文件头和第一条record的offset
+// 开头没有magic的是v1文件，返回的文件头只有版本号
+func DecodeLogFileHeader(buf []byte) (*LogFileHeader, int64, error) {
+	if len(buf) < len(logFileMagic) || !bytes.Equal(buf[:len(logFileMagic)], logFileMagic) {
+		return &LogFileHeader{Version: LogFileV1}, 0, nil
+	}
+	if len(buf) < LogFileHeaderSize {
+		return nil, 0, ErrInvalidLogFileHeader
+	}
+	crc := crc32.Checksum(buf[:LogFileHeaderSize-4], castagnoliTable)
+	if crc != binary.LittleEndian.Uint32(buf[LogFileHeaderSize-4:LogFileHeaderSize]) {
+		return nil, 0, ErrInvalidLogFileHeader
+	}
+	h := &LogFileHeader{
+		Version:   buf[4],
+		FileType:  FileType(buf[5]),
+		CreatedAt: int64(binary.LittleEndian.Uint64(buf[8:16])),
+		KeyID:     binary.LittleEndian.Uint32(buf[16:20]),
+	}
+	if h.KeyID != 0 {
+		h.KeyCheck = append([]byte{}, buf[20:28]...)
+	}
+	if h.Version < LogFileV2 {
+		return nil, 0, ErrInvalidLogFileHeader
+	}
+	if h.Version > CurrentLogFileVersion {
+		return nil, 0, ErrUnsupportedLogFileVersion
+	}
+	return h, LogFileHeaderSize, nil
+}
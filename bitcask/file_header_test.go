@@ -0,0 +1,77 @@
+package bitcask
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeLogFileHeader(t *testing.T) {
+	header := &LogFileHeader{Version: LogFileV2, FileType: Hash, CreatedAt: 1660000000000000000}
+	buf := EncodeLogFileHeader(header)
+	assert.Len(t, buf, LogFileHeaderSize)
+
+	got, offset, err := DecodeLogFileHeader(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, header, got)
+	assert.Equal(t, int64(LogFileHeaderSize), offset)
+
+	// 没有magic的是v1文件
+	v1, _ := EncodeRecord(&LogRecord{Key: []byte("key"), Value: []byte("value")})
+	got, offset, err = DecodeLogFileHeader(v1)
+	assert.Nil(t, err)
+	assert.Equal(t, LogFileV1, got.Version)
+	assert.Equal(t, int64(0), offset)
+
+	corrupt := append([]byte{}, buf...)
+	corrupt[10] ^= 0xff
+	_, _, err = DecodeLogFileHeader(corrupt)
+	assert.Equal(t, ErrInvalidLogFileHeader, err)
+	_, _, err = DecodeLogFileHeader(buf[:LogFileHeaderSize-1])
+	assert.Equal(t, ErrInvalidLogFileHeader, err)
+
+	newer := EncodeLogFileHeader(&LogFileHeader{Version: CurrentLogFileVersion + 1, FileType: Hash})
+	_, _, err = DecodeLogFileHeader(newer)
+	assert.Equal(t, ErrUnsupportedLogFileVersion, err)
+}
+
+func TestOpenLogFile_Header(t *testing.T) {
+	path := t.TempDir()
+	lf, err := OpenLogFile(path, 1, 1024, Set, FileIO)
+	assert.Nil(t, err)
+	assert.Equal(t, CurrentLogFileVersion, lf.Header.Version)
+	assert.Equal(t, Set, lf.Header.FileType)
+	assert.Equal(t, int64(LogFileHeaderSize), lf.WriteOffSet)
+	assert.Nil(t, lf.Close())
+
+	// 重新打开读到同一个文件头
+	lf2, err := OpenLogFile(path, 1, 1024, Set, MMap)
+	assert.Nil(t, err)
+	assert.Equal(t, lf.Header, lf2.Header)
+	assert.Nil(t, lf2.Close())
+
+	// 文件头中的数据类型和文件名不一致
+	name, _ := LogFileName(path, 1, Set)
+	assert.Nil(t, os.Rename(name, filepath.Join(path, FileNameMap[ZSet]+"0000000001")))
+	_, err = OpenLogFile(path, 1, 1024, ZSet, FileIO)
+	assert.Equal(t, ErrLogFileTypeMismatch, err)
+
+	// v1文件按v1读写
+	v1, size := EncodeRecord(&LogRecord{Key: []byte("key"), Value: []byte("value")})
+	name, _ = LogFileName(path, 2, Str)
+	assert.Nil(t, os.WriteFile(name, append(v1, make([]byte, 1024)...), 0644))
+	lf, err = OpenLogFile(path, 2, 1024, Str, FileIO)
+	assert.Nil(t, err)
+	assert.Equal(t, LogFileV1, lf.Header.Version)
+	assert.Equal(t, int64(0), lf.DataOffset)
+	lr, n, err := lf.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(size), n)
+	assert.Equal(t, []byte("value"), lr.Value)
+	assert.Zero(t, lr.Timestamp)
+	buf, _ := lf.EncodeRecord(lr)
+	assert.Equal(t, v1, buf)
+	assert.Nil(t, lf.Close())
+}
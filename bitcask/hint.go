@@ -0,0 +1,168 @@
+package bitcask
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"sdb/flock"
+)
+
+// hint文件：每个非活跃日志文件对应一个hint文件，只记录索引需要的信息，不记录value
+// 启动时读hint文件就能构建索引，不用把整个日志文件的value都读一遍
+// hint文件中每条记录复用LogRecord的编码格式:
+// key       --> record的key
+// type      --> record的type
+// expiredAt --> record的过期时间
+// value     --> record_offset | record_size，varint编码，指向blob文件的record后面再跟blob指针
+
+const (
+	// HintFilePrefix hint文件统一前缀，不能用log.，否则会被当成日志文件
+	HintFilePrefix = "hint."
+
+	// hintTmpSuffix 先写临时文件，写完再rename，防止写一半的hint文件被当成完整的
+	hintTmpSuffix = ".tmp"
+)
+
+// ErrInvalidHint hint文件内容损坏
+var ErrInvalidHint = errors.New("invalid hint file")
+
+// HintRecord hint文件中的一条记录，对应日志文件中的一条record
+type HintRecord struct {
+	Key       []byte
+	Type      RecordType
+	ExpiredAt int64
+	Offset    int64        // record在日志文件中的offset
+	Size      int64        // record在日志文件中的大小
+	Blob      *BlobPointer // record的value在blob文件中时，value的位置
+}
+
+// HintFileName 拼接hint文件全路径，example: path/hint.string.0000000001
+func HintFileName(path string, fID uint32, fType FileType) (string, error) {
+	logName, ok := FileNameMap[fType]
+	if !ok {
+		return "", ErrUnsupportedLogFileType
+	}
+	fName := HintFilePrefix + logName[len(FilePrefix):] + fmt.Sprintf("%010d", fID)
+	return filepath.Join(path, fName), nil
+}
+
+// WriteHintFile 把hints写入fID对应的hint文件，已存在则覆盖
+func WriteHintFile(path string, fID uint32, fType FileType, hints []*HintRecord) error {
+	name, err := HintFileName(path, fID, fType)
+	if err != nil {
+		return err
+	}
+
+	var buf []byte
+	for _, hint := range hints {
+		hintBuf, _ := EncodeRecord(encodeHint(hint))
+		buf = append(buf, hintBuf...)
+	}
+
+	tmpName := name + hintTmpSuffix
+	file, err := os.OpenFile(tmpName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(buf); err != nil {
+		_ = file.Close()
+		return err
+	}
+	// 先刷盘再rename，保证rename后的hint文件一定是完整的
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpName, name); err != nil {
+		return err
+	}
+	return flock.SyncFileLock(path)
+}
+
+// ReadHintFile 读取fID对应的hint文件，文件不存在返回os.ErrNotExist，内容损坏返回ErrInvalidHint
+func ReadHintFile(path string, fID uint32, fType FileType) ([]*HintRecord, error) {
+	name, err := HintFileName(path, fID, fType)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var hints []*HintRecord
+	for offset := int64(0); offset < int64(len(buf)); {
+		lr, size, err := DecodeRecord(buf[offset:])
+		if err != nil {
+			return nil, ErrInvalidHint
+		}
+		hint, err := decodeHint(lr)
+		if err != nil {
+			return nil, err
+		}
+		hints = append(hints, hint)
+		offset += size
+	}
+	return hints, nil
+}
+
+// RemoveHintFile 删除fID对应的hint文件，不存在不报错
+func RemoveHintFile(path string, fID uint32, fType FileType) error {
+	name, err := HintFileName(path, fID, fType)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func encodeHint(hint *HintRecord) *LogRecord {
+	buf := make([]byte, binary.MaxVarintLen64*2)
+	var index int
+	index += binary.PutVarint(buf[index:], hint.Offset)
+	index += binary.PutVarint(buf[index:], hint.Size)
+	if hint.Blob != nil {
+		buf = append(buf[:index], EncodeBlobPointer(hint.Blob)...)
+		index = len(buf)
+	}
+	return &LogRecord{
+		Key:       hint.Key,
+		Value:     buf[:index],
+		ExpiredAt: hint.ExpiredAt,
+		Type:      hint.Type,
+	}
+}
+
+func decodeHint(lr *LogRecord) (*HintRecord, error) {
+	offset, n := binary.Varint(lr.Value)
+	if n <= 0 {
+		return nil, ErrInvalidHint
+	}
+	size, m := binary.Varint(lr.Value[n:])
+	if m <= 0 {
+		return nil, ErrInvalidHint
+	}
+	hint := &HintRecord{
+		Key:       lr.Key,
+		Type:      lr.Type,
+		ExpiredAt: lr.ExpiredAt,
+		Offset:    offset,
+		Size:      size,
+	}
+	if lr.Type&TypeBlob != 0 {
+		blob, _, err := DecodeBlobPointer(lr.Value[n+m:])
+		if err != nil {
+			return nil, ErrInvalidHint
+		}
+		hint.Blob = blob
+	}
+	return hint, nil
+}
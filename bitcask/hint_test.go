@@ -0,0 +1,78 @@
+package bitcask
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteHintFile(t *testing.T) {
+	path := t.TempDir()
+	hints := []*HintRecord{
+		{Key: []byte("key-1"), Offset: 0, Size: 21},
+		{Key: []byte("key-2"), Offset: 21, Size: 30, ExpiredAt: 443434211},
+		{Key: []byte("key-1"), Offset: 51, Size: 12, Type: TypeDelete},
+		{Key: []byte("key-3"), Offset: 63, Size: 20, Type: TypeBlob, Blob: &BlobPointer{FileID: 2, Offset: 32, Size: 4096}},
+	}
+	err := WriteHintFile(path, 1, Str, hints)
+	assert.Nil(t, err)
+
+	got, err := ReadHintFile(path, 1, Str)
+	assert.Nil(t, err)
+	assert.Equal(t, hints, got)
+
+	// 临时文件已经rename
+	name, _ := HintFileName(path, 1, Str)
+	assert.Equal(t, filepath.Join(path, "hint.string.0000000001"), name)
+	_, err = os.Stat(name + hintTmpSuffix)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestReadHintFile(t *testing.T) {
+	path := t.TempDir()
+
+	t.Run("not-exist", func(t *testing.T) {
+		_, err := ReadHintFile(path, 2, List)
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		assert.Nil(t, WriteHintFile(path, 3, Hash, nil))
+		hints, err := ReadHintFile(path, 3, Hash)
+		assert.Nil(t, err)
+		assert.Empty(t, hints)
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		hints := []*HintRecord{{Key: []byte("key"), Offset: 10, Size: 20}}
+		assert.Nil(t, WriteHintFile(path, 4, Set, hints))
+		name, _ := HintFileName(path, 4, Set)
+		buf, _ := os.ReadFile(name)
+		buf[len(buf)-1] ^= 0xff
+		assert.Nil(t, os.WriteFile(name, buf, 0644))
+
+		_, err := ReadHintFile(path, 4, Set)
+		assert.Equal(t, ErrInvalidHint, err)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		hints := []*HintRecord{{Key: []byte("key"), Offset: 10, Size: 20}}
+		assert.Nil(t, WriteHintFile(path, 5, ZSet, hints))
+		name, _ := HintFileName(path, 5, ZSet)
+		buf, _ := os.ReadFile(name)
+		assert.Nil(t, os.WriteFile(name, buf[:len(buf)-2], 0644))
+
+		_, err := ReadHintFile(path, 5, ZSet)
+		assert.Equal(t, ErrInvalidHint, err)
+	})
+}
+
+func TestRemoveHintFile(t *testing.T) {
+	path := t.TempDir()
+	assert.Nil(t, WriteHintFile(path, 6, Str, nil))
+	assert.Nil(t, RemoveHintFile(path, 6, Str))
+	// 不存在不报错
+	assert.Nil(t, RemoveHintFile(path, 6, Str))
+}
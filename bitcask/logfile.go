@@ -1,12 +1,20 @@
 package bitcask
 
 import (
+	"bytes"
+	"container/list"
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"io"
+	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"sdb/ioselector"
 )
@@ -15,17 +23,26 @@ var (
 	// ErrInvalidCrc CRC校验失败
 	ErrInvalidCrc = errors.New("invalid crc")
 
+	// ErrInvalidRecordHeader record头部的varint或者key、value大小不合法
+	ErrInvalidRecordHeader = errors.New("invalid record header")
+
 	// ErrWriteSizeNotEqual 写入的数据大小和buffer大小不相等
 	ErrWriteSizeNotEqual = errors.New("write size is not equal to record size")
 
 	// ErrEndOfRecord record结尾
 	ErrEndOfRecord = errors.New("end of record in log file")
 
-	// ErrUnsupportedIOType 只支持标准IO和MMAP
+	// ErrUnsupportedIOType 只支持标准IO、MMAP、带缓冲的标准IO和direct IO
 	ErrUnsupportedIOType = errors.New("unsupported io type")
 
 	// ErrUnsupportedLogFileType 不支持的数据格式
 	ErrUnsupportedLogFileType = errors.New("unsupported log file type")
+
+	// ErrRecordAfterTail 写坏的record之后还有完整的record，不是尾部写了一半，不能截断
+	ErrRecordAfterTail = errors.New("valid record found after the corrupted one")
+
+	// ErrInvalidLogFileName 不是合法的日志文件名
+	ErrInvalidLogFileName = errors.New("invalid log file name")
 )
 
 const (
@@ -34,6 +51,14 @@ const (
 
 	// FilePrefix 磁盘中的文件统一前缀
 	FilePrefix = "log."
+
+	// TruncateTail每次读写的字节数
+	truncateChunkSize = 64 << 10
+
+	// 新文件先分配这么大，写满了再扩展
+	initialFileSize = 1 << 20
+	// 每次扩展翻倍，但最多扩展这么大
+	maxGrowSize = 64 << 20
 )
 
 type FileType byte
@@ -56,11 +81,11 @@ var (
 	}
 
 	FileTypesMap = map[string]FileType{
-		"str":  Str,
-		"list": List,
-		"hash": Hash,
-		"set":  Set,
-		"zset": ZSet,
+		"string": Str,
+		"list":   List,
+		"hash":   Hash,
+		"set":    Set,
+		"zset":   ZSet,
 	}
 )
 
@@ -71,32 +96,93 @@ const (
 	FileIO IOType = iota
 	// MMap 内存映射IO
 	MMap
+	// BufferedIO 带写缓冲的标准IO
+	BufferedIO
+	// DirectIO 不经过page cache的IO
+	DirectIO
 )
 
 // LogFile 读写磁盘文件的抽象
 type LogFile struct {
+	// 读文件时持有读锁，关闭IoSelector、转为只读时持有写锁
 	sync.RWMutex
 	FileID      uint32                // 文件id
 	WriteOffSet int64                 // 追加写的offset
 	IoSelector  ioselector.IOSelector // IO接口
+	Header      *LogFileHeader        // 文件头，v1文件只有版本号
+	DataOffset  int64                 // 第一条record的offset，v1文件是0，v2文件是文件头大小
+	cipher      *Cipher               // 加密文件的密钥，nil表示没加密
+	Capacity    int64                 // 文件容量，新建时的大小阈值，写满了转为非活跃文件，扩展时不超过它
+	size        int64                 // 文件当前的大小，只有写文件的协程会改
+	unsynced    int64                 // 上次刷盘之后写入的字节数
+	fileName    string
+	ioType      IOType
+
+	// 只读的非活跃文件：cache非nil，IoSelector由cache在读的时候打开，超出打开数上限时被关闭置为nil
+	cache  *FileCache
+	elem   *list.Element // 在cache的LRU中的位置，cache.mu保护
+	closed bool          // Close、Delete之后不再打开
+
+	// 引用计数：打开时是1，由db的文件map持有；读文件前Ref，读完Release，
+	// Delete只标记删除并释放map持有的引用，最后一个引用释放时才真正删除文件
+	refs    int32
+	deleted int32
+	// ViewLogRecord返回的record还没释放的个数，大于0时cache不会关闭文件，Close等最后一个释放时再关闭
+	pins int32
+
+	// 组提交：synced之前的数据已经刷盘，syncing表示有协程正在刷盘，其他协程在syncCond上等它的结果
+	syncMu   sync.Mutex
+	syncCond *sync.Cond
+	synced   int64
+	syncing  bool
 }
 
-// OpenLogFile 根据指定路径打开文件或者新建文件
+// OpenLogFile 根据指定路径打开文件或者新建文件，不支持加密
 func OpenLogFile(path string, fID uint32, fSize int64, fType FileType, ioType IOType) (lf *LogFile, err error) {
-	lf = &LogFile{FileID: fID}
-	fileName, err := lf.getLogFileName(path, fID, fType)
+	return OpenEncryptedLogFile(path, fID, fSize, fType, ioType, nil)
+}
+
+// OpenEncryptedLogFile 打开文件或者新建文件，新文件用keyring当前的密钥加密，
+// 已有的加密文件按文件头中的key id从keyring找密钥，找不到或者密钥不对时返回错误
+func OpenEncryptedLogFile(path string, fID uint32, fSize int64, fType FileType, ioType IOType, keyring *Keyring) (lf *LogFile, err error) {
+	fileName, err := LogFileName(path, fID, fType)
 	if err != nil {
 		return nil, err
 	}
+	return openLogFile(fileName, fID, fSize, fType, ioType, keyring)
+}
 
+// 打开fileName对应的文件，日志文件和blob文件共用，fSize是文件的容量
+// 新文件不预分配fSize，先分配initialFileSize，写的时候按需扩展；已有的文件按实际大小打开，
+// 比fSize大的（之前的大小阈值更大）容量就是实际大小，不会被截断
+func openLogFile(fileName string, fID uint32, fSize int64, fType FileType, ioType IOType, keyring *Keyring) (lf *LogFile, err error) {
+	lf = &LogFile{FileID: fID, Capacity: fSize, size: fSize, fileName: fileName, ioType: ioType, refs: 1}
+	lf.syncCond = sync.NewCond(&lf.syncMu)
+	if lf.size > initialFileSize {
+		lf.size = initialFileSize
+	}
+	if stat, statErr := os.Stat(fileName); statErr == nil && stat.Size() > 0 {
+		lf.size = stat.Size()
+		if lf.size > lf.Capacity {
+			lf.Capacity = lf.size
+		}
+	}
 	var selector ioselector.IOSelector
 	switch ioType {
 	case FileIO:
-		if selector, err = ioselector.NewStandardIOSelector(fileName, fSize); err != nil {
+		if selector, err = ioselector.NewStandardIOSelector(fileName, lf.size); err != nil {
 			return
 		}
 	case MMap:
-		if selector, err = ioselector.NewMMapSelector(fileName, fSize); err != nil {
+		if selector, err = ioselector.NewMMapSelector(fileName, lf.size); err != nil {
+			return
+		}
+	case BufferedIO:
+		if selector, err = ioselector.NewBufferedIOSelector(fileName, lf.size); err != nil {
+			return
+		}
+	case DirectIO:
+		if selector, err = ioselector.NewDirectIOSelector(fileName, lf.size); err != nil {
 			return
 		}
 	default:
@@ -104,11 +190,111 @@ func OpenLogFile(path string, fID uint32, fSize int64, fType FileType, ioType IO
 	}
 
 	lf.IoSelector = selector
+	if err = lf.initHeader(fType, keyring); err != nil {
+		_ = selector.Close()
+		return nil, err
+	}
 	return
 }
 
+// OpenReadOnlyLogFile 只读打开已有的非活跃日志文件，只读一下文件头，读record的时候才由cache打开文件，
+// cache为nil时不限制打开的文件数
+func OpenReadOnlyLogFile(path string, fID uint32, fType FileType, ioType IOType, keyring *Keyring, cache *FileCache) (*LogFile, error) {
+	fileName, err := LogFileName(path, fID, fType)
+	if err != nil {
+		return nil, err
+	}
+	return openReadOnlyLogFile(fileName, fID, fType, ioType, keyring, cache)
+}
+
+func openReadOnlyLogFile(fileName string, fID uint32, fType FileType, ioType IOType, keyring *Keyring, cache *FileCache) (*LogFile, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, LogFileHeaderSize)
+	if _, err = file.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	lf := &LogFile{FileID: fID, Capacity: stat.Size(), size: stat.Size(), fileName: fileName, ioType: ioType, cache: cache, refs: 1}
+	lf.syncCond = sync.NewCond(&lf.syncMu)
+	if cache == nil {
+		lf.cache = NewFileCache(0)
+	}
+	// 没写过的文件不能补写文件头，按当前版本的空文件处理
+	if bytes.Equal(buf, make([]byte, LogFileHeaderSize)) {
+		lf.Header = &LogFileHeader{Version: CurrentLogFileVersion, FileType: fType}
+		lf.DataOffset, lf.WriteOffSet = LogFileHeaderSize, LogFileHeaderSize
+		return lf, nil
+	}
+	if err = lf.decodeHeader(buf, fType, keyring); err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+// initHeader 读文件头，新文件（开头全是0）写入当前版本的文件头
+func (lf *LogFile) initHeader(fType FileType, keyring *Keyring) error {
+	buf := make([]byte, LogFileHeaderSize)
+	if _, err := lf.IoSelector.Read(buf, 0); err != nil && err != io.EOF {
+		return err
+	}
+	if bytes.Equal(buf, make([]byte, LogFileHeaderSize)) {
+		lf.Header = &LogFileHeader{Version: CurrentLogFileVersion, FileType: fType, CreatedAt: time.Now().UnixNano()}
+		if keyID := keyring.CurrentKeyID(); keyID != 0 {
+			c, err := keyring.Cipher(keyID)
+			if err != nil {
+				return err
+			}
+			lf.Header.KeyID, lf.Header.KeyCheck, lf.cipher = keyID, c.KeyCheck, c
+		}
+		if _, err := lf.IoSelector.Write(EncodeLogFileHeader(lf.Header), 0); err != nil {
+			return err
+		}
+		lf.DataOffset = LogFileHeaderSize
+		lf.WriteOffSet = LogFileHeaderSize
+		return nil
+	}
+	return lf.decodeHeader(buf, fType, keyring)
+}
+
+// 解析已有文件的文件头，加密文件找到对应的密钥
+func (lf *LogFile) decodeHeader(buf []byte, fType FileType, keyring *Keyring) error {
+	header, dataOffset, err := DecodeLogFileHeader(buf)
+	if err != nil {
+		return err
+	}
+	if header.Version != LogFileV1 && header.FileType != fType {
+		return ErrLogFileTypeMismatch
+	}
+	if lf.cipher, err = keyring.OpenCipher(header.KeyID, header.KeyCheck); err != nil {
+		return err
+	}
+	lf.Header, lf.DataOffset, lf.WriteOffSet = header, dataOffset, dataOffset
+	return nil
+}
+
+// EncodeRecord 按文件的版本编码record，加密文件先加密
+func (lf *LogFile) EncodeRecord(lr *LogRecord) ([]byte, int) {
+	if lf.cipher != nil {
+		lr = EncryptRecord(lf.cipher, lr)
+	}
+	return EncodeRecordVersion(lr, lf.Header.Version)
+}
+
 // getLogFileName 拼接文件全路径
 func (lf *LogFile) getLogFileName(path string, fid uint32, fType FileType) (name string, err error) {
+	return LogFileName(path, fid, fType)
+}
+
+// LogFileName 拼接日志文件全路径，example: path/log.string.0000000001
+func LogFileName(path string, fid uint32, fType FileType) (name string, err error) {
 	if _, ok := FileNameMap[fType]; !ok {
 		return "", ErrUnsupportedLogFileType
 	}
@@ -118,21 +304,143 @@ func (lf *LogFile) getLogFileName(path string, fid uint32, fType FileType) (name
 	return
 }
 
-// readBytes 读取文件指定大小字节
-func (lf *LogFile) readBytes(offset, n int64) (buf []byte, err error) {
-	buf = make([]byte, n)
-	_, err = lf.IoSelector.Read(buf, offset)
-	return
+// ParseLogFileName 从日志文件名解析出文件类型和id，example: log.string.0000000001
+func ParseLogFileName(name string) (fType FileType, fid uint32, err error) {
+	splitNames := strings.Split(name, ".")
+	if len(splitNames) != 3 || splitNames[0]+"." != FilePrefix {
+		return 0, 0, ErrInvalidLogFileName
+	}
+	fType, ok := FileTypesMap[splitNames[1]]
+	if !ok {
+		return 0, 0, ErrUnsupportedLogFileType
+	}
+	id, err := strconv.ParseUint(splitNames[2], 10, 32)
+	if err != nil {
+		return 0, 0, ErrInvalidLogFileName
+	}
+	return fType, uint32(id), nil
+}
+
+// read 读文件，持有读锁，读的过程中文件不会被关闭；只读文件没打开的话先让cache打开，
+// 刚打开就被其他协程淘汰了的话重试
+func (lf *LogFile) read(b []byte, offset int64) (int, error) {
+	for {
+		lf.RLock()
+		if selector := lf.IoSelector; selector != nil {
+			cache := lf.cache
+			n, err := selector.Read(b, offset)
+			lf.RUnlock()
+			if cache != nil {
+				cache.touch(lf)
+			}
+			return n, err
+		}
+		cache, closed := lf.cache, lf.closed
+		lf.RUnlock()
+		if cache == nil || closed {
+			return 0, ErrLogFileClosed
+		}
+		if err := cache.open(lf); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// readBytes 读取文件指定大小字节，读到文件末尾不足n时返回已读的部分和io.EOF
+func (lf *LogFile) readBytes(offset, n int64) ([]byte, error) {
+	buf := make([]byte, n)
+	m, err := lf.read(buf, offset)
+	return buf[:m], err
+}
+
+// pin 只读的mmap文件打开后pin住，返回能直接读映射内存的Viewer，用完调用unpin
+// 不是mmap方式或者还是活跃文件时返回ErrViewUnsupported
+func (lf *LogFile) pin() (ioselector.Viewer, error) {
+	for {
+		lf.RLock()
+		if selector := lf.IoSelector; selector != nil {
+			cache := lf.cache
+			viewer, ok := selector.(ioselector.Viewer)
+			if ok && cache != nil {
+				// 持有读锁时加计数，cache淘汰、Close拿到写锁之后看到的计数是准确的
+				atomic.AddInt32(&lf.pins, 1)
+			}
+			lf.RUnlock()
+			if !ok || cache == nil {
+				return nil, ioselector.ErrViewUnsupported
+			}
+			cache.touch(lf)
+			return viewer, nil
+		}
+		cache, closed := lf.cache, lf.closed
+		lf.RUnlock()
+		if cache == nil || closed {
+			return nil, ErrLogFileClosed
+		}
+		if err := cache.open(lf); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// unpin 释放pin，文件在pin住期间被Close的话，最后一个释放时关闭
+func (lf *LogFile) unpin() {
+	if atomic.AddInt32(&lf.pins, -1) > 0 {
+		return
+	}
+	lf.Lock()
+	defer lf.Unlock()
+	if lf.closed && atomic.LoadInt32(&lf.pins) == 0 && lf.IoSelector != nil {
+		_ = lf.IoSelector.Close()
+		lf.IoSelector = nil
+	}
 }
 
 // ReadLogRecord 根据 offset 从文件读出logRecord
 func (lf *LogFile) ReadLogRecord(offset int64) (lr *LogRecord, recordSize int64, err error) {
+	return lf.readLogRecord(offset, lf.readBytes)
+}
+
+// ViewLogRecord 和ReadLogRecord一样读出record，但是key和value直接指向mmap只读映射的内存，不拷贝，
+// 加密、压缩的record解码之后是新分配的内存；release之前文件不会被关闭、淘汰或者删除，release只能调用一次
+// 不是mmap方式或者还是活跃文件时返回ErrViewUnsupported，调用方改用ReadLogRecord
+func (lf *LogFile) ViewLogRecord(offset int64) (lr *LogRecord, recordSize int64, release func(), err error) {
+	viewer, err := lf.pin()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	lf.Ref()
+	release = func() {
+		lf.unpin()
+		_ = lf.Release()
+	}
+	if lr, recordSize, err = lf.readLogRecord(offset, viewer.View); err != nil {
+		release()
+		return nil, 0, nil, err
+	}
+	return lr, recordSize, release, nil
+}
+
+// readLogRecord 用readAt读出offset处的record，readAt读到文件末尾不足n时返回已读的部分和io.EOF
+func (lf *LogFile) readLogRecord(offset int64, readAt func(offset, n int64) ([]byte, error)) (lr *LogRecord, recordSize int64, err error) {
 	// read recordHead
-	headerBuf, err := lf.readBytes(offset, MaxHeaderSize)
+	// 文件末尾剩余不足MaxHeaderSize字节时，也可能是一条完整的record，读到多少算多少
+	v1 := lf.Header.Version == LogFileV1
+	maxHeaderSize, decode := int64(MaxHeaderSizeV2), decodeHeaderV2
+	if v1 {
+		maxHeaderSize, decode = MaxHeaderSize, decodeHeader
+	}
+	headerBuf, err := readAt(offset, maxHeaderSize)
+	if err != nil && !(err == io.EOF && len(headerBuf) > 0) {
+		return nil, 0, err
+	}
+	header, headerSize, err := decode(headerBuf)
 	if err != nil {
 		return nil, 0, err
 	}
-	header, headerSize := decodeHeader(headerBuf)
+	if header == nil {
+		return nil, 0, io.EOF
+	}
 
 	if header.crc32 == 0 && header.kSize == 0 && header.vSize == 0 {
 		return nil, 0, ErrEndOfRecord
@@ -141,14 +449,24 @@ func (lf *LogFile) ReadLogRecord(offset int64) (lr *LogRecord, recordSize int64,
 	lr = &LogRecord{
 		ExpiredAt: header.expiredAt,
 		Type:      header.typ,
+		Timestamp: header.timestamp,
+		Flags:     header.flags,
 	}
 	keySize, valueSize := int64(header.kSize), int64(header.vSize)
 	recordSize = headerSize + keySize + valueSize
+	// 损坏的header可能带着很大的key、value大小，超出文件容量的不去分配内存读
+	if recordSize > lf.Capacity-offset {
+		return nil, 0, ErrInvalidRecordHeader
+	}
 
 	// 读出key&value
 	if keySize > 0 || valueSize > 0 {
-		kvBuf, err := lf.readBytes(offset+headerSize, keySize+valueSize)
+		kvBuf, err := readAt(offset+headerSize, keySize+valueSize)
 		if err != nil {
+			// header完整但是key&value超出了文件末尾，是写了一半的record
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
 			return nil, 0, err
 		}
 		lr.Key = kvBuf[:keySize]
@@ -156,18 +474,100 @@ func (lf *LogFile) ReadLogRecord(offset int64) (lr *LogRecord, recordSize int64,
 	}
 
 	// crc校验
-	if crc := getRecordCrc(lr, headerBuf[crc32.Size:headerSize]); crc != header.crc32 {
+	getCrc := getRecordCrcV2
+	if v1 {
+		getCrc = getRecordCrc
+	}
+	if crc := getCrc(lr, headerBuf[crc32.Size:headerSize]); crc != header.crc32 {
 		return nil, 0, ErrInvalidCrc
 	}
-	return
+	// 解密、解压后返回，调用方看到的都是原始的key和value
+	if lf.cipher != nil {
+		if err = DecryptRecord(lf.cipher, lr); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err = DecompressRecord(lr); err != nil {
+		return nil, 0, err
+	}
+	return lr, recordSize, nil
+}
+
+// TruncateTail 把offset之后写坏的数据清零，返回清掉的字节数，之后从offset开始追加写
+// 活跃文件是按块扩展的，不改变文件大小，只把offset到最后一个非0字节之间清零
+// offset之后还能解码出crc正确的record说明是文件中间损坏了，返回ErrRecordAfterTail，不清零
+func (lf *LogFile) TruncateTail(offset int64) (int64, error) {
+	buf := make([]byte, truncateChunkSize)
+	end := offset
+	for pos := offset; ; pos += int64(len(buf)) {
+		n, err := lf.read(buf, pos)
+		for i := n - 1; i >= 0; i-- {
+			if buf[i] != 0 {
+				end = pos + int64(i) + 1
+				break
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, err
+		}
+	}
+	found, err := lf.hasRecordIn(offset, end)
+	if err != nil {
+		return 0, err
+	}
+	if found {
+		return 0, ErrRecordAfterTail
+	}
+
+	zeros := make([]byte, truncateChunkSize)
+	for pos := offset; pos < end; pos += truncateChunkSize {
+		size := end - pos
+		if size > truncateChunkSize {
+			size = truncateChunkSize
+		}
+		if _, err := lf.IoSelector.Write(zeros[:size], pos); err != nil {
+			return 0, err
+		}
+	}
+	if err := lf.Sync(); err != nil {
+		return 0, err
+	}
+	atomic.StoreInt64(&lf.WriteOffSet, offset)
+	return end - offset, nil
+}
+
+// hasRecordIn 逐字节找(offset, end)之间有没有能解码并且crc正确的record
+func (lf *LogFile) hasRecordIn(offset, end int64) (bool, error) {
+	if end-offset <= 1 {
+		return false, nil
+	}
+	buf := make([]byte, end-offset)
+	if _, err := lf.read(buf, offset); err != nil && err != io.EOF {
+		return false, err
+	}
+	for i := 1; i < len(buf); i++ {
+		if _, _, err := DecodeRecordVersion(buf[i:], lf.Header.Version); err == nil {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
-// 追加写logfile
+// 追加写logfile，只读文件不能写
 func (lf *LogFile) Write(buf []byte) error {
 	if len(buf) <= 0 {
 		return nil
 	}
+	if lf.cache != nil {
+		return ioselector.ErrReadOnly
+	}
 	offset := atomic.LoadInt64(&lf.WriteOffSet)
+	if err := lf.grow(offset + int64(len(buf))); err != nil {
+		return err
+	}
 	n, err := lf.IoSelector.Write(buf, offset)
 	if err != nil {
 		return err
@@ -178,21 +578,184 @@ func (lf *LogFile) Write(buf []byte) error {
 
 	// offset后移
 	atomic.AddInt64(&lf.WriteOffSet, int64(n))
+	atomic.AddInt64(&lf.unsynced, int64(n))
 	return nil
 }
 
-// Sync 刷盘
+// grow 文件不够写到end时扩展，每次翻倍，最多扩展maxGrowSize，不超过文件容量
+// 扩展出来的部分全是0，崩溃后启动时读到0就是ErrEndOfRecord，和预分配的文件一样
+func (lf *LogFile) grow(end int64) error {
+	if end <= lf.size {
+		return nil
+	}
+	step := lf.size
+	if step > maxGrowSize {
+		step = maxGrowSize
+	}
+	size := lf.size + step
+	if size > lf.Capacity {
+		size = lf.Capacity
+	}
+	if size < end {
+		size = end
+	}
+	if err := lf.IoSelector.Truncate(size); err != nil {
+		return err
+	}
+	// 一条record比容量还大时，文件容量就是这条record的结尾，读的时候按容量检查record大小
+	if size > lf.Capacity {
+		lf.Capacity = size
+	}
+	lf.size = size
+	return nil
+}
+
+// Trim 文件转为非活跃文件，不会再写了，截掉WriteOffSet之后扩展出来的空间
+func (lf *LogFile) Trim() error {
+	offset := atomic.LoadInt64(&lf.WriteOffSet)
+	if offset <= 0 || offset >= lf.size {
+		return nil
+	}
+	if err := lf.IoSelector.Truncate(offset); err != nil {
+		return err
+	}
+	lf.size = offset
+	return nil
+}
+
+// Size 文件当前的大小，只能在写文件的协程调用
+func (lf *LogFile) Size() int64 {
+	return lf.size
+}
+
+// Sync 刷盘，只读文件转为只读之前已经刷过了
 func (lf *LogFile) Sync() error {
-	return lf.IoSelector.Sync()
+	// 先取offset再刷盘，之前写完的数据都会被这次刷盘持久化
+	end := atomic.LoadInt64(&lf.WriteOffSet)
+	n := atomic.SwapInt64(&lf.unsynced, 0)
+	lf.RLock()
+	var err error
+	if lf.cache == nil {
+		err = lf.IoSelector.Sync()
+	}
+	lf.RUnlock()
+	if err != nil {
+		atomic.AddInt64(&lf.unsynced, n)
+		return err
+	}
+	lf.syncMu.Lock()
+	if end > lf.synced {
+		lf.synced = end
+	}
+	lf.syncMu.Unlock()
+	return nil
 }
 
-// Close 关闭读写
+// SyncTo 等待offset之前写入的数据刷盘，用于组提交：
+// 并发调用时只有一个协程刷盘，一次刷盘持久化所有已经写完的数据，其他协程等它的结果，失败时由下一个协程重试
+func (lf *LogFile) SyncTo(offset int64) error {
+	lf.syncMu.Lock()
+	defer lf.syncMu.Unlock()
+	for lf.synced < offset {
+		if lf.syncing {
+			lf.syncCond.Wait()
+			continue
+		}
+		lf.syncing = true
+		lf.syncMu.Unlock()
+		// 先让出cpu，让已经就绪的写协程追加完record，这次刷盘能多带一些
+		runtime.Gosched()
+		err := lf.Sync()
+		lf.syncMu.Lock()
+		lf.syncing = false
+		lf.syncCond.Broadcast()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnsyncedBytes 上次刷盘之后写入的字节数
+func (lf *LogFile) UnsyncedBytes() int64 {
+	return atomic.LoadInt64(&lf.unsynced)
+}
+
+// SetReadOnly 文件不会再写了，刷盘后关闭读写句柄，之后读的时候由cache只读打开，受打开文件数上限的限制
+func (lf *LogFile) SetReadOnly(cache *FileCache) error {
+	if err := lf.Sync(); err != nil {
+		return err
+	}
+	lf.Lock()
+	defer lf.Unlock()
+	if lf.cache != nil || lf.closed {
+		return nil
+	}
+	err := lf.IoSelector.Close()
+	lf.IoSelector, lf.cache = nil, cache
+	return err
+}
+
+// Close 关闭读写，还有没释放的ViewLogRecord时等它们释放了再关闭
 func (lf *LogFile) Close() error {
-	return lf.IoSelector.Close()
+	lf.Lock()
+	lf.closed = true
+	cache, selector := lf.cache, lf.IoSelector
+	var err error
+	if cache == nil {
+		err = selector.Close()
+	} else if selector != nil && atomic.LoadInt32(&lf.pins) == 0 {
+		err = selector.Close()
+		lf.IoSelector = nil
+	}
+	lf.Unlock()
+	if cache != nil {
+		cache.remove(lf)
+	}
+	return err
+}
+
+// Ref 读文件之前增加引用计数，读完调用Release，引用期间文件被Delete也不会真正删除
+func (lf *LogFile) Ref() {
+	atomic.AddInt32(&lf.refs, 1)
 }
 
-// Delete 删除文件
+// Release 释放Ref增加的引用，文件已经被Delete并且这是最后一个引用时删除文件
+func (lf *LogFile) Release() error {
+	if atomic.AddInt32(&lf.refs, -1) > 0 || atomic.LoadInt32(&lf.deleted) == 0 {
+		return nil
+	}
+	return lf.remove()
+}
+
+// Delete 删除文件，还有其他引用时等最后一个引用释放再删除，重复调用只生效一次
 // File can`t be retrieved if do this, so use it carefully.
 func (lf *LogFile) Delete() error {
-	return lf.IoSelector.Delete()
+	if !atomic.CompareAndSwapInt32(&lf.deleted, 0, 1) {
+		return nil
+	}
+	return lf.Release()
+}
+
+// 关闭并删除文件
+func (lf *LogFile) remove() error {
+	lf.Lock()
+	lf.closed = true
+	cache, selector := lf.cache, lf.IoSelector
+	var err error
+	if cache == nil {
+		err = selector.Delete()
+	} else {
+		// 只读文件可能没打开，关闭之后直接删除
+		if selector != nil {
+			_ = selector.Close()
+			lf.IoSelector = nil
+		}
+		err = os.Remove(lf.fileName)
+	}
+	lf.Unlock()
+	if cache != nil {
+		cache.remove(lf)
+	}
+	return err
 }
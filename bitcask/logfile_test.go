@@ -1 +1,307 @@
 package bitcask
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"sdb/ioselector"
+)
+
+func TestLogFile_ReadLogRecord(t *testing.T) {
+	for _, ioType := range []IOType{FileIO, MMap, BufferedIO, DirectIO} {
+		path := filepath.Join(os.TempDir(), "sdb-logfile")
+		assert.Nil(t, os.MkdirAll(path, os.ModePerm))
+
+		record := &LogRecord{Key: []byte("key"), Value: []byte("value")}
+		buf, size := EncodeRecordV2(record)
+		// 文件大小刚好放下文件头和两条record，第二条record在文件末尾剩余不足MaxHeaderSizeV2字节
+		end := int64(LogFileHeaderSize + size*2)
+		lf, err := OpenLogFile(path, 1, end, Str, ioType)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(LogFileHeaderSize), lf.DataOffset)
+		assert.Nil(t, lf.Write(buf))
+		assert.Nil(t, lf.Write(buf))
+
+		for offset := lf.DataOffset; offset < end; offset += int64(size) {
+			lr, n, err := lf.ReadLogRecord(offset)
+			assert.Nil(t, err)
+			assert.Equal(t, int64(size), n)
+			assert.Equal(t, record.Key, lr.Key)
+			assert.Equal(t, record.Value, lr.Value)
+		}
+		_, _, err = lf.ReadLogRecord(end)
+		assert.NotNil(t, err)
+
+		// 损坏的header里value大小超出了文件容量，不按它分配内存
+		corrupt := make([]byte, MaxHeaderSizeV2)
+		copy(corrupt, buf[:6])
+		n := 6 + binary.PutVarint(corrupt[6:], 3)
+		binary.PutVarint(corrupt[n:], 1<<30)
+		_, err = lf.IoSelector.Write(corrupt, lf.DataOffset)
+		assert.Nil(t, err)
+		_, _, err = lf.ReadLogRecord(lf.DataOffset)
+		assert.Equal(t, ErrInvalidRecordHeader, err)
+
+		assert.Nil(t, lf.Delete())
+		assert.Nil(t, os.RemoveAll(path))
+	}
+}
+
+func TestParseLogFileName(t *testing.T) {
+	for fType := range FileNameMap {
+		name, err := LogFileName("", 12, fType)
+		assert.Nil(t, err)
+		typ, fid, err := ParseLogFileName(name)
+		assert.Nil(t, err)
+		assert.Equal(t, fType, typ)
+		assert.Equal(t, uint32(12), fid)
+	}
+
+	for _, name := range []string{"log.string", "hint.string.0000000001", "log.string.abc", "log.str.0000000001"} {
+		_, _, err := ParseLogFileName(name)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestLogFile_TruncateTail(t *testing.T) {
+	for _, ioType := range []IOType{FileIO, MMap, BufferedIO, DirectIO} {
+		path := filepath.Join(os.TempDir(), "sdb-logfile-truncate")
+		assert.Nil(t, os.MkdirAll(path, os.ModePerm))
+
+		record := &LogRecord{Key: []byte("key"), Value: []byte("value")}
+		lf, err := OpenLogFile(path, 1, 1024, Str, ioType)
+		assert.Nil(t, err)
+		buf, size := lf.EncodeRecord(record)
+		assert.Nil(t, lf.Write(buf))
+		// 第二条record只写了一半
+		assert.Nil(t, lf.Write(buf[:size-2]))
+		tail := lf.DataOffset + int64(size)
+		_, _, err = lf.ReadLogRecord(tail)
+		assert.Equal(t, ErrInvalidCrc, err)
+
+		dropped, err := lf.TruncateTail(tail)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(size-2), dropped)
+		assert.Equal(t, tail, lf.WriteOffSet)
+		_, _, err = lf.ReadLogRecord(tail)
+		assert.Equal(t, ErrEndOfRecord, err)
+		lr, _, err := lf.ReadLogRecord(lf.DataOffset)
+		assert.Nil(t, err)
+		assert.Equal(t, record.Value, lr.Value)
+
+		// 写坏的record后面还有完整的record，不是尾部写了一半，不清零
+		assert.Nil(t, lf.Write(buf[:size-2]))
+		assert.Nil(t, lf.Write(buf))
+		_, err = lf.TruncateTail(tail)
+		assert.Equal(t, ErrRecordAfterTail, err)
+		lr, _, err = lf.ReadLogRecord(tail + int64(size-2))
+		assert.Nil(t, err)
+		assert.Equal(t, record.Value, lr.Value)
+
+		assert.Nil(t, lf.Delete())
+		assert.Nil(t, os.RemoveAll(path))
+	}
+}
+
+func TestLogFile_Grow(t *testing.T) {
+	for _, ioType := range []IOType{FileIO, MMap, BufferedIO, DirectIO} {
+		path := filepath.Join(os.TempDir(), "sdb-logfile-grow")
+		assert.Nil(t, os.MkdirAll(path, os.ModePerm))
+		fileSize := func(lf *LogFile) int64 {
+			name, _ := LogFileName(path, lf.FileID, Str)
+			stat, err := os.Stat(name)
+			assert.Nil(t, err)
+			return stat.Size()
+		}
+
+		// 新文件不预分配阈值大小
+		threshold := int64(8 << 20)
+		lf, err := OpenLogFile(path, 1, threshold, Str, ioType)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(initialFileSize), fileSize(lf))
+
+		record := &LogRecord{Key: []byte("key"), Value: make([]byte, 20<<10)}
+		buf, size := lf.EncodeRecord(record)
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, lf.Write(buf))
+		}
+		assert.Greater(t, fileSize(lf), lf.WriteOffSet)
+		assert.Less(t, fileSize(lf), threshold)
+		for offset := lf.DataOffset; offset < lf.WriteOffSet; offset += int64(size) {
+			lr, _, err := lf.ReadLogRecord(offset)
+			assert.Nil(t, err)
+			assert.Equal(t, record.Value, lr.Value)
+		}
+		_, _, err = lf.ReadLogRecord(lf.WriteOffSet)
+		assert.Equal(t, ErrEndOfRecord, err)
+
+		// 截掉之后读到文件末尾是io.EOF
+		assert.Nil(t, lf.Trim())
+		assert.Equal(t, lf.WriteOffSet, fileSize(lf))
+		_, _, err = lf.ReadLogRecord(lf.WriteOffSet)
+		assert.Equal(t, io.EOF, err)
+		end := lf.WriteOffSet
+		assert.Nil(t, lf.Close())
+
+		// 重新打开按实际大小，阈值变大也不会撑大老文件
+		lf, err = OpenLogFile(path, 1, threshold*2, Str, ioType)
+		assert.Nil(t, err)
+		assert.Equal(t, end, fileSize(lf))
+		lr, _, err := lf.ReadLogRecord(end - int64(size))
+		assert.Nil(t, err)
+		assert.Equal(t, record.Value, lr.Value)
+		assert.Nil(t, lf.Delete())
+
+		// 一条record就超过阈值时按需扩展
+		lf, err = OpenLogFile(path, 2, 1024, Str, ioType)
+		assert.Nil(t, err)
+		buf, _ = lf.EncodeRecord(record)
+		assert.Nil(t, lf.Write(buf))
+		lr, _, err = lf.ReadLogRecord(lf.DataOffset)
+		assert.Nil(t, err)
+		assert.Equal(t, record.Value, lr.Value)
+
+		assert.Nil(t, lf.Delete())
+		assert.Nil(t, os.RemoveAll(path))
+	}
+}
+
+func TestLogFile_SyncTo(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "sdb-logfile-sync")
+	assert.Nil(t, os.MkdirAll(path, os.ModePerm))
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	lf, err := OpenLogFile(path, 1, 1<<20, Str, FileIO)
+	assert.Nil(t, err)
+
+	// 并发写，每个协程都要等到自己写的数据刷盘
+	buf, _ := lf.EncodeRecord(&LogRecord{Key: []byte("key"), Value: []byte("value")})
+	var mu sync.Mutex
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				mu.Lock()
+				assert.Nil(t, lf.Write(buf))
+				end := lf.WriteOffSet
+				mu.Unlock()
+				assert.Nil(t, lf.SyncTo(end))
+				lf.syncMu.Lock()
+				assert.GreaterOrEqual(t, lf.synced, end)
+				lf.syncMu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	// 已经刷过盘的位置直接返回
+	assert.Nil(t, lf.SyncTo(lf.DataOffset))
+
+	// 刷盘失败时返回错误
+	assert.Nil(t, lf.Write(buf))
+	assert.Nil(t, lf.Close())
+	assert.NotNil(t, lf.SyncTo(lf.WriteOffSet))
+}
+
+func TestLogFile_Ref(t *testing.T) {
+	for _, ioType := range []IOType{FileIO, MMap} {
+		path := t.TempDir()
+		lf, err := OpenLogFile(path, 1, 1<<20, Str, ioType)
+		assert.Nil(t, err)
+		record := &LogRecord{Key: []byte("key"), Value: []byte("value")}
+		buf, _ := lf.EncodeRecord(record)
+		assert.Nil(t, lf.Write(buf))
+
+		// 有引用时Delete只做标记，还能读
+		lf.Ref()
+		assert.Nil(t, lf.Delete())
+		assert.Nil(t, lf.Delete())
+		_, err = os.Stat(lf.fileName)
+		assert.Nil(t, err)
+		lr, _, err := lf.ReadLogRecord(lf.DataOffset)
+		assert.Nil(t, err)
+		assert.Equal(t, record.Value, lr.Value)
+
+		// 最后一个引用释放时删除
+		assert.Nil(t, lf.Release())
+		_, err = os.Stat(lf.fileName)
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestLogFile_ViewLogRecord(t *testing.T) {
+	path := t.TempDir()
+	records := make([]*LogRecord, 3)
+	files := make([]*LogFile, len(records))
+	for i := range files {
+		lf, err := OpenLogFile(path, uint32(i+1), 1<<20, Str, MMap)
+		assert.Nil(t, err)
+		records[i] = &LogRecord{Key: []byte(fmt.Sprintf("key-%d", i)), Value: []byte(fmt.Sprintf("value-%d", i))}
+		buf, _ := lf.EncodeRecord(records[i])
+		assert.Nil(t, lf.Write(buf))
+		// 活跃文件扩展时会重新映射，不支持
+		_, _, _, err = lf.ViewLogRecord(lf.DataOffset)
+		assert.Equal(t, ioselector.ErrViewUnsupported, err)
+		assert.Nil(t, lf.Trim())
+		files[i] = lf
+	}
+	cache := NewFileCache(1)
+	for _, lf := range files {
+		assert.Nil(t, lf.SetReadOnly(cache))
+	}
+
+	lr, _, release, err := files[0].ViewLogRecord(files[0].DataOffset)
+	assert.Nil(t, err)
+	assert.Equal(t, records[0].Key, lr.Key)
+	assert.Equal(t, records[0].Value, lr.Value)
+	// pin住的文件不会被淘汰，暂时超出打开数上限
+	for _, lf := range files[1:] {
+		lr, _, err := lf.ReadLogRecord(lf.DataOffset)
+		assert.Nil(t, err)
+		assert.Equal(t, records[lf.FileID-1].Value, lr.Value)
+	}
+	assert.Equal(t, 2, cache.Len())
+	assert.NotNil(t, files[0].IoSelector)
+	// 删除也要等release
+	assert.Nil(t, files[0].Delete())
+	_, err = os.Stat(files[0].fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, records[0].Value, lr.Value)
+	release()
+	_, err = os.Stat(files[0].fileName)
+	assert.True(t, os.IsNotExist(err))
+
+	// Close等release之后再关闭
+	lr, _, release, err = files[1].ViewLogRecord(files[1].DataOffset)
+	assert.Nil(t, err)
+	assert.Nil(t, files[1].Close())
+	assert.NotNil(t, files[1].IoSelector)
+	assert.Equal(t, records[1].Value, lr.Value)
+	release()
+	assert.Nil(t, files[1].IoSelector)
+	_, _, _, err = files[1].ViewLogRecord(files[1].DataOffset)
+	assert.Equal(t, ErrLogFileClosed, err)
+
+	// 不是record开头的offset返回错误，不会一直pin住
+	_, _, _, err = files[2].ViewLogRecord(files[2].DataOffset + 1)
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(0), files[2].pins)
+	assert.Nil(t, files[2].Close())
+	assert.Equal(t, 0, cache.Len())
+
+	// 不是mmap方式不支持
+	lf, err := OpenLogFile(path, 4, 1<<20, Str, FileIO)
+	assert.Nil(t, err)
+	assert.Nil(t, lf.SetReadOnly(NewFileCache(0)))
+	_, _, _, err = lf.ViewLogRecord(lf.DataOffset)
+	assert.Equal(t, ioselector.ErrViewUnsupported, err)
+	assert.Nil(t, lf.Close())
+}
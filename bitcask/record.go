@@ -3,6 +3,9 @@ package bitcask
 import (
 	"encoding/binary"
 	"hash/crc32"
+	"io"
+	"math"
+	"time"
 )
 
 /*
@@ -13,6 +16,17 @@ crc32	typ    kSize	vSize	expiredAt
 
 const MaxHeaderSize = 25
 
+/*
+v2 record的头部最大长度，多了flags和写入时间
+crc32c	flags	typ	kSize	vSize	expiredAt	timestamp
+ 4    +   1   +  1  +   5   +   5   +    10     +    10     = 36
+*/
+
+const MaxHeaderSizeV2 = 36
+
+// v2 record的crc用Castagnoli多项式，现代CPU有专门的指令
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
 type RecordType byte
 
 const (
@@ -28,14 +42,18 @@ type LogRecord struct {
 	Value     []byte
 	ExpiredAt int64
 	Type      RecordType
+	Timestamp int64 // 写入时间，unix纳秒，只有v2 record有，编码时为0取当前时间
+	Flags     byte  // 只有v2 record有，预留
 }
 
 type RecordHeader struct {
 	crc32     uint32
+	flags     byte
 	typ       RecordType
 	kSize     uint32
 	vSize     uint32
 	expiredAt int64
+	timestamp int64
 }
 
 /*
@@ -79,29 +97,64 @@ func EncodeRecord(l *LogRecord) (buf []byte, recordSize int) {
 	return
 }
 
+// DecodeRecord 从字节切片头部解码出一条record，返回record和它占用的字节数
+// 切片长度不足返回io.ErrUnexpectedEOF，全0返回ErrEndOfRecord
+func DecodeRecord(buf []byte) (lr *LogRecord, recordSize int64, err error) {
+	header, headerSize, err := decodeHeader(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	if header == nil {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if header.crc32 == 0 && header.kSize == 0 && header.vSize == 0 {
+		return nil, 0, ErrEndOfRecord
+	}
+
+	keySize, valueSize := int64(header.kSize), int64(header.vSize)
+	recordSize = headerSize + keySize + valueSize
+	if headerSize <= crc32.Size || headerSize > int64(len(buf)) || recordSize > int64(len(buf)) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	lr = &LogRecord{
+		Key:       buf[headerSize : headerSize+keySize],
+		Value:     buf[headerSize+keySize : recordSize],
+		ExpiredAt: header.expiredAt,
+		Type:      header.typ,
+	}
+
+	// crc校验
+	if crc := getRecordCrc(lr, buf[crc32.Size:headerSize]); crc != header.crc32 {
+		return nil, 0, ErrInvalidCrc
+	}
+	return
+}
+
 //解码日志文件切片
-func decodeHeader(buf []byte) (h *RecordHeader, index int64) {
+func decodeHeader(buf []byte) (h *RecordHeader, index int64, err error) {
 	if len(buf) <= 4 {
-		return nil, 0
+		return nil, 0, nil
 	}
 	h = &RecordHeader{
 		crc32: binary.LittleEndian.Uint32(buf[:4]),
 		typ:   RecordType(buf[4]),
 	}
 	index = 5
-	kSize, n := binary.Varint(buf[index:])
-	h.kSize = uint32(kSize)
-	index += int64(n)
-
-	vSize, n := binary.Varint(buf[index:])
-	h.vSize = uint32(vSize)
-	index += int64(n)
-
-	expiredAt, n := binary.Varint(buf[index:])
-	h.expiredAt = expiredAt
-	index += int64(n)
-
-	return h, index
+	kSize, err := decodeVarint(buf, &index)
+	if err != nil {
+		return nil, 0, err
+	}
+	vSize, err := decodeVarint(buf, &index)
+	if err != nil {
+		return nil, 0, err
+	}
+	if h.kSize, h.vSize, err = checkRecordSize(kSize, vSize); err != nil {
+		return nil, 0, err
+	}
+	if h.expiredAt, err = decodeVarint(buf, &index); err != nil {
+		return nil, 0, err
+	}
+	return h, index, nil
 }
 
 func getRecordCrc(l *LogRecord, h []byte) (crc uint32) {
@@ -113,3 +166,155 @@ func getRecordCrc(l *LogRecord, h []byte) (crc uint32) {
 	crc = crc32.Update(crc, crc32.IEEETable, l.Value)
 	return
 }
+
+/*
+v2 record:
++---------+-------+--------+----------+------------+-----------+-----------+-------+---------+
+|  crc32c | flags |  type  | key size | value size | expiresAt | timestamp |  key  |  value  |
++---------+-------+--------+----------+------------+-----------+-----------+-------+---------+
+|-------------------------------RecordHeader-------------------------------|
+          |--------------------------------crc check-----------------------------------------|
+*/
+
+// EncodeRecordV2 按v2格式编码record
+func EncodeRecordV2(l *LogRecord) (buf []byte, recordSize int) {
+	if l == nil {
+		return nil, 0
+	}
+
+	kSize := len(l.Key)
+	vSize := len(l.Value)
+	timestamp := l.Timestamp
+	if timestamp == 0 {
+		timestamp = time.Now().UnixNano()
+	}
+	header := make([]byte, MaxHeaderSizeV2)
+	header[4] = l.Flags
+	header[5] = byte(l.Type)
+	index := 6
+	index += binary.PutVarint(header[index:], int64(kSize))
+	index += binary.PutVarint(header[index:], int64(vSize))
+	index += binary.PutVarint(header[index:], l.ExpiredAt)
+	index += binary.PutVarint(header[index:], timestamp)
+
+	recordSize = index + kSize + vSize
+	buf = make([]byte, recordSize)
+	copy(buf[:index], header)
+	copy(buf[index:], l.Key)
+	copy(buf[index+kSize:], l.Value)
+
+	crc := crc32.Checksum(buf[4:], castagnoliTable)
+	binary.LittleEndian.PutUint32(buf[:4], crc)
+	return
+}
+
+// DecodeRecordV2 从字节切片头部解码出一条v2 record，错误和DecodeRecord一样
+func DecodeRecordV2(buf []byte) (lr *LogRecord, recordSize int64, err error) {
+	header, headerSize, err := decodeHeaderV2(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	if header == nil {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if header.crc32 == 0 && header.kSize == 0 && header.vSize == 0 {
+		return nil, 0, ErrEndOfRecord
+	}
+
+	keySize, valueSize := int64(header.kSize), int64(header.vSize)
+	recordSize = headerSize + keySize + valueSize
+	if headerSize <= crc32.Size || headerSize > int64(len(buf)) || recordSize > int64(len(buf)) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	lr = &LogRecord{
+		Key:       buf[headerSize : headerSize+keySize],
+		Value:     buf[headerSize+keySize : recordSize],
+		ExpiredAt: header.expiredAt,
+		Type:      header.typ,
+		Timestamp: header.timestamp,
+		Flags:     header.flags,
+	}
+
+	if crc := getRecordCrcV2(lr, buf[crc32.Size:headerSize]); crc != header.crc32 {
+		return nil, 0, ErrInvalidCrc
+	}
+	return
+}
+
+// EncodeRecordVersion 按日志文件的版本编码record
+func EncodeRecordVersion(l *LogRecord, version byte) ([]byte, int) {
+	if version == LogFileV1 {
+		return EncodeRecord(l)
+	}
+	return EncodeRecordV2(l)
+}
+
+// DecodeRecordVersion 按日志文件的版本解码record
+func DecodeRecordVersion(buf []byte, version byte) (*LogRecord, int64, error) {
+	if version == LogFileV1 {
+		return DecodeRecord(buf)
+	}
+	return DecodeRecordV2(buf)
+}
+
+func decodeHeaderV2(buf []byte) (h *RecordHeader, index int64, err error) {
+	if len(buf) <= 6 {
+		return nil, 0, nil
+	}
+	h = &RecordHeader{
+		crc32: binary.LittleEndian.Uint32(buf[:4]),
+		flags: buf[4],
+		typ:   RecordType(buf[5]),
+	}
+	index = 6
+	kSize, err := decodeVarint(buf, &index)
+	if err != nil {
+		return nil, 0, err
+	}
+	vSize, err := decodeVarint(buf, &index)
+	if err != nil {
+		return nil, 0, err
+	}
+	if h.kSize, h.vSize, err = checkRecordSize(kSize, vSize); err != nil {
+		return nil, 0, err
+	}
+	if h.expiredAt, err = decodeVarint(buf, &index); err != nil {
+		return nil, 0, err
+	}
+	if h.timestamp, err = decodeVarint(buf, &index); err != nil {
+		return nil, 0, err
+	}
+	return h, index, nil
+}
+
+// decodeVarint 从buf[*index:]解码一个varint并后移index
+// buf在varint中间结束的是写了一半的header，返回io.ErrUnexpectedEOF；超过64位的是损坏的header
+func decodeVarint(buf []byte, index *int64) (int64, error) {
+	v, n := binary.Varint(buf[*index:])
+	if n == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if n < 0 {
+		return 0, ErrInvalidRecordHeader
+	}
+	*index += int64(n)
+	return v, nil
+}
+
+// checkRecordSize key和value的大小不能是负数，也不能超过uint32
+func checkRecordSize(kSize, vSize int64) (uint32, uint32, error) {
+	if kSize < 0 || vSize < 0 || kSize > math.MaxUint32 || vSize > math.MaxUint32 {
+		return 0, 0, ErrInvalidRecordHeader
+	}
+	return uint32(kSize), uint32(vSize), nil
+}
+
+func getRecordCrcV2(l *LogRecord, h []byte) (crc uint32) {
+	if l == nil {
+		return 0
+	}
+	crc = crc32.Checksum(h, castagnoliTable)
+	crc = crc32.Update(crc, castagnoliTable, l.Key)
+	crc = crc32.Update(crc, castagnoliTable, l.Value)
+	return
+}
@@ -1,6 +1,7 @@
 package bitcask
 
 import (
+	"io"
 	"reflect"
 	"testing"
 )
@@ -53,29 +54,42 @@ func Test_decodeHeader(t *testing.T) {
 		args  args
 		want  *RecordHeader
 		want1 int64
+		err   error
 	}{
 		{
-			"nil", args{buf: nil}, nil, 0,
+			"nil", args{buf: nil}, nil, 0, nil,
 		},
 		{
-			"no-enough-bytes", args{buf: []byte{1, 4, 3, 22}}, nil, 0,
+			"no-enough-bytes", args{buf: []byte{1, 4, 3, 22}}, nil, 0, nil,
 		},
 		{
-			"no-fields", args{buf: []byte{28, 223, 68, 33, 0, 0, 0, 0}}, &RecordHeader{crc32: 558161692}, 8,
+			"no-fields", args{buf: []byte{28, 223, 68, 33, 0, 0, 0, 0}}, &RecordHeader{crc32: 558161692}, 8, nil,
 		},
 		{
-			"normal", args{buf: []byte{101, 208, 223, 156, 0, 4, 14, 198, 147, 242, 166, 3}}, &RecordHeader{crc32: 2631913573, typ: 0, kSize: 2, vSize: 7, expiredAt: 443434211}, 12,
+			"normal", args{buf: []byte{101, 208, 223, 156, 0, 4, 14, 198, 147, 242, 166, 3}}, &RecordHeader{crc32: 2631913573, typ: 0, kSize: 2, vSize: 7, expiredAt: 443434211}, 12, nil,
+		},
+		{
+			"torn-varint", args{buf: []byte{101, 208, 223, 156, 0, 4, 14, 198, 147}}, nil, 0, io.ErrUnexpectedEOF,
+		},
+		{
+			"negative-size", args{buf: []byte{101, 208, 223, 156, 0, 3, 14, 0}}, nil, 0, ErrInvalidRecordHeader,
+		},
+		{
+			"overflow-varint", args{buf: []byte{101, 208, 223, 156, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 0, 0}}, nil, 0, ErrInvalidRecordHeader,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, got1 := decodeHeader(tt.args.buf)
+			got, got1, err := decodeHeader(tt.args.buf)
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("decodeHeader() got = %v, want %v", got, tt.want)
 			}
 			if got1 != tt.want1 {
 				t.Errorf("decodeHeader() got1 = %v, want %v", got1, tt.want1)
 			}
+			if err != tt.err {
+				t.Errorf("decodeHeader() err = %v, want %v", err, tt.err)
+			}
 		})
 	}
 }
@@ -108,3 +122,96 @@ func Test_getRecordCrc(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodeRecord(t *testing.T) {
+	buf, _ := EncodeRecord(&LogRecord{Key: []byte("kv"), Value: []byte("lotusdb"), ExpiredAt: 443434211})
+	corrupt := append([]byte{}, buf...)
+	corrupt[len(corrupt)-1] ^= 0xff
+
+	type args struct {
+		buf []byte
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    *LogRecord
+		want1   int64
+		wantErr error
+	}{
+		{
+			"nil", args{buf: nil}, nil, 0, io.ErrUnexpectedEOF,
+		},
+		{
+			"end-of-record", args{buf: make([]byte, MaxHeaderSize)}, nil, 0, ErrEndOfRecord,
+		},
+		{
+			"normal", args{buf: append(buf, 0, 0, 0)}, &LogRecord{Key: []byte("kv"), Value: []byte("lotusdb"), ExpiredAt: 443434211}, 21, nil,
+		},
+		{
+			"truncated", args{buf: buf[:len(buf)-1]}, nil, 0, io.ErrUnexpectedEOF,
+		},
+		{
+			"invalid-crc", args{buf: corrupt}, nil, 0, ErrInvalidCrc,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, got1, err := DecodeRecord(tt.args.buf)
+			if err != tt.wantErr {
+				t.Errorf("DecodeRecord() err = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DecodeRecord() got = %v, want %v", got, tt.want)
+			}
+			if got1 != tt.want1 {
+				t.Errorf("DecodeRecord() got1 = %v, want %v", got1, tt.want1)
+			}
+		})
+	}
+}
+
+func TestDecodeRecordV2(t *testing.T) {
+	record := &LogRecord{Key: []byte("kv"), Value: []byte("lotusdb"), ExpiredAt: 443434211, Timestamp: 1660000000000000000, Flags: 3, Type: TypeDelete}
+	buf, size := EncodeRecordV2(record)
+	corrupt := append([]byte{}, buf...)
+	corrupt[4] ^= 0xff
+
+	got, got1, err := DecodeRecordV2(append(buf, 0, 0, 0))
+	if err != nil || got1 != int64(size) || !reflect.DeepEqual(got, record) {
+		t.Errorf("DecodeRecordV2() got = %v, %v, %v, want %v, %v", got, got1, err, record, size)
+	}
+	// 没有指定写入时间时用当前时间
+	if got, _, _ := DecodeRecordV2(mustEncodeRecordV2(&LogRecord{Key: []byte("kv")})); got == nil || got.Timestamp == 0 {
+		t.Errorf("DecodeRecordV2() timestamp not set")
+	}
+	if _, _, err = DecodeRecordV2(make([]byte, MaxHeaderSizeV2)); err != ErrEndOfRecord {
+		t.Errorf("DecodeRecordV2() err = %v, want %v", err, ErrEndOfRecord)
+	}
+	if _, _, err = DecodeRecordV2(buf[:size-1]); err != io.ErrUnexpectedEOF {
+		t.Errorf("DecodeRecordV2() err = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	// 负数的key大小、超过64位的varint在分配内存之前就报错
+	negative := append([]byte{}, buf...)
+	negative[6] = 3
+	if _, _, err = DecodeRecordV2(negative); err != ErrInvalidRecordHeader {
+		t.Errorf("DecodeRecordV2() err = %v, want %v", err, ErrInvalidRecordHeader)
+	}
+	overflow := append(append([]byte{}, buf[:6]...), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 0, 0, 0)
+	if _, _, err = DecodeRecordV2(overflow); err != ErrInvalidRecordHeader {
+		t.Errorf("DecodeRecordV2() err = %v, want %v", err, ErrInvalidRecordHeader)
+	}
+	// flags也在crc校验范围内
+	if _, _, err = DecodeRecordV2(corrupt); err != ErrInvalidCrc {
+		t.Errorf("DecodeRecordV2() err = %v, want %v", err, ErrInvalidCrc)
+	}
+	// v1和v2的编码不能互相解码
+	if _, _, err = DecodeRecordVersion(buf, LogFileV1); err == nil {
+		t.Errorf("DecodeRecordVersion() decoded v2 record as v1")
+	}
+}
+
+func mustEncodeRecordV2(l *LogRecord) []byte {
+	buf, _ := EncodeRecordV2(l)
+	return buf
+}
@@ -0,0 +1,477 @@
+package sdb
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"sdb/bitcask"
+	"sdb/count"
+	"sdb/ioselector"
+	"sdb/logger"
+	"sdb/utils"
+)
+
+// 键值分离：不小于BlobThreshold的value写到blob文件，日志文件中的record只保存指针，格式见bitcask/blob.go
+// blob文件不记到MANIFEST：merge blob文件时，有效的value走正常的写入流程重新写一遍（新的blob record和新的指针record），
+// 都刷盘之后才删除老的blob文件，中途崩溃的话老文件还在，数据不会丢
+// blob的无效数据单独记在blob自己的count file中，keyDir记着value所在的blob位置，覆盖、删除时一起统计
+// 写了blob record但是指针record没写成功（崩溃）的value不会被统计为无效数据，只能等所在文件被merge时回收
+
+// blobFiles 一种数据类型的blob文件，受db.mu保护
+type blobFiles struct {
+	activeFile     *bitcask.LogFile
+	immutableFiles map[uint32]*bitcask.LogFile
+	countFile      *count.CountFile
+}
+
+// value是否写到blob文件，zset的value是分值，启动时要用来构建跳表，不分离
+func (db *SDB) blobEnabled(dataType DataType, lr *bitcask.LogRecord) bool {
+	return db.opts.BlobThreshold > 0 && dataType != ZSet &&
+		lr.Type == bitcask.TypeDefault && len(lr.Value) >= db.opts.BlobThreshold
+}
+
+// 启动时打开已有的blob文件，最大的fid是活跃文件
+func (db *SDB) initBlobFiles() error {
+	dirEntries, err := os.ReadDir(db.opts.DBPath)
+	if err != nil {
+		return err
+	}
+	fileIDMap := make(map[DataType][]uint32)
+	for _, entry := range dirEntries {
+		fType, fID, err := bitcask.ParseBlobFileName(entry.Name())
+		if err != nil {
+			continue
+		}
+		fileIDMap[DataType(fType)] = append(fileIDMap[DataType(fType)], fID)
+	}
+
+	db.blobFiles = make(map[DataType]*blobFiles)
+	for dataType := String; dataType < logFileTypeNum; dataType++ {
+		fIDs := fileIDMap[dataType]
+		if len(fIDs) == 0 && (db.opts.BlobThreshold <= 0 || dataType == ZSet) {
+			continue
+		}
+		bf, err := db.newBlobFiles(dataType)
+		if err != nil {
+			return err
+		}
+		db.blobFiles[dataType] = bf
+		sort.Slice(fIDs, func(i, j int) bool {
+			return fIDs[i] < fIDs[j]
+		})
+		fType, ioType := bitcask.FileType(dataType), bitcask.IOType(db.opts.IoType)
+		for i, fID := range fIDs {
+			if i < len(fIDs)-1 {
+				lf, err := bitcask.OpenReadOnlyBlobFile(db.opts.DBPath, fID, fType, ioType, db.keyring, db.fileCache)
+				if err != nil {
+					return err
+				}
+				bf.immutableFiles[fID] = lf
+				continue
+			}
+			lf, err := bitcask.OpenBlobFile(db.opts.DBPath, fID, db.fileCapacity(bf.countFile, fID), fType, ioType, db.keyring)
+			if err != nil {
+				return err
+			}
+			bf.activeFile = lf
+			if err = db.initBlobWriteOffset(dataType, lf); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (db *SDB) newBlobFiles(dataType DataType) (*blobFiles, error) {
+	countFilePath := filepath.Join(db.opts.DBPath, count.CountFilePath)
+	if !utils.PathExist(countFilePath) {
+		if err := os.MkdirAll(countFilePath, os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+	name := bitcask.BlobFilePrefix + bitcask.FileNameMap[bitcask.FileType(dataType)][len(bitcask.FilePrefix):] + count.CountFileName
+	cf, err := count.NewEncryptedCountFile(countFilePath, name, db.opts.CountBufferSize, db.keyring)
+	if err != nil {
+		return nil, err
+	}
+	return &blobFiles{immutableFiles: make(map[uint32]*bitcask.LogFile), countFile: cf}, nil
+}
+
+// 活跃blob文件没有索引指向末尾，读一遍找到写的位置，尾部写了一半的record和日志文件一样处理
+func (db *SDB) initBlobWriteOffset(dataType DataType, lf *bitcask.LogFile) error {
+	offset := lf.DataOffset
+	for {
+		_, recordSize, err := lf.ReadLogRecord(offset)
+		if err == io.EOF || err == bitcask.ErrEndOfRecord {
+			break
+		}
+		if err != nil {
+			if !db.opts.RecoverTornWrite {
+				logger.Errorf("read blob file err, dataType: [%v], fid: [%v], offset: [%v], err: [%v]", dataType, lf.FileID, offset, err)
+				return ErrCorruptLogFile
+			}
+			dropped, truncateErr := lf.TruncateTail(offset)
+			if truncateErr == bitcask.ErrRecordAfterTail {
+				logger.Errorf("corrupted record in the middle of active blob file, dataType: [%v], fid: [%v], offset: [%v], err: [%v]", dataType, lf.FileID, offset, err)
+				return ErrCorruptLogFile
+			}
+			if truncateErr != nil {
+				return truncateErr
+			}
+			logger.Warnf("truncate torn write in active blob file, dataType: [%v], fid: [%v], offset: [%v], dropped bytes: [%v], err: [%v]",
+				dataType, lf.FileID, offset, dropped, err)
+			break
+		}
+		offset += recordSize
+	}
+	atomic.StoreInt64(&lf.WriteOffSet, offset)
+	return nil
+}
+
+// 把完整的record写到活跃blob文件，返回指向它的指针，调用方需要持有对应数据类型的索引锁
+func (db *SDB) writeBlobRecord(dataType DataType, lr *bitcask.LogRecord) (*bitcask.BlobPointer, error) {
+	activeFile, err := db.getActiveBlobFile(dataType)
+	if err != nil {
+		return nil, err
+	}
+	lr = db.compressRecord(lr)
+	lrBuf, recordSize := activeFile.EncodeRecord(lr)
+	if activeFile.WriteOffSet+int64(recordSize) > activeFile.Capacity {
+		if err = activeFile.Sync(); err != nil {
+			return nil, err
+		}
+		if activeFile, err = db.rotateBlobFile(dataType); err != nil {
+			return nil, err
+		}
+		lrBuf, recordSize = activeFile.EncodeRecord(lr)
+	}
+
+	writeAt := atomic.LoadInt64(&activeFile.WriteOffSet)
+	if err = activeFile.Write(lrBuf); err != nil {
+		return nil, err
+	}
+	if err = db.syncAfterWrite(dataType, activeFile, true); err != nil {
+		return nil, err
+	}
+	return &bitcask.BlobPointer{FileID: activeFile.FileID, Offset: writeAt, Size: int64(recordSize)}, nil
+}
+
+// 获取活跃blob文件，还没有的话新建
+func (db *SDB) getActiveBlobFile(dataType DataType) (*bitcask.LogFile, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	bf := db.blobFiles[dataType]
+	if bf == nil {
+		var err error
+		if bf, err = db.newBlobFiles(dataType); err != nil {
+			return nil, err
+		}
+		db.blobFiles[dataType] = bf
+	}
+	if bf.activeFile == nil {
+		lf, err := db.openBlobFile(dataType, bitcask.InitialLogFileId)
+		if err != nil {
+			return nil, err
+		}
+		bf.activeFile = lf
+	}
+	return bf.activeFile, nil
+}
+
+// 打开fID对应的blob文件，新文件初始化下它在count file中的记录，调用方需要持有db.mu写锁
+func (db *SDB) openBlobFile(dataType DataType, fID uint32) (*bitcask.LogFile, error) {
+	opts := db.opts
+	lf, err := bitcask.OpenBlobFile(opts.DBPath, fID, opts.LogFileSizeThreshold,
+		bitcask.FileType(dataType), bitcask.IOType(opts.IoType), db.keyring)
+	if err != nil {
+		return nil, err
+	}
+	db.blobFiles[dataType].countFile.SetFileSize(fID, uint32(lf.Capacity))
+	return lf, nil
+}
+
+// 活跃blob文件写满了，转为非活跃文件，新建一个活跃blob文件
+func (db *SDB) rotateBlobFile(dataType DataType) (*bitcask.LogFile, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.rotateBlobFileLocked(dataType)
+}
+
+// 调用方需要持有db.mu写锁
+func (db *SDB) rotateBlobFileLocked(dataType DataType) (*bitcask.LogFile, error) {
+	bf := db.blobFiles[dataType]
+	if err := trimLogFile(bf.countFile, bf.activeFile); err != nil {
+		return nil, err
+	}
+	lf, err := db.openBlobFile(dataType, bf.activeFile.FileID+1)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.syncDBPath(); err != nil {
+		return nil, err
+	}
+	old := bf.activeFile
+	bf.immutableFiles[old.FileID] = old
+	bf.activeFile = lf
+	// 老的活跃文件不会再写了，转为只读
+	if err = old.SetReadOnly(db.fileCache); err != nil {
+		logger.Errorf("set blob file read-only err, dataType: [%v], fid: [%v], err: [%v]", dataType, old.FileID, err)
+	}
+	return lf, nil
+}
+
+// 获取blob文件并增加引用计数，用完之后调用方Release
+func (db *SDB) getBlobFile(dataType DataType, fID uint32) *bitcask.LogFile {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	bf := db.blobFiles[dataType]
+	if bf == nil {
+		return nil
+	}
+	lf := bf.immutableFiles[fID]
+	if bf.activeFile != nil && bf.activeFile.FileID == fID {
+		lf = bf.activeFile
+	}
+	if lf != nil {
+		lf.Ref()
+	}
+	return lf
+}
+
+// 按日志文件中record的指针读出blob文件中的value
+func (db *SDB) readBlobValue(dataType DataType, pointer []byte) ([]byte, error) {
+	blob, _, err := bitcask.DecodeBlobPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	lf := db.getBlobFile(dataType, blob.FileID)
+	if lf == nil {
+		return nil, ErrLogFileNotFound
+	}
+	defer lf.Release()
+	record, _, err := lf.ReadLogRecord(blob.Offset)
+	if err != nil {
+		return nil, err
+	}
+	return record.Value, nil
+}
+
+// 和readBlobValue一样，blob文件是只读的mmap文件时直接返回映射的内存，用完调用release
+func (db *SDB) viewBlobValue(dataType DataType, pointer []byte) ([]byte, func(), error) {
+	blob, _, err := bitcask.DecodeBlobPointer(pointer)
+	if err != nil {
+		return nil, nil, err
+	}
+	lf := db.getBlobFile(dataType, blob.FileID)
+	if lf == nil {
+		return nil, nil, ErrLogFileNotFound
+	}
+	defer lf.Release()
+	record, _, release, err := lf.ViewLogRecord(blob.Offset)
+	if err == ioselector.ErrViewUnsupported {
+		if record, _, err = lf.ReadLogRecord(blob.Offset); err != nil {
+			return nil, nil, err
+		}
+		return record.Value, noRelease, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return record.Value, release, nil
+}
+
+// blob中的value被覆盖或者删除，计入blob的count file
+func (db *SDB) sendBlobCount(blob *bitcask.BlobPointer, dataType DataType) {
+	db.mu.RLock()
+	bf := db.blobFiles[dataType]
+	db.mu.RUnlock()
+	if bf == nil {
+		return
+	}
+	select {
+	case bf.countFile.CountRcv <- &count.CountUpdate{FileID: blob.FileID, RecordSize: int(blob.Size)}:
+	default:
+		logger.Warn("[db] send to blob count chan fail")
+	}
+}
+
+// MergeBlobFiles 手动merge dataType的blob文件，无效数据比例达到ratio的非活跃blob文件中的有效value重写到活跃blob文件
+func (db *SDB) MergeBlobFiles(dataType DataType, ratio float64) error {
+	if atomic.LoadInt32(&db.mergeState) > 0 {
+		return ErrMergeRunning
+	}
+	return db.mergeBlob(dataType, ratio)
+}
+
+func (db *SDB) mergeBlob(dataType DataType, ratio float64) error {
+	atomic.AddInt32(&db.mergeState, 1)
+	defer atomic.AddInt32(&db.mergeState, -1)
+
+	db.mu.RLock()
+	bf := db.blobFiles[dataType]
+	db.mu.RUnlock()
+	if bf == nil || bf.activeFile == nil {
+		return nil
+	}
+	bf.countFile.Flush()
+	if err := bf.countFile.Sync(); err != nil {
+		return err
+	}
+	mcl, err := bf.countFile.GetMCL(bf.activeFile.FileID, ratio)
+	if err != nil {
+		return err
+	}
+	return db.mergeBlobFiles(dataType, mcl)
+}
+
+// 把fIDs对应blob文件中有效的value重新写一遍，刷盘之后删除这些文件
+func (db *SDB) mergeBlobFiles(dataType DataType, fIDs []uint32) error {
+	sort.Slice(fIDs, func(i, j int) bool {
+		return fIDs[i] < fIDs[j]
+	})
+	// 被merge的文件在merge期间一直被引用，删除时释放，出错没删除的在这里释放
+	var inputs []*bitcask.LogFile
+	defer func() {
+		for _, lf := range inputs {
+			_ = lf.Release()
+		}
+	}()
+	db.mu.RLock()
+	if bf := db.blobFiles[dataType]; bf != nil {
+		// 活跃blob文件不merge
+		for _, fID := range fIDs {
+			if lf := bf.immutableFiles[fID]; lf != nil {
+				lf.Ref()
+				inputs = append(inputs, lf)
+			}
+		}
+	}
+	db.mu.RUnlock()
+	if len(inputs) == 0 {
+		return nil
+	}
+
+	for _, lf := range inputs {
+		offset := lf.DataOffset
+		for {
+			record, size, err := lf.ReadLogRecord(offset)
+			if err != nil {
+				if err == io.EOF || err == bitcask.ErrEndOfRecord {
+					break
+				}
+				return err
+			}
+			if err = db.rewriteBlob(dataType, lf.FileID, offset, record); err != nil {
+				return err
+			}
+			offset += size
+		}
+	}
+
+	// 新的blob record和指针record都刷盘之后才能删除老文件
+	if err := db.Sync(); err != nil {
+		return err
+	}
+	// 没有其他协程在读的文件马上删除，有的话等它们读完再删除
+	db.mu.Lock()
+	bf := db.blobFiles[dataType]
+	for _, lf := range inputs {
+		delete(bf.immutableFiles, lf.FileID)
+		_ = lf.Delete()
+		_ = lf.Release()
+	}
+	db.mu.Unlock()
+	bf.countFile.Flush()
+	for _, lf := range inputs {
+		bf.countFile.Clear(lf.FileID)
+	}
+	inputs = nil
+	return db.syncDBPath()
+}
+
+// 索引中的key还指向这个blob record的话，把record重新写一遍，value大小仍然超过阈值的会写到活跃blob文件
+func (db *SDB) rewriteBlob(dataType DataType, fID uint32, offset int64, record *bitcask.LogRecord) error {
+	// 找到record在索引中的keyDir，设置好对应的ar树
+	var kd interface{}
+	idxKey := record.Key
+	switch dataType {
+	case String:
+		db.strIndex.mu.Lock()
+		defer db.strIndex.mu.Unlock()
+		kd = db.strIndex.idxTree.Get(record.Key)
+	case List:
+		db.listIndex.mu.Lock()
+		defer db.listIndex.mu.Unlock()
+		listKey, _ := utils.DecodeListKey(record.Key)
+		if tree := db.listIndex.trees[string(listKey)]; tree != nil {
+			db.listIndex.idxTree = tree
+			kd = tree.Get(record.Key)
+		}
+	case Hash:
+		db.hashIndex.mu.Lock()
+		defer db.hashIndex.mu.Unlock()
+		key, field := utils.DecodeHashKey(record.Key)
+		if tree := db.hashIndex.trees[string(key)]; tree != nil {
+			db.hashIndex.idxTree = tree
+			kd, idxKey = tree.Get(field), field
+		}
+	case Set:
+		db.setIndex.mu.Lock()
+		defer db.setIndex.mu.Unlock()
+		key, sum := utils.DecodeSetKey(record.Key)
+		if tree := db.setIndex.trees[string(key)]; tree != nil {
+			db.setIndex.idxTree = tree
+			kd, idxKey = tree.Get(sum), sum
+		}
+	}
+
+	latestKeyDir, _ := kd.(*keyDir)
+	if latestKeyDir == nil || latestKeyDir.blob == nil ||
+		latestKeyDir.blob.FileID != fID || latestKeyDir.blob.Offset != offset ||
+		(latestKeyDir.expiredAt != 0 && latestKeyDir.expiredAt <= time.Now().Unix()) {
+		return nil
+	}
+	newKeyDir, err := db.writeLogRecord(record, dataType)
+	if err != nil {
+		return err
+	}
+	// 老的指针record和blob record都计入无效数据
+	return db.updateIndexTree(&bitcask.LogRecord{Key: idxKey, Value: record.Value}, newKeyDir, true, dataType)
+}
+
+// 刷盘活跃blob文件和blob的count file
+func (db *SDB) syncBlobFiles() error {
+	for _, bf := range db.blobFiles {
+		if bf.activeFile != nil {
+			if err := bf.activeFile.Sync(); err != nil {
+				return err
+			}
+		}
+		if err := bf.countFile.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 关闭所有blob文件和blob的count file
+func (db *SDB) closeBlobFiles() {
+	for _, bf := range db.blobFiles {
+		if bf.activeFile != nil {
+			_ = bf.activeFile.Sync()
+			_ = bf.activeFile.Close()
+		}
+		for _, lf := range bf.immutableFiles {
+			_ = lf.Close()
+		}
+		bf.countFile.Once.Do(func() {
+			close(bf.countFile.CountRcv)
+		})
+		bf.countFile.Wait()
+	}
+}
@@ -0,0 +1,164 @@
+package sdb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"sdb/bitcask"
+	"sdb/options"
+)
+
+func TestSDB_Blob(t *testing.T) {
+	pwd, _ := os.Getwd()
+	opts := options.NewDefaultOptions(filepath.Join(pwd, "test/blob"))
+	opts.LogFileSizeThreshold = 4 << 10
+	opts.LogFileMergeInterval = 0
+	opts.CountBufferSize = 1024
+	opts.BlobThreshold = 1024
+	db, err := OpenDB(opts)
+	assert.Nil(t, err)
+	defer func() {
+		clearDB(db)
+	}()
+
+	bigValue := func(i, version int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("big-%04d-%04d;", i, version)), 100)
+	}
+	assertValues := func(db *SDB, n, version int) {
+		for i := 0; i < n; i++ {
+			val, err := db.Get(getTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, bigValue(i, version), val)
+			val, err = db.HGet([]byte("hash"), getTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, bigValue(i, version), val)
+		}
+		val, err := db.Get([]byte("small"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("inline"), val)
+	}
+	// 文件中是否有value的内容
+	containsValue := func(prefix string, value []byte) bool {
+		dirEntries, err := os.ReadDir(opts.DBPath)
+		assert.Nil(t, err)
+		for _, entry := range dirEntries {
+			if entry.IsDir() || !strings.HasPrefix(entry.Name(), prefix) {
+				continue
+			}
+			buf, err := os.ReadFile(filepath.Join(opts.DBPath, entry.Name()))
+			assert.Nil(t, err)
+			if bytes.Contains(buf, value) {
+				return true
+			}
+		}
+		return false
+	}
+
+	writeCount := 10
+	for i := 0; i < writeCount; i++ {
+		assert.Nil(t, db.Set(getTestKey(i), bigValue(i, 0)))
+		assert.Nil(t, db.HSet([]byte("hash"), getTestKey(i), bigValue(i, 0)))
+	}
+	assert.Nil(t, db.Set([]byte("small"), []byte("inline")))
+	assertValues(db, writeCount, 0)
+	// 大value只在blob文件中，小value还在日志文件中
+	assert.False(t, containsValue(bitcask.FilePrefix, bigValue(0, 0)))
+	assert.True(t, containsValue(bitcask.BlobFilePrefix, bigValue(0, 0)))
+	assert.True(t, containsValue(bitcask.FilePrefix, []byte("inline")))
+
+	// 覆盖之后老的blob文件都是无效数据，merge blob文件回收；多覆盖几次，日志文件中的指针record也写满一个文件
+	for round := 0; round < 8; round++ {
+		for i := 0; i < writeCount; i++ {
+			assert.Nil(t, db.Set(getTestKey(i), bigValue(i, 1)))
+			assert.Nil(t, db.HSet([]byte("hash"), getTestKey(i), bigValue(i, 1)))
+		}
+	}
+	blobFiles := func(dataType DataType) int {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		return len(db.blobFiles[dataType].immutableFiles) + 1
+	}
+	before := blobFiles(String)
+	waitBlobMergeCandidate(t, db, String)
+	assert.Nil(t, db.MergeBlobFiles(String, 0.5))
+	assert.Less(t, blobFiles(String), before)
+	assert.False(t, containsValue(bitcask.BlobFilePrefix+"string.", bigValue(0, 0)))
+	assertValues(db, writeCount, 1)
+
+	// 删除的value也计入blob的无效数据
+	assert.Nil(t, db.Delete(getTestKey(0)))
+	_, err = db.Get(getTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, db.Set(getTestKey(0), bigValue(0, 1)))
+
+	// merge日志文件只搬指针，value还在原来的blob文件
+	fID := waitMergeCandidate(t, db, Hash)
+	assert.Nil(t, db.MergeSpecificLogFile(Hash, int(fID), 0))
+	assertValues(db, writeCount, 1)
+
+	// 从索引快照和日志文件重启都能找到blob
+	db = reopenDB(t, db, opts, false)
+	assertValues(db, writeCount, 1)
+	db = reopenDB(t, db, opts, true)
+	assertValues(db, writeCount, 1)
+	// 重启之后覆盖，blob的无效数据统计照常
+	for i := 0; i < writeCount; i++ {
+		assert.Nil(t, db.HSet([]byte("hash"), getTestKey(i), bigValue(i, 2)))
+	}
+	waitBlobMergeCandidate(t, db, Hash)
+	assert.Nil(t, db.MergeBlobFiles(Hash, 0.5))
+	for i := 0; i < writeCount; i++ {
+		val, err := db.HGet([]byte("hash"), getTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, bigValue(i, 2), val)
+	}
+	activeBlob := db.blobFiles[Hash].activeFile.FileID
+	assert.Nil(t, db.CloseDB())
+
+	report, err := Check(opts.DBPath, false, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Problems)
+
+	// blob文件丢了能检查出来
+	name, _ := bitcask.BlobFileName(opts.DBPath, activeBlob, bitcask.Hash)
+	assert.Nil(t, os.Rename(name, name+".bak"))
+	report, err = Check(opts.DBPath, false, nil)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, report.Problems)
+	assert.Nil(t, os.Rename(name+".bak", name))
+
+	db, err = OpenDB(opts)
+	assert.Nil(t, err)
+}
+
+// 等待blob的count file统计到无效数据
+func waitBlobMergeCandidate(t *testing.T, db *SDB, dataType DataType) {
+	waitBlobMergeFiles(t, db, dataType, nil)
+}
+
+// 等待fIDs对应的blob文件都成为merge候选，fIDs为空时至少要有一个候选
+func waitBlobMergeFiles(t *testing.T, db *SDB, dataType DataType, fIDs []uint32) {
+	db.mu.RLock()
+	bf := db.blobFiles[dataType]
+	db.mu.RUnlock()
+	bf.countFile.Flush()
+	mcl, err := bf.countFile.GetMCL(bf.activeFile.FileID, 0.5)
+	assert.Nil(t, err)
+	if len(mcl) == 0 {
+		t.Fatalf("no blob merge candidate for data type %v", dataType)
+	}
+	candidates := make(map[uint32]bool)
+	for _, fID := range mcl {
+		candidates[fID] = true
+	}
+	for _, fID := range fIDs {
+		if !candidates[fID] {
+			t.Fatalf("blob file %d of data type %v is not a merge candidate", fID, dataType)
+		}
+	}
+}
@@ -0,0 +1,546 @@
+package sdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"sdb/bitcask"
+	"sdb/count"
+	"sdb/flock"
+	"sdb/options"
+	"sdb/utils"
+)
+
+// 离线一致性检查，给cmd/sdb-check使用，检查时db不能处于打开状态
+// 检查内容：
+// 1. 每个日志文件中每条record的crc和压缩的value，最后一条record之后只能是0
+// 2. count file中每个文件的无效字节数和日志文件中实际被覆盖、删除的record大小是否一致
+// 3. list中没有元信息或者不在元信息范围内的元素，以及元信息范围内不存在的元素
+// 4. hash、set、zset的record key能否解码
+// 5. 有效的指针record指向的blob文件是否存在，blob record是否在文件范围内
+// 加密的文件需要通过keys提供密钥，解密后再检查
+// repair模式下，损坏的日志文件中能解码的、还是对应key最后一次写入的record（包括损坏位置之后的）按原顺序
+// 写到一个新的文件id中，记到MANIFEST后原文件移到quarantine目录；count file按实际的无效字节数重写
+
+// CheckReport 检查结果
+type CheckReport struct {
+	Files    int      // 检查的日志文件数
+	Records  int      // 有效的record数
+	Problems []string // 发现的问题
+	Repaired []string // repair模式下做的修复
+}
+
+// OK 没有发现问题
+func (r *CheckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *CheckReport) addProblem(format string, v ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, v...))
+}
+
+// 日志文件中解码出的一条record
+type checkRecord struct {
+	lr     *bitcask.LogRecord
+	fileID uint32
+	offset int64
+	size   int64
+}
+
+// 按fid顺序重放一种数据类型的所有record，统计每个文件的无效字节数，规则和db运行时发给count file的一致：
+// 覆盖时旧record无效，删除时旧record和删除record本身都无效
+type typeChecker struct {
+	dataType DataType
+	report   *CheckReport
+	live     map[string]*checkRecord
+	last     map[string]*checkRecord // 每个key最后一条record，包括删除记录，修复时只留下这些
+	dead     map[uint32]int64
+}
+
+// 需要修复的损坏的日志文件
+type damagedFile struct {
+	fileID     uint32
+	buf        []byte
+	dataOffset int64
+	records    []*checkRecord
+}
+
+// Check 检查path下的数据文件，repair为true时修复能修复的问题，keys用于读取加密的文件，没有加密时可以传nil
+func Check(path string, repair bool, keys options.KeyProvider) (*CheckReport, error) {
+	if !utils.PathExist(path) {
+		return nil, os.ErrNotExist
+	}
+	// 检查只读，加共享锁就够了，修复要改文件，需要排他锁
+	fileLock, err := flock.AcquireFileLock(filepath.Join(path, lockFileName), !repair)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = fileLock.Release()
+	}()
+
+	db := &SDB{opts: options.Options{DBPath: path}, keyring: &bitcask.Keyring{Lookup: keys}}
+	report := &CheckReport{}
+	if err = db.loadManifest(); err != nil {
+		report.addProblem("%v: %v", manifestFileName, err)
+		db.manifest = &manifest{}
+	}
+	// 修复时新文件要记到MANIFEST中
+	if repair && db.manifest.live != nil {
+		if db.manifest.file, err = os.OpenFile(db.manifestName(), os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = db.closeManifest()
+		}()
+	}
+
+	var repaired bool
+	for dataType := String; dataType < logFileTypeNum; dataType++ {
+		if _, err := os.Stat(db.mergeMarkerName(dataType)); err == nil {
+			report.addProblem("%v: unfinished merge, open the db to recover it", filepath.Base(db.mergeMarkerName(dataType)))
+		}
+		typeRepaired, err := db.checkDataType(dataType, report, repair)
+		if err != nil {
+			return nil, err
+		}
+		repaired = repaired || typeRepaired
+	}
+	// 修复改变了record的位置，索引快照作废
+	if repaired {
+		db.removeIndexSnapshot()
+		if err = db.syncDBPath(); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// 检查一种数据类型的所有日志文件和count file，返回是否做了修复
+func (db *SDB) checkDataType(dataType DataType, report *CheckReport, repair bool) (bool, error) {
+	fType := bitcask.FileType(dataType)
+	fIDs, err := db.listLogFiles(dataType)
+	if err != nil {
+		return false, err
+	}
+
+	// 和MANIFEST中记录的有效文件对比
+	if db.manifest.live != nil {
+		existed := make(map[uint32]struct{})
+		for _, fID := range fIDs {
+			existed[fID] = struct{}{}
+			if _, ok := db.manifest.live[dataType][fID]; !ok {
+				name, _ := bitcask.LogFileName("", fID, fType)
+				report.addProblem("%v: not in manifest", name)
+			}
+		}
+		for _, fID := range db.liveFileIDs(dataType) {
+			if _, ok := existed[fID]; !ok {
+				name, _ := bitcask.LogFileName("", fID, fType)
+				report.addProblem("%v: in manifest but missing", name)
+			}
+		}
+	}
+
+	var repaired bool
+	fileSizes := make(map[uint32]int)
+	checker := &typeChecker{
+		dataType: dataType,
+		report:   report,
+		live:     make(map[string]*checkRecord),
+		last:     make(map[string]*checkRecord),
+		dead:     make(map[uint32]int64),
+	}
+	var damaged []*damagedFile
+	for _, fID := range fIDs {
+		name, _ := bitcask.LogFileName(db.opts.DBPath, fID, fType)
+		buf, err := os.ReadFile(name)
+		if err != nil {
+			return false, err
+		}
+		report.Files++
+		fileSizes[fID] = len(buf)
+
+		header, dataOffset, err := bitcask.DecodeLogFileHeader(buf)
+		if err != nil {
+			// 文件头坏了不知道record的格式，没法修复
+			report.addProblem("%v: %v", filepath.Base(name), err)
+			continue
+		}
+		if header.Version != bitcask.LogFileV1 && header.FileType != fType {
+			report.addProblem("%v: %v", filepath.Base(name), bitcask.ErrLogFileTypeMismatch)
+		}
+		c, err := db.keyring.OpenCipher(header.KeyID, header.KeyCheck)
+		if err != nil {
+			// 没有密钥没法检查record
+			report.addProblem("%v: %v", filepath.Base(name), err)
+			continue
+		}
+		records, corrupted := scanLogFile(fID, buf, header.Version, dataOffset, c)
+		for _, offset := range corrupted {
+			report.addProblem("%v: corrupted data at offset %v", filepath.Base(name), offset)
+		}
+		for _, record := range records {
+			report.Records++
+			checker.add(record)
+		}
+		if repair && len(corrupted) > 0 {
+			damaged = append(damaged, &damagedFile{fileID: fID, buf: buf, dataOffset: dataOffset, records: records})
+		}
+	}
+	// 所有文件都重放完才知道哪些record是key最后一次写入的，新文件的id排在所有文件之后
+	nextFID := uint32(0)
+	for _, fID := range append(fIDs, db.liveFileIDs(dataType)...) {
+		if fID >= nextFID {
+			nextFID = fID + 1
+		}
+	}
+	for _, d := range damaged {
+		salvaged, err := db.salvageLogFile(checker, d, nextFID, fileSizes)
+		if err != nil {
+			return false, err
+		}
+		report.Repaired = append(report.Repaired, fmt.Sprintf("%v: salvaged %v records to %v",
+			checker.fileName(d.fileID), salvaged, checker.fileName(nextFID)))
+		nextFID++
+		repaired = true
+	}
+	if dataType == List {
+		checker.checkList()
+	}
+	blobSizes, err := db.blobFileSizes(dataType)
+	if err != nil {
+		return false, err
+	}
+	checker.checkBlobs(blobSizes)
+
+	countRepaired, err := db.checkCountFile(checker, fileSizes, repair)
+	if err != nil {
+		return false, err
+	}
+	return repaired || countRepaired, nil
+}
+
+// 目录中某种数据类型的所有日志文件id，从小到大排序
+func (db *SDB) listLogFiles(dataType DataType) ([]uint32, error) {
+	dirEntries, err := os.ReadDir(db.opts.DBPath)
+	if err != nil {
+		return nil, err
+	}
+	var fIDs []uint32
+	for _, file := range dirEntries {
+		fType, fID, err := bitcask.ParseLogFileName(file.Name())
+		if err != nil || DataType(fType) != dataType {
+			continue
+		}
+		fIDs = append(fIDs, fID)
+	}
+	sort.Slice(fIDs, func(i, j int) bool {
+		return fIDs[i] < fIDs[j]
+	})
+	return fIDs, nil
+}
+
+// 目录中某种数据类型的所有blob文件的大小
+func (db *SDB) blobFileSizes(dataType DataType) (map[uint32]int64, error) {
+	dirEntries, err := os.ReadDir(db.opts.DBPath)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[uint32]int64)
+	for _, file := range dirEntries {
+		fType, fID, err := bitcask.ParseBlobFileName(file.Name())
+		if err != nil || DataType(fType) != dataType {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			return nil, err
+		}
+		sizes[fID] = info.Size()
+	}
+	return sizes, nil
+}
+
+// 按文件版本解码日志文件中所有能解码的record，返回解密、解压后的record和损坏的位置，c为nil表示文件没加密，
+// 遇到损坏的数据时逐字节往后找下一条能解码的record
+func scanLogFile(fID uint32, buf []byte, version byte, dataOffset int64, c *bitcask.Cipher) (records []*checkRecord, corrupted []int64) {
+	// 最后一个非0字节之后是预分配的空间
+	end := int64(len(buf))
+	for end > 0 && buf[end-1] == 0 {
+		end--
+	}
+
+	offset := dataOffset
+	for offset < end {
+		lr, size, err := bitcask.DecodeRecordVersion(buf[offset:], version)
+		if err == nil {
+			// crc正确但是解密或者解压不了的record也算损坏，跳过这一条
+			if c != nil {
+				err = bitcask.DecryptRecord(c, lr)
+			}
+			if err == nil {
+				err = bitcask.DecompressRecord(lr)
+			}
+			if err != nil {
+				corrupted = append(corrupted, offset)
+			} else {
+				records = append(records, &checkRecord{lr: lr, fileID: fID, offset: offset, size: size})
+			}
+			offset += size
+			continue
+		}
+		corrupted = append(corrupted, offset)
+		for offset++; offset < end; offset++ {
+			if _, _, err = bitcask.DecodeRecordVersion(buf[offset:], version); err == nil {
+				break
+			}
+		}
+	}
+	return
+}
+
+func (c *typeChecker) add(record *checkRecord) {
+	lr := record.lr
+	switch c.dataType {
+	case List:
+		if lr.Type != bitcask.TypeListSeq && len(lr.Key) < 4 {
+			c.report.addProblem("%v: list record at offset %v has undecodable key", c.fileName(record.fileID), record.offset)
+		}
+	case Hash, Set, ZSet:
+		if !utils.ValidHashKey(lr.Key) {
+			c.report.addProblem("%v: record at offset %v has undecodable key", c.fileName(record.fileID), record.offset)
+		}
+	}
+
+	key := string(lr.Key)
+	c.last[key] = record
+	old := c.live[key]
+	// 删除记录本身总是无效数据，和运行时一样计入，不管之前的record是不是已经被merge掉了
+	if lr.Type == bitcask.TypeDelete {
+		if old != nil {
+			c.dead[old.fileID] += old.size
+			delete(c.live, key)
+		}
+		c.dead[record.fileID] += record.size
+		return
+	}
+	if old != nil {
+		c.dead[old.fileID] += old.size
+	}
+	c.live[key] = record
+}
+
+// list元素必须在元信息的headSeq和tailSeq之间，元信息范围内的元素必须都存在
+func (c *typeChecker) checkList() {
+	type listSeq struct {
+		head, tail uint32
+		found      uint32
+	}
+	seqs := make(map[string]*listSeq)
+	for key, record := range c.live {
+		if record.lr.Type != bitcask.TypeListSeq {
+			continue
+		}
+		if len(record.lr.Value) != 8 {
+			c.report.addProblem("%v: list seq record at offset %v has invalid value", c.fileName(record.fileID), record.offset)
+			continue
+		}
+		seqs[key] = &listSeq{
+			head: binary.LittleEndian.Uint32(record.lr.Value[:4]),
+			tail: binary.LittleEndian.Uint32(record.lr.Value[4:8]),
+		}
+	}
+
+	var problems []string
+	for _, record := range c.live {
+		if record.lr.Type == bitcask.TypeListSeq || len(record.lr.Key) < 4 {
+			continue
+		}
+		listKey, seq := utils.DecodeListKey(record.lr.Key)
+		if s := seqs[string(listKey)]; s != nil && seq > s.head && seq < s.tail {
+			s.found++
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("%v: orphan list element at offset %v, key [%s] seq [%v]",
+			c.fileName(record.fileID), record.offset, listKey, seq))
+	}
+	for key, s := range seqs {
+		if want := s.tail - s.head - 1; s.head < s.tail && s.found != want {
+			record := c.live[key]
+			problems = append(problems, fmt.Sprintf("%v: orphan list seq record at offset %v, key [%s] expects %v elements, found %v",
+				c.fileName(record.fileID), record.offset, key, want, s.found))
+		}
+	}
+	sort.Strings(problems)
+	c.report.Problems = append(c.report.Problems, problems...)
+}
+
+// 有效的指针record指向的blob record必须在blob文件范围内
+func (c *typeChecker) checkBlobs(blobSizes map[uint32]int64) {
+	var problems []string
+	for _, record := range c.live {
+		if record.lr.Type&bitcask.TypeBlob == 0 {
+			continue
+		}
+		blob, _, err := bitcask.DecodeBlobPointer(record.lr.Value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%v: record at offset %v has invalid blob pointer", c.fileName(record.fileID), record.offset))
+			continue
+		}
+		if size, ok := blobSizes[blob.FileID]; !ok || blob.Offset+blob.Size > size {
+			blobName, _ := bitcask.BlobFileName("", blob.FileID, bitcask.FileType(c.dataType))
+			problems = append(problems, fmt.Sprintf("%v: record at offset %v points to missing blob %v at offset %v",
+				c.fileName(record.fileID), record.offset, blobName, blob.Offset))
+		}
+	}
+	sort.Strings(problems)
+	c.report.Problems = append(c.report.Problems, problems...)
+}
+
+func (c *typeChecker) fileName(fID uint32) string {
+	name, _ := bitcask.LogFileName("", fID, bitcask.FileType(c.dataType))
+	return name
+}
+
+// 对比count file中记录的无效字节数和实际的无效字节数，repair模式下不一致时重写count file
+func (db *SDB) checkCountFile(c *typeChecker, fileSizes map[uint32]int, repair bool) (bool, error) {
+	countPath := filepath.Join(db.opts.DBPath, count.CountFilePath)
+	countName := bitcask.FileNameMap[bitcask.FileType(c.dataType)] + count.CountFileName
+	counts, countCipher, err := count.ReadCountFile(countPath, countName, db.keyring)
+	if err != nil {
+		return false, err
+	}
+
+	var mismatched bool
+	recorded := make(map[uint32]struct{})
+	for _, fc := range counts {
+		recorded[fc.FileID] = struct{}{}
+		if _, ok := fileSizes[fc.FileID]; !ok {
+			c.report.addProblem("%v: stale entry for missing file %v", countName, fc.FileID)
+			mismatched = true
+			continue
+		}
+		if int64(fc.UsedSize) != c.dead[fc.FileID] {
+			c.report.addProblem("%v: file %v has %v dead bytes, count file records %v", countName, fc.FileID, c.dead[fc.FileID], fc.UsedSize)
+			mismatched = true
+		}
+	}
+	for fID, dead := range c.dead {
+		if _, ok := recorded[fID]; !ok && dead > 0 {
+			c.report.addProblem("%v: file %v has %v dead bytes, count file has no entry", countName, fID, dead)
+			mismatched = true
+		}
+	}
+	if !repair || !mismatched {
+		return false, nil
+	}
+
+	fIDs := make([]uint32, 0, len(fileSizes))
+	for fID := range fileSizes {
+		fIDs = append(fIDs, fID)
+	}
+	sort.Slice(fIDs, func(i, j int) bool {
+		return fIDs[i] < fIDs[j]
+	})
+	newCounts := make([]*count.FileCount, 0, len(fIDs))
+	for _, fID := range fIDs {
+		newCounts = append(newCounts, &count.FileCount{
+			FileID:   fID,
+			FileSize: uint32(fileSizes[fID]),
+			UsedSize: uint32(c.dead[fID]),
+		})
+	}
+	if err = count.WriteCountFile(countPath, countName, newCounts, countCipher); err != nil {
+		return false, err
+	}
+	c.report.Repaired = append(c.report.Repaired, fmt.Sprintf("%v: rewritten", countName))
+	return true, nil
+}
+
+// 把损坏的文件中还是对应key最后一次写入的record按原顺序写到newFID中，替换损坏的文件，返回留下的record数
+// 被后面的文件覆盖或者删除的record丢掉也不影响重放的结果，留下的record排在所有文件之后重放，结果也不变；
+// 原文件的id不复用，新文件刷盘并记到MANIFEST之后才把原文件移到quarantine目录，中间崩溃的话多出来的文件启动时被隔离
+// record原样拷贝，压缩、加密过的不用重新编码，文件头也原样拷贝
+func (db *SDB) salvageLogFile(c *typeChecker, d *damagedFile, newFID uint32, fileSizes map[uint32]int) (int, error) {
+	buf := append([]byte{}, d.buf[:d.dataOffset]...)
+	var salvaged int
+	var dead int64
+	for _, record := range d.records {
+		if c.last[string(record.lr.Key)] != record {
+			continue
+		}
+		offset := int64(len(buf))
+		buf = append(buf, d.buf[record.offset:record.offset+record.size]...)
+		record.fileID, record.offset = newFID, offset
+		// 删除记录本身总是无效数据
+		if record.lr.Type == bitcask.TypeDelete {
+			dead += record.size
+		}
+		salvaged++
+	}
+
+	fType := bitcask.FileType(c.dataType)
+	name, err := bitcask.LogFileName(db.opts.DBPath, d.fileID, fType)
+	if err != nil {
+		return 0, err
+	}
+	newName, err := bitcask.LogFileName(db.opts.DBPath, newFID, fType)
+	if err != nil {
+		return 0, err
+	}
+	tmpName := newName + manifestTmpSuffix
+	if err = writeFileSync(tmpName, buf); err != nil {
+		return 0, err
+	}
+	if err = os.Rename(tmpName, newName); err != nil {
+		return 0, err
+	}
+	if err = db.syncDBPath(); err != nil {
+		return 0, err
+	}
+	// 没有MANIFEST的老目录按文件名加载，不用记
+	if db.manifest.file != nil {
+		if err = db.logManifestEdit(manifestMerge, c.dataType, []uint32{newFID}, []uint32{d.fileID}); err != nil {
+			return 0, err
+		}
+	}
+
+	quarantinePath := filepath.Join(db.opts.DBPath, quarantineDirName)
+	if err = os.MkdirAll(quarantinePath, os.ModePerm); err != nil {
+		return 0, err
+	}
+	if err = os.Rename(name, filepath.Join(quarantinePath, filepath.Base(name))); err != nil {
+		return 0, err
+	}
+	if err = bitcask.RemoveHintFile(db.opts.DBPath, d.fileID, fType); err != nil {
+		return 0, err
+	}
+
+	// count file按新文件统计
+	delete(c.dead, d.fileID)
+	delete(fileSizes, d.fileID)
+	c.dead[newFID] = dead
+	fileSizes[newFID] = len(buf)
+	return salvaged, nil
+}
+
+// 写入文件并刷盘
+func writeFileSync(name string, buf []byte) error {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(buf); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,172 @@
+package sdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"sdb/bitcask"
+	"sdb/utils"
+)
+
+func TestCheck(t *testing.T) {
+	db, opts := openMergeTestDB(t, "test/check")
+	defer func() {
+		_ = os.RemoveAll(opts.DBPath)
+	}()
+
+	writeCount := 200
+	for i := 0; i < writeCount; i++ {
+		assert.Nil(t, db.Set(getTestKey(i), getTestValue(i)))
+	}
+	// 覆盖和删除产生无效数据
+	for i := 0; i < writeCount/2; i++ {
+		assert.Nil(t, db.Set(getTestKey(i), getTestValue(i+1)))
+	}
+	assert.Nil(t, db.Delete(getTestKey(0)))
+	assert.Nil(t, db.RPush([]byte("list"), []byte("a"), []byte("b"), []byte("c")))
+	_, err := db.LPop([]byte("list"))
+	assert.Nil(t, err)
+	assert.Nil(t, db.HSet([]byte("hash"), []byte("f1"), []byte("v1")))
+	assert.Nil(t, db.HSet([]byte("hash"), []byte("f1"), []byte("v2")))
+	assert.Nil(t, db.SAdd([]byte("set"), []byte("m1"), []byte("m2")))
+	assert.Nil(t, db.SRem([]byte("set"), []byte("m1")))
+	assert.Nil(t, db.ZAdd([]byte("zset"), 1, []byte("m1")))
+	assert.Nil(t, db.ZAdd([]byte("zset"), 2, []byte("m1")))
+	assert.Nil(t, db.CloseDB())
+
+	t.Run("clean", func(t *testing.T) {
+		report, err := Check(opts.DBPath, false, nil)
+		assert.Nil(t, err)
+		assert.Empty(t, report.Problems)
+		assert.Greater(t, report.Files, logFileTypeNum)
+	})
+
+	t.Run("db opened", func(t *testing.T) {
+		db, err := OpenDB(opts)
+		assert.Nil(t, err)
+		_, err = Check(opts.DBPath, false, nil)
+		assert.NotNil(t, err)
+		assert.Nil(t, db.CloseDB())
+	})
+
+	t.Run("orphan and undecodable keys", func(t *testing.T) {
+		db, err := OpenDB(opts)
+		assert.Nil(t, err)
+		// 绕过list和hash的接口直接写record
+		_, err = db.writeLogRecord(&bitcask.LogRecord{Key: utils.EncodeListKey([]byte("orphan"), 1), Value: []byte("x")}, List)
+		assert.Nil(t, err)
+		_, err = db.writeLogRecord(&bitcask.LogRecord{Key: append(utils.EncodeHashKey([]byte("hash"), []byte("f2")), 0x7f), Value: []byte("x")}, Hash)
+		assert.Nil(t, err)
+		assert.Nil(t, db.CloseDB())
+
+		report, err := Check(opts.DBPath, false, nil)
+		assert.Nil(t, err)
+		assert.Len(t, report.Problems, 2)
+		assert.Contains(t, report.Problems[0], "orphan list element")
+		assert.Contains(t, report.Problems[1], "undecodable key")
+	})
+
+	t.Run("repair", func(t *testing.T) {
+		// 找到string日志文件中两条相邻的、没有被覆盖过的record，破坏前一条
+		var name string
+		var buf []byte
+		var corruptAt int64
+		var lostKey, nextKey []byte
+		for fID := uint32(0); lostKey == nil && fID < 100; fID++ {
+			name, _ = bitcask.LogFileName(opts.DBPath, fID, bitcask.Str)
+			buf, err = os.ReadFile(name)
+			assert.Nil(t, err)
+			header, offset, err := bitcask.DecodeLogFileHeader(buf)
+			assert.Nil(t, err)
+			var prevOffset int64
+			var prev *bitcask.LogRecord
+			for lostKey == nil {
+				lr, size, err := bitcask.DecodeRecordVersion(buf[offset:], header.Version)
+				if err != nil {
+					break
+				}
+				if prev != nil && string(prev.Key) >= string(getTestKey(writeCount/2)) && string(lr.Key) > string(prev.Key) {
+					lostKey, nextKey, corruptAt = prev.Key, lr.Key, prevOffset
+				}
+				prev, prevOffset = lr, offset
+				offset += size
+			}
+		}
+		lostKey, nextKey = append([]byte{}, lostKey...), append([]byte{}, nextKey...)
+		buf[corruptAt+10] ^= 0xff
+		assert.Nil(t, os.WriteFile(name, buf, 0644))
+
+		report, err := Check(opts.DBPath, false, nil)
+		assert.Nil(t, err)
+		assert.Contains(t, report.Problems, fmt.Sprintf("%v: corrupted data at offset %v", filepath.Base(name), corruptAt))
+
+		report, err = Check(opts.DBPath, true, nil)
+		assert.Nil(t, err)
+		assert.NotEmpty(t, report.Repaired)
+		_, err = os.Stat(filepath.Join(opts.DBPath, quarantineDirName, filepath.Base(name)))
+		assert.Nil(t, err)
+		// 救回来的record写到新的文件id中，原来的id不复用
+		_, err = os.Stat(name)
+		assert.True(t, os.IsNotExist(err))
+
+		// 修复之后只剩下之前写入的孤儿record
+		report, err = Check(opts.DBPath, false, nil)
+		assert.Nil(t, err)
+		assert.Len(t, report.Problems, 2)
+
+		// 只丢了损坏的那条record，之后的record都救回来了
+		db, err := OpenDB(opts)
+		assert.Nil(t, err)
+		defer func() {
+			_ = db.CloseDB()
+		}()
+		_, err = db.Get(lostKey)
+		assert.Equal(t, ErrKeyNotFound, err)
+		// 救回来的文件排在最后重放，被覆盖、删除的旧值不能回来
+		_, err = db.Get(getTestKey(0))
+		assert.Equal(t, ErrKeyNotFound, err)
+		for i := 1; i < writeCount; i++ {
+			if string(getTestKey(i)) == string(lostKey) {
+				continue
+			}
+			want := getTestValue(i)
+			if i < writeCount/2 {
+				want = getTestValue(i + 1)
+			}
+			val, err := db.Get(getTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, want, val)
+		}
+		val, err := db.Get(nextKey)
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+	})
+}
+
+// merge掉被删除的value之后，删除记录本身还是计入无效数据，和count file一致
+func TestCheck_AfterMerge(t *testing.T) {
+	db, opts := openMergeTestDB(t, "test/check-merge")
+	defer func() {
+		_ = os.RemoveAll(opts.DBPath)
+	}()
+
+	writeCount := 300
+	for i := 0; i < writeCount; i++ {
+		assert.Nil(t, db.Set(getTestKey(i), getTestValue(i)))
+	}
+	for i := 0; i < writeCount/3; i++ {
+		assert.Nil(t, db.Delete(getTestKey(i)))
+	}
+	// 删除不存在的key也会写删除记录
+	assert.Nil(t, db.Delete([]byte("missing")))
+	waitMergeFile(t, db, String, 0)
+	assert.Nil(t, db.MergeSpecificLogFile(String, 0, 0))
+	assert.Nil(t, db.CloseDB())
+
+	report, err := Check(opts.DBPath, false, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Problems)
+}
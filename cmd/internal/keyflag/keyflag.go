@@ -0,0 +1,57 @@
+// Package keyflag 离线工具读取加密数据目录用的密钥参数，格式是 id:hex编码的密钥，可以重复指定多个
+package keyflag
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"sdb/bitcask"
+	"sdb/options"
+)
+
+// ErrInvalidKeyFlag 密钥参数格式不对
+var ErrInvalidKeyFlag = errors.New("invalid key, want <key id>:<hex key>")
+
+// Keys key id和密钥的映射，实现flag.Value
+type Keys map[uint32][]byte
+
+func (k Keys) String() string {
+	ids := make([]string, 0, len(k))
+	for id := range k {
+		ids = append(ids, strconv.FormatUint(uint64(id), 10))
+	}
+	return strings.Join(ids, ",")
+}
+
+func (k Keys) Set(s string) error {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return ErrInvalidKeyFlag
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil || id == 0 {
+		return ErrInvalidKeyFlag
+	}
+	key, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return ErrInvalidKeyFlag
+	}
+	if _, err = bitcask.NewCipher(uint32(id), key); err != nil {
+		return fmt.Errorf("key %d: %w", id, err)
+	}
+	k[uint32(id)] = key
+	return nil
+}
+
+// Provider 按key id查找密钥
+func (k Keys) Provider() options.KeyProvider {
+	return func(keyID uint32) ([]byte, error) {
+		if key, ok := k[keyID]; ok {
+			return key, nil
+		}
+		return nil, bitcask.ErrEncryptionKeyNotFound
+	}
+}
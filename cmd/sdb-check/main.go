@@ -0,0 +1,43 @@
+// sdb-check 离线检查数据目录的一致性，db不能处于打开状态
+// usage: sdb-check [--repair] [--key id:hex]... <db path>
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"sdb"
+	"sdb/cmd/internal/keyflag"
+)
+
+func main() {
+	repair := flag.Bool("repair", false, "salvage valid records from corrupted log files and rewrite count files")
+	keys := keyflag.Keys{}
+	flag.Var(keys, "key", "encryption key of an encrypted db, <key id>:<hex key>, repeat for rotated keys")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [--repair] [--key id:hex]... <db path>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	report, err := sdb.Check(flag.Arg(0), *repair, keys.Provider())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "check err: %v\n", err)
+		os.Exit(1)
+	}
+	for _, problem := range report.Problems {
+		fmt.Println("problem:", problem)
+	}
+	for _, repaired := range report.Repaired {
+		fmt.Println("repaired:", repaired)
+	}
+	fmt.Printf("checked %d log files, %d records, %d problems\n", report.Files, report.Records, len(report.Problems))
+	if !report.OK() && !*repair {
+		os.Exit(1)
+	}
+}
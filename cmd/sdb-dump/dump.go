@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"sdb/bitcask"
+	"sdb/options"
+	"sdb/utils"
+)
+
+const (
+	formatText = "text"
+	formatJSON = "json"
+)
+
+// ErrUnsupportedFormat 只支持text和json两种输出格式
+var ErrUnsupportedFormat = errors.New("unsupported output format")
+
+// dumpRecord 日志文件中一条record解码后的内容，key按文件的数据类型解码
+type dumpRecord struct {
+	Offset     int64  `json:"offset"`
+	Size       int64  `json:"size"`
+	CRC        uint32 `json:"crc"`
+	HeaderSize int64  `json:"header_size"`
+	KeySize    int    `json:"key_size"`
+	ValueSize  int    `json:"value_size"`
+	Type       string `json:"type"`
+	ExpiredAt  int64  `json:"expired_at"`
+	Version    byte   `json:"version"`
+	Timestamp  int64  `json:"timestamp,omitempty"` // 写入时间，unix纳秒，v1文件没有
+	Flags      byte   `json:"flags,omitempty"`
+	Compressed bool   `json:"compressed,omitempty"` // value是压缩过的，输出的是解压后的value
+	Encrypted  bool   `json:"encrypted,omitempty"`  // record是加密的，输出的是解密后的key和value
+	Blob       string `json:"blob,omitempty"`       // value在blob文件中，blob的 file_id:offset:size
+
+	Key    string  `json:"key"`
+	Seq    *uint32 `json:"seq,omitempty"`    // list元素的seq
+	Head   *uint32 `json:"head,omitempty"`   // list元信息的headSeq
+	Tail   *uint32 `json:"tail,omitempty"`   // list元信息的tailSeq
+	Field  string  `json:"field,omitempty"`  // hash的field
+	Sum    string  `json:"sum,omitempty"`    // set成员的hash值，hex
+	Member string  `json:"member,omitempty"` // zset的member
+	Score  string  `json:"score,omitempty"`  // zset的score
+	Value  string  `json:"value,omitempty"`
+
+	Error string `json:"error,omitempty"` // 解码失败的原因，之后的数据不再解析
+}
+
+// 把name对应的日志文件中每条record按format输出到w，加密的文件通过keys找密钥
+func dumpLogFile(w io.Writer, name, format string, keys options.KeyProvider) error {
+	if format != formatText && format != formatJSON {
+		return ErrUnsupportedFormat
+	}
+	// blob文件的格式和日志文件一样
+	fType, _, err := bitcask.ParseLogFileName(filepath.Base(name))
+	if err != nil {
+		var blobErr error
+		if fType, _, blobErr = bitcask.ParseBlobFileName(filepath.Base(name)); blobErr != nil {
+			return err
+		}
+	}
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	header, offset, err := bitcask.DecodeLogFileHeader(buf)
+	if err != nil {
+		return err
+	}
+	c, err := (&bitcask.Keyring{Lookup: keys}).OpenCipher(header.KeyID, header.KeyCheck)
+	if err != nil {
+		return err
+	}
+	if format == formatText && header.Version != bitcask.LogFileV1 {
+		created := time.Unix(0, header.CreatedAt).Format(time.RFC3339Nano)
+		if _, err = fmt.Fprintf(w, "# version=%d type=%s created_at=%s", header.Version, fileTypeName(header.FileType), created); err != nil {
+			return err
+		}
+		if header.KeyID != 0 {
+			if _, err = fmt.Fprintf(w, " key_id=%d", header.KeyID); err != nil {
+				return err
+			}
+		}
+		if _, err = fmt.Fprintln(w); err != nil {
+			return err
+		}
+	}
+
+	for offset < int64(len(buf)) {
+		lr, size, err := bitcask.DecodeRecordVersion(buf[offset:], header.Version)
+		if err == bitcask.ErrEndOfRecord {
+			return nil
+		}
+		record := &dumpRecord{Offset: offset}
+		if err != nil {
+			record.Error = err.Error()
+		} else {
+			record.Version = header.Version
+			decodeRecord(record, fType, buf[offset:offset+size], lr, c)
+		}
+		if err = writeRecord(w, record, format); err != nil {
+			return err
+		}
+		if record.Error != "" {
+			return nil
+		}
+		offset += size
+	}
+	return nil
+}
+
+func decodeRecord(record *dumpRecord, fType bitcask.FileType, buf []byte, lr *bitcask.LogRecord, c *bitcask.Cipher) {
+	record.Size = int64(len(buf))
+	record.CRC = binary.LittleEndian.Uint32(buf[:4])
+	record.KeySize, record.ValueSize = len(lr.Key), len(lr.Value)
+	record.HeaderSize = record.Size - int64(record.KeySize+record.ValueSize)
+	// 加密的record先解密，压缩过的value解压后再按类型解析，key_size和value_size还是文件中的大小
+	if c != nil {
+		if err := bitcask.DecryptRecord(c, lr); err != nil {
+			record.Error = err.Error()
+			return
+		}
+		record.Encrypted = true
+	}
+	if lr.Type&bitcask.TypeCompressed != 0 {
+		if err := bitcask.DecompressRecord(lr); err != nil {
+			record.Error = err.Error()
+			return
+		}
+		record.Compressed = true
+	}
+	// 指针record的value是blob的位置，不是真正的value
+	if lr.Type&bitcask.TypeBlob != 0 {
+		blob, _, err := bitcask.DecodeBlobPointer(lr.Value)
+		if err != nil {
+			record.Error = err.Error()
+			return
+		}
+		record.Blob = fmt.Sprintf("%d:%d:%d", blob.FileID, blob.Offset, blob.Size)
+		lr.Type &^= bitcask.TypeBlob
+		lr.Value = nil
+	}
+	record.ExpiredAt = lr.ExpiredAt
+	record.Timestamp, record.Flags = lr.Timestamp, lr.Flags
+	record.Type = recordTypeName(lr.Type)
+	record.Key, record.Value = string(lr.Key), string(lr.Value)
+
+	switch fType {
+	case bitcask.List:
+		if lr.Type == bitcask.TypeListSeq {
+			if len(lr.Value) == 8 {
+				head, tail := binary.LittleEndian.Uint32(lr.Value[:4]), binary.LittleEndian.Uint32(lr.Value[4:8])
+				record.Head, record.Tail, record.Value = &head, &tail, ""
+			}
+			return
+		}
+		if len(lr.Key) >= 4 {
+			key, seq := utils.DecodeListKey(lr.Key)
+			record.Key, record.Seq = string(key), &seq
+		}
+	case bitcask.Hash:
+		if utils.ValidHashKey(lr.Key) {
+			key, field := utils.DecodeHashKey(lr.Key)
+			record.Key, record.Field = string(key), string(field)
+		}
+	case bitcask.Set:
+		if utils.ValidHashKey(lr.Key) {
+			key, sum := utils.DecodeSetKey(lr.Key)
+			record.Key, record.Sum = string(key), hex.EncodeToString(sum)
+		}
+	case bitcask.ZSet:
+		if utils.ValidHashKey(lr.Key) {
+			key, member := utils.DecodeZSetKey(lr.Key)
+			record.Key, record.Member = string(key), string(member)
+			record.Score, record.Value = string(lr.Value), ""
+		}
+	}
+}
+
+func fileTypeName(fType bitcask.FileType) string {
+	for name, typ := range bitcask.FileTypesMap {
+		if typ == fType {
+			return name
+		}
+	}
+	return fmt.Sprintf("unknown(%d)", fType)
+}
+
+func recordTypeName(typ bitcask.RecordType) string {
+	switch typ {
+	case bitcask.TypeDefault:
+		return "default"
+	case bitcask.TypeDelete:
+		return "delete"
+	case bitcask.TypeListSeq:
+		return "list_seq"
+	}
+	return fmt.Sprintf("unknown(%d)", typ)
+}
+
+func writeRecord(w io.Writer, record *dumpRecord, format string) error {
+	if format == formatJSON {
+		buf, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(buf))
+		return err
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "offset=%d", record.Offset)
+	if record.Error != "" {
+		fmt.Fprintf(&sb, " error=%q", record.Error)
+		_, err := fmt.Fprintln(w, sb.String())
+		return err
+	}
+	fmt.Fprintf(&sb, " size=%d crc=%08x header_size=%d key_size=%d value_size=%d type=%s",
+		record.Size, record.CRC, record.HeaderSize, record.KeySize, record.ValueSize, record.Type)
+	if record.ExpiredAt == 0 {
+		sb.WriteString(" expired_at=never")
+	} else {
+		fmt.Fprintf(&sb, " expired_at=%s", time.Unix(record.ExpiredAt, 0).Format(time.RFC3339))
+	}
+	if record.Timestamp != 0 {
+		fmt.Fprintf(&sb, " timestamp=%s", time.Unix(0, record.Timestamp).Format(time.RFC3339Nano))
+	}
+	if record.Flags != 0 {
+		fmt.Fprintf(&sb, " flags=%02x", record.Flags)
+	}
+	fmt.Fprintf(&sb, " key=%q", record.Key)
+	if record.Seq != nil {
+		fmt.Fprintf(&sb, " seq=%d", *record.Seq)
+	}
+	if record.Head != nil {
+		fmt.Fprintf(&sb, " head=%d tail=%d", *record.Head, *record.Tail)
+	}
+	if record.Field != "" {
+		fmt.Fprintf(&sb, " field=%q", record.Field)
+	}
+	if record.Sum != "" {
+		fmt.Fprintf(&sb, " sum=%s", record.Sum)
+	}
+	if record.Member != "" {
+		fmt.Fprintf(&sb, " member=%q score=%s", record.Member, record.Score)
+	}
+	if record.Encrypted {
+		sb.WriteString(" encrypted")
+	}
+	if record.Compressed {
+		sb.WriteString(" compressed")
+	}
+	if record.Blob != "" {
+		fmt.Fprintf(&sb, " blob=%s", record.Blob)
+	}
+	if record.Value != "" {
+		fmt.Fprintf(&sb, " value=%q", record.Value)
+	}
+	_, err := fmt.Fprintln(w, sb.String())
+	return err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"sdb/bitcask"
+	"sdb/utils"
+)
+
+func writeTestLogFile(t *testing.T, fType bitcask.FileType, records ...*bitcask.LogRecord) string {
+	path := t.TempDir()
+	lf, err := bitcask.OpenLogFile(path, 1, 1024, fType, bitcask.FileIO)
+	assert.Nil(t, err)
+	for _, record := range records {
+		buf, _ := lf.EncodeRecord(record)
+		assert.Nil(t, lf.Write(buf))
+	}
+	assert.Nil(t, lf.Close())
+	name, _ := bitcask.LogFileName(path, 1, fType)
+	return name
+}
+
+func TestDumpLogFile(t *testing.T) {
+	seq := make([]byte, 8)
+	seq[0], seq[4] = 1, 3
+	name := writeTestLogFile(t, bitcask.List,
+		&bitcask.LogRecord{Key: utils.EncodeListKey([]byte("list"), 2), Value: []byte("a")},
+		&bitcask.LogRecord{Key: []byte("list"), Value: seq, Type: bitcask.TypeListSeq},
+		&bitcask.LogRecord{Key: utils.EncodeListKey([]byte("list"), 2), Type: bitcask.TypeDelete},
+	)
+
+	var out bytes.Buffer
+	assert.Nil(t, dumpLogFile(&out, name, formatText, nil))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	// 第一行是文件头
+	assert.Len(t, lines, 4)
+	assert.Contains(t, lines[0], "# version=2 type=list created_at=")
+	assert.Contains(t, lines[1], `type=default expired_at=never timestamp=`)
+	assert.Contains(t, lines[1], `key="list" seq=2 value="a"`)
+	assert.Contains(t, lines[2], `key="list" head=1 tail=3`)
+	assert.Contains(t, lines[3], `type=delete expired_at=never timestamp=`)
+
+	name = writeTestLogFile(t, bitcask.ZSet,
+		&bitcask.LogRecord{Key: utils.EncodeZSetKey([]byte("zset"), []byte("m1")), Value: []byte("1.5"), ExpiredAt: 100},
+	)
+	out.Reset()
+	assert.Nil(t, dumpLogFile(&out, name, formatJSON, nil))
+	var record dumpRecord
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &record))
+	assert.Equal(t, int64(bitcask.LogFileHeaderSize), record.Offset)
+	assert.Equal(t, bitcask.LogFileV2, record.Version)
+	assert.NotZero(t, record.Timestamp)
+	assert.Equal(t, "zset", record.Key)
+	assert.Equal(t, "m1", record.Member)
+	assert.Equal(t, "1.5", record.Score)
+	assert.Equal(t, int64(100), record.ExpiredAt)
+	assert.Equal(t, record.Size, record.HeaderSize+int64(record.KeySize+record.ValueSize))
+
+	// 压缩过的value输出解压后的内容
+	value := strings.Repeat("json", 50)
+	name = writeTestLogFile(t, bitcask.Str,
+		bitcask.CompressRecord(&bitcask.LogRecord{Key: []byte("str"), Value: []byte(value)}, 0),
+	)
+	out.Reset()
+	assert.Nil(t, dumpLogFile(&out, name, formatText, nil))
+	lines = strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[1], `type=default`)
+	assert.Contains(t, lines[1], `key="str" compressed value="`+value+`"`)
+
+	// 指针record输出blob的位置
+	pointer := bitcask.EncodeBlobPointer(&bitcask.BlobPointer{FileID: 2, Offset: 32, Size: 4096})
+	name = writeTestLogFile(t, bitcask.Str,
+		&bitcask.LogRecord{Key: []byte("big"), Value: pointer, Type: bitcask.TypeBlob},
+	)
+	out.Reset()
+	assert.Nil(t, dumpLogFile(&out, name, formatText, nil))
+	lines = strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[1], `type=default`)
+	assert.Contains(t, lines[1], `key="big" blob=2:32:4096`)
+	assert.NotContains(t, lines[1], "value=")
+
+	// 加密的文件用密钥解密后输出，没有密钥时报错
+	path := t.TempDir()
+	keyring := &bitcask.Keyring{KeyID: 3, Lookup: func(keyID uint32) ([]byte, error) {
+		return []byte("0123456789abcdef"), nil
+	}}
+	lf, err := bitcask.OpenEncryptedLogFile(path, 1, 1024, bitcask.Str, bitcask.FileIO, keyring)
+	assert.Nil(t, err)
+	buf, _ := lf.EncodeRecord(&bitcask.LogRecord{Key: []byte("str"), Value: []byte("secret")})
+	assert.Nil(t, lf.Write(buf))
+	assert.Nil(t, lf.Close())
+	name, _ = bitcask.LogFileName(path, 1, bitcask.Str)
+	out.Reset()
+	assert.Nil(t, dumpLogFile(&out, name, formatText, keyring.Lookup))
+	lines = strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[0], "key_id=3")
+	assert.Contains(t, lines[1], `key="str" encrypted value="secret"`)
+	assert.Equal(t, bitcask.ErrEncryptionKeyNotFound, dumpLogFile(&out, name, formatText, nil))
+
+	name = writeTestLogFile(t, bitcask.Hash,
+		&bitcask.LogRecord{Key: utils.EncodeHashKey([]byte("hash"), []byte("f1")), Value: []byte("v1")},
+	)
+	// 破坏第二条record之前的数据，第一条正常输出，之后输出错误
+	buf, err = os.ReadFile(name)
+	assert.Nil(t, err)
+	_, size, err := bitcask.DecodeRecordV2(buf[bitcask.LogFileHeaderSize:])
+	assert.Nil(t, err)
+	copy(buf[bitcask.LogFileHeaderSize+size:], []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	assert.Nil(t, os.WriteFile(name, buf, 0644))
+	out.Reset()
+	assert.Nil(t, dumpLogFile(&out, name, formatText, nil))
+	lines = strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 3)
+	assert.Contains(t, lines[1], `key="hash" field="f1" value="v1"`)
+	assert.Contains(t, lines[2], "error=")
+
+	assert.Equal(t, ErrUnsupportedFormat, dumpLogFile(&out, name, "xml", nil))
+}
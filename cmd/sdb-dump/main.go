@@ -0,0 +1,37 @@
+// sdb-dump 按可读的格式输出一个日志文件中的所有record，key按文件的数据类型解码
+// usage: sdb-dump [--format text|json] [--key id:hex]... <log file or blob file>
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+
+	"sdb/cmd/internal/keyflag"
+)
+
+func main() {
+	format := flag.String("format", formatText, "output format, text or json (one record per line)")
+	keys := keyflag.Keys{}
+	flag.Var(keys, "key", "encryption key of an encrypted log file, <key id>:<hex key>, repeat for rotated keys")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [--format text|json] [--key id:hex]... <log.<type>.<fid>|blob.<type>.<fid>>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	err := dumpLogFile(w, flag.Arg(0), *format, keys.Provider())
+	if flushErr := w.Flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dump err: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,36 @@
+// sdb-migrate 离线把数据目录中的日志文件升级到当前版本，db不能处于打开状态
+// usage: sdb-migrate [--key id:hex]... <db path>
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"sdb"
+	"sdb/cmd/internal/keyflag"
+)
+
+func main() {
+	keys := keyflag.Keys{}
+	flag.Var(keys, "key", "encryption key of an encrypted db, <key id>:<hex key>, repeat for rotated keys")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [--key id:hex]... <db path>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	migrated, err := sdb.Migrate(flag.Arg(0), keys.Provider())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate err: %v\n", err)
+		os.Exit(1)
+	}
+	for _, name := range migrated {
+		fmt.Println("migrated:", name)
+	}
+	fmt.Printf("migrated %d log files\n", len(migrated))
+}
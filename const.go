@@ -4,6 +4,13 @@ const (
 	logFileTypeNum = 5
 
 	lockFileName = "FLOCK"
+
+	indexSnapshotFileName = "INDEX_SNAPSHOT"
+	snapshotTmpSuffix     = ".tmp"
+
+	// merge标记文件前缀，后面跟数据类型，example: MERGE.string
+	mergeMarkerPrefix    = "MERGE."
+	mergeMarkerTmpSuffix = ".tmp"
 )
 
 type DataType byte
@@ -1,9 +1,10 @@
 package count
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
-	"io"
+	"os"
 	"path/filepath"
 	"sort"
 	"sync"
@@ -19,14 +20,26 @@ import (
 // | file__id | file_size | used_size |
 // +----------+-----------+-----------+
 // 0----------4-----------8-----------12
+// 加密的countFile开头是一个文件头，之后每条记录单独用AES-GCM加密成 nonce | 密文 | tag，40bytes
+// +-------+--------+-----------+----------+----------+-----+
+// | magic | key_id | key_check | reserved | record 1 | ... |
+// +-------+--------+-----------+----------+----------+-----+
+// 0-------4--------8-----------16---------40
+// 两种格式中全0的记录都是空闲的
 
 const (
 	countFileRecordSize       = 12
 	countFileSize       int64 = 2 << 12 // hintFile总文件大小，默认8kb
 	CountFileName             = "count_file"
 	CountFilePath             = "COUNT_FILE"
+
+	encryptedRecordSize          = countFileRecordSize + bitcask.SealOverhead
+	encryptedHeaderSize          = encryptedRecordSize
+	encryptedCountFileSize int64 = 8 << 12 // 加密后记录变大，文件也放大，能记录的文件数差不多
 )
 
+var countFileMagic = []byte("SDBC")
+
 // ErrCountFileNoSpace countFile文件空间不足,按照默认一共可以统计652个文件，不会不足，说明出错了
 var ErrCountFileNoSpace = errors.New("[count_file] not enough space can be allocated for count file")
 
@@ -34,6 +47,8 @@ var ErrCountFileNoSpace = errors.New("[count_file] not enough space can be alloc
 type CountUpdate struct {
 	FileID     uint32
 	RecordSize int
+
+	flushed chan struct{} // Flush发的标记，处理到这里时关闭，不是更新
 }
 
 // CountFile 内存的抽象
@@ -46,52 +61,89 @@ type CountFile struct {
 	freeOffsets []int64          // 空闲的offset,栈结构
 
 	selector ioselector.IOSelector
+	cipher   *bitcask.Cipher // 加密用的密钥，nil表示没加密
 
 	CountRcv chan *CountUpdate // 接受keyDir的更新
+	closed   chan struct{}     // 监听协程处理完所有更新、关闭文件后关闭
+}
+
+// FileCount count file中的一条记录
+type FileCount struct {
+	FileID   uint32
+	FileSize uint32
+	UsedSize uint32
 }
 
-// NewCountFile 新建countFile文件，或者打开存在的countFile
+// NewCountFile 新建countFile文件，或者打开存在的countFile，不加密
 func NewCountFile(path, name string, bufferSize int) (*CountFile, error) {
+	return NewEncryptedCountFile(path, name, bufferSize, nil)
+}
+
+// NewEncryptedCountFile 新建或者打开countFile，keyring当前的密钥和文件不一致时（开启加密、轮换密钥）先用新的密钥重写整个文件
+func NewEncryptedCountFile(path, name string, bufferSize int, keyring *bitcask.Keyring) (*CountFile, error) {
+	fileName := filepath.Join(path, name)
+	buf, err := os.ReadFile(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var c *bitcask.Cipher
+	if keyID := keyring.CurrentKeyID(); keyID != 0 {
+		if c, err = keyring.Cipher(keyID); err != nil {
+			return nil, err
+		}
+	}
+	if buf != nil {
+		counts, fileCipher, err := decodeCountFile(buf, keyring)
+		if err != nil {
+			return nil, err
+		}
+		if keyIDOf(fileCipher) != keyIDOf(c) {
+			if err = WriteCountFile(path, name, counts, c); err != nil {
+				return nil, err
+			}
+		}
+	} else if c != nil {
+		// 加密的count file要先写文件头
+		if err = WriteCountFile(path, name, nil, c); err != nil {
+			return nil, err
+		}
+	}
 
 	// 使用mmap()方式，因为：
 	// 1.count_file文件不是顺序写，是随机写，适合mmap，不用频繁寻道
 	// 2.大小固定8kb，mmap以页为单位，一般一页为4kb，最多读两页，占用内存也很小
-	selector, err := ioselector.NewMMapSelector(filepath.Join(path, name), countFileSize)
+	dataOffset, recordSize, fileSize := layoutOf(c)
+	selector, err := ioselector.NewMMapSelector(fileName, fileSize)
 	if err != nil {
 		return nil, err
 	}
+	cf := &CountFile{
+		usedOffsets: make(map[uint32]int64),
+		selector:    selector,
+		cipher:      c,
+		CountRcv:    make(chan *CountUpdate, bufferSize),
+		Once:        new(sync.Once),
+		closed:      make(chan struct{}),
+	}
 
-	var (
-		usedOffsets = make(map[uint32]int64)
-		freeOffsets []int64
-		countRcv    = make(chan *CountUpdate, bufferSize)
-	)
-
-	for offset := int64(0); ; offset += countFileRecordSize {
-		buf := make([]byte, 8) // 读file_id和file_size
-		if _, err = selector.Read(buf, offset); err != nil {
-			if err == io.EOF || err == bitcask.ErrEndOfRecord {
-				break // 读完正常退出
-			}
+	// 文件末尾不足一条记录的空间不能用
+	for offset := dataOffset; offset+recordSize <= fileSize; offset += recordSize {
+		fc, err := cf.readRecord(offset)
+		if err == bitcask.ErrDecryptFailed {
+			// 写了一半的加密记录，统计信息只影响merge的选择，当作空闲的
+			logger.Warnf("[count_file] discard corrupted record at offset %v in %v", offset, name)
+			_, err = selector.Write(make([]byte, recordSize), offset)
+		}
+		if err != nil {
+			_ = selector.Close()
 			return nil, err
 		}
-
-		fileID := binary.LittleEndian.Uint32(buf[:4])
-		fSize := binary.LittleEndian.Uint32(buf[4:8])
-
-		if fileID == 0 && fSize == 0 { // 空闲的offset
-			freeOffsets = append(freeOffsets, offset)
+		if fc == nil { // 空闲的offset
+			cf.freeOffsets = append(cf.freeOffsets, offset)
 		} else { // 已使用的offset
-			usedOffsets[fileID] = offset
+			cf.usedOffsets[fc.FileID] = offset
 		}
 	}
-	cf := &CountFile{
-		usedOffsets: usedOffsets,
-		freeOffsets: freeOffsets,
-		CountRcv:    countRcv,
-		selector:    selector,
-		Once:        new(sync.Once),
-	}
 	// 启动监听协程，监听file的更新
 	go cf.listenUpdate()
 	return cf, nil
@@ -114,16 +166,54 @@ func (cf *CountFile) SetFileSize(fileID uint32, fileSize uint32) error {
 	}
 
 	// 写入file_id和file_size
-	buf := make([]byte, 8)
-	binary.LittleEndian.PutUint32(buf[:4], fileID)
-	binary.LittleEndian.PutUint32(buf[4:8], fileSize)
-	if _, err = cf.selector.Write(buf, offset); err != nil {
+	if err = cf.writeRecord(offset, &FileCount{FileID: fileID, FileSize: fileSize}); err != nil {
 		logger.Errorf("[count_file] set file size err: %v", err)
 		return err
 	}
 	return nil
 }
 
+// UpdateFileSize 文件转为非活跃文件截掉多余空间之后，把记录的file_size改成实际大小，占用率按实际大小算
+func (cf *CountFile) UpdateFileSize(fileID uint32, fileSize uint32) error {
+	cf.Lock()
+	defer cf.Unlock()
+
+	offset, err := cf.alloc(fileID)
+	if err != nil {
+		logger.Errorf("[count_file] count file allocate err: %v", err)
+		return err
+	}
+	fc, err := cf.readRecord(offset)
+	if err != nil {
+		return err
+	}
+	if fc == nil {
+		fc = &FileCount{FileID: fileID}
+	}
+	fc.FileSize = fileSize
+	if err = cf.writeRecord(offset, fc); err != nil {
+		logger.Errorf("[count_file] update file size err: %v", err)
+		return err
+	}
+	return nil
+}
+
+// FileSize 获取指定file_id记录的file_size，建立时是容量，转为非活跃文件之后是实际大小，没有记录时返回0
+func (cf *CountFile) FileSize(fileID uint32) (uint32, error) {
+	cf.Lock()
+	defer cf.Unlock()
+
+	offset, ok := cf.usedOffsets[fileID]
+	if !ok {
+		return 0, nil
+	}
+	fc, err := cf.readRecord(offset)
+	if err != nil || fc == nil {
+		return 0, err
+	}
+	return fc.FileSize, nil
+}
+
 // GetMCL == get merge candidate list
 // 从count file获取需要被merge的文件
 // 传入活跃文件id，不merge活跃文件，传入ratio设置的占用率阈值，超过的视为需要merge了
@@ -131,29 +221,20 @@ func (cf *CountFile) GetMCL(activeFID uint32, ratio float64) ([]uint32, error) {
 	cf.Lock()
 	defer cf.Unlock()
 
-	var offset int64
 	var mcl []uint32 // 待压缩文件列表
 	// 读文件
-	for {
-		buf := make([]byte, countFileRecordSize)
-		_, err := cf.selector.Read(buf, offset)
+	dataOffset, recordSize, fileSize := layoutOf(cf.cipher)
+	for offset := dataOffset; offset+recordSize <= fileSize; offset += recordSize {
+		fc, err := cf.readRecord(offset)
 		if err != nil {
-			if err == io.EOF || err == bitcask.ErrEndOfRecord {
-				break
-			}
 			return nil, err
 		}
-		offset += countFileRecordSize
-
-		fileID := binary.LittleEndian.Uint32(buf[:4])
-		fileSize := binary.LittleEndian.Uint32(buf[4:8])
-		usedSize := binary.LittleEndian.Uint32(buf[8:12])
 
-		if fileSize != 0 && usedSize != 0 { // 跳过空闲的offset
-			curRatio := float64(usedSize) / float64(fileSize)
+		if fc != nil && fc.FileSize != 0 && fc.UsedSize != 0 { // 跳过空闲的offset
+			curRatio := float64(fc.UsedSize) / float64(fc.FileSize)
 			// 不是活跃文件并且占用率超过阈值
-			if curRatio >= ratio && fileID != activeFID {
-				mcl = append(mcl, fileID)
+			if curRatio >= ratio && fc.FileID != activeFID {
+				mcl = append(mcl, fc.FileID)
 			}
 		}
 	}
@@ -164,6 +245,13 @@ func (cf *CountFile) GetMCL(activeFID uint32, ratio float64) ([]uint32, error) {
 	return mcl, nil
 }
 
+// Flush 等待在这之前发到CountRcv的更新都写入count file，CountRcv关闭之后不能调用
+func (cf *CountFile) Flush() {
+	flushed := make(chan struct{})
+	cf.CountRcv <- &CountUpdate{flushed: flushed}
+	<-flushed
+}
+
 // Sync 刷盘
 func (cf *CountFile) Sync() error {
 	return cf.selector.Sync()
@@ -173,6 +261,11 @@ func (cf *CountFile) Close() error {
 	return cf.selector.Close()
 }
 
+// Wait 等待CountRcv关闭后剩余的更新写完、文件关闭
+func (cf *CountFile) Wait() {
+	<-cf.closed
+}
+
 // Clear 清理指定file_id的统计记录
 func (cf *CountFile) Clear(fileID uint32) error {
 	cf.Lock()
@@ -191,8 +284,8 @@ func (cf *CountFile) Clear(fileID uint32) error {
 	}
 
 	// 清空file_id的countFile record：写一个空的buf
-	buf := make([]byte, countFileRecordSize)
-	if _, err = cf.selector.Write(buf, offset); err != nil {
+	_, recordSize, _ := layoutOf(cf.cipher)
+	if _, err = cf.selector.Write(make([]byte, recordSize), offset); err != nil {
 		logger.Errorf("[count_file] file_id %v clear err: %v", fileID, err)
 		return err
 	}
@@ -231,8 +324,13 @@ func (cf *CountFile) listenUpdate() {
 				if err := cf.selector.Close(); err != nil {
 					logger.Errorf("close count file err: %v", err)
 				}
+				close(cf.closed)
 				return
 			}
+			if countRcv.flushed != nil {
+				close(countRcv.flushed)
+				continue
+			}
 			cf.updateCountFile(countRcv.FileID, countRcv.RecordSize)
 		}
 	}
@@ -254,26 +352,149 @@ func (cf *CountFile) updateCountFile(fileID uint32, recordSize int) {
 		return
 	}
 
-	var buf []byte
-	if recordSize > 0 { // 更新、新增
-		// 读 used size
-		buf = make([]byte, 4)
-		offset += 8
-		if _, err = cf.selector.Read(buf, offset); err != nil {
-			logger.Errorf("[count_file] update count file err: %v", err)
-			return
-		}
-
-		// used_size加上新加的record_size,
-		usedSize := binary.LittleEndian.Uint32(buf)
-		binary.LittleEndian.PutUint32(buf, usedSize+uint32(recordSize))
-	} else { // 删除，直接清空hintFile记录
-		buf = make([]byte, countFileRecordSize)
+	// 读出记录，used_size加上新加的record_size
+	fc, err := cf.readRecord(offset)
+	if err != nil {
+		logger.Errorf("[count_file] update count file err: %v", err)
+		return
+	}
+	if fc == nil {
+		fc = &FileCount{FileID: fileID}
 	}
+	fc.UsedSize += uint32(recordSize)
 
 	// 写如新的countFile记录
-	if _, err = cf.selector.Write(buf, offset); err != nil {
+	if err = cf.writeRecord(offset, fc); err != nil {
 		logger.Errorf("[count_file] update count file err: %v", err)
 		return
 	}
 }
+
+// 读出offset处的记录，空闲的返回nil
+func (cf *CountFile) readRecord(offset int64) (*FileCount, error) {
+	_, recordSize, _ := layoutOf(cf.cipher)
+	buf := make([]byte, recordSize)
+	if _, err := cf.selector.Read(buf, offset); err != nil {
+		return nil, err
+	}
+	return decodeFileCount(buf, cf.cipher)
+}
+
+func (cf *CountFile) writeRecord(offset int64, fc *FileCount) error {
+	_, err := cf.selector.Write(encodeFileCount(fc, cf.cipher), offset)
+	return err
+}
+
+// ReadCountFile 只读方式读出count file中的所有记录，不启动监听协程，给离线检查工具使用
+// 加密的count file从keyring中找密钥，同时返回密钥，用于按原来的密钥重写
+func ReadCountFile(path, name string, keyring *bitcask.Keyring) ([]*FileCount, *bitcask.Cipher, error) {
+	buf, err := os.ReadFile(filepath.Join(path, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	return decodeCountFile(buf, keyring)
+}
+
+// WriteCountFile 用counts重写整个count file，c不为nil时加密，db打开时不能调用
+func WriteCountFile(path, name string, counts []*FileCount, c *bitcask.Cipher) error {
+	dataOffset, recordSize, fileSize := layoutOf(c)
+	if dataOffset+int64(len(counts))*recordSize > fileSize {
+		return ErrCountFileNoSpace
+	}
+	buf := make([]byte, fileSize)
+	if c != nil {
+		copy(buf[:4], countFileMagic)
+		binary.LittleEndian.PutUint32(buf[4:8], c.KeyID)
+		copy(buf[8:16], c.KeyCheck)
+	}
+	for i, fc := range counts {
+		copy(buf[dataOffset+int64(i)*recordSize:], encodeFileCount(fc, c))
+	}
+
+	name = filepath.Join(path, name)
+	tmpName := name + ".tmp"
+	file, err := os.OpenFile(tmpName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(buf); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, name)
+}
+
+// 解析整个count file，返回不空闲的记录和文件加密用的密钥
+func decodeCountFile(buf []byte, keyring *bitcask.Keyring) ([]*FileCount, *bitcask.Cipher, error) {
+	var c *bitcask.Cipher
+	if len(buf) >= encryptedHeaderSize && bytes.Equal(buf[:4], countFileMagic) {
+		var err error
+		if c, err = keyring.OpenCipher(binary.LittleEndian.Uint32(buf[4:8]), buf[8:16]); err != nil {
+			return nil, nil, err
+		}
+	}
+	dataOffset, recordSize, _ := layoutOf(c)
+	var counts []*FileCount
+	for offset := dataOffset; offset+recordSize <= int64(len(buf)); offset += recordSize {
+		// 解密失败的记录跳过，和打开时一样当作空闲的
+		fc, err := decodeFileCount(buf[offset:offset+recordSize], c)
+		if err == nil && fc != nil {
+			counts = append(counts, fc)
+		}
+	}
+	return counts, c, nil
+}
+
+// 文件格式：第一条记录的offset，每条记录的大小，文件大小
+func layoutOf(c *bitcask.Cipher) (dataOffset, recordSize, fileSize int64) {
+	if c == nil {
+		return 0, countFileRecordSize, countFileSize
+	}
+	return encryptedHeaderSize, encryptedRecordSize, encryptedCountFileSize
+}
+
+func keyIDOf(c *bitcask.Cipher) uint32 {
+	if c == nil {
+		return 0
+	}
+	return c.KeyID
+}
+
+func encodeFileCount(fc *FileCount, c *bitcask.Cipher) []byte {
+	buf := make([]byte, countFileRecordSize)
+	binary.LittleEndian.PutUint32(buf[:4], fc.FileID)
+	binary.LittleEndian.PutUint32(buf[4:8], fc.FileSize)
+	binary.LittleEndian.PutUint32(buf[8:12], fc.UsedSize)
+	if c != nil {
+		return c.Seal(buf)
+	}
+	return buf
+}
+
+// 全0的是空闲记录，返回nil
+func decodeFileCount(buf []byte, c *bitcask.Cipher) (*FileCount, error) {
+	if bytes.Equal(buf, make([]byte, len(buf))) {
+		return nil, nil
+	}
+	if c != nil {
+		var err error
+		if buf, err = c.Open(buf); err != nil {
+			return nil, err
+		}
+	}
+	return &FileCount{
+		FileID:   binary.LittleEndian.Uint32(buf[:4]),
+		FileSize: binary.LittleEndian.Uint32(buf[4:8]),
+		UsedSize: binary.LittleEndian.Uint32(buf[8:12]),
+	}, nil
+}
@@ -1 +1,116 @@
 package count
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"sdb/bitcask"
+)
+
+func TestCountFile_Update(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "sdb-count")
+	assert.Nil(t, os.MkdirAll(path, os.ModePerm))
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+
+	cf, err := NewCountFile(path, CountFileName, 16)
+	assert.Nil(t, err)
+	// 第一个分配的offset在文件末尾，必须放得下完整的一条记录
+	assert.Nil(t, cf.SetFileSize(0, 1024))
+	assert.Nil(t, cf.SetFileSize(1, 1024))
+	cf.CountRcv <- &CountUpdate{FileID: 0, RecordSize: 100}
+	cf.CountRcv <- &CountUpdate{FileID: 0, RecordSize: 50}
+	cf.CountRcv <- &CountUpdate{FileID: 1, RecordSize: 600}
+	// 等更新都写进去了再读
+	cf.Flush()
+
+	mcl, err := cf.GetMCL(2, 0.5)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint32{1}, mcl)
+	size, err := cf.FileSize(1)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1024), size)
+	size, err = cf.FileSize(2)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0), size)
+	// 文件截掉多余空间之后按实际大小算占用率
+	assert.Nil(t, cf.UpdateFileSize(0, 200))
+	mcl, err = cf.GetMCL(2, 0.5)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint32{0, 1}, mcl)
+	close(cf.CountRcv)
+
+	counts, _, err := ReadCountFile(path, CountFileName, nil)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []*FileCount{
+		{FileID: 0, FileSize: 200, UsedSize: 150},
+		{FileID: 1, FileSize: 1024, UsedSize: 600},
+	}, counts)
+
+	// 重写之后重新打开，记录不变
+	for _, fc := range counts {
+		if fc.FileID == 0 {
+			fc.UsedSize = 0
+		}
+	}
+	assert.Nil(t, WriteCountFile(path, CountFileName, counts, nil))
+	read, _, err := ReadCountFile(path, CountFileName, nil)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, counts, read)
+	cf, err = NewCountFile(path, CountFileName, 16)
+	assert.Nil(t, err)
+	mcl, err = cf.GetMCL(2, 0.1)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint32{1}, mcl)
+	close(cf.CountRcv)
+}
+
+func TestCountFile_Encrypted(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "sdb-count-encrypted")
+	assert.Nil(t, os.MkdirAll(path, os.ModePerm))
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	keys := map[uint32][]byte{
+		1: []byte("0123456789abcdef"),
+		2: []byte("fedcba9876543210"),
+	}
+	keyring := func(keyID uint32) *bitcask.Keyring {
+		return &bitcask.Keyring{KeyID: keyID, Lookup: func(keyID uint32) ([]byte, error) {
+			return keys[keyID], nil
+		}}
+	}
+
+	cf, err := NewEncryptedCountFile(path, CountFileName, 16, keyring(1))
+	assert.Nil(t, err)
+	assert.Nil(t, cf.SetFileSize(0, 1024))
+	cf.CountRcv <- &CountUpdate{FileID: 0, RecordSize: 100}
+	close(cf.CountRcv)
+	cf.Wait()
+
+	// 文件中没有明文的记录
+	_, _, err = ReadCountFile(path, CountFileName, nil)
+	assert.Equal(t, bitcask.ErrEncryptionKeyNotFound, err)
+	counts, c, err := ReadCountFile(path, CountFileName, keyring(0))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), c.KeyID)
+	assert.Equal(t, []*FileCount{{FileID: 0, FileSize: 1024, UsedSize: 100}}, counts)
+
+	// 换了密钥，打开时用新密钥重写
+	cf, err = NewEncryptedCountFile(path, CountFileName, 16, keyring(2))
+	assert.Nil(t, err)
+	close(cf.CountRcv)
+	cf.Wait()
+	counts, c, err = ReadCountFile(path, CountFileName, keyring(0))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), c.KeyID)
+	assert.Equal(t, []*FileCount{{FileID: 0, FileSize: 1024, UsedSize: 100}}, counts)
+
+	// 密钥不对
+	keys[2] = []byte("0000000000000000")
+	_, _, err = ReadCountFile(path, CountFileName, keyring(0))
+	assert.Equal(t, bitcask.ErrWrongEncryptionKey, err)
+}
@@ -22,6 +22,11 @@ type (
 		immutableFiles map[DataType]immutableFiles   // 非活跃文件map，每种数据类型多个非活跃文件
 		fileIDMap      map[DataType][]uint32         // 仅启动时OpenDB使用，以后不更新，fid有序
 		countFiles     map[DataType]*count.CountFile
+		manifest       *manifest        // 每种数据类型有效的日志文件
+		keyring        *bitcask.Keyring // 加密用的密钥，nil表示不加密
+		blobFiles      map[DataType]*blobFiles
+		fileCache      *bitcask.FileCache // 非活跃文件只读、按需打开，打开的个数受MaxOpenFiles限制
+		valueCache     *valueCache        // 读过的value，nil表示不缓存
 
 		dumpState ioselector.IOSelector
 
@@ -37,6 +42,17 @@ type (
 
 		closed     int32 // close状态,1表示db已经close
 		mergeState int32 // merge状态，表示有正在进行merge的协程数，每种data type merge可以并发
+		// 写了标记文件之后失败的merge，索引已经指向没提交的输出文件，标记文件要留到下次启动时回滚，
+		// 在这之前这种数据类型不能再merge，否则标记文件会被覆盖
+		mergeFailed [logFileTypeNum]int32
+
+		// 后台生成hint文件的协程持有读锁，merge和close前加写锁等待它们完成
+		hintLock sync.RWMutex
+
+		syncPolicy   options.SyncPolicy
+		pendingSyncs [logFileTypeNum]pendingSync // SyncAlways时每种数据类型等待组提交的位置
+		syncQuit     chan struct{}               // 关闭后后台刷盘协程退出
+		syncDone     chan struct{}               // 后台刷盘协程退出后关闭
 	}
 
 	immutableFiles map[uint32]*bitcask.LogFile // file_id与非活跃文件的映射
@@ -47,8 +63,9 @@ type (
 		fileID       uint32
 		recordSize   int
 		recordOffset int64
-		expiredAt    int64  // 如果没有设置为0，表示永不过期
-		value        []byte // only use in KeyValueMemMode
+		expiredAt    int64                // 如果没有设置为0，表示永不过期
+		value        []byte               // only use in KeyValueMemMode
+		blob         *bitcask.BlobPointer // value在blob文件中时，value的位置
 	}
 )
 
@@ -70,17 +87,22 @@ func (db *SDB) Sync() error {
 			return err
 		}
 	}
-	return nil
+	return db.syncBlobFiles()
 }
 
 func (db *SDB) CloseDB() error {
+	db.stopBackgroundSync()
+	// 先dump索引快照，下次启动只需要重放快照之后的日志
+	if err := db.dumpIndexSnapshot(); err != nil {
+		logger.Errorf("dump index snapshot err: %v", err)
+	}
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	// 释放文件锁
-	if db.fileLock != nil {
-		_ = db.fileLock.Release()
-	}
+	// 等待后台hint文件生成完，再关闭文件
+	db.waitHintFiles()
+
 	// 关闭并持久化活跃文件
 	for _, activeFile := range db.activeFiles {
 		_ = activeFile.Sync()
@@ -93,17 +115,55 @@ func (db *SDB) CloseDB() error {
 			_ = file.Close()
 		}
 	}
+	db.closeBlobFiles()
+	_ = db.closeManifest()
 	// 关闭并持久化count file
 	for _, cf := range db.countFiles {
 		cf.Once.Do(func() {
 			close(cf.CountRcv)
 		})
+		cf.Wait()
+	}
+	// 文件都关闭之后再释放文件锁，否则其他进程可能读到还没写完的count file
+	if db.fileLock != nil {
+		_ = db.fileLock.Release()
 	}
 	// 设置关闭标志位
 	atomic.StoreInt32(&db.closed, 1)
 	return nil
 }
 
+// 关闭打开的所有文件，释放文件锁，OpenDB失败时用，不dump索引快照
+func (db *SDB) closeFiles() {
+	for _, activeFile := range db.activeFiles {
+		_ = activeFile.Close()
+	}
+	for _, immutableFiles := range db.immutableFiles {
+		for _, file := range immutableFiles {
+			_ = file.Close()
+		}
+	}
+	db.closeBlobFiles()
+	_ = db.closeManifest()
+	for _, cf := range db.countFiles {
+		cf.Once.Do(func() {
+			close(cf.CountRcv)
+		})
+		cf.Wait()
+	}
+	_ = db.fileLock.Release()
+}
+
+// 五种索引的锁，需要同时锁住所有索引时使用
+func (db *SDB) indexLocks() []*sync.RWMutex {
+	return []*sync.RWMutex{db.strIndex.mu, db.listIndex.mu, db.hashIndex.mu, db.setIndex.mu, db.zsetIndex.mu}
+}
+
+// 目录刷盘，保证目录下文件的新建、rename、删除持久化
+func (db *SDB) syncDBPath() error {
+	return flock.SyncFileLock(db.opts.DBPath)
+}
+
 func (db *SDB) isClosed() bool {
 	return atomic.LoadInt32(&db.closed) == 1
 }
@@ -126,4 +186,8 @@ func (db *SDB) sendCountChan(oldVal interface{}, updated bool, dataType DataType
 	default:
 		logger.Warn("[db] send to count chan fail")
 	}
+	// 指向的blob也一起失效
+	if keyDir.blob != nil {
+		db.sendBlobCount(keyDir.blob, dataType)
+	}
 }
@@ -14,4 +14,22 @@ var (
 
 	//ErrMergeRunning 文件进行merge时无法再进行merge
 	ErrMergeRunning = errors.New("log file merge is running, retry later")
+
+	// ErrCorruptLogFile 日志文件中间有损坏的record，无法恢复
+	ErrCorruptLogFile = errors.New("log file is corrupted")
+
+	// ErrLegacyRecordKey 有老版本编码的hash、set、zset record，要先用sdb-migrate转换
+	ErrLegacyRecordKey = errors.New("log file has records in the old key encoding, run sdb-migrate first")
+
+	// ErrUnfinishedMerge 有没完成的merge，需要先打开db恢复
+	ErrUnfinishedMerge = errors.New("unfinished merge, open the db to recover it first")
+
+	// ErrMergeFailed 之前的merge中途失败了，重新打开db回滚之后才能再merge
+	ErrMergeFailed = errors.New("previous merge failed, reopen the db to roll it back before merging again")
+
+	// ErrInvalidEncryptionKeyID 设置了密钥但是key id是0
+	ErrInvalidEncryptionKeyID = errors.New("encryption key id must not be 0")
+
+	// ErrInvalidSyncPolicy 刷盘间隔或者字节数不是正数
+	ErrInvalidSyncPolicy = errors.New("invalid sync policy, interval and bytes must be positive")
 )
@@ -0,0 +1,149 @@
+package sdb
+
+import (
+	"sync/atomic"
+	"time"
+
+	"sdb/bitcask"
+	"sdb/count"
+	"sdb/logger"
+	"sdb/options"
+)
+
+// 按设置得到刷盘策略，老的Sync设置为true时等同于SyncAlways
+func newSyncPolicy(opts options.Options) (options.SyncPolicy, error) {
+	policy := opts.SyncPolicy
+	if opts.Sync {
+		policy = options.SyncAlways
+	}
+	switch policy.Mode {
+	case options.SyncModeInterval:
+		if policy.Interval <= 0 {
+			return policy, ErrInvalidSyncPolicy
+		}
+	case options.SyncModeBytes:
+		if policy.Bytes <= 0 {
+			return policy, ErrInvalidSyncPolicy
+		}
+	}
+	return policy, nil
+}
+
+// 同步写时一种数据类型最后写到的日志文件和blob文件的位置，持有该类型的索引锁时读写
+type pendingSync struct {
+	logFile, blobFile *bitcask.LogFile
+	logEnd, blobEnd   int64
+}
+
+// 写完record之后按刷盘策略决定要不要刷盘，调用方需要持有dataType的索引锁
+// SyncAlways不在这里刷盘，只记下写到的位置，释放索引锁之后由unlockAndSync组提交；定时刷盘交给后台协程
+func (db *SDB) syncAfterWrite(dataType DataType, lf *bitcask.LogFile, blob bool) error {
+	switch db.syncPolicy.Mode {
+	case options.SyncModeAlways:
+		pending := &db.pendingSyncs[dataType]
+		if blob {
+			pending.blobFile, pending.blobEnd = lf, atomic.LoadInt64(&lf.WriteOffSet)
+		} else {
+			pending.logFile, pending.logEnd = lf, atomic.LoadInt64(&lf.WriteOffSet)
+		}
+	case options.SyncModeBytes:
+		if lf.UnsyncedBytes() >= db.syncPolicy.Bytes {
+			return lf.Sync()
+		}
+	}
+	return nil
+}
+
+// 释放dataType的索引锁，SyncAlways时等到这次写入的数据刷盘之后才返回，写操作defer调用，刷盘出错写到err
+// 不持有索引锁等刷盘，并发写的协程各自追加record，由其中一个协程一起刷盘（组提交），不用每次写都刷一次
+func (db *SDB) unlockAndSync(dataType DataType, err *error) {
+	// 持有锁时取出并清空，否则后面没有写入的操作会去刷已经刷过（甚至已经关闭）的文件
+	pending := db.pendingSyncs[dataType]
+	db.pendingSyncs[dataType] = pendingSync{}
+	db.indexLocks()[dataType].Unlock()
+	if *err != nil {
+		return
+	}
+	// 一次写操作可能先写blob文件再写日志文件，都要刷盘
+	if pending.blobFile != nil {
+		if *err = pending.blobFile.SyncTo(pending.blobEnd); *err != nil {
+			return
+		}
+	}
+	if pending.logFile != nil {
+		*err = pending.logFile.SyncTo(pending.logEnd)
+	}
+}
+
+// 定时刷盘策略启动后台刷盘协程
+func (db *SDB) startBackgroundSync() {
+	if db.syncPolicy.Mode != options.SyncModeInterval {
+		return
+	}
+	db.syncQuit, db.syncDone = make(chan struct{}), make(chan struct{})
+	go db.syncPeriodically()
+}
+
+// 停止后台刷盘协程，等它退出后才能关闭文件
+func (db *SDB) stopBackgroundSync() {
+	if db.syncQuit == nil {
+		return
+	}
+	close(db.syncQuit)
+	<-db.syncDone
+	db.syncQuit = nil
+}
+
+func (db *SDB) syncPeriodically() {
+	defer close(db.syncDone)
+	ticker := time.NewTicker(db.syncPolicy.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := db.syncActiveFiles(); err != nil {
+				logger.Errorf("background sync err: %v", err)
+				if db.opts.OnSyncError != nil {
+					db.opts.OnSyncError(err)
+				}
+			}
+		case <-db.syncQuit:
+			return
+		}
+	}
+}
+
+// 刷盘所有活跃文件和count file，只在取文件时加db读锁，刷盘的时候不阻塞读写
+func (db *SDB) syncActiveFiles() error {
+	db.mu.RLock()
+	files := make([]*bitcask.LogFile, 0, len(db.activeFiles)+len(db.blobFiles))
+	for _, activeFile := range db.activeFiles {
+		files = append(files, activeFile)
+	}
+	for _, bf := range db.blobFiles {
+		if bf.activeFile != nil {
+			files = append(files, bf.activeFile)
+		}
+	}
+	countFiles := make([]*count.CountFile, 0, len(db.countFiles)+len(db.blobFiles))
+	for _, cf := range db.countFiles {
+		countFiles = append(countFiles, cf)
+	}
+	for _, bf := range db.blobFiles {
+		countFiles = append(countFiles, bf.countFile)
+	}
+	db.mu.RUnlock()
+
+	for _, lf := range files {
+		if err := lf.Sync(); err != nil {
+			return err
+		}
+	}
+	for _, cf := range countFiles {
+		if err := cf.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package sdb
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"sdb/options"
+)
+
+func TestNewSyncPolicy(t *testing.T) {
+	opts := options.NewDefaultOptions("")
+	policy, err := newSyncPolicy(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, options.SyncNever, policy)
+
+	// 老的Sync设置等同于SyncAlways
+	opts.Sync = true
+	policy, err = newSyncPolicy(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, options.SyncAlways, policy)
+
+	opts.Sync = false
+	for _, invalid := range []options.SyncPolicy{options.SyncEveryInterval(0), options.SyncEveryNBytes(-1)} {
+		opts.SyncPolicy = invalid
+		_, err = newSyncPolicy(opts)
+		assert.Equal(t, ErrInvalidSyncPolicy, err)
+	}
+}
+
+func TestSDB_SyncPolicy(t *testing.T) {
+	pwd, _ := os.Getwd()
+	open := func(t *testing.T, policy options.SyncPolicy) *SDB {
+		opts := options.NewDefaultOptions(filepath.Join(pwd, "test/sync"))
+		opts.CountBufferSize = 1024
+		opts.SyncPolicy = policy
+		db, err := OpenDB(opts)
+		assert.Nil(t, err)
+		return db
+	}
+
+	t.Run("always", func(t *testing.T) {
+		db := open(t, options.SyncAlways)
+		defer clearDB(db)
+		for i := 0; i < 10; i++ {
+			assert.Nil(t, db.Set(getTestKey(i), getTestValue(i)))
+			assert.Equal(t, int64(0), db.activeFiles[String].UnsyncedBytes())
+			// 刷盘之后等待刷盘的位置已经清空
+			assert.Equal(t, pendingSync{}, db.pendingSyncs[String])
+		}
+	})
+
+	t.Run("group commit", func(t *testing.T) {
+		db := open(t, options.SyncAlways)
+		defer func() {
+			clearDB(db)
+		}()
+		// 并发写的协程一起刷盘，每个写操作返回时数据都已经刷盘
+		wg := new(sync.WaitGroup)
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := g * 50; i < (g+1)*50; i++ {
+					assert.Nil(t, db.Set(getTestKey(i), getTestValue(i)))
+					assert.Nil(t, db.HSet([]byte("hash"), getTestKey(i), getTestValue(i)))
+				}
+			}(g)
+		}
+		wg.Wait()
+		crashDB(db)
+
+		db = open(t, options.SyncAlways)
+		for i := 0; i < 400; i++ {
+			val, err := db.Get(getTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, getTestValue(i), val)
+			val, err = db.HGet([]byte("hash"), getTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, getTestValue(i), val)
+		}
+		// 刷盘失败时写操作返回错误
+		assert.Nil(t, db.activeFiles[String].Close())
+		assert.NotNil(t, db.Set(getTestKey(0), getTestValue(0)))
+	})
+
+	t.Run("every n bytes", func(t *testing.T) {
+		db := open(t, options.SyncEveryNBytes(1024))
+		defer clearDB(db)
+		assert.Nil(t, db.Set(getTestKey(0), getTestValue(0)))
+		synced := false
+		for i := 1; i < 100; i++ {
+			before := db.activeFiles[String].UnsyncedBytes()
+			assert.Nil(t, db.Set(getTestKey(i), getTestValue(i)))
+			after := db.activeFiles[String].UnsyncedBytes()
+			assert.Less(t, after, int64(1024))
+			synced = synced || after < before
+		}
+		assert.True(t, synced)
+	})
+
+	t.Run("every interval", func(t *testing.T) {
+		db := open(t, options.SyncEveryInterval(10*time.Millisecond))
+		defer clearDB(db)
+		for i := 0; i < 10; i++ {
+			assert.Nil(t, db.Set(getTestKey(i), getTestValue(i)))
+		}
+		assert.Greater(t, db.activeFiles[String].UnsyncedBytes(), int64(0))
+		// 写操作不刷盘，后台协程刷
+		assert.Eventually(t, func() bool {
+			return db.activeFiles[String].UnsyncedBytes() == 0
+		}, time.Second, 5*time.Millisecond)
+	})
+
+	t.Run("sync error", func(t *testing.T) {
+		pwd, _ := os.Getwd()
+		opts := options.NewDefaultOptions(filepath.Join(pwd, "test/sync"))
+		opts.CountBufferSize = 1024
+		opts.SyncPolicy = options.SyncEveryInterval(10 * time.Millisecond)
+		errs := make(chan error, 16)
+		opts.OnSyncError = func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		}
+		db, err := OpenDB(opts)
+		assert.Nil(t, err)
+		defer clearDB(db)
+		assert.Nil(t, db.Set(getTestKey(0), getTestValue(0)))
+
+		// 活跃文件被关闭了，后台刷盘失败通过回调通知
+		assert.Nil(t, db.activeFiles[String].Close())
+		select {
+		case err := <-errs:
+			assert.NotNil(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("sync error not reported")
+		}
+	})
+}
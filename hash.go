@@ -13,9 +13,9 @@ import (
 //文件中key｜field1->val1
 
 //HSet ...
-func (db *SDB) HSet(key, field, value []byte) error {
+func (db *SDB) HSet(key, field, value []byte) (err error) {
 	db.hashIndex.mu.Lock()
-	defer db.hashIndex.mu.Unlock()
+	defer db.unlockAndSync(Hash, &err)
 
 	hashKey := utils.EncodeHashKey(key, field)
 	//把hash key作为key写record，因为每条record需要知道他的key和field，建索引时需要
@@ -55,3 +55,36 @@ func (db *SDB) HGet(key, field []byte) ([]byte, error) {
 	}
 	return val, err
 }
+
+// HDel 删除指定key的hash中的field，不存在的field忽略，返回删除的field个数
+func (db *SDB) HDel(key []byte, fields ...[]byte) (n int, err error) {
+	db.hashIndex.mu.Lock()
+	defer db.unlockAndSync(Hash, &err)
+
+	if db.hashIndex.trees[string(key)] == nil {
+		return 0, nil
+	}
+	db.hashIndex.idxTree = db.hashIndex.trees[string(key)]
+
+	var count int
+	for _, field := range fields {
+		if db.hashIndex.idxTree.Get(field) == nil {
+			continue
+		}
+		//删除记录的key也是hashKey，启动时才能找到对应的ar树
+		record := &bitcask.LogRecord{Key: utils.EncodeHashKey(key, field), Type: bitcask.TypeDelete}
+		keyDir, err := db.writeLogRecord(record, Hash)
+		if err != nil {
+			return count, err
+		}
+		if err = db.deleteIndexTree(field, keyDir, Hash); err != nil {
+			return count, err
+		}
+		count++
+	}
+	//hash空了，释放这个key的索引树
+	if db.hashIndex.idxTree.Size() == 0 {
+		delete(db.hashIndex.trees, string(key))
+	}
+	return count, nil
+}
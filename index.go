@@ -6,6 +6,7 @@ import (
 
 	"sdb/art"
 	"sdb/bitcask"
+	"sdb/ioselector"
 	"sdb/options"
 	"sdb/utils"
 	"sdb/zset"
@@ -121,14 +122,33 @@ func (db *SDB) deleteIndexTree(key []byte, keyDir *keyDir, dType DataType) error
 	valDeleted, deleted := idxTree.Delete(key)
 	db.sendCountChan(valDeleted, deleted, dType)
 	// 还有标记这个key被删除的record没有删除，即删除标志位为1的记录本身
-	// 因为已经删除了，删除的这条记录的记录也应该删除
-	db.sendCountChan(keyDir, deleted, dType)
+	// 删除记录本身总是无效数据，删的key不存在时也计入：key之前的record被merge掉之后，
+	// 从日志文件分不清删除时key在不在，sdb-check只能都按无效数据统计，运行时要和它一致
+	db.sendCountChan(keyDir, true, dType)
 	return nil
 }
 
 // 通用取值函数
 func (db *SDB) getVal(key []byte, dataType DataType) ([]byte, error) {
-	// 根据key从ar树中获取keyDir
+	keyDir, err := db.getKeyDir(key, dataType)
+	if err != nil {
+		return nil, err
+	}
+	// In KeyValueMemMode, the value will be stored in memory.
+	// So get the value from the index info.
+	if db.opts.StoreMode == options.MemoryMode && len(keyDir.value) != 0 {
+		return keyDir.value, nil
+	}
+
+	// 读过的value在缓存中，拷贝一份返回，调用方修改了也不影响缓存
+	if value, ok := db.valueCache.get(dataType, keyDir.fileID, keyDir.recordOffset); ok {
+		return append([]byte(nil), value...), nil
+	}
+	return db.readVal(dataType, keyDir)
+}
+
+// 根据key从ar树中获取keyDir，不存在或者过期时返回ErrKeyNotFound
+func (db *SDB) getKeyDir(key []byte, dataType DataType) (*keyDir, error) {
 	var idxTree *art.AdaptiveRadixTree
 	switch dataType {
 	case String:
@@ -155,22 +175,18 @@ func (db *SDB) getVal(key []byte, dataType DataType) ([]byte, error) {
 	if keyDir.expiredAt != 0 && keyDir.expiredAt <= time.Now().Unix() {
 		return nil, ErrKeyNotFound
 	}
-	// In KeyValueMemMode, the value will be stored in memory.
-	// So get the value from the index info.
-	if db.opts.StoreMode == options.MemoryMode && len(keyDir.value) != 0 {
-		return keyDir.value, nil
-	}
+	return keyDir, nil
+}
 
+// 从日志文件读keyDir指向的value，读完放入缓存
+func (db *SDB) readVal(dataType DataType, keyDir *keyDir) ([]byte, error) {
 	// In KeyOnlyMemMode, the value not in memory, so get the value from log file at the offset.
-	lf := db.getActiveLogFile(dataType)
-	// 如果不在活跃文件中,从非活跃文件读，找到file_id对应的非活跃文件
-	if lf.FileID != keyDir.fileID {
-		lf = db.getImmutableFile(dataType, keyDir.fileID)
-	}
-
+	// 读完之前文件一直被引用，merge删除它也要等读完
+	lf := db.refLogFile(dataType, keyDir.fileID)
 	if lf == nil {
 		return nil, ErrLogFileNotFound
 	}
+	defer lf.Release()
 
 	// 根据offset从文件系统读record
 	record, _, err := lf.ReadLogRecord(keyDir.recordOffset)
@@ -181,5 +197,59 @@ func (db *SDB) getVal(key []byte, dataType DataType) ([]byte, error) {
 	if record.Type == bitcask.TypeDelete || (record.ExpiredAt != 0 && record.ExpiredAt < time.Now().Unix()) {
 		return nil, ErrKeyNotFound
 	}
-	return record.Value, nil
+	// value在blob文件中，按指针去读
+	value := record.Value
+	if record.Type&bitcask.TypeBlob != 0 {
+		if value, err = db.readBlobValue(dataType, record.Value); err != nil {
+			return nil, err
+		}
+	}
+	db.valueCache.put(dataType, keyDir.fileID, keyDir.recordOffset, value)
+	return value, nil
 }
+
+// getValView 和getVal一样，但是value在只读的mmap文件中时直接返回映射的内存，不拷贝，
+// 调用release之前文件不会被关闭、淘汰或者删除；其他情况下返回拷贝出来的value，release什么都不做
+func (db *SDB) getValView(key []byte, dataType DataType) ([]byte, func(), error) {
+	keyDir, err := db.getKeyDir(key, dataType)
+	if err != nil {
+		return nil, nil, err
+	}
+	if db.opts.StoreMode == options.MemoryMode && len(keyDir.value) != 0 {
+		return keyDir.value, noRelease, nil
+	}
+	// view是只读的，直接返回缓存中的value
+	if value, ok := db.valueCache.get(dataType, keyDir.fileID, keyDir.recordOffset); ok {
+		return value, noRelease, nil
+	}
+
+	lf := db.refLogFile(dataType, keyDir.fileID)
+	if lf == nil {
+		return nil, nil, ErrLogFileNotFound
+	}
+	defer lf.Release()
+	record, _, release, err := lf.ViewLogRecord(keyDir.recordOffset)
+	if err == ioselector.ErrViewUnsupported {
+		// 活跃文件或者不是mmap方式，按普通方式读，value在blob文件中的话还可以直接返回blob文件映射的内存
+		record, _, err = lf.ReadLogRecord(keyDir.recordOffset)
+		release = noRelease
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if record.Type == bitcask.TypeDelete || (record.ExpiredAt != 0 && record.ExpiredAt < time.Now().Unix()) {
+		release()
+		return nil, nil, ErrKeyNotFound
+	}
+	// 指针解码之后就用不到日志文件了，value从blob文件中读
+	if record.Type&bitcask.TypeBlob != 0 {
+		pointer := record.Value
+		defer release()
+		return db.viewBlobValue(dataType, pointer)
+	}
+	// 映射的内存可能被解除，不放入缓存
+	return record.Value, release, nil
+}
+
+// 不需要释放的value
+func noRelease() {}
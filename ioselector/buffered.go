@@ -0,0 +1,145 @@
+package ioselector
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// 缓冲写满这么大就写到文件
+const bufferedWriteSize = 64 << 10
+
+// BufferedIOSelector 标准IO加上用户态的写缓冲，追加写先攒在buf中，写满、Sync、Close时才写文件，
+// 省掉每条record一次的WriteAt系统调用；还没写到文件的部分读的时候从buf中读
+// 进程崩溃时buf中的数据会丢失，和没有刷盘时机器掉电一样，需要持久化的话配合刷盘策略使用
+type BufferedIOSelector struct {
+	file      *os.File
+	mu        sync.RWMutex // 写和flush改buf加写锁，读加读锁
+	buf       []byte       // 还没写到文件的数据
+	bufOffset int64        // buf第一个字节在文件中的offset
+}
+
+func NewBufferedIOSelector(fileName string, fileSize int64) (IOSelector, error) {
+	if fileSize <= 0 {
+		return nil, ErrInvalidFileSize
+	}
+	file, err := openFile(fileName, fileSize)
+	if err != nil {
+		return nil, err
+	}
+	return &BufferedIOSelector{file: file, buf: make([]byte, 0, bufferedWriteSize)}, nil
+}
+
+// Write 紧接着buf末尾的写追加到buf，其他位置的写（比如文件头、清零写坏的尾部）先把buf写到文件，再从这个位置重新开始攒
+func (bio *BufferedIOSelector) Write(b []byte, offset int64) (int, error) {
+	bio.mu.Lock()
+	defer bio.mu.Unlock()
+	if len(bio.buf) > 0 && offset != bio.bufOffset+int64(len(bio.buf)) {
+		if err := bio.flush(); err != nil {
+			return 0, err
+		}
+	}
+	if len(bio.buf) == 0 {
+		bio.bufOffset = offset
+	}
+	bio.buf = append(bio.buf, b...)
+	if len(bio.buf) >= bufferedWriteSize {
+		if err := bio.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Read 先读文件，再用buf中还没写到文件的数据覆盖对应的部分
+func (bio *BufferedIOSelector) Read(b []byte, offset int64) (int, error) {
+	bio.mu.RLock()
+	defer bio.mu.RUnlock()
+	n, err := bio.file.ReadAt(b, offset)
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+
+	bufEnd := bio.bufOffset + int64(len(bio.buf))
+	readEnd := offset + int64(len(b))
+	if len(bio.buf) == 0 || offset >= bufEnd || readEnd <= bio.bufOffset {
+		return n, err
+	}
+	start, end := offset, readEnd
+	if start < bio.bufOffset {
+		start = bio.bufOffset
+	}
+	if end > bufEnd {
+		end = bufEnd
+	}
+	// 文件末尾和buf之间没有数据的部分是0
+	for i := int64(n); i < start-offset; i++ {
+		b[i] = 0
+	}
+	copy(b[start-offset:end-offset], bio.buf[start-bio.bufOffset:end-bio.bufOffset])
+	if int(end-offset) > n {
+		n = int(end - offset)
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// 把buf写到文件，调用方需要持有写锁
+func (bio *BufferedIOSelector) flush() error {
+	if len(bio.buf) == 0 {
+		return nil
+	}
+	if _, err := bio.file.WriteAt(bio.buf, bio.bufOffset); err != nil {
+		return err
+	}
+	bio.bufOffset += int64(len(bio.buf))
+	bio.buf = bio.buf[:0]
+	return nil
+}
+
+// Sync 把buf写到文件再刷盘，刷盘时不持有锁，不阻塞读写
+func (bio *BufferedIOSelector) Sync() error {
+	bio.mu.Lock()
+	err := bio.flush()
+	bio.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return bio.file.Sync()
+}
+
+func (bio *BufferedIOSelector) Close() error {
+	// 先持久化
+	if err := bio.Sync(); err != nil {
+		return err
+	}
+	return bio.file.Close()
+}
+
+func (bio *BufferedIOSelector) Delete() error {
+	bio.mu.Lock()
+	bio.buf = bio.buf[:0]
+	bio.mu.Unlock()
+	// 清空文件
+	if err := bio.file.Truncate(0); err != nil {
+		return err
+	}
+	if err := bio.file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(bio.file.Name())
+}
+
+func (bio *BufferedIOSelector) Truncate(size int64) error {
+	if size <= 0 {
+		return ErrInvalidFileSize
+	}
+	bio.mu.Lock()
+	defer bio.mu.Unlock()
+	if err := bio.flush(); err != nil {
+		return err
+	}
+	return bio.file.Truncate(size)
+}
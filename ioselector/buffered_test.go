@@ -0,0 +1,79 @@
+package ioselector
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBufferedIOSelector(t *testing.T) {
+	name := filepath.Join(os.TempDir(), "sdb-buffered-io")
+	defer func() {
+		_ = os.Remove(name)
+	}()
+	selector, err := NewBufferedIOSelector(name, 1024)
+	assert.Nil(t, err)
+	file, err := os.Open(name)
+	assert.Nil(t, err)
+	defer file.Close()
+	readFile := func(offset int64, n int) []byte {
+		buf := make([]byte, n)
+		_, err := file.ReadAt(buf, offset)
+		assert.Nil(t, err)
+		return buf
+	}
+
+	// 追加写先在缓冲中，文件里还没有，读的时候能读到
+	_, err = selector.Write([]byte("hello"), 0)
+	assert.Nil(t, err)
+	_, err = selector.Write([]byte(" world"), 5)
+	assert.Nil(t, err)
+	assert.Equal(t, make([]byte, 11), readFile(0, 11))
+	buf := make([]byte, 7)
+	n, err := selector.Read(buf, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, n)
+	assert.Equal(t, []byte("lo worl"), buf)
+
+	// 不连续的写先把缓冲写到文件
+	_, err = selector.Write([]byte("tail"), 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello world"), readFile(0, 11))
+	// 跨过文件末尾的读，超出的部分返回io.EOF
+	buf = make([]byte, 30)
+	n, err = selector.Read(buf, 1000)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 24, n)
+	assert.Equal(t, []byte("tail"), buf[:4])
+
+	// Sync之后都在文件里
+	assert.Nil(t, selector.Sync())
+	assert.Equal(t, []byte("tail"), readFile(1000, 4))
+
+	// 写满缓冲自动写文件
+	big := make([]byte, bufferedWriteSize)
+	big[len(big)-1] = 'x'
+	_, err = selector.Write(big, 2000)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("x"), readFile(2000+bufferedWriteSize-1, 1))
+
+	// 缓冲在文件末尾之后，文件末尾和缓冲之间没写过的部分读出来是0
+	assert.Nil(t, selector.Truncate(4096))
+	_, err = selector.Write([]byte("after"), 5000)
+	assert.Nil(t, err)
+	buf = make([]byte, 10)
+	n, err = selector.Read(buf, 4092)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 4, n)
+	for i := range buf {
+		buf[i] = 0xff
+	}
+	n, err = selector.Read(buf, 4998)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 7, n)
+	assert.Equal(t, []byte("\x00\x00after"), buf[:n])
+	assert.Nil(t, selector.Close())
+}
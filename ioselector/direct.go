@@ -0,0 +1,236 @@
+package ioselector
+
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// O_DIRECT要求读写的offset、长度和内存地址都按块对齐
+const (
+	directBlockSize    = 4096
+	directWriteBufSize = 64 << 10
+)
+
+// DirectIOSelector 用O_DIRECT（darwin是F_NOCACHE）读写文件，不经过内核的page cache，不会挤掉同一台机器上其他服务的缓存
+// 写的时候把覆盖到的块整块写下去，头尾不完整的块先读出原来的内容再合并；
+// 追加写时最后一个块经常只写了一部分，缓存在tail中，下一次追加写不用再读；
+// 整块写会把文件撑到块的末尾，写的时候不截断，Sync、Close、Truncate时再截回写到的位置
+type DirectIOSelector struct {
+	file     *os.File
+	readOnly bool
+
+	mu         sync.Mutex // 写、Sync、Truncate加锁，保护tail和fileSize
+	tail       []byte     // 最近写过的一个块，对齐的内存
+	tailOffset int64      // tail在文件中的offset，-1表示tail没有缓存
+	size       int64      // 逻辑上的文件大小，和其他IOSelector一致，读不会超过它，原子读写
+	fileSize   int64      // 磁盘上文件的实际大小，整块写之后可能比size大
+	wbuf       []byte     // 写用的对齐内存，不超过directWriteBufSize的写复用它
+}
+
+func NewDirectIOSelector(fileName string, fileSize int64) (IOSelector, error) {
+	if fileSize <= 0 {
+		return nil, ErrInvalidFileSize
+	}
+	file, err := openDirectFile(fileName, os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		return nil, err
+	}
+	if err = extendFile(file, fileSize); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return &DirectIOSelector{
+		file:       file,
+		tail:       alignedBlock(directBlockSize),
+		tailOffset: -1,
+		size:       stat.Size(),
+		fileSize:   stat.Size(),
+	}, nil
+}
+
+// NewReadOnlyDirectIOSelector 只读打开已有的文件
+func NewReadOnlyDirectIOSelector(fileName string) (IOSelector, error) {
+	file, err := openDirectFile(fileName, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	return &DirectIOSelector{file: file, tailOffset: -1, readOnly: true}, nil
+}
+
+func (dio *DirectIOSelector) Write(b []byte, offset int64) (int, error) {
+	if dio.readOnly {
+		return 0, ErrReadOnly
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	dio.mu.Lock()
+	defer dio.mu.Unlock()
+
+	end := offset + int64(len(b))
+	alignedStart, alignedEnd := alignDown(offset), alignUp(end)
+	var buf []byte
+	if alignedEnd-alignedStart <= directWriteBufSize {
+		if dio.wbuf == nil {
+			dio.wbuf = alignedBlock(directWriteBufSize)
+		}
+		buf = dio.wbuf[:alignedEnd-alignedStart]
+	} else {
+		buf = alignedBlock(int(alignedEnd - alignedStart))
+	}
+	// 头尾不完整的块先填上原来的内容
+	if offset != alignedStart {
+		if err := dio.readBlock(buf[:directBlockSize], alignedStart); err != nil {
+			return 0, err
+		}
+	}
+	if lastBlock := alignedEnd - directBlockSize; end != alignedEnd && (lastBlock != alignedStart || offset == alignedStart) {
+		if err := dio.readBlock(buf[lastBlock-alignedStart:], lastBlock); err != nil {
+			return 0, err
+		}
+	}
+	copy(buf[offset-alignedStart:], b)
+	if _, err := dio.file.WriteAt(buf, alignedStart); err != nil {
+		return 0, err
+	}
+
+	// 整块写会把文件撑到块的末尾，这里只记下来，每次都截断的话追加写一次就多一次ftruncate
+	if alignedEnd > dio.fileSize {
+		dio.fileSize = alignedEnd
+	}
+	if end > dio.size {
+		atomic.StoreInt64(&dio.size, end)
+	}
+	dio.tailOffset = alignedEnd - directBlockSize
+	copy(dio.tail, buf[dio.tailOffset-alignedStart:])
+	return len(b), nil
+}
+
+// 读出offset处的一个块，是缓存的tail就直接用，超出文件末尾的部分是0，调用方需要持有锁
+func (dio *DirectIOSelector) readBlock(block []byte, offset int64) error {
+	if offset == dio.tailOffset {
+		copy(block, dio.tail)
+		return nil
+	}
+	n, err := dio.file.ReadAt(block, offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	for i := n; i < len(block); i++ {
+		block[i] = 0
+	}
+	return nil
+}
+
+// Read 读覆盖到的整块，再拷出需要的部分，读到文件末尾不足len(b)时返回已读的部分和io.EOF
+func (dio *DirectIOSelector) Read(b []byte, offset int64) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	alignedStart := alignDown(offset)
+	buf := alignedBlock(int(alignUp(offset+int64(len(b))) - alignedStart))
+	n, err := dio.file.ReadAt(buf, alignedStart)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	// 可写的文件末尾可能有整块写撑出来的部分，不算文件的内容
+	if !dio.readOnly {
+		if limit := atomic.LoadInt64(&dio.size) - alignedStart; int64(n) > limit {
+			n = int(limit)
+		}
+	}
+	skip := int(offset - alignedStart)
+	if n <= skip {
+		return 0, io.EOF
+	}
+	n = copy(b, buf[skip:n])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (dio *DirectIOSelector) Sync() error {
+	if dio.readOnly {
+		return nil
+	}
+	// 整块写撑出来的部分截回写到的位置再刷盘，文件大小和其他IOSelector一致
+	dio.mu.Lock()
+	if dio.fileSize > dio.size {
+		if err := dio.file.Truncate(dio.size); err != nil {
+			dio.mu.Unlock()
+			return err
+		}
+		dio.fileSize = dio.size
+	}
+	dio.mu.Unlock()
+	return dio.file.Sync()
+}
+
+func (dio *DirectIOSelector) Close() error {
+	// 先持久化
+	if err := dio.Sync(); err != nil {
+		return err
+	}
+	return dio.file.Close()
+}
+
+func (dio *DirectIOSelector) Delete() error {
+	// 清空文件
+	if !dio.readOnly {
+		if err := dio.file.Truncate(0); err != nil {
+			return err
+		}
+	}
+	if err := dio.file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(dio.file.Name())
+}
+
+func (dio *DirectIOSelector) Truncate(size int64) error {
+	if dio.readOnly {
+		return ErrReadOnly
+	}
+	if size <= 0 {
+		return ErrInvalidFileSize
+	}
+	dio.mu.Lock()
+	defer dio.mu.Unlock()
+	if err := dio.file.Truncate(size); err != nil {
+		return err
+	}
+	// 截断到tail中间时，tail后面的部分已经不在文件里了
+	if size < dio.tailOffset+directBlockSize {
+		dio.tailOffset = -1
+	}
+	atomic.StoreInt64(&dio.size, size)
+	dio.fileSize = size
+	return nil
+}
+
+func alignDown(offset int64) int64 {
+	return offset &^ (directBlockSize - 1)
+}
+
+func alignUp(offset int64) int64 {
+	return alignDown(offset + directBlockSize - 1)
+}
+
+// 分配起始地址按块对齐的内存，size是块大小的整数倍
+func alignedBlock(size int) []byte {
+	buf := make([]byte, size+directBlockSize)
+	shift := int(uintptr(unsafe.Pointer(&buf[0])) & (directBlockSize - 1))
+	if shift != 0 {
+		shift = directBlockSize - shift
+	}
+	return buf[shift : shift+size : shift+size]
+}
@@ -0,0 +1,20 @@
+package ioselector
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// darwin没有O_DIRECT，打开之后设置F_NOCACHE，效果类似
+func openDirectFile(fileName string, flag int) (*os.File, error) {
+	file, err := os.OpenFile(fileName, flag, DefaultFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = unix.FcntlInt(file.Fd(), unix.F_NOCACHE, 1); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return file, nil
+}
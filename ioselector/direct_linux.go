@@ -0,0 +1,12 @@
+package ioselector
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// 用O_DIRECT打开文件，读写直接和磁盘交互，不经过page cache
+func openDirectFile(fileName string, flag int) (*os.File, error) {
+	return os.OpenFile(fileName, flag|unix.O_DIRECT, DefaultFilePerm)
+}
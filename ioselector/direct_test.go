@@ -0,0 +1,109 @@
+package ioselector
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirectIOSelector(t *testing.T) {
+	name := filepath.Join(os.TempDir(), "sdb-direct-io")
+	defer func() {
+		_ = os.Remove(name)
+	}()
+	selector, err := NewDirectIOSelector(name, 3*directBlockSize)
+	assert.Nil(t, err)
+	readFile := func(offset int64, n int) []byte {
+		buf := make([]byte, n)
+		file, err := os.Open(name)
+		assert.Nil(t, err)
+		defer file.Close()
+		_, err = file.ReadAt(buf, offset)
+		assert.Nil(t, err)
+		return buf
+	}
+
+	// 不对齐的追加写，块的尾部不完整
+	_, err = selector.Write([]byte("hello"), 0)
+	assert.Nil(t, err)
+	_, err = selector.Write([]byte(" world"), 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello world"), readFile(0, 11))
+	buf := make([]byte, 7)
+	n, err := selector.Read(buf, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, n)
+	assert.Equal(t, []byte("lo worl"), buf)
+
+	// 跨块的写，头尾两个块原来的内容不变
+	_, err = selector.Write([]byte("tail"), directBlockSize-2)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello world"), readFile(0, 11))
+	assert.Equal(t, []byte("tail"), readFile(directBlockSize-2, 4))
+	_, err = selector.Write(bytes.Repeat([]byte("x"), directBlockSize-100), 100)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello world"), readFile(0, 11))
+	assert.Equal(t, []byte("xxil"), readFile(directBlockSize-2, 4))
+	buf = make([]byte, directBlockSize-97)
+	n, err = selector.Read(buf, 99)
+	assert.Nil(t, err)
+	assert.Equal(t, len(buf), n)
+	assert.Equal(t, byte(0), buf[0])
+	assert.Equal(t, bytes.Repeat([]byte("x"), directBlockSize-100), buf[1:n-2])
+	assert.Equal(t, []byte("il"), buf[n-2:])
+
+	// 写到文件末尾之后，文件先被撑到块的末尾，读不会超过写到的位置，Sync之后文件大小是写到的位置
+	_, err = selector.Write([]byte("after"), 3*directBlockSize+10)
+	assert.Nil(t, err)
+	stat, err := os.Stat(name)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4*directBlockSize), stat.Size())
+	buf = make([]byte, 10)
+	n, err = selector.Read(buf, 3*directBlockSize+8)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 7, n)
+	assert.Equal(t, []byte("\x00\x00after"), buf[:n])
+	n, err = selector.Read(buf, 4*directBlockSize)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 0, n)
+	assert.Nil(t, selector.Sync())
+	stat, err = os.Stat(name)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3*directBlockSize+15), stat.Size())
+
+	// 截断到缓存的块中间，后面再写不会把截掉的内容写回去
+	assert.Nil(t, selector.Truncate(3*directBlockSize+12))
+	_, err = selector.Write([]byte("!"), 3*directBlockSize+20)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("\x00\x00af\x00\x00\x00\x00\x00\x00\x00\x00!"), readFile(3*directBlockSize+8, 13))
+
+	assert.Nil(t, selector.Sync())
+	assert.Nil(t, selector.Close())
+
+	// 重新打开，按文件原来的大小
+	selector, err = NewDirectIOSelector(name, directBlockSize)
+	assert.Nil(t, err)
+	buf = make([]byte, 11)
+	_, err = selector.Read(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello world"), buf)
+	assert.Nil(t, selector.Delete())
+	_, err = os.Stat(name)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAlignedBlock(t *testing.T) {
+	for _, size := range []int{directBlockSize, 3 * directBlockSize} {
+		buf := alignedBlock(size)
+		assert.Equal(t, size, len(buf))
+		assert.Equal(t, uintptr(0), uintptr(unsafe.Pointer(&buf[0]))%directBlockSize)
+	}
+	assert.Equal(t, int64(0), alignDown(directBlockSize-1))
+	assert.Equal(t, int64(directBlockSize), alignUp(1))
+	assert.Equal(t, int64(directBlockSize), alignUp(directBlockSize))
+}
@@ -8,7 +8,15 @@ import (
 // DefaultFilePerm 默认普通文件，文件所有者对该文件有读写权限，用户组和其他人只有读权限，
 const DefaultFilePerm = 0644
 
-var ErrInvalidFileSize = errors.New("file size can`t be zero or negative")
+var (
+	ErrInvalidFileSize = errors.New("file size can`t be zero or negative")
+
+	// ErrReadOnly 只读打开的文件不能写
+	ErrReadOnly = errors.New("file is opened read-only")
+
+	// ErrViewUnsupported 只有只读的mmap文件能直接返回映射的内存
+	ErrViewUnsupported = errors.New("view is only supported on read-only mmap files")
+)
 
 // IOSelector 文件抽象接口
 type IOSelector interface {
@@ -21,24 +29,40 @@ type IOSelector interface {
 	Close() error
 
 	Delete() error
+
+	// Truncate 把文件扩展或者截断到size，活跃文件写满了扩展，不再写了截掉后面没用到的空间
+	Truncate(size int64) error
 }
 
+// Viewer 能直接返回文件内容而不拷贝的IOSelector，返回的切片指向映射的内存，selector关闭之前一直有效，不能修改
+type Viewer interface {
+	// View 返回offset开始的n个字节，读到文件末尾不足n时返回已有的部分和io.EOF
+	View(offset, n int64) ([]byte, error)
+}
+
+// 打开文件，文件不足fileSize时扩展到fileSize，已有的文件比fileSize大时不截断
 func openFile(fileName string, fileSize int64) (*os.File, error) {
 	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, DefaultFilePerm)
 	if err != nil {
 		return nil, err
 	}
-	stat, err := file.Stat()
-	if err != nil {
+	if err = extendFile(file, fileSize); err != nil {
+		_ = file.Close()
 		return nil, err
 	}
+	return file, nil
+}
 
+// 文件不足fileSize时扩展到fileSize
+func extendFile(file *os.File, fileSize int64) error {
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
 	// 打开文件空间不足
 	if stat.Size() < fileSize {
 		// 重新分配空间
-		if err = file.Truncate(fileSize); err != nil {
-			return nil, err
-		}
+		return file.Truncate(fileSize)
 	}
-	return file, nil
+	return nil
 }
@@ -0,0 +1,85 @@
+package ioselector
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadOnlySelector(t *testing.T) {
+	openers := map[string]func(fileName string) (IOSelector, error){
+		"standard": NewReadOnlyStandardIOSelector,
+		"mmap":     NewReadOnlyMMapSelector,
+		"direct":   NewReadOnlyDirectIOSelector,
+	}
+	for name, open := range openers {
+		t.Run(name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), "sdb-read-only")
+			// 文件不存在时不会新建
+			_, err := open(fileName)
+			assert.True(t, os.IsNotExist(err))
+
+			assert.Nil(t, os.WriteFile(fileName, []byte("hello world"), DefaultFilePerm))
+			selector, err := open(fileName)
+			assert.Nil(t, err)
+			buf := make([]byte, 5)
+			_, err = selector.Read(buf, 6)
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("world"), buf)
+
+			_, err = selector.Write([]byte("x"), 0)
+			assert.Equal(t, ErrReadOnly, err)
+			assert.Equal(t, ErrReadOnly, selector.Truncate(1))
+			assert.Nil(t, selector.Sync())
+			assert.Nil(t, selector.Close())
+			content, err := os.ReadFile(fileName)
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("hello world"), content)
+
+			// 删除时不清空文件，直接删掉
+			selector, err = open(fileName)
+			assert.Nil(t, err)
+			assert.Nil(t, selector.Delete())
+			_, err = os.Stat(fileName)
+			assert.True(t, os.IsNotExist(err))
+
+			// 空文件也能打开
+			assert.Nil(t, os.WriteFile(fileName, nil, DefaultFilePerm))
+			selector, err = open(fileName)
+			assert.Nil(t, err)
+			assert.Nil(t, selector.Close())
+		})
+	}
+}
+
+func TestMMapSelector_View(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "sdb-view")
+	// 可写的映射不支持
+	selector, err := NewMMapSelector(fileName, 16)
+	assert.Nil(t, err)
+	_, err = selector.Write([]byte("hello world"), 0)
+	assert.Nil(t, err)
+	_, err = selector.(Viewer).View(0, 5)
+	assert.Equal(t, ErrViewUnsupported, err)
+	assert.Nil(t, selector.Truncate(11))
+	assert.Nil(t, selector.Close())
+
+	selector, err = NewReadOnlyMMapSelector(fileName)
+	assert.Nil(t, err)
+	defer selector.Close()
+	viewer := selector.(Viewer)
+	buf, err := viewer.View(6, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("world"), buf)
+	// 不能append到映射的内存中
+	assert.Equal(t, 5, cap(buf))
+	// 读到文件末尾返回已有的部分
+	buf, err = viewer.View(6, 10)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, []byte("world"), buf)
+	_, err = viewer.View(11, 1)
+	assert.Equal(t, io.EOF, err)
+}
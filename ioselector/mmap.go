@@ -3,15 +3,18 @@ package ioselector
 import (
 	"io"
 	"os"
+	"sync"
 
 	"sdb/mmap"
 )
 
 // MMapSelector MMAP方式实现IOSelector
 type MMapSelector struct {
-	file *os.File
-	buf  []byte // 没有加锁，因为写不同的offset不会race
-	cap  int64
+	file     *os.File
+	mu       sync.RWMutex // 写不同的offset不会race，锁只防止读写、刷盘的时候Truncate换了映射或者解除了映射
+	buf      []byte
+	cap      int64
+	readOnly bool // 只读映射，不能写、刷盘和Truncate
 }
 
 func NewMMapSelector(fileName string, fileSize int64) (IOSelector, error) {
@@ -22,6 +25,14 @@ func NewMMapSelector(fileName string, fileSize int64) (IOSelector, error) {
 	if err != nil {
 		return nil, err
 	}
+	// 已有的文件比fileSize大（比如升级格式后record变长了），按实际大小映射，否则后面的数据读不到
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() > fileSize {
+		fileSize = stat.Size()
+	}
 	buf, err := mmap.MMap(file, true, fileSize)
 	if err != nil {
 		return nil, err
@@ -30,11 +41,37 @@ func NewMMapSelector(fileName string, fileSize int64) (IOSelector, error) {
 	return &MMapSelector{file: file, buf: buf, cap: int64(len(buf))}, nil
 }
 
+// NewReadOnlyMMapSelector 只读打开已有的文件，按文件大小映射为只读内存，空文件不映射
+func NewReadOnlyMMapSelector(fileName string) (IOSelector, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	var buf []byte
+	if stat.Size() > 0 {
+		if buf, err = mmap.MMap(file, false, stat.Size()); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
+	return &MMapSelector{file: file, buf: buf, cap: int64(len(buf)), readOnly: true}, nil
+}
+
 func (m *MMapSelector) Write(b []byte, offset int64) (int, error) {
+	if m.readOnly {
+		return 0, ErrReadOnly
+	}
 	l := int64(len(b))
 	if l <= 0 {
 		return 0, nil
 	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	if offset < 0 || l+offset > m.cap {
 		return 0, io.EOF
 	}
@@ -42,23 +79,55 @@ func (m *MMapSelector) Write(b []byte, offset int64) (int, error) {
 }
 
 func (m *MMapSelector) Read(b []byte, offset int64) (int, error) {
-	if offset < 0 || offset >= m.cap || offset+int64(len(b)) >= m.cap {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if offset < 0 || offset >= m.cap {
 		return 0, io.EOF
 	}
-	return copy(b, m.buf[offset:]), nil
+	// 和ReadAt一样，读到文件末尾不足len(b)时返回已读的部分和io.EOF
+	n := copy(b, m.buf[offset:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// View 只读映射不会被Truncate换掉，可以直接返回映射的内存；可写的活跃文件扩展时会重新映射，不支持
+func (m *MMapSelector) View(offset, n int64) ([]byte, error) {
+	if !m.readOnly {
+		return nil, ErrViewUnsupported
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if offset < 0 || offset >= m.cap {
+		return nil, io.EOF
+	}
+	if end := offset + n; end <= m.cap {
+		return m.buf[offset:end:end], nil
+	}
+	return m.buf[offset:m.cap:m.cap], io.EOF
 }
 
 func (m *MMapSelector) Sync() error {
+	if m.readOnly {
+		return nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	return mmap.MSync(m.buf)
 }
 
 func (m *MMapSelector) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	// 先持久化
-	if err := mmap.MSync(m.buf); err != nil {
-		return err
+	if !m.readOnly {
+		if err := mmap.MSync(m.buf); err != nil {
+			return err
+		}
 	}
 	// 再取消映射
-	if err := mmap.MUnmap(m.buf); err != nil {
+	if err := m.unmap(); err != nil {
 		return err
 	}
 	// 最后关闭文件
@@ -66,14 +135,17 @@ func (m *MMapSelector) Close() error {
 }
 
 func (m *MMapSelector) Delete() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	// 取消映射
-	if err := mmap.MUnmap(m.buf); err != nil {
+	if err := m.unmap(); err != nil {
 		return err
 	}
-	m.buf = nil // 清空buf
 	// 清空文件
-	if err := m.file.Truncate(0); err != nil {
-		return err
+	if !m.readOnly {
+		if err := m.file.Truncate(0); err != nil {
+			return err
+		}
 	}
 	// 关闭文件
 	if err := m.file.Close(); err != nil {
@@ -81,3 +153,45 @@ func (m *MMapSelector) Delete() error {
 	}
 	return os.Remove(m.file.Name())
 }
+
+// 取消映射并清空buf，空文件没有映射
+func (m *MMapSelector) unmap() error {
+	if m.buf == nil {
+		return nil
+	}
+	if err := mmap.MUnmap(m.buf); err != nil {
+		return err
+	}
+	m.buf, m.cap = nil, 0
+	return nil
+}
+
+// Truncate 扩展时先扩展文件再扩大映射，截断时先缩小映射再截断文件，映射始终不超出文件
+func (m *MMapSelector) Truncate(size int64) error {
+	if m.readOnly {
+		return ErrReadOnly
+	}
+	if size <= 0 {
+		return ErrInvalidFileSize
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if size == m.cap {
+		return nil
+	}
+	grow := size > m.cap
+	if grow {
+		if err := m.file.Truncate(size); err != nil {
+			return err
+		}
+	}
+	buf, err := mmap.MRemap(m.file, m.buf, size)
+	if err != nil {
+		return err
+	}
+	m.buf, m.cap = buf, size
+	if grow {
+		return nil
+	}
+	return m.file.Truncate(size)
+}
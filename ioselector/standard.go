@@ -5,7 +5,8 @@ import (
 )
 
 type StandardIOSelector struct {
-	file *os.File
+	file     *os.File
+	readOnly bool
 }
 
 func NewStandardIOSelector(fileName string, fileSize int64) (IOSelector, error) {
@@ -19,7 +20,19 @@ func NewStandardIOSelector(fileName string, fileSize int64) (IOSelector, error)
 	return &StandardIOSelector{file: file}, nil
 }
 
+// NewReadOnlyStandardIOSelector 只读打开已有的文件
+func NewReadOnlyStandardIOSelector(fileName string) (IOSelector, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return &StandardIOSelector{file: file, readOnly: true}, nil
+}
+
 func (sio *StandardIOSelector) Write(b []byte, offset int64) (int, error) {
+	if sio.readOnly {
+		return 0, ErrReadOnly
+	}
 	return sio.file.WriteAt(b, offset)
 }
 
@@ -28,6 +41,9 @@ func (sio *StandardIOSelector) Read(b []byte, offset int64) (int, error) {
 }
 
 func (sio *StandardIOSelector) Sync() error {
+	if sio.readOnly {
+		return nil
+	}
 	return sio.file.Sync()
 }
 
@@ -41,11 +57,23 @@ func (sio *StandardIOSelector) Close() error {
 
 func (sio *StandardIOSelector) Delete() error {
 	// 清空文件
-	if err := sio.file.Truncate(0); err != nil {
-		return err
+	if !sio.readOnly {
+		if err := sio.file.Truncate(0); err != nil {
+			return err
+		}
 	}
 	if err := sio.file.Close(); err != nil {
 		return err
 	}
 	return os.Remove(sio.file.Name())
 }
+
+func (sio *StandardIOSelector) Truncate(size int64) error {
+	if sio.readOnly {
+		return ErrReadOnly
+	}
+	if size <= 0 {
+		return ErrInvalidFileSize
+	}
+	return sio.file.Truncate(size)
+}
@@ -24,9 +24,9 @@ import (
 const initialListSeq = math.MaxUint32 / 2
 
 //LPush list允许重复
-func (db *SDB) LPush(key []byte, values ...[]byte) error {
+func (db *SDB) LPush(key []byte, values ...[]byte) (err error) {
 	db.listIndex.mu.Lock()
-	defer db.listIndex.mu.Unlock()
+	defer db.unlockAndSync(List, &err)
 
 	//用ar树作为list，如果key对应的list不存在则创建
 	if db.listIndex.trees[string(key)] == nil {
@@ -43,15 +43,15 @@ func (db *SDB) LPush(key []byte, values ...[]byte) error {
 }
 
 // LPop removes and returns 队头元素
-func (db *SDB) LPop(key []byte) ([]byte, error) {
+func (db *SDB) LPop(key []byte) (val []byte, err error) {
 	db.listIndex.mu.Lock()
-	defer db.listIndex.mu.Unlock()
+	defer db.unlockAndSync(List, &err)
 	return db.popList(key, true)
 }
 
-func (db *SDB) RPush(key []byte, values ...[]byte) error {
+func (db *SDB) RPush(key []byte, values ...[]byte) (err error) {
 	db.listIndex.mu.Lock()
-	defer db.listIndex.mu.Unlock()
+	defer db.unlockAndSync(List, &err)
 
 	//用ar树作为list，如果key对应的list不存在则创建
 	if db.listIndex.trees[string(key)] == nil {
@@ -68,9 +68,9 @@ func (db *SDB) RPush(key []byte, values ...[]byte) error {
 }
 
 // RPop Removes and returns 队尾元素
-func (db *SDB) RPop(key []byte) ([]byte, error) {
+func (db *SDB) RPop(key []byte) (val []byte, err error) {
 	db.listIndex.mu.Lock()
-	defer db.listIndex.mu.Unlock()
+	defer db.unlockAndSync(List, &err)
 	return db.popList(key, false)
 }
 
@@ -189,6 +189,9 @@ func (db *SDB) popList(key []byte, isLeft bool) ([]byte, error) {
 		return nil, err
 	}
 
-	err = db.deleteIndexTree(key, keyDir, List)
+	//删除的是元素的索引，不是list元信息的索引
+	if err = db.deleteIndexTree(listKey, keyDir, List); err != nil {
+		return nil, err
+	}
 	return val, nil
 }
@@ -1,9 +1,13 @@
 package sdb
 
 import (
+	"io"
 	"sync/atomic"
 
 	"sdb/bitcask"
+	"sdb/count"
+	"sdb/logger"
+	"sdb/options"
 )
 
 func (db *SDB) initLogFile(dataType DataType) (err error) {
@@ -15,12 +19,20 @@ func (db *SDB) initLogFile(dataType DataType) (err error) {
 	}
 	opts := db.opts
 	fileType, IOType := bitcask.FileType(dataType), bitcask.IOType(opts.IoType)
-	lf, err := bitcask.OpenLogFile(opts.DBPath, bitcask.InitialLogFileId, opts.LogFileSizeThreshold, fileType, IOType)
+	lf, err := bitcask.OpenEncryptedLogFile(opts.DBPath, bitcask.InitialLogFileId, opts.LogFileSizeThreshold, fileType, IOType, db.keyring)
 	if err != nil {
 		return
 	}
+	// 文件建好后再记到MANIFEST，中间崩溃的话这个文件是游离文件，下次启动时被隔离
+	if err = db.syncDBPath(); err != nil {
+		return
+	}
+	if err = db.logManifestEdit(manifestCreate, dataType, []uint32{lf.FileID}, nil); err != nil {
+		_ = lf.Delete()
+		return
+	}
 
-	db.countFiles[dataType].SetFileSize(lf.FileID, uint32(opts.LogFileSizeThreshold))
+	db.countFiles[dataType].SetFileSize(lf.FileID, uint32(lf.Capacity))
 	db.activeFiles[dataType] = lf
 	return
 }
@@ -42,12 +54,26 @@ func (db *SDB) writeLogRecord(lr *bitcask.LogRecord, dataType DataType) (kd *key
 		return nil, ErrLogFileNotFound
 	}
 
-	opts := db.opts
-	// 编码record
-	lrBuf, recordSize := bitcask.EncodeRecord(lr)
+	// 大value先写到blob文件，日志文件中只写指针
+	var blob *bitcask.BlobPointer
+	if db.blobEnabled(dataType, lr) {
+		if blob, err = db.writeBlobRecord(dataType, lr); err != nil {
+			return
+		}
+		lr = &bitcask.LogRecord{
+			Key:       lr.Key,
+			Value:     bitcask.EncodeBlobPointer(blob),
+			ExpiredAt: lr.ExpiredAt,
+			Type:      lr.Type | bitcask.TypeBlob,
+		}
+	} else {
+		lr = db.compressRecord(lr)
+	}
+	// 按活跃文件的版本编码record
+	lrBuf, recordSize := activeFile.EncodeRecord(lr)
 
-	// 超过设定每个日志文件大小阈值，把活跃日志文件设置为非活跃文件
-	if activeFile.WriteOffSet+int64(recordSize) > opts.LogFileSizeThreshold {
+	// 超过活跃日志文件的容量，把活跃日志文件设置为非活跃文件
+	if activeFile.WriteOffSet+int64(recordSize) > activeFile.Capacity {
 
 		// 先把活跃文件刷盘
 		if err = activeFile.Sync(); err != nil {
@@ -58,25 +84,11 @@ func (db *SDB) writeLogRecord(lr *bitcask.LogRecord, dataType DataType) (kd *key
 		db.mu.Lock()
 		defer db.mu.Unlock()
 
-		// 老活跃文件视为immutableFiles，转移下内存中的映射关系
-		activeFileId := activeFile.FileID
-		if db.immutableFiles[dataType] == nil {
-			db.immutableFiles[dataType] = make(immutableFiles)
-		}
-		db.immutableFiles[dataType][activeFileId] = activeFile
-
-		// 打开一个新日志文件，来作为新的活跃日志文件
-		var lf *bitcask.LogFile
-		fType, IOType := bitcask.FileType(dataType), bitcask.IOType(opts.IoType)
-		lf, err = bitcask.OpenLogFile(opts.DBPath, activeFileId+1, opts.LogFileSizeThreshold, fType, IOType)
-		if err != nil {
+		if activeFile, err = db.rotateActiveFile(dataType, activeFile.FileID+1); err != nil {
 			return
 		}
-		// 新日志文件，初始化下他在count file中的记录
-		db.countFiles[dataType].SetFileSize(lf.FileID, uint32(opts.LogFileSizeThreshold))
-		// 活跃文件映射替换为新文件
-		db.activeFiles[dataType] = lf
-		activeFile = lf
+		// 新文件的版本可能和老文件不一样，重新编码
+		lrBuf, recordSize = activeFile.EncodeRecord(lr)
 	}
 
 	// 获取这个文件开始写的地方
@@ -85,26 +97,197 @@ func (db *SDB) writeLogRecord(lr *bitcask.LogRecord, dataType DataType) (kd *key
 	if err = activeFile.Write(lrBuf); err != nil {
 		return
 	}
-	// 是否立刻持久化，根据设置
-	if opts.Sync {
-		if err = activeFile.Sync(); err != nil {
-			return
-		}
+	// 按刷盘策略持久化
+	if err = db.syncAfterWrite(dataType, activeFile, false); err != nil {
+		return
 	}
 	kd = &keyDir{
 		fileID:       activeFile.FileID,
 		recordSize:   recordSize,
 		recordOffset: writeAt,
 		expiredAt:    lr.ExpiredAt,
+		blob:         blob,
 	}
 	return
 }
 
+// 按设置压缩record的value，返回的是新的record，keyDir中缓存的还是原始value
+func (db *SDB) compressRecord(lr *bitcask.LogRecord) *bitcask.LogRecord {
+	if db.opts.Compression == options.NoCompression {
+		return lr
+	}
+	return bitcask.CompressRecord(lr, db.opts.CompressMinSize)
+}
+
+// 打开fID对应的日志文件，新日志文件初始化下他在count file中的记录
+func (db *SDB) openLogFile(dataType DataType, fID uint32) (*bitcask.LogFile, error) {
+	opts := db.opts
+	fType, IOType := bitcask.FileType(dataType), bitcask.IOType(opts.IoType)
+	lf, err := bitcask.OpenEncryptedLogFile(opts.DBPath, fID, opts.LogFileSizeThreshold, fType, IOType, db.keyring)
+	if err != nil {
+		return nil, err
+	}
+	db.countFiles[dataType].SetFileSize(lf.FileID, uint32(lf.Capacity))
+	return lf, nil
+}
+
+// 已有文件的容量：新建时记在count file中的大小阈值，改了LogFileSizeThreshold之后老文件还按原来的容量写，
+// 没有记录的用当前的阈值
+func (db *SDB) fileCapacity(cf *count.CountFile, fID uint32) int64 {
+	if size, err := cf.FileSize(fID); err == nil && size > 0 {
+		return int64(size)
+	}
+	return db.opts.LogFileSizeThreshold
+}
+
+// 截掉不会再写的文件扩展出来没用到的空间，count file里的大小同步改成截掉之后的，
+// 否则没写满就转为非活跃的文件按容量算占用率，一直达不到merge的阈值
+func trimLogFile(cf *count.CountFile, lf *bitcask.LogFile) error {
+	if err := lf.Trim(); err != nil {
+		return err
+	}
+	return cf.UpdateFileSize(lf.FileID, uint32(lf.Size()))
+}
+
+// 把活跃文件转为非活跃文件，打开fID作为新的活跃文件，调用方需要持有db.mu写锁
+func (db *SDB) rotateActiveFile(dataType DataType, fID uint32) (*bitcask.LogFile, error) {
+	// 老活跃文件不会再写了，截掉扩展出来没用到的空间
+	if err := trimLogFile(db.countFiles[dataType], db.activeFiles[dataType]); err != nil {
+		return nil, err
+	}
+	// 打开一个新日志文件，来作为新的活跃日志文件
+	lf, err := db.openLogFile(dataType, fID)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.syncDBPath(); err != nil {
+		return nil, err
+	}
+	if err = db.logManifestEdit(manifestRotate, dataType, []uint32{fID}, nil); err != nil {
+		_ = lf.Delete()
+		return nil, err
+	}
+
+	// 老活跃文件视为immutableFiles，转移下内存中的映射关系
+	activeFile := db.activeFiles[dataType]
+	if db.immutableFiles[dataType] == nil {
+		db.immutableFiles[dataType] = make(immutableFiles)
+	}
+	db.immutableFiles[dataType][activeFile.FileID] = activeFile
+	// 活跃文件映射替换为新文件
+	db.activeFiles[dataType] = lf
+	// 老活跃文件转为只读，读的时候再按需打开
+	if err = activeFile.SetReadOnly(db.fileCache); err != nil {
+		logger.Errorf("set log file read-only err, dataType: [%v], fid: [%v], err: [%v]", dataType, activeFile.FileID, err)
+	}
+	// 老活跃文件不会再写了，后台生成它的hint文件，协程结束时释放读锁和文件的引用
+	if db.hintFileEnabled(dataType, activeFile) {
+		db.hintLock.RLock()
+		activeFile.Ref()
+		go db.writeHintFile(dataType, activeFile)
+	}
+	return lf, nil
+}
+
+// 活跃文件的密钥和当前设置的不一样时（轮换了密钥，或者新开启了加密），转成非活跃文件
+func (db *SDB) rotateStaleActiveFiles() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for dataType, activeFile := range db.activeFiles {
+		if activeFile.Header.KeyID == db.keyring.CurrentKeyID() {
+			continue
+		}
+		if _, err := db.rotateActiveFile(dataType, activeFile.FileID+1); err != nil {
+			return err
+		}
+	}
+	for dataType, bf := range db.blobFiles {
+		if bf.activeFile == nil || bf.activeFile.Header.KeyID == db.keyring.CurrentKeyID() {
+			continue
+		}
+		if _, err := db.rotateBlobFileLocked(dataType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 获取非活跃文件并增加引用计数，用完之后调用方Release
 func (db *SDB) getImmutableFile(dataType DataType, fid uint32) (lf *bitcask.LogFile) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 	if db.immutableFiles[dataType] != nil {
 		lf = db.immutableFiles[dataType][fid]
 	}
+	if lf != nil {
+		lf.Ref()
+	}
+	return
+}
+
+// 获取fid对应的活跃或者非活跃文件并增加引用计数，用完之后调用方Release，
+// 引用期间文件被merge删除的话，等引用释放之后才真正删除
+func (db *SDB) refLogFile(dataType DataType, fid uint32) (lf *bitcask.LogFile) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if lf = db.activeFiles[dataType]; lf == nil || lf.FileID != fid {
+		lf = db.immutableFiles[dataType][fid]
+	}
+	if lf != nil {
+		lf.Ref()
+	}
 	return
 }
+
+// zset的索引需要record的value（score），hint文件中没有value，
+// 而zset日志文件中的value只是score，本身就和hint文件差不多大，所以zset不生成hint文件
+// 加密的日志文件也不生成，否则key会明文落盘
+// 内存模式的索引里要存value，启动时总是要读日志文件，hint文件用不上
+func (db *SDB) hintFileEnabled(dataType DataType, lf *bitcask.LogFile) bool {
+	return db.opts.StoreMode != options.MemoryMode && dataType != ZSet && lf.Header.KeyID == 0
+}
+
+// 把一条record转换为hint记录
+func newHintRecord(record *bitcask.LogRecord, offset, recordSize int64) *bitcask.HintRecord {
+	hint := &bitcask.HintRecord{
+		Key:       record.Key,
+		Type:      record.Type,
+		ExpiredAt: record.ExpiredAt,
+		Offset:    offset,
+		Size:      recordSize,
+	}
+	if record.Type&bitcask.TypeBlob != 0 {
+		hint.Blob, _, _ = bitcask.DecodeBlobPointer(record.Value)
+	}
+	return hint
+}
+
+// 遍历非活跃文件，生成它的hint文件，调用方已经增加了文件的引用
+func (db *SDB) writeHintFile(dataType DataType, lf *bitcask.LogFile) {
+	defer db.hintLock.RUnlock()
+	defer lf.Release()
+
+	offset := lf.DataOffset
+	var hints []*bitcask.HintRecord
+	for {
+		record, recordSize, err := lf.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF || err == bitcask.ErrEndOfRecord {
+				break
+			}
+			logger.Errorf("read log file err when write hint file, dataType: [%v], fid: [%v], err: [%v]", dataType, lf.FileID, err)
+			return
+		}
+		hints = append(hints, newHintRecord(record, offset, recordSize))
+		offset += recordSize
+	}
+	if err := bitcask.WriteHintFile(db.opts.DBPath, lf.FileID, bitcask.FileType(dataType), hints); err != nil {
+		logger.Errorf("write hint file err, dataType: [%v], fid: [%v], err: [%v]", dataType, lf.FileID, err)
+	}
+}
+
+// 等待所有后台生成hint文件的协程结束
+func (db *SDB) waitHintFiles() {
+	db.hintLock.Lock()
+	db.hintLock.Unlock()
+}
@@ -0,0 +1,281 @@
+package sdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"sdb/bitcask"
+	"sdb/logger"
+)
+
+// MANIFEST：记录每种数据类型当前有效的日志文件，OpenDB以它为准，不再根据目录中的文件名推断
+// 只追加写，每条编辑复用LogRecord的编码格式，type字段表示编辑种类：
+// +---------+--------+--------+-----+
+// | version | edit 1 | edit 2 | ... |
+// +---------+--------+--------+-----+
+// version: value是版本号
+// edit:    key是data_type，value是 新增文件个数 | 新增文件id... | 删除文件个数 | 删除文件id...
+// 编辑种类：
+// snapshot: 启动时把有效文件集合重写成一个新的MANIFEST，每种数据类型一条，防止无限增长
+// create:   第一个活跃文件
+// rotate:   活跃文件写满，新的活跃文件
+// merge:    merge提交，输出文件加入，被merge的文件删除
+// 日志文件先创建再写编辑，崩溃时尾部写了一半的编辑直接丢弃，对应的文件当作游离文件
+// 目录中不在有效集合里的日志文件连同它的hint文件移动到quarantine目录，不加载
+
+const (
+	manifestFileName    = "MANIFEST"
+	manifestTmpSuffix   = ".tmp"
+	quarantineDirName   = "quarantine"
+	manifestVersion     = 1
+	manifestVersionSize = 1
+)
+
+const (
+	manifestHeader bitcask.RecordType = iota
+	manifestSnapshot
+	manifestCreate
+	manifestRotate
+	manifestMerge
+)
+
+var (
+	// ErrInvalidManifest MANIFEST文件损坏
+	ErrInvalidManifest = errors.New("invalid manifest")
+
+	// ErrUnsupportedManifestVersion MANIFEST版本比当前程序新
+	ErrUnsupportedManifestVersion = errors.New("unsupported manifest version")
+
+	// ErrMissingLogFile MANIFEST中记录的日志文件不存在
+	ErrMissingLogFile = errors.New("log file in manifest is missing")
+)
+
+type manifest struct {
+	mu   sync.Mutex
+	file *os.File                         // 追加写的MANIFEST文件
+	live map[DataType]map[uint32]struct{} // 每种数据类型有效的文件id，为nil说明还没有MANIFEST
+}
+
+func (db *SDB) manifestName() string {
+	return filepath.Join(db.opts.DBPath, manifestFileName)
+}
+
+// loadManifest 重放MANIFEST中的编辑，得到每种数据类型有效的文件集合，文件不存在时live为nil
+func (db *SDB) loadManifest() error {
+	db.manifest = &manifest{}
+	buf, err := os.ReadFile(db.manifestName())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	header, offset, err := bitcask.DecodeRecord(buf)
+	if err != nil || header.Type != manifestHeader || len(header.Value) != manifestVersionSize {
+		return ErrInvalidManifest
+	}
+	if header.Value[0] > manifestVersion {
+		return ErrUnsupportedManifestVersion
+	}
+
+	db.manifest.live = make(map[DataType]map[uint32]struct{})
+	for offset < int64(len(buf)) {
+		lr, size, err := bitcask.DecodeRecord(buf[offset:])
+		if err != nil {
+			// 尾部写了一半的编辑，对应的操作还没生效，丢弃
+			logger.Warnf("discard torn manifest edit at offset [%v], err: [%v]", offset, err)
+			break
+		}
+		if lr.Type < manifestSnapshot || lr.Type > manifestMerge || len(lr.Key) != 1 || lr.Key[0] >= logFileTypeNum {
+			return ErrInvalidManifest
+		}
+		fIDs, ok := decodeFileIDs(lr.Value, 2)
+		if !ok {
+			return ErrInvalidManifest
+		}
+		db.manifest.apply(DataType(lr.Key[0]), fIDs[0], fIDs[1])
+		offset += size
+	}
+	return nil
+}
+
+// openManifest 没有MANIFEST时（老版本的数据目录）根据目录中的文件名生成有效集合，
+// 然后把有效集合重写成新的MANIFEST，打开它用于追加写，最后隔离不在集合中的日志文件
+func (db *SDB) openManifest() error {
+	if db.manifest.live == nil {
+		live, err := db.scanLogFiles()
+		if err != nil {
+			return err
+		}
+		db.manifest.live = live
+	}
+
+	buf, _ := bitcask.EncodeRecord(&bitcask.LogRecord{Type: manifestHeader, Value: []byte{manifestVersion}})
+	for dataType := String; dataType < logFileTypeNum; dataType++ {
+		editBuf, _ := bitcask.EncodeRecord(&bitcask.LogRecord{
+			Key:   []byte{byte(dataType)},
+			Value: encodeFileIDs(db.liveFileIDs(dataType), nil),
+			Type:  manifestSnapshot,
+		})
+		buf = append(buf, editBuf...)
+	}
+
+	name := db.manifestName()
+	tmpName := name + manifestTmpSuffix
+	if err := os.WriteFile(tmpName, buf, 0644); err != nil {
+		return err
+	}
+	tmpFile, err := os.Open(tmpName)
+	if err != nil {
+		return err
+	}
+	err = tmpFile.Sync()
+	_ = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmpName, name); err != nil {
+		return err
+	}
+	if err = db.syncDBPath(); err != nil {
+		return err
+	}
+
+	if db.manifest.file, err = os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return err
+	}
+	return db.quarantineStrayFiles()
+}
+
+// 根据目录中的文件名生成有效集合，只在升级老版本数据目录时使用
+func (db *SDB) scanLogFiles() (map[DataType]map[uint32]struct{}, error) {
+	dirEntries, err := os.ReadDir(db.opts.DBPath)
+	if err != nil {
+		return nil, err
+	}
+	live := make(map[DataType]map[uint32]struct{})
+	for _, file := range dirEntries {
+		fType, fID, err := bitcask.ParseLogFileName(file.Name())
+		if err != nil {
+			continue
+		}
+		dataType := DataType(fType)
+		if live[dataType] == nil {
+			live[dataType] = make(map[uint32]struct{})
+		}
+		live[dataType][fID] = struct{}{}
+	}
+	return live, nil
+}
+
+// 不在有效集合中的日志文件，说明是崩溃时写了一半或者是外来的文件，连同hint文件移动到quarantine目录
+// 有效集合中的文件不存在的话，数据已经丢失，不能继续打开
+func (db *SDB) quarantineStrayFiles() error {
+	dirEntries, err := os.ReadDir(db.opts.DBPath)
+	if err != nil {
+		return err
+	}
+	existed := make(map[DataType]map[uint32]struct{})
+	quarantinePath := filepath.Join(db.opts.DBPath, quarantineDirName)
+	for _, file := range dirEntries {
+		if file.IsDir() || !strings.HasPrefix(file.Name(), bitcask.FilePrefix) {
+			continue
+		}
+		fType, fID, err := bitcask.ParseLogFileName(file.Name())
+		if err == nil {
+			if _, ok := db.manifest.live[DataType(fType)][fID]; ok {
+				if existed[DataType(fType)] == nil {
+					existed[DataType(fType)] = make(map[uint32]struct{})
+				}
+				existed[DataType(fType)][fID] = struct{}{}
+				continue
+			}
+		}
+
+		logger.Warnf("stray log file [%v] is not in manifest, move it to [%v]", file.Name(), quarantinePath)
+		if err = os.MkdirAll(quarantinePath, os.ModePerm); err != nil {
+			return err
+		}
+		if err = os.Rename(filepath.Join(db.opts.DBPath, file.Name()), filepath.Join(quarantinePath, file.Name())); err != nil {
+			return err
+		}
+		if hintName, err := bitcask.HintFileName(db.opts.DBPath, fID, fType); err == nil {
+			if err = os.Rename(hintName, filepath.Join(quarantinePath, filepath.Base(hintName))); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	for dataType, fIDs := range db.manifest.live {
+		for fID := range fIDs {
+			if _, ok := existed[dataType][fID]; !ok {
+				logger.Errorf("log file in manifest is missing, dataType: [%v], fid: [%v]", dataType, fID)
+				return ErrMissingLogFile
+			}
+		}
+	}
+	return db.syncDBPath()
+}
+
+// logManifestEdit 追加一条编辑并刷盘，然后更新内存中的有效集合
+func (db *SDB) logManifestEdit(editType bitcask.RecordType, dataType DataType, added, deleted []uint32) error {
+	db.manifest.mu.Lock()
+	defer db.manifest.mu.Unlock()
+
+	buf, _ := bitcask.EncodeRecord(&bitcask.LogRecord{
+		Key:   []byte{byte(dataType)},
+		Value: encodeFileIDs(added, deleted),
+		Type:  editType,
+	})
+	if _, err := db.manifest.file.Write(buf); err != nil {
+		return err
+	}
+	if err := db.manifest.file.Sync(); err != nil {
+		return err
+	}
+	db.manifest.apply(dataType, added, deleted)
+	return nil
+}
+
+// 有效的文件id，从小到大排序
+func (db *SDB) liveFileIDs(dataType DataType) []uint32 {
+	db.manifest.mu.Lock()
+	defer db.manifest.mu.Unlock()
+
+	fIDs := make([]uint32, 0, len(db.manifest.live[dataType]))
+	for fID := range db.manifest.live[dataType] {
+		fIDs = append(fIDs, fID)
+	}
+	sort.Slice(fIDs, func(i, j int) bool {
+		return fIDs[i] < fIDs[j]
+	})
+	return fIDs
+}
+
+func (db *SDB) closeManifest() error {
+	if db.manifest == nil || db.manifest.file == nil {
+		return nil
+	}
+	return db.manifest.file.Close()
+}
+
+// 应用一条编辑，重复应用结果不变；还没有MANIFEST时不记录
+func (m *manifest) apply(dataType DataType, added, deleted []uint32) {
+	if m.live == nil {
+		return
+	}
+	if m.live[dataType] == nil {
+		m.live[dataType] = make(map[uint32]struct{})
+	}
+	for _, fID := range added {
+		m.live[dataType][fID] = struct{}{}
+	}
+	for _, fID := range deleted {
+		delete(m.live[dataType], fID)
+	}
+}
@@ -0,0 +1,91 @@
+package sdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"sdb/bitcask"
+)
+
+func TestSDB_Manifest(t *testing.T) {
+	db, opts := openMergeTestDB(t, "test/manifest")
+	defer func() {
+		_ = os.RemoveAll(opts.DBPath)
+	}()
+
+	writeCount := 300
+	for i := 0; i < writeCount; i++ {
+		assert.Nil(t, db.Set(getTestKey(i), getTestValue(i)))
+	}
+	strFIDs := db.liveFileIDs(String)
+	assert.Greater(t, len(strFIDs), 1)
+	assertValues := func(db *SDB) {
+		for i := 0; i < writeCount; i++ {
+			val, err := db.Get(getTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, getTestValue(i), val)
+		}
+	}
+
+	t.Run("stray file", func(t *testing.T) {
+		assert.Nil(t, db.CloseDB())
+		// 不在MANIFEST中的日志文件，即使文件名合法也不能加载
+		stray, err := bitcask.OpenLogFile(opts.DBPath, 999, opts.LogFileSizeThreshold, bitcask.Str, bitcask.FileIO)
+		assert.Nil(t, err)
+		buf, _ := bitcask.EncodeRecord(&bitcask.LogRecord{Key: getTestKey(0), Value: []byte("stray")})
+		assert.Nil(t, stray.Write(buf))
+		assert.Nil(t, stray.Close())
+		db.removeIndexSnapshot()
+
+		db, err = OpenDB(opts)
+		assert.Nil(t, err)
+		assertValues(db)
+		assert.Equal(t, strFIDs, db.liveFileIDs(String))
+		name, _ := bitcask.LogFileName(opts.DBPath, 999, bitcask.Str)
+		_, err = os.Stat(name)
+		assert.True(t, os.IsNotExist(err))
+		_, err = os.Stat(filepath.Join(opts.DBPath, quarantineDirName, filepath.Base(name)))
+		assert.Nil(t, err)
+	})
+
+	t.Run("torn edit", func(t *testing.T) {
+		assert.Nil(t, db.CloseDB())
+		file, err := os.OpenFile(filepath.Join(opts.DBPath, manifestFileName), os.O_WRONLY|os.O_APPEND, 0644)
+		assert.Nil(t, err)
+		buf, _ := bitcask.EncodeRecord(&bitcask.LogRecord{Key: []byte{byte(String)}, Value: encodeFileIDs([]uint32{1000}, nil), Type: manifestRotate})
+		_, err = file.Write(buf[:len(buf)-1])
+		assert.Nil(t, err)
+		assert.Nil(t, file.Close())
+
+		db, err = OpenDB(opts)
+		assert.Nil(t, err)
+		assertValues(db)
+		assert.Equal(t, strFIDs, db.liveFileIDs(String))
+	})
+
+	t.Run("upgrade", func(t *testing.T) {
+		// 老版本的数据目录没有MANIFEST，根据文件名生成
+		assert.Nil(t, db.CloseDB())
+		assert.Nil(t, os.Remove(filepath.Join(opts.DBPath, manifestFileName)))
+		db.removeIndexSnapshot()
+
+		var err error
+		db, err = OpenDB(opts)
+		assert.Nil(t, err)
+		assertValues(db)
+		assert.Equal(t, strFIDs, db.liveFileIDs(String))
+		_, err = os.Stat(filepath.Join(opts.DBPath, manifestFileName))
+		assert.Nil(t, err)
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		assert.Nil(t, db.CloseDB())
+		name, _ := bitcask.LogFileName(opts.DBPath, strFIDs[0], bitcask.Str)
+		assert.Nil(t, os.Remove(name))
+
+		_, err := OpenDB(opts)
+		assert.Equal(t, ErrMissingLogFile, err)
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"sdb/bitcask"
 	"sdb/logger"
 	"sdb/utils"
+	"sort"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -20,6 +21,22 @@ func (db *SDB) MergeSpecificLogFile(dataType DataType, fID int, ratio float64) e
 	return db.merge(dataType, fID, ratio)
 }
 
+// Recompress 按当前的压缩设置重写dataType所有的非活跃文件，修改Compression之后调用，
+// 重写走merge的流程，不管文件中无效数据的比例
+func (db *SDB) Recompress(dataType DataType) error {
+	return db.rewriteLogFiles(dataType, func(lf *bitcask.LogFile) bool {
+		return true
+	})
+}
+
+// Reencrypt 用当前的密钥重写dataType中用老密钥加密或者没有加密的非活跃文件，轮换密钥之后调用，
+// 重写完老密钥就可以不用了
+func (db *SDB) Reencrypt(dataType DataType) error {
+	return db.rewriteLogFiles(dataType, func(lf *bitcask.LogFile) bool {
+		return lf.Header.KeyID != db.keyring.CurrentKeyID()
+	})
+}
+
 //定期进行merge
 func (db *SDB) regularLogFileMerge() {
 	if db.opts.LogFileMergeInterval <= 0 {
@@ -47,6 +64,9 @@ func (db *SDB) regularLogFileMerge() {
 					if err != nil {
 						logger.Errorf("log file gc err, dataType: [%v], err: [%v]", dataType, err)
 					}
+					if err = db.mergeBlob(dataType, db.opts.LogFileMergeRatio); err != nil {
+						logger.Errorf("blob file gc err, dataType: [%v], err: [%v]", dataType, err)
+					}
 				}(dt)
 			}
 		case <-quitSignal:
@@ -59,72 +79,309 @@ func (db *SDB) merge(dataType DataType, specifiedFid int, ratio float64) error {
 	atomic.AddInt32(&db.mergeState, 1)
 	defer atomic.AddInt32(&db.mergeState, -1)
 
+	// 等待后台hint文件生成完，防止merge删除正在生成hint的文件
+	db.waitHintFiles()
+
 	//获取活跃文件
 	activeLogFile := db.getActiveLogFile(dataType)
 	if activeLogFile == nil {
 		return nil
 	}
+	// count file是异步更新的，先等已经发出的更新都写进去，手动merge才能看到刚产生的无效数据
+	db.countFiles[dataType].Flush()
 	if err := db.countFiles[dataType].Sync(); err != nil {
 		return err
 	}
 	//获取可压缩文件id列表
-
 	mcl, err := db.countFiles[dataType].GetMCL(activeLogFile.FileID, ratio)
 	if err != nil {
 		return err
 	}
+	//如果指定文件
+	if specifiedFid >= 0 {
+		var specified []uint32
+		for _, fID := range mcl {
+			if uint32(specifiedFid) == fID {
+				specified = append(specified, fID)
+			}
+		}
+		mcl = specified
+	}
+	return db.mergeFiles(dataType, mcl)
+}
 
-	for _, fID := range mcl {
-		//如果指定文件
-		if specifiedFid >= 0 && uint32(specifiedFid) != fID {
-			continue
+// 不管无效数据的比例，把满足条件的非活跃文件都merge一遍，用于按新的设置重写老文件
+func (db *SDB) rewriteLogFiles(dataType DataType, filter func(lf *bitcask.LogFile) bool) error {
+	if atomic.LoadInt32(&db.mergeState) > 0 {
+		return ErrMergeRunning
+	}
+	atomic.AddInt32(&db.mergeState, 1)
+	defer atomic.AddInt32(&db.mergeState, -1)
+
+	db.waitHintFiles()
+	var fIDs, blobFIDs []uint32
+	db.mu.RLock()
+	for fID, lf := range db.immutableFiles[dataType] {
+		if filter(lf) {
+			fIDs = append(fIDs, fID)
 		}
+	}
+	if bf := db.blobFiles[dataType]; bf != nil {
+		for fID, lf := range bf.immutableFiles {
+			if filter(lf) {
+				blobFIDs = append(blobFIDs, fID)
+			}
+		}
+	}
+	db.mu.RUnlock()
+	if err := db.mergeFiles(dataType, fIDs); err != nil {
+		return err
+	}
+	return db.mergeBlobFiles(dataType, blobFIDs)
+}
+
+// 把fIDs中的有效record重写到新的输出文件中，然后提交merge，删除这些文件
+func (db *SDB) mergeFiles(dataType DataType, fIDs []uint32) (err error) {
+	sort.Slice(fIDs, func(i, j int) bool {
+		return fIDs[i] < fIDs[j]
+	})
+
+	if atomic.LoadInt32(&db.mergeFailed[dataType]) != 0 {
+		return ErrMergeFailed
+	}
+	job := &mergeJob{dataType: dataType, marker: &mergeMarker{state: mergeRunning}}
+	// 被merge的文件在merge期间一直被引用，提交时删除文件的同时释放，没提交的在这里释放
+	defer func() {
+		for _, immutableFile := range job.inputs {
+			_ = immutableFile.Release()
+		}
+		// 已经有输出文件（写了标记文件）的merge失败了，保留标记文件，下次启动时处理，在这之前不再merge
+		if err != nil && len(job.marker.outputs) > 0 {
+			atomic.StoreInt32(&db.mergeFailed[dataType], 1)
+			logger.Errorf("merge failed, dataType: [%v], reopen the db to recover it, err: [%v]", dataType, err)
+		}
+	}()
+	for _, fID := range fIDs {
 		//不会压缩活跃文件，活跃文件装不下会转移为非活跃，找到这个非活跃文件
 		immutableFile := db.getImmutableFile(dataType, fID)
 		if immutableFile == nil {
 			continue
 		}
+		job.marker.inputs = append(job.marker.inputs, fID)
+		job.inputs = append(job.inputs, immutableFile)
+	}
+	if len(job.inputs) == 0 {
+		return nil
+	}
 
-		//遍历要merge的file
-		var offset int64
-		for record, size, err := immutableFile.ReadLogRecord(offset); ; offset += size {
-			if err != nil {
-				if err == io.EOF || err == bitcask.ErrEndOfRecord {
-					break //读完正常退出
-				}
-				return err
-			}
+	//有效的record重写到输出文件中，出错的话标记文件还是running状态，下次启动时回滚，被merge的文件都还在
+	for _, immutableFile := range job.inputs {
+		if err = db.mergeLogFile(job, immutableFile); err != nil {
+			return err
+		}
+	}
+	return db.commitMerge(job)
+}
 
-			//删除记录的记录/过期记录跳过，不需要重写
-			if record.Type == bitcask.TypeDelete || (record.ExpiredAt != 0 && record.ExpiredAt <= time.Now().Unix()) {
-				continue
-			}
-			var rewriteErr error
-			switch dataType {
-			case String:
-				rewriteErr = db.rewriteStr(immutableFile.FileID, offset, int(size), record)
-			case List:
-				rewriteErr = db.rewriteList(immutableFile.FileID, offset, int(size), record)
-			case Hash:
-				rewriteErr = db.rewriteHash(immutableFile.FileID, offset, int(size), record)
-			}
-			if rewriteErr != nil {
-				return rewriteErr
+// mergeJob 一次merge的状态，被merge的文件中有效的record重写到专门的输出文件中，不和前台写活跃文件抢
+type mergeJob struct {
+	dataType DataType
+	marker   *mergeMarker
+	output   *bitcask.LogFile   // 当前写的输出文件
+	inputs   []*bitcask.LogFile // 被merge的文件，merge期间持有它们的引用
+	nextFID  uint32             // 预留给输出文件的id区间[nextFID, endFID)，用完了再预留
+	endFID   uint32
+}
+
+// 遍历被merge的文件，把有效的record重写到输出文件
+func (db *SDB) mergeLogFile(job *mergeJob, immutableFile *bitcask.LogFile) error {
+	fID := immutableFile.FileID
+	//还有更老的文件时，老文件中可能有被删除的key的旧记录，删除记录不能丢，否则重启后key会复活
+	keepTombstone := db.hasOlderLogFile(job.dataType, fID, job.marker.inputs)
+
+	offset := immutableFile.DataOffset
+	for {
+		record, size, err := immutableFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF || err == bitcask.ErrEndOfRecord {
+				return nil //读完正常退出
 			}
+			return err
+		}
+		recordOffset := offset
+		offset += size
+
+		//过期记录跳过，不需要重写；还有更老的文件时和删除记录一样，要留下删除记录
+		if record.ExpiredAt != 0 && record.ExpiredAt <= time.Now().Unix() && !keepTombstone {
+			continue
+		}
+		//没有更老的文件，删除记录已经没用了，跳过
+		if record.Type == bitcask.TypeDelete && !keepTombstone {
+			continue
+		}
+		//解码不了的key启动时就跳过了，不在索引中
+		if !validRecordKey(job.dataType, record) {
+			continue
+		}
+		var rewriteErr error
+		switch job.dataType {
+		case String:
+			rewriteErr = db.rewriteStr(job, fID, recordOffset, int(size), record)
+		case List:
+			rewriteErr = db.rewriteList(job, fID, recordOffset, int(size), record)
+		case Hash:
+			rewriteErr = db.rewriteHash(job, fID, recordOffset, int(size), record)
+		case Set:
+			rewriteErr = db.rewriteSet(job, fID, recordOffset, int(size), record)
+		case ZSet:
+			rewriteErr = db.rewriteZSet(job, fID, recordOffset, int(size), record)
+		}
+		if rewriteErr != nil {
+			return rewriteErr
+		}
+	}
+}
+
+// 提交merge：输出文件刷盘后把标记文件改为committed，之后再删除被merge的文件，
+// 删除过程中崩溃的话，下次启动时根据标记文件继续删除
+func (db *SDB) commitMerge(job *mergeJob) error {
+	dataType := job.dataType
+	if job.output != nil {
+		if err := trimLogFile(db.countFiles[job.dataType], job.output); err != nil {
+			return err
 		}
+		if err := job.output.SetReadOnly(db.fileCache); err != nil {
+			return err
+		}
+	}
+	job.marker.state = mergeCommitted
+	if err := db.writeMergeMarker(dataType, job.marker); err != nil {
+		return err
+	}
+	// 输出文件加入、被merge的文件删除记到MANIFEST，这里崩溃的话启动时根据标记文件补上
+	if err := db.logManifestEdit(manifestMerge, dataType, job.marker.outputs, job.marker.inputs); err != nil {
+		return err
+	}
 
-		// 原来的fID中的数据已经全部重写到新文件中，活跃，如果满了再迁移
-		db.mu.Lock()
-		delete(db.immutableFiles[dataType], fID)
+	// 释放merge持有的引用，没有其他协程在读的文件马上删除，有的话等它们读完再删除
+	db.mu.Lock()
+	for _, immutableFile := range job.inputs {
+		delete(db.immutableFiles[dataType], immutableFile.FileID)
 		_ = immutableFile.Delete()
-		db.mu.Unlock()
+		_ = immutableFile.Release()
+	}
+	job.inputs = nil
+	db.mu.Unlock()
+	// 索引快照引用了被删除的文件，作废
+	db.removeIndexSnapshot()
+	// 被merge的文件的更新都处理完再清除统计，否则晚到的更新会给已经删除的文件留下统计
+	db.countFiles[dataType].Flush()
+	for _, fID := range job.marker.inputs {
+		// hint文件也一起删除
+		if err := bitcask.RemoveHintFile(db.opts.DBPath, fID, bitcask.FileType(dataType)); err != nil {
+			logger.Errorf("remove hint file err, dataType: [%v], fid: [%v], err: [%v]", dataType, fID, err)
+		}
 		// 把合并后的file_id从count_file清除了
 		db.countFiles[dataType].Clear(fID)
 	}
+	// 输出文件不会再写了，后台生成它们的hint文件
+	for _, fID := range job.marker.outputs {
+		output := db.getImmutableFile(dataType, fID)
+		if output == nil {
+			continue
+		}
+		if !db.hintFileEnabled(dataType, output) {
+			_ = output.Release()
+			continue
+		}
+		db.hintLock.RLock()
+		go db.writeHintFile(dataType, output)
+	}
+	// 删除持久化之后才能删除标记文件
+	if err := db.syncDBPath(); err != nil {
+		return err
+	}
+	return db.removeMergeMarker(dataType)
+}
+
+// 把record写到merge输出文件，写满了新建一个，调用方需要持有对应数据类型的索引锁
+func (db *SDB) writeMergeRecord(job *mergeJob, lr *bitcask.LogRecord) (*keyDir, error) {
+	if job.output == nil {
+		if err := db.newMergeOutput(job); err != nil {
+			return nil, err
+		}
+	}
+	// 读出来的record已经解压，按当前的设置重新压缩
+	lr = db.compressRecord(lr)
+	lrBuf, recordSize := job.output.EncodeRecord(lr)
+	if job.output.WriteOffSet+int64(recordSize) > job.output.Capacity {
+		if err := db.newMergeOutput(job); err != nil {
+			return nil, err
+		}
+		lrBuf, recordSize = job.output.EncodeRecord(lr)
+	}
+
+	writeAt := atomic.LoadInt64(&job.output.WriteOffSet)
+	if err := job.output.Write(lrBuf); err != nil {
+		return nil, err
+	}
+	return &keyDir{
+		fileID:       job.output.FileID,
+		recordSize:   recordSize,
+		recordOffset: writeAt,
+		expiredAt:    lr.ExpiredAt,
+	}, nil
+}
+
+// 新建merge输出文件，id从预留的区间里取；第一次新建时预留活跃文件之后的一段id，每个被merge的文件一个，
+// 活跃文件移到这段id之后，这样输出文件排在merge开始后前台写入的数据之前，启动重放日志时旧数据不会覆盖新数据；
+// 输出文件一般不会比被merge的文件多，只有换了压缩设置之类的情况才会用完，用完了再预留一段
+func (db *SDB) newMergeOutput(job *mergeJob) error {
+	// 写满的输出文件截掉没用到的空间，刷盘后转为只读
+	if job.output != nil {
+		if err := trimLogFile(db.countFiles[job.dataType], job.output); err != nil {
+			return err
+		}
+		if err := job.output.SetReadOnly(db.fileCache); err != nil {
+			return err
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if job.nextFID == job.endFID {
+		activeFile := db.activeFiles[job.dataType]
+		if err := activeFile.Sync(); err != nil {
+			return err
+		}
+		n := uint32(len(job.marker.inputs))
+		if n == 0 {
+			n = 1
+		}
+		fID := activeFile.FileID + 1
+		if _, err := db.rotateActiveFile(job.dataType, fID+n); err != nil {
+			return err
+		}
+		job.nextFID, job.endFID = fID, fID+n
+	}
+	fID := job.nextFID
+	// 先把输出文件id记到标记文件中，再新建文件，崩溃后启动时才能找到它回滚
+	job.marker.outputs = append(job.marker.outputs, fID)
+	if err := db.writeMergeMarker(job.dataType, job.marker); err != nil {
+		return err
+	}
+	output, err := db.openLogFile(job.dataType, fID)
+	if err != nil {
+		return err
+	}
+	job.nextFID++
+	db.immutableFiles[job.dataType][fID] = output
+	job.output = output
 	return nil
 }
 
-func (db *SDB) rewriteStr(fID uint32, offset int64, recordSize int, record *bitcask.LogRecord) error {
+func (db *SDB) rewriteStr(job *mergeJob, fID uint32, offset int64, recordSize int, record *bitcask.LogRecord) error {
 	//加锁，会阻碍string索引的主协程操作的，比如get，set
 	db.strIndex.mu.Lock()
 	defer db.strIndex.mu.Unlock()
@@ -132,14 +389,19 @@ func (db *SDB) rewriteStr(fID uint32, offset int64, recordSize int, record *bitc
 	//索引树中的keyDir都是最新的，包括fID，offset，size，以这个为准
 	//对于被删除的记录，因为删除操作时索引已经删除了，此时kd为nil，直接返回，不会重写
 	keDir := db.strIndex.idxTree.Get(record.Key)
+	if record.Type == bitcask.TypeDelete {
+		return db.rewriteTombstone(job, keDir == nil, record)
+	}
+	//过期的record相当于删除记录，只有string能设置过期时间
+	if record.ExpiredAt != 0 && record.ExpiredAt <= time.Now().Unix() {
+		return db.rewriteExpired(job, keDir, fID, offset, record)
+	}
 	if keDir == nil {
 		return nil
 	}
-	//索引树中的keyDir都是最新的，包括fID，offset，size，以这个为准
-	//对于被删除的记录，因为删除操作时索引已经删除了，此时kd为nil，直接返回，不会重写
-	return db.rewrite(keDir, String, fID, offset, recordSize, record)
+	return db.rewrite(job, keDir, fID, offset, recordSize, record, record.Key)
 }
-func (db *SDB) rewriteList(fID uint32, offset int64, recordSize int, record *bitcask.LogRecord) error {
+func (db *SDB) rewriteList(job *mergeJob, fID uint32, offset int64, recordSize int, record *bitcask.LogRecord) error {
 	db.listIndex.mu.Lock()
 	defer db.listIndex.mu.Unlock()
 
@@ -147,51 +409,152 @@ func (db *SDB) rewriteList(fID uint32, offset int64, recordSize int, record *bit
 	if record.Type != bitcask.TypeListSeq {
 		treeKey, _ = utils.DecodeListKey(record.Key)
 	}
-	if db.listIndex.trees[string(treeKey)] == nil {
-		return nil
+	var keyDir interface{}
+	if db.listIndex.trees[string(treeKey)] != nil {
+		db.listIndex.idxTree = db.listIndex.trees[string(treeKey)]
+		keyDir = db.listIndex.idxTree.Get(record.Key)
+	}
+	if record.Type == bitcask.TypeDelete {
+		return db.rewriteTombstone(job, keyDir == nil, record)
 	}
-	db.listIndex.idxTree = db.listIndex.trees[string(treeKey)]
-
-	keyDir := db.listIndex.idxTree.Get(record.Key)
 	if keyDir == nil {
 		return nil
 	}
-	return db.rewrite(keyDir, List, fID, offset, recordSize, record)
+	return db.rewrite(job, keyDir, fID, offset, recordSize, record, record.Key)
 }
-func (db *SDB) rewriteHash(fID uint32, offset int64, recordSize int, record *bitcask.LogRecord) error {
-	db.listIndex.mu.Lock()
-	defer db.listIndex.mu.Unlock()
+func (db *SDB) rewriteHash(job *mergeJob, fID uint32, offset int64, recordSize int, record *bitcask.LogRecord) error {
+	db.hashIndex.mu.Lock()
+	defer db.hashIndex.mu.Unlock()
 
 	treeKey, field := utils.DecodeHashKey(record.Key)
 
 	//获取属于的ar树
-	if db.listIndex.trees[string(treeKey)] == nil {
+	var kd interface{}
+	if db.hashIndex.trees[string(treeKey)] != nil {
+		db.hashIndex.idxTree = db.hashIndex.trees[string(treeKey)]
+		kd = db.hashIndex.idxTree.Get(field)
+	}
+	if record.Type == bitcask.TypeDelete {
+		return db.rewriteTombstone(job, kd == nil, record)
+	}
+	if kd == nil {
 		return nil
 	}
-	db.listIndex.idxTree = db.listIndex.trees[string(treeKey)]
 
-	kd := db.listIndex.idxTree.Get(field)
+	return db.rewrite(job, kd, fID, offset, recordSize, record, field)
+}
+func (db *SDB) rewriteSet(job *mergeJob, fID uint32, offset int64, recordSize int, record *bitcask.LogRecord) error {
+	db.setIndex.mu.Lock()
+	defer db.setIndex.mu.Unlock()
+
+	treeKey, sum := utils.DecodeSetKey(record.Key)
+
+	//获取属于的ar树，ar树中是成员的hash值
+	var kd interface{}
+	if db.setIndex.trees[string(treeKey)] != nil {
+		db.setIndex.idxTree = db.setIndex.trees[string(treeKey)]
+		kd = db.setIndex.idxTree.Get(sum)
+	}
+	if record.Type == bitcask.TypeDelete {
+		return db.rewriteTombstone(job, kd == nil, record)
+	}
+	if kd == nil {
+		return nil
+	}
+
+	return db.rewrite(job, kd, fID, offset, recordSize, record, sum)
+}
+func (db *SDB) rewriteZSet(job *mergeJob, fID uint32, offset int64, recordSize int, record *bitcask.LogRecord) error {
+	db.zsetIndex.mu.Lock()
+	defer db.zsetIndex.mu.Unlock()
+
+	treeKey, member := utils.DecodeZSetKey(record.Key)
+
+	//跳表中已经没有这个成员，说明被删除了
+	ok, _ := db.zsetIndex.indexes.ZScore(string(treeKey), string(member))
+	if record.Type == bitcask.TypeDelete {
+		return db.rewriteTombstone(job, !ok, record)
+	}
+	if !ok {
+		return nil
+	}
+	if db.zsetIndex.trees[string(treeKey)] == nil {
+		return nil
+	}
+	db.zsetIndex.idxTree = db.zsetIndex.trees[string(treeKey)]
+
+	sum, err := db.zsetMemberSum(member)
+	if err != nil {
+		return err
+	}
+	kd := db.zsetIndex.idxTree.Get(sum)
 	if kd == nil {
 		return nil
 	}
 
-	return db.rewrite(kd, Hash, fID, offset, recordSize, record)
+	//跳表中的分值不变，只需要更新ar树中的位置
+	return db.rewrite(job, kd, fID, offset, recordSize, record, sum)
 }
 
-func (db *SDB) rewrite(kd interface{}, dataType DataType, fID uint32, offset int64, recordSize int, record *bitcask.LogRecord) error {
+// rewrite 把仍然有效的record重写到merge输出文件，idxKey是record在索引树中的key
+func (db *SDB) rewrite(job *mergeJob, kd interface{}, fID uint32, offset int64, recordSize int, record *bitcask.LogRecord, idxKey []byte) error {
 	//判断是新文件(同样的fID, offset, size)以及未过期才进行重写，这里把旧文件和过期文件去掉了
 	if latestKeyDir, _ := kd.(*keyDir); latestKeyDir != nil && latestKeyDir.fileID == fID &&
 		latestKeyDir.recordOffset == offset && latestKeyDir.recordSize == recordSize &&
 		(latestKeyDir.expiredAt == 0 || latestKeyDir.expiredAt > time.Now().Unix()) {
-		// 将record重新写到活跃文件中
-		newKeyDir, err := db.writeLogRecord(record, dataType)
+		// 将record重新写到输出文件中
+		newKeyDir, err := db.writeMergeRecord(job, record)
 		if err != nil {
 			return err
 		}
+		// 指针record只搬指针，blob文件中的value不动，内存模式缓存的value沿用
+		value := record.Value
+		if record.Type&bitcask.TypeBlob != 0 {
+			newKeyDir.blob, value = latestKeyDir.blob, latestKeyDir.value
+		}
 		// 更新索引树
-		if err = db.updateIndexTree(record, newKeyDir, false, dataType); err != nil {
+		if err = db.updateIndexTree(&bitcask.LogRecord{Key: idxKey, Value: value}, newKeyDir, false, job.dataType); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// rewriteTombstone 把删除记录重写到merge输出文件，deleted为false说明key删除后又被写入了，
+// 新记录在删除记录之后，删除记录不需要保留
+func (db *SDB) rewriteTombstone(job *mergeJob, deleted bool, record *bitcask.LogRecord) error {
+	if !deleted {
+		return nil
+	}
+	keyDir, err := db.writeMergeRecord(job, record)
+	if err != nil {
+		return err
+	}
+	//删除记录本身就是无效数据，直接计入count file
+	db.sendCountChan(keyDir, true, job.dataType)
+	return nil
+}
+
+// rewriteExpired 还有更老的文件时，过期的record换成删除记录写到输出文件，否则老文件中的旧值重启后会复活
+// key之后又被写入了的话不需要；索引还指向这条record的话从索引删除，被merge的文件马上就删除了
+func (db *SDB) rewriteExpired(job *mergeJob, kd interface{}, fID uint32, offset int64, record *bitcask.LogRecord) error {
+	if latestKeyDir, _ := kd.(*keyDir); latestKeyDir != nil {
+		if latestKeyDir.fileID != fID || latestKeyDir.recordOffset != offset {
+			return nil
+		}
+		db.strIndex.idxTree.Delete(record.Key)
+	}
+	return db.rewriteTombstone(job, true, &bitcask.LogRecord{Key: record.Key, Type: bitcask.TypeDelete})
+}
+
+// 是否还有比fID更老的非活跃文件，同一批被merge的文件会一起删除，不算在内
+func (db *SDB) hasOlderLogFile(dataType DataType, fID uint32, inputs []uint32) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for id := range db.immutableFiles[dataType] {
+		if id < fID && !containsFileID(inputs, id) {
+			return true
+		}
+	}
+	return false
+}
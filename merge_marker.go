@@ -0,0 +1,196 @@
+package sdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sdb/bitcask"
+)
+
+// merge标记文件：每种数据类型一个，记录正在进行的merge，用来在崩溃后完成或者回滚merge
+// 标记文件复用LogRecord的编码格式，type字段表示merge的状态：
+// key   --> data_type
+// value --> 输出文件个数 | 输出文件id... | 被merge的文件个数 | 被merge的文件id...
+// 状态变化：
+// running:   每新建一个输出文件前写一次，崩溃后启动时删除输出文件，原文件都还在，相当于没有merge
+// committed: 输出文件全部刷盘后写，崩溃后启动时删除被merge的文件，完成merge
+// 标记文件都是先写临时文件再rename，rename后目录刷盘，保证状态切换是原子的
+
+const (
+	mergeRunning bitcask.RecordType = iota
+	mergeCommitted
+)
+
+// ErrInvalidMergeMarker merge标记文件损坏
+var ErrInvalidMergeMarker = errors.New("invalid merge marker")
+
+type mergeMarker struct {
+	state   bitcask.RecordType
+	outputs []uint32 // merge输出文件id
+	inputs  []uint32 // 被merge的文件id
+}
+
+// 标记文件全路径，example: path/MERGE.string
+func (db *SDB) mergeMarkerName(dataType DataType) string {
+	logName := bitcask.FileNameMap[bitcask.FileType(dataType)]
+	typeName := strings.TrimSuffix(logName[len(bitcask.FilePrefix):], ".")
+	return filepath.Join(db.opts.DBPath, mergeMarkerPrefix+typeName)
+}
+
+// 写标记文件，已存在则覆盖
+func (db *SDB) writeMergeMarker(dataType DataType, marker *mergeMarker) error {
+	buf, _ := bitcask.EncodeRecord(&bitcask.LogRecord{
+		Key:   []byte{byte(dataType)},
+		Value: encodeMergeMarker(marker),
+		Type:  marker.state,
+	})
+
+	name := db.mergeMarkerName(dataType)
+	tmpName := name + mergeMarkerTmpSuffix
+	file, err := os.OpenFile(tmpName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(buf); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpName, name); err != nil {
+		return err
+	}
+	return db.syncDBPath()
+}
+
+// 读标记文件，不存在返回os.ErrNotExist
+func (db *SDB) readMergeMarker(dataType DataType) (*mergeMarker, error) {
+	buf, err := os.ReadFile(db.mergeMarkerName(dataType))
+	if err != nil {
+		return nil, err
+	}
+	lr, _, err := bitcask.DecodeRecord(buf)
+	if err != nil || len(lr.Key) != 1 || DataType(lr.Key[0]) != dataType {
+		return nil, ErrInvalidMergeMarker
+	}
+	if lr.Type != mergeRunning && lr.Type != mergeCommitted {
+		return nil, ErrInvalidMergeMarker
+	}
+	marker, err := decodeMergeMarker(lr.Value)
+	if err != nil {
+		return nil, err
+	}
+	marker.state = lr.Type
+	return marker, nil
+}
+
+// 删除标记文件，merge结束
+func (db *SDB) removeMergeMarker(dataType DataType) error {
+	if err := os.Remove(db.mergeMarkerName(dataType)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return db.syncDBPath()
+}
+
+// recoverMerge 启动时处理上次崩溃时没有完成的merge，需要在加载MANIFEST之后、加载日志文件之前调用
+// running状态回滚，删除输出文件；committed状态继续完成，删除被merge的文件
+func (db *SDB) recoverMerge() error {
+	for dataType := String; dataType < logFileTypeNum; dataType++ {
+		marker, err := db.readMergeMarker(dataType)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		fIDs := marker.outputs
+		if marker.state == mergeCommitted {
+			fIDs = marker.inputs
+			// MANIFEST可能还没有记录这次merge，重复记录不影响结果
+			db.manifest.apply(dataType, marker.outputs, marker.inputs)
+		}
+		fType := bitcask.FileType(dataType)
+		for _, fID := range fIDs {
+			name, err := bitcask.LogFileName(db.opts.DBPath, fID, fType)
+			if err != nil {
+				return err
+			}
+			if err = os.Remove(name); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err = bitcask.RemoveHintFile(db.opts.DBPath, fID, fType); err != nil {
+				return err
+			}
+			_ = db.countFiles[dataType].Clear(fID)
+		}
+		// 快照可能引用了删除的文件
+		db.removeIndexSnapshot()
+		if err = db.syncDBPath(); err != nil {
+			return err
+		}
+		if err = db.removeMergeMarker(dataType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeMergeMarker(marker *mergeMarker) []byte {
+	return encodeFileIDs(marker.outputs, marker.inputs)
+}
+
+func decodeMergeMarker(buf []byte) (*mergeMarker, error) {
+	fIDs, ok := decodeFileIDs(buf, 2)
+	if !ok {
+		return nil, ErrInvalidMergeMarker
+	}
+	return &mergeMarker{outputs: fIDs[0], inputs: fIDs[1]}, nil
+}
+
+// 多组文件id编码：个数 | id... | 个数 | id...，都是uvarint
+func encodeFileIDs(lists ...[]uint32) []byte {
+	size := len(lists)
+	for _, fIDs := range lists {
+		size += len(fIDs)
+	}
+	buf := make([]byte, binary.MaxVarintLen32*size)
+	var index int
+	for _, fIDs := range lists {
+		index += binary.PutUvarint(buf[index:], uint64(len(fIDs)))
+		for _, fID := range fIDs {
+			index += binary.PutUvarint(buf[index:], uint64(fID))
+		}
+	}
+	return buf[:index]
+}
+
+// 解码n组文件id，格式不对返回false
+func decodeFileIDs(buf []byte, n int) ([][]uint32, bool) {
+	var index int
+	lists := make([][]uint32, n)
+	for i := 0; i < n; i++ {
+		count, size := binary.Uvarint(buf[index:])
+		if size <= 0 {
+			return nil, false
+		}
+		index += size
+		for j := uint64(0); j < count; j++ {
+			fID, size := binary.Uvarint(buf[index:])
+			if size <= 0 {
+				return nil, false
+			}
+			index += size
+			lists[i] = append(lists[i], uint32(fID))
+		}
+	}
+	return lists, true
+}
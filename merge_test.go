@@ -0,0 +1,821 @@
+package sdb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"sdb/bitcask"
+	"sdb/options"
+)
+
+func TestSDB_MergeSet(t *testing.T) {
+	db, opts := openMergeTestDB(t, "test/merge-set")
+	defer func() {
+		clearDB(db)
+	}()
+
+	key := []byte("set")
+	writeCount := 300
+	for i := 0; i < writeCount; i++ {
+		assert.Nil(t, db.SAdd(key, []byte(fmt.Sprintf("member-%d", i))))
+	}
+	// 删除一半成员，产生无效数据，每个文件中都还有有效数据
+	for i := 0; i < writeCount; i += 2 {
+		assert.Nil(t, db.SRem(key, []byte(fmt.Sprintf("member-%d", i))))
+	}
+	fID := waitMergeCandidate(t, db, Set)
+	assert.Nil(t, db.MergeSpecificLogFile(Set, int(fID), 0))
+	assert.Nil(t, db.getImmutableFile(Set, fID))
+
+	assertMembers := func(db *SDB) {
+		assert.Equal(t, writeCount/2, db.SCard(key))
+		for i := 0; i < writeCount; i++ {
+			assert.Equal(t, i%2 == 1, db.SIsMember(key, []byte(fmt.Sprintf("member-%d", i))))
+		}
+		members, err := db.SMembers(key)
+		assert.Nil(t, err)
+		assert.Equal(t, writeCount/2, len(members))
+	}
+	assertMembers(db)
+
+	db = reopenDB(t, db, opts, true)
+	assertMembers(db)
+}
+
+func TestSDB_MergeZSet(t *testing.T) {
+	db, opts := openMergeTestDB(t, "test/merge-zset")
+	defer func() {
+		clearDB(db)
+	}()
+
+	key := []byte("zset")
+	writeCount := 300
+	for i := 0; i < writeCount; i++ {
+		assert.Nil(t, db.ZAdd(key, float64(i), []byte(fmt.Sprintf("member-%d", i))))
+	}
+	// 更新一部分成员的分值，删除一部分成员，产生无效数据，每个文件中都还有有效数据
+	for i := 0; i < writeCount; i += 3 {
+		assert.Nil(t, db.ZAdd(key, float64(writeCount+i), []byte(fmt.Sprintf("member-%d", i))))
+	}
+	for i := 1; i < writeCount; i += 3 {
+		assert.Nil(t, db.ZRem(key, []byte(fmt.Sprintf("member-%d", i))))
+	}
+	fID := waitMergeCandidate(t, db, ZSet)
+	assert.Nil(t, db.MergeSpecificLogFile(ZSet, int(fID), 0))
+	assert.Nil(t, db.getImmutableFile(ZSet, fID))
+
+	var want [][]byte
+	for i := 2; i < writeCount; i += 3 {
+		want = append(want, []byte(fmt.Sprintf("member-%d", i)))
+	}
+	for i := 0; i < writeCount; i += 3 {
+		want = append(want, []byte(fmt.Sprintf("member-%d", i)))
+	}
+	assert.Equal(t, want, db.ZRange(key, 0, -1))
+
+	// 分别从快照和日志文件恢复
+	db = reopenDB(t, db, opts, false)
+	assert.Equal(t, want, db.ZRange(key, 0, -1))
+	ok, score := db.ZScore(key, []byte("member-0"))
+	assert.True(t, ok)
+	assert.Equal(t, float64(writeCount), score)
+	db = reopenDB(t, db, opts, true)
+	assert.Equal(t, want, db.ZRange(key, 0, -1))
+}
+
+func TestSDB_MergeHash(t *testing.T) {
+	db, opts := openMergeTestDB(t, "test/merge-hash")
+	defer func() {
+		clearDB(db)
+	}()
+
+	key := []byte("hash")
+	writeCount := 300
+	for i := 0; i < writeCount; i++ {
+		assert.Nil(t, db.HSet(key, getTestKey(i), getTestValue(i)))
+	}
+	// 覆盖写一半field，每个文件中都还有有效数据
+	for i := 0; i < writeCount; i += 2 {
+		assert.Nil(t, db.HSet(key, getTestKey(i), getTestValue(i+writeCount)))
+	}
+	fID := waitMergeCandidate(t, db, Hash)
+	assert.Nil(t, db.MergeSpecificLogFile(Hash, int(fID), 0))
+
+	assertFields := func(db *SDB) {
+		for i := 0; i < writeCount; i++ {
+			want := getTestValue(i)
+			if i%2 == 0 {
+				want = getTestValue(i + writeCount)
+			}
+			val, err := db.HGet(key, getTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, want, val)
+		}
+	}
+	assertFields(db)
+
+	db = reopenDB(t, db, opts, true)
+	assertFields(db)
+}
+
+func TestSDB_MergeTombstone(t *testing.T) {
+	key, fillKey := []byte("deleted"), []byte("fill")
+	member := func(i int) []byte {
+		return []byte(fmt.Sprintf("member-%d", i))
+	}
+	tests := []struct {
+		name     string
+		dataType DataType
+		put      func(db *SDB, i int) error
+		del      func(db *SDB, i int) error
+		fill     func(db *SDB, i int) error
+		exists   func(db *SDB, i int) bool
+	}{
+		{
+			name:     "string",
+			dataType: String,
+			put:      func(db *SDB, i int) error { return db.Set(getTestKey(i), getTestValue(i)) },
+			del:      func(db *SDB, i int) error { return db.Delete(getTestKey(i)) },
+			fill:     func(db *SDB, i int) error { return db.Set(append(fillKey, getTestKey(i)...), getTestValue(i)) },
+			exists: func(db *SDB, i int) bool {
+				_, err := db.Get(getTestKey(i))
+				return err == nil
+			},
+		},
+		{
+			name:     "list",
+			dataType: List,
+			put:      func(db *SDB, i int) error { return db.RPush(key, getTestValue(i)) },
+			del: func(db *SDB, i int) error {
+				_, err := db.LPop(key)
+				return err
+			},
+			fill: func(db *SDB, i int) error { return db.RPush(fillKey, getTestValue(i)) },
+			exists: func(db *SDB, i int) bool {
+				// ar树中除了list元信息，还有元素的索引，说明元素复活了
+				tree := db.listIndex.trees[string(key)]
+				return tree != nil && tree.Size() > 1
+			},
+		},
+		{
+			name:     "hash",
+			dataType: Hash,
+			put:      func(db *SDB, i int) error { return db.HSet(key, getTestKey(i), getTestValue(i)) },
+			del: func(db *SDB, i int) error {
+				_, err := db.HDel(key, getTestKey(i))
+				return err
+			},
+			fill: func(db *SDB, i int) error { return db.HSet(fillKey, getTestKey(i), getTestValue(i)) },
+			exists: func(db *SDB, i int) bool {
+				val, _ := db.HGet(key, getTestKey(i))
+				return val != nil
+			},
+		},
+		{
+			name:     "set",
+			dataType: Set,
+			put:      func(db *SDB, i int) error { return db.SAdd(key, member(i)) },
+			del:      func(db *SDB, i int) error { return db.SRem(key, member(i)) },
+			fill:     func(db *SDB, i int) error { return db.SAdd(fillKey, member(i)) },
+			exists:   func(db *SDB, i int) bool { return db.SIsMember(key, member(i)) },
+		},
+		{
+			name:     "zset",
+			dataType: ZSet,
+			put:      func(db *SDB, i int) error { return db.ZAdd(key, float64(i), member(i)) },
+			del:      func(db *SDB, i int) error { return db.ZRem(key, member(i)) },
+			fill:     func(db *SDB, i int) error { return db.ZAdd(fillKey, float64(i), member(i)) },
+			exists: func(db *SDB, i int) bool {
+				ok, _ := db.ZScore(key, member(i))
+				return ok
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, opts := openMergeTestDB(t, "test/merge-tombstone-"+tt.name)
+			defer func() {
+				clearDB(db)
+			}()
+
+			writeCount := 100
+			for i := 0; i < writeCount; i++ {
+				assert.Nil(t, tt.put(db, i))
+			}
+			// 删除记录写在后面的文件中，老文件中还有原来的记录
+			firstFID := db.getActiveLogFile(tt.dataType).FileID
+			for i := 0; i < writeCount; i++ {
+				assert.Nil(t, tt.del(db, i))
+			}
+			lastFID := db.getActiveLogFile(tt.dataType).FileID
+			for i := 0; db.getActiveLogFile(tt.dataType).FileID == lastFID; i++ {
+				assert.Nil(t, tt.fill(db, i))
+			}
+
+			// 只merge有删除记录的文件，最老的文件保留下来
+			for fID := firstFID; fID <= lastFID; fID++ {
+				if fID == 0 {
+					continue
+				}
+				waitMergeFile(t, db, tt.dataType, fID)
+				assert.Nil(t, db.MergeSpecificLogFile(tt.dataType, int(fID), 0))
+				assert.Nil(t, db.getImmutableFile(tt.dataType, fID))
+			}
+			assert.NotNil(t, db.getImmutableFile(tt.dataType, 0))
+
+			db = reopenDB(t, db, opts, true)
+			for i := 0; i < writeCount; i++ {
+				assert.False(t, tt.exists(db, i), "entry %d resurrected", i)
+			}
+		})
+	}
+}
+
+// 还有更老的文件时，merge掉过期的record也要留下删除记录，否则老文件中的旧值重启后会复活
+func TestSDB_MergeExpired(t *testing.T) {
+	for _, restart := range []bool{false, true} {
+		t.Run(fmt.Sprintf("restart=%v", restart), func(t *testing.T) {
+			db, opts := openMergeTestDB(t, "test/merge-expired")
+			defer func() {
+				clearDB(db)
+			}()
+
+			writeCount := 100
+			dummyKey := func(i int) []byte {
+				return append([]byte("dummy-"), getTestKey(i)...)
+			}
+			for i := 0; i < writeCount; i++ {
+				assert.Nil(t, db.Set(getTestKey(i), getTestValue(i)))
+			}
+			// 过期的record写在后面的文件中，夹着之后被覆盖的record，这些文件才能被merge
+			firstFID := db.getActiveLogFile(String).FileID
+			for i := 0; i < writeCount; i++ {
+				assert.Nil(t, db.SetEX(getTestKey(i), getTestValue(i+1), time.Second))
+				assert.Nil(t, db.Set(dummyKey(i), getTestValue(i)))
+			}
+			lastFID := db.getActiveLogFile(String).FileID
+			for i := 0; i < writeCount || db.getActiveLogFile(String).FileID == lastFID; i++ {
+				assert.Nil(t, db.Set(dummyKey(i%writeCount), getTestValue(i+1)))
+			}
+			time.Sleep(2 * time.Second)
+			// 重启之后过期的key不在索引中了
+			if restart {
+				db = reopenDB(t, db, opts, true)
+			}
+
+			for fID := firstFID; fID <= lastFID; fID++ {
+				if fID == 0 {
+					continue
+				}
+				waitMergeFile(t, db, String, fID)
+				assert.Nil(t, db.MergeSpecificLogFile(String, int(fID), 0))
+			}
+			assert.NotNil(t, db.getImmutableFile(String, 0))
+			for i := 0; i < writeCount; i++ {
+				_, err := db.Get(getTestKey(i))
+				assert.Equal(t, ErrKeyNotFound, err)
+			}
+
+			db = reopenDB(t, db, opts, true)
+			for i := 0; i < writeCount; i++ {
+				_, err := db.Get(getTestKey(i))
+				assert.Equal(t, ErrKeyNotFound, err, "key %d resurrected", i)
+			}
+		})
+	}
+}
+
+func TestSDB_MergeRecover(t *testing.T) {
+	tests := []struct {
+		name  string
+		state bitcask.RecordType
+	}{
+		{name: "rollback", state: mergeRunning},
+		{name: "roll forward", state: mergeCommitted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, opts := openMergeTestDB(t, "test/merge-recover")
+			defer func() {
+				clearDB(db)
+			}()
+
+			writeCount := 300
+			for i := 0; i < writeCount; i++ {
+				assert.Nil(t, db.Set(getTestKey(i), getTestValue(i)))
+			}
+			for i := 0; i < writeCount; i += 2 {
+				assert.Nil(t, db.Set(getTestKey(i), getTestValue(i+writeCount)))
+			}
+			fID := waitMergeCandidate(t, db, String)
+
+			// 有效数据重写完之后崩溃，running状态还没提交，committed状态已提交但被merge的文件还没删除
+			job := &mergeJob{dataType: String, marker: &mergeMarker{state: mergeRunning, inputs: []uint32{fID}}}
+			assert.Nil(t, db.mergeLogFile(job, db.getImmutableFile(String, fID)))
+			assert.Equal(t, 1, len(job.marker.outputs))
+			output := job.marker.outputs[0]
+			if tt.state == mergeCommitted {
+				job.marker.state = mergeCommitted
+				assert.Nil(t, db.writeMergeMarker(String, job.marker))
+			}
+			db.waitHintFiles()
+			crashDB(db)
+
+			var err error
+			db, err = OpenDB(opts)
+			assert.Nil(t, err)
+			fIDs := sortedFileIDs(db, String)
+			assert.Equal(t, tt.state == mergeRunning, containsFileID(fIDs, fID))
+			assert.Equal(t, tt.state == mergeCommitted, containsFileID(fIDs, output))
+			_, err = os.Stat(db.mergeMarkerName(String))
+			assert.True(t, os.IsNotExist(err))
+
+			for i := 0; i < writeCount; i++ {
+				want := getTestValue(i)
+				if i%2 == 0 {
+					want = getTestValue(i + writeCount)
+				}
+				val, err := db.Get(getTestKey(i))
+				assert.Nil(t, err)
+				assert.Equal(t, want, val)
+			}
+		})
+	}
+}
+
+// 删除不存在的key写的删除记录也是无效数据，全是这种记录的文件达到merge的阈值，merge之后和sdb-check的统计一致
+func TestSDB_MergeMissingKeyTombstones(t *testing.T) {
+	db, opts := openMergeTestDB(t, "test/merge-missing-tombstones")
+	defer func() {
+		_ = os.RemoveAll(opts.DBPath)
+	}()
+
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, db.Delete(getTestKey(i)))
+	}
+	fIDs := sortedFileIDs(db, String)
+	assert.Greater(t, len(fIDs), 1)
+	db.countFiles[String].Flush()
+	mcl, err := db.countFiles[String].GetMCL(db.activeFiles[String].FileID, db.opts.LogFileMergeRatio)
+	assert.Nil(t, err)
+	assert.Equal(t, fIDs[:len(fIDs)-1], mcl)
+
+	// 没有更老的文件，删除记录merge之后就丢掉了
+	assert.Nil(t, db.MergeSpecificLogFile(String, int(fIDs[0]), db.opts.LogFileMergeRatio))
+	assert.False(t, containsFileID(sortedFileIDs(db, String), fIDs[0]))
+	assert.Nil(t, db.CloseDB())
+
+	report, err := Check(opts.DBPath, false, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Problems)
+}
+
+// 一次merge的输出文件用预留的一段连续的id，活跃文件只移动一次
+func TestSDB_MergeReservedFileIDs(t *testing.T) {
+	db, opts := openMergeTestDB(t, "test/merge-reserved")
+	defer func() {
+		clearDB(db)
+	}()
+
+	writeCount := 300
+	for i := 0; i < writeCount; i++ {
+		assert.Nil(t, db.Set(getTestKey(i), getTestValue(i)))
+	}
+	activeFID := db.activeFiles[String].FileID
+	inputs := len(db.immutableFiles[String])
+	assert.Greater(t, inputs, 1)
+
+	assert.Nil(t, db.Recompress(String))
+	fIDs := sortedFileIDs(db, String)
+	assert.Equal(t, activeFID+uint32(inputs)+1, db.activeFiles[String].FileID)
+	// 老的活跃文件没有被merge，后面是输出文件，最后是新的活跃文件
+	outputs := fIDs[1 : len(fIDs)-1]
+	assert.Equal(t, activeFID, fIDs[0])
+	assert.Greater(t, len(outputs), 1)
+	for i, fID := range outputs {
+		assert.Equal(t, activeFID+uint32(i)+1, fID)
+	}
+
+	db = reopenDB(t, db, opts, true)
+	for i := 0; i < writeCount; i++ {
+		val, err := db.Get(getTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, getTestValue(i), val)
+	}
+}
+
+// 放不下一条大record提前转为非活跃的文件，按截掉之后的大小算占用率
+func TestSDB_MergeTrimmedFile(t *testing.T) {
+	db, _ := openMergeTestDB(t, "test/merge-trimmed")
+	defer func() {
+		clearDB(db)
+	}()
+
+	assert.Nil(t, db.Set([]byte("small"), bytes.Repeat([]byte("s"), 200)))
+	fID := db.activeFiles[String].FileID
+	assert.Nil(t, db.Set([]byte("big"), bytes.Repeat([]byte("b"), 4000)))
+	assert.NotEqual(t, fID, db.activeFiles[String].FileID)
+	assert.Nil(t, db.Delete([]byte("small")))
+
+	size, err := db.countFiles[String].FileSize(fID)
+	assert.Nil(t, err)
+	assert.Less(t, size, uint32(512))
+	db.countFiles[String].Flush()
+	mcl, err := db.countFiles[String].GetMCL(db.activeFiles[String].FileID, db.opts.LogFileMergeRatio)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint32{fID}, mcl)
+}
+
+func openMergeTestDB(t *testing.T, dir string) (*SDB, options.Options) {
+	pwd, _ := os.Getwd()
+	path := filepath.Join(pwd, dir)
+	opts := options.NewDefaultOptions(path)
+	opts.LogFileSizeThreshold = 4 << 10
+	opts.LogFileMergeInterval = 0
+	// 默认的count channel太大，merge测试会开很多db
+	opts.CountBufferSize = 1024
+	db, err := OpenDB(opts)
+	assert.Nil(t, err)
+	return db, opts
+}
+
+// 重启db，removeSnapshot为true时删除索引快照，从日志文件恢复索引
+func reopenDB(t *testing.T, db *SDB, opts options.Options, removeSnapshot bool) *SDB {
+	assert.Nil(t, db.CloseDB())
+	if removeSnapshot {
+		assert.Nil(t, os.Remove(filepath.Join(opts.DBPath, indexSnapshotFileName)))
+	}
+	db, err := OpenDB(opts)
+	assert.Nil(t, err)
+	return db
+}
+
+// 等待count file统计到无效数据，返回最早的可以merge的文件
+func waitMergeCandidate(t *testing.T, db *SDB, dataType DataType) uint32 {
+	db.countFiles[dataType].Flush()
+	mcl, err := db.countFiles[dataType].GetMCL(db.getActiveLogFile(dataType).FileID, 0)
+	assert.Nil(t, err)
+	if len(mcl) == 0 {
+		t.Fatalf("no merge candidate for data type %v", dataType)
+	}
+	return mcl[0]
+}
+
+// 等待count file统计到fID中的无效数据
+func waitMergeFile(t *testing.T, db *SDB, dataType DataType, fID uint32) {
+	db.countFiles[dataType].Flush()
+	mcl, err := db.countFiles[dataType].GetMCL(db.getActiveLogFile(dataType).FileID, 0)
+	assert.Nil(t, err)
+	for _, id := range mcl {
+		if id == fID {
+			return
+		}
+	}
+	t.Fatalf("file %d of data type %v is not a merge candidate", fID, dataType)
+}
+
+func TestSDB_Recompress(t *testing.T) {
+	db, opts := openMergeTestDB(t, "test/merge-recompress")
+	defer func() {
+		clearDB(db)
+	}()
+
+	key := []byte("hash")
+	jsonValue := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"id":%d,"tags":["sdb","sdb","sdb","sdb","sdb","sdb"],"desc":"%0200d"}`, i, i))
+	}
+	assertValues := func(db *SDB, n int) {
+		for i := 0; i < n; i++ {
+			val, err := db.HGet(key, getTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, jsonValue(i), val)
+		}
+	}
+	// 先不压缩写一批
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.HSet(key, getTestKey(i), jsonValue(i)))
+	}
+	// 日志文件中实际写入的字节数，最后一个非0字节之后是预分配的空间
+	writtenBytes := func(db *SDB) (n int) {
+		for _, fID := range db.liveFileIDs(Hash) {
+			name, _ := bitcask.LogFileName(opts.DBPath, fID, bitcask.Hash)
+			buf, err := os.ReadFile(name)
+			assert.Nil(t, err)
+			n += len(bytes.TrimRight(buf, "\x00")) - bitcask.LogFileHeaderSize
+		}
+		return n
+	}
+	uncompressed := writtenBytes(db)
+	assert.Nil(t, db.CloseDB())
+
+	// 打开压缩之后，老的没压缩的record照常读取
+	opts.Compression = options.FlateCompression
+	opts.CompressMinSize = 64
+	db, err := OpenDB(opts)
+	assert.Nil(t, err)
+	assertValues(db, 100)
+	for i := 100; i < 200; i++ {
+		assert.Nil(t, db.HSet(key, getTestKey(i), jsonValue(i)))
+	}
+	// 同样多的record压缩后写入的字节数少得多
+	compressed := writtenBytes(db) - uncompressed
+	assert.Less(t, compressed*2, uncompressed)
+
+	// 按新的设置重写老文件
+	assert.Nil(t, db.Recompress(Hash))
+	assert.Less(t, writtenBytes(db), compressed*3)
+	db = reopenDB(t, db, opts, true)
+	assertValues(db, 200)
+	assert.Nil(t, db.CloseDB())
+
+	report, err := Check(opts.DBPath, false, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Problems)
+	db, err = OpenDB(opts)
+	assert.Nil(t, err)
+}
+
+func TestSDB_Reencrypt(t *testing.T) {
+	db, opts := openMergeTestDB(t, "test/merge-reencrypt")
+	defer func() {
+		_ = os.RemoveAll(opts.DBPath)
+	}()
+
+	key := []byte("pii")
+	writeValues := func(db *SDB, from, to int) {
+		for i := from; i < to; i++ {
+			assert.Nil(t, db.HSet(key, getTestKey(i), getTestValue(i)))
+		}
+	}
+	assertValues := func(db *SDB, n int) {
+		for i := 0; i < n; i++ {
+			val, err := db.HGet(key, getTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, getTestValue(i), val)
+		}
+	}
+	// 所有日志文件都用keyID加密，目录中没有明文的value
+	assertEncrypted := func(db *SDB, keyID uint32) {
+		for _, fID := range db.liveFileIDs(Hash) {
+			name, _ := bitcask.LogFileName(opts.DBPath, fID, bitcask.Hash)
+			buf, err := os.ReadFile(name)
+			assert.Nil(t, err)
+			header, _, err := bitcask.DecodeLogFileHeader(buf)
+			assert.Nil(t, err)
+			assert.Equal(t, keyID, header.KeyID)
+			assert.False(t, bytes.Contains(buf, []byte("sdb-test-value")))
+		}
+	}
+	writeValues(db, 0, 100)
+	assert.Nil(t, db.CloseDB())
+
+	// 开启加密，老的明文文件照常读取，活跃文件换成加密的
+	keys := map[uint32][]byte{1: []byte("0123456789abcdef"), 2: []byte("fedcba9876543210")}
+	opts.EncryptionKey, opts.EncryptionKeyID = keys[1], 1
+	db, err := OpenDB(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), db.getActiveLogFile(Hash).Header.KeyID)
+	assertValues(db, 100)
+	writeValues(db, 100, 200)
+	assert.Nil(t, db.Reencrypt(Hash))
+	assertEncrypted(db, 1)
+	db = reopenDB(t, db, opts, false)
+	assertValues(db, 200)
+
+	// 轮换密钥，老密钥通过KeyProvider提供，重写之后就不需要了
+	opts.EncryptionKey, opts.EncryptionKeyID = keys[2], 2
+	opts.KeyProvider = func(keyID uint32) ([]byte, error) {
+		return keys[keyID], nil
+	}
+	db = reopenDB(t, db, opts, false)
+	assertValues(db, 200)
+	assert.Nil(t, db.Reencrypt(Hash))
+	assertEncrypted(db, 2)
+	opts.KeyProvider = nil
+	db = reopenDB(t, db, opts, false)
+	assertValues(db, 200)
+	assert.Nil(t, db.CloseDB())
+
+	// 加密的数据不生成hint文件和索引快照
+	dirEntries, err := os.ReadDir(opts.DBPath)
+	assert.Nil(t, err)
+	for _, entry := range dirEntries {
+		assert.False(t, strings.HasPrefix(entry.Name(), "hint."), entry.Name())
+		assert.NotEqual(t, indexSnapshotFileName, entry.Name())
+	}
+
+	report, err := Check(opts.DBPath, false, func(keyID uint32) ([]byte, error) {
+		return keys[keyID], nil
+	})
+	assert.Nil(t, err)
+	assert.Empty(t, report.Problems)
+	_, err = Check(opts.DBPath, false, nil)
+	assert.Equal(t, bitcask.ErrEncryptionKeyNotFound, err)
+
+	// 密钥不对时打开失败，而不是读到crc错误
+	opts.EncryptionKey = keys[1]
+	_, err = OpenDB(opts)
+	assert.Equal(t, bitcask.ErrWrongEncryptionKey, err)
+}
+
+// 并发读的同时反复merge，读的文件被merge删除也要等读完，不会读到关闭或者解除映射的文件
+func TestSDB_ReadDuringMerge(t *testing.T) {
+	bigValue := func(i int) []byte {
+		return bytes.Repeat(getTestValue(i), 50)
+	}
+	for _, ioType := range []options.IOType{options.FileIO, options.MMap, options.DirectIO} {
+		t.Run(fmt.Sprint(ioType), func(t *testing.T) {
+			pwd, _ := os.Getwd()
+			opts := options.NewDefaultOptions(filepath.Join(pwd, "test/merge-read"))
+			opts.IoType = ioType
+			opts.LogFileSizeThreshold = 4 << 10
+			opts.LogFileMergeInterval = 0
+			opts.CountBufferSize = 1024
+			opts.BlobThreshold = 1024
+			opts.MaxOpenFiles = 4
+			db, err := OpenDB(opts)
+			assert.Nil(t, err)
+			defer clearDB(db)
+
+			liveCount := 100
+			for i := 0; i < liveCount; i++ {
+				assert.Nil(t, db.Set(getTestKey(i), getTestValue(i)))
+				assert.Nil(t, db.HSet([]byte("hash"), getTestKey(i), bigValue(i)))
+			}
+
+			stop := make(chan struct{})
+			wg := new(sync.WaitGroup)
+			defer func() {
+				close(stop)
+				wg.Wait()
+			}()
+			for g := 0; g < 4; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for i := g; ; i = (i + 1) % liveCount {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						val, err := db.Get(getTestKey(i))
+						assert.Nil(t, err)
+						assert.Equal(t, getTestValue(i), val)
+						if g == 1 {
+							view, release, err := db.GetView(getTestKey(i))
+							assert.Nil(t, err)
+							assert.Equal(t, getTestValue(i), view)
+							release()
+						}
+						// HGet在读锁下切换hashIndex.idxTree，只让一个协程读hash
+						if g == 0 {
+							val, err = db.HGet([]byte("hash"), getTestKey(i))
+							assert.Nil(t, err)
+							assert.Equal(t, bigValue(i), val)
+						}
+					}
+				}(g)
+			}
+
+			// 覆盖写产生无效数据，有效的key分散在被merge的文件中
+			for round := 0; round < 10; round++ {
+				for i := 0; i < 100; i++ {
+					key := []byte(fmt.Sprintf("dead-%d", i))
+					assert.Nil(t, db.Set(key, bytes.Repeat(getTestValue(round), 4)))
+					assert.Nil(t, db.HSet([]byte("dead-hash"), key, bigValue(round)))
+				}
+				// 第一轮写入的都是有效数据
+				if round == 0 {
+					continue
+				}
+				fID := waitMergeCandidate(t, db, String)
+				assert.Nil(t, db.MergeSpecificLogFile(String, int(fID), 0))
+				fID = waitMergeCandidate(t, db, Hash)
+				assert.Nil(t, db.MergeSpecificLogFile(Hash, int(fID), 0))
+				if round%3 == 2 {
+					waitBlobMergeCandidate(t, db, Hash)
+					assert.Nil(t, db.MergeBlobFiles(Hash, 0.5))
+				}
+			}
+		})
+	}
+}
+
+// merge中途失败时保留标记文件，不再merge这种数据类型，重启时回滚
+func TestSDB_MergeFailed(t *testing.T) {
+	db, opts := openMergeTestDB(t, "test/merge-failed")
+	defer func() {
+		clearDB(db)
+	}()
+
+	writeCount := 300
+	for i := 0; i < writeCount; i++ {
+		assert.Nil(t, db.Set(getTestKey(i), getTestValue(i)))
+	}
+	for i := 0; i < writeCount; i += 2 {
+		assert.Nil(t, db.Set(getTestKey(i), getTestValue(i+writeCount)))
+	}
+	assertValues := func() {
+		for i := 0; i < writeCount; i++ {
+			want := getTestValue(i)
+			if i%2 == 0 {
+				want = getTestValue(i + writeCount)
+			}
+			val, err := db.Get(getTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, want, val)
+		}
+	}
+	fID := waitMergeCandidate(t, db, String)
+
+	// 破坏被merge的文件中最后一条record，前面的有效record已经重写到输出文件之后才读到它
+	lf := db.getImmutableFile(String, fID)
+	var lastOffset int64
+	for offset := lf.DataOffset; ; {
+		_, size, err := lf.ReadLogRecord(offset)
+		if err != nil {
+			break
+		}
+		lastOffset, offset = offset, offset+size
+	}
+	_ = lf.Release()
+	name, _ := bitcask.LogFileName(opts.DBPath, fID, bitcask.Str)
+	buf, err := os.ReadFile(name)
+	assert.Nil(t, err)
+	buf[lastOffset+10] ^= 0xff
+	assert.Nil(t, os.WriteFile(name, buf, 0644))
+
+	assert.Equal(t, bitcask.ErrInvalidCrc, db.MergeSpecificLogFile(String, int(fID), 0))
+	assert.Equal(t, ErrMergeFailed, db.MergeSpecificLogFile(String, int(fID), 0))
+	assert.Equal(t, ErrMergeFailed, db.Recompress(String))
+	marker, err := db.readMergeMarker(String)
+	assert.Nil(t, err)
+	assert.Equal(t, mergeRunning, marker.state)
+	assert.Equal(t, []uint32{fID}, marker.inputs)
+	assert.NotEmpty(t, marker.outputs)
+	// 其他数据类型不受影响，索引指向输出文件也能读到
+	assert.Nil(t, db.HSet([]byte("hash"), []byte("f"), []byte("v")))
+	assertValues()
+
+	// 修好文件之后重启，回滚输出文件，被merge的文件还在，可以再merge
+	buf[lastOffset+10] ^= 0xff
+	assert.Nil(t, os.WriteFile(name, buf, 0644))
+	db = reopenDB(t, db, opts, false)
+	fIDs := sortedFileIDs(db, String)
+	assert.True(t, containsFileID(fIDs, fID))
+	for _, output := range marker.outputs {
+		assert.False(t, containsFileID(fIDs, output))
+	}
+	assertValues()
+	fID = waitMergeCandidate(t, db, String)
+	assert.Nil(t, db.MergeSpecificLogFile(String, int(fID), 0))
+	assertValues()
+}
+
+// 被引用的文件merge之后还能读，最后一个引用释放之后才删除
+func TestSDB_MergeReferencedFile(t *testing.T) {
+	db, _ := openMergeTestDB(t, "test/merge-ref")
+	defer func() {
+		clearDB(db)
+	}()
+
+	writeCount := 300
+	for i := 0; i < writeCount; i++ {
+		assert.Nil(t, db.Set(getTestKey(i), getTestValue(i)))
+	}
+	for i := 0; i < writeCount; i += 2 {
+		assert.Nil(t, db.Set(getTestKey(i), getTestValue(i+1)))
+	}
+	fID := waitMergeCandidate(t, db, String)
+	lf := db.refLogFile(String, fID)
+	assert.NotNil(t, lf)
+	record, _, err := lf.ReadLogRecord(lf.DataOffset)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.MergeSpecificLogFile(String, int(fID), 0))
+	assert.Nil(t, db.refLogFile(String, fID))
+	name, _ := bitcask.LogFileName(db.opts.DBPath, fID, bitcask.Str)
+	_, err = os.Stat(name)
+	assert.Nil(t, err)
+	again, _, err := lf.ReadLogRecord(lf.DataOffset)
+	assert.Nil(t, err)
+	assert.Equal(t, record.Key, again.Key)
+
+	assert.Nil(t, lf.Release())
+	_, err = os.Stat(name)
+	assert.True(t, os.IsNotExist(err))
+	for i := 0; i < writeCount; i++ {
+		val, err := db.Get(getTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, getTestValue(i+(i+1)%2), val)
+	}
+}
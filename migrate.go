@@ -0,0 +1,182 @@
+package sdb
+
+import (
+	"os"
+	"path/filepath"
+
+	"sdb/bitcask"
+	"sdb/flock"
+	"sdb/logger"
+	"sdb/options"
+	"sdb/utils"
+)
+
+// 离线升级数据目录，给cmd/sdb-migrate使用，db不能处于打开状态
+// 把没有文件头的v1日志文件重写成当前版本，文件id不变；v1 record没有写入时间，用文件的修改时间代替
+// 老版本写的hash、set、zset record的key编码和现在不一样，OpenDB会报错，升级时一起转换，见migrateRecordKey
+// 每个文件先写临时文件再rename，中途崩溃的话目录中v1和v2文件混在一起，也能正常打开，重新执行即可
+// record的位置变了，升级前先删除hint文件和索引快照，升级后按新的record大小重写count file
+
+// Migrate 把path下的日志文件升级到当前版本，返回升级了的文件名，keys用于重写加密的count file，没有加密时可以传nil
+func Migrate(path string, keys options.KeyProvider) ([]string, error) {
+	if !utils.PathExist(path) {
+		return nil, os.ErrNotExist
+	}
+	fileLock, err := flock.AcquireFileLock(filepath.Join(path, lockFileName), false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = fileLock.Release()
+	}()
+
+	db := &SDB{opts: options.Options{DBPath: path}, keyring: &bitcask.Keyring{Lookup: keys}}
+	if err = db.loadManifest(); err != nil {
+		return nil, err
+	}
+	for dataType := String; dataType < logFileTypeNum; dataType++ {
+		if _, err := os.Stat(db.mergeMarkerName(dataType)); err == nil {
+			return nil, ErrUnfinishedMerge
+		}
+	}
+
+	var migrated []string
+	for dataType := String; dataType < logFileTypeNum; dataType++ {
+		fIDs, err := db.listLogFiles(dataType)
+		if err != nil {
+			return nil, err
+		}
+		var typeMigrated bool
+		for _, fID := range fIDs {
+			ok, err := db.migrateLogFile(dataType, fID)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				name, _ := bitcask.LogFileName("", fID, bitcask.FileType(dataType))
+				migrated = append(migrated, name)
+				typeMigrated = true
+			}
+		}
+		if !typeMigrated {
+			continue
+		}
+		// record变长了，无效字节数跟着变，按新文件重新统计
+		report := &CheckReport{}
+		if _, err = db.checkDataType(dataType, report, true); err != nil {
+			return nil, err
+		}
+		if !report.OK() {
+			logger.Warnf("problems found after migrating dataType [%v]: %v", dataType, report.Problems)
+		}
+	}
+	if err = db.syncDBPath(); err != nil {
+		return nil, err
+	}
+	return migrated, nil
+}
+
+// 把一个v1日志文件重写成当前版本，文件大小不小于原文件，已经是新版本的文件跳过
+func (db *SDB) migrateLogFile(dataType DataType, fID uint32) (bool, error) {
+	fType := bitcask.FileType(dataType)
+	name, err := bitcask.LogFileName(db.opts.DBPath, fID, fType)
+	if err != nil {
+		return false, err
+	}
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		return false, err
+	}
+	header, _, err := bitcask.DecodeLogFileHeader(buf)
+	if err != nil {
+		return false, err
+	}
+	if header.Version == bitcask.CurrentLogFileVersion {
+		return false, nil
+	}
+
+	// v1文件不会加密
+	records, corrupted := scanLogFile(fID, buf, header.Version, 0, nil)
+	if len(corrupted) > 0 {
+		logger.Errorf("log file [%v] is corrupted at offset %v, run sdb-check --repair first", filepath.Base(name), corrupted)
+		return false, ErrCorruptLogFile
+	}
+	stat, err := os.Stat(name)
+	if err != nil {
+		return false, err
+	}
+	modTime := stat.ModTime().UnixNano()
+
+	newBuf := bitcask.EncodeLogFileHeader(&bitcask.LogFileHeader{
+		Version:   bitcask.CurrentLogFileVersion,
+		FileType:  fType,
+		CreatedAt: modTime,
+	})
+	for _, record := range records {
+		keep, err := migrateRecordKey(dataType, record)
+		if err != nil {
+			logger.Errorf("convert record key of log file [%v] at offset %v err: %v", filepath.Base(name), record.offset, err)
+			return false, err
+		}
+		if !keep {
+			continue
+		}
+		record.lr.Timestamp = modTime
+		recordBuf, _ := bitcask.EncodeRecordVersion(record.lr, bitcask.CurrentLogFileVersion)
+		newBuf = append(newBuf, recordBuf...)
+	}
+	// 保留原来预分配的空间，活跃文件升级后还能继续写
+	if len(newBuf) < len(buf) {
+		newBuf = append(newBuf, make([]byte, len(buf)-len(newBuf))...)
+	}
+
+	// 先删hint文件和索引快照，避免rename之后崩溃时用旧的位置加载新文件
+	db.removeIndexSnapshot()
+	if err = bitcask.RemoveHintFile(db.opts.DBPath, fID, fType); err != nil {
+		return false, err
+	}
+	tmpName := name + manifestTmpSuffix
+	if err = writeFileSync(tmpName, newBuf); err != nil {
+		return false, err
+	}
+	if err = os.Rename(tmpName, name); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// 把老版本编码的key转换成现在的编码，不是老版本编码的不变，返回false的record丢弃
+// hash：老的编码丢了field末尾header大小的字节，老版本重启后索引里的就是截断的field，按截断的field转换
+// set：老版本key是集合的key，value是成员，按成员的hash值编码；删除记录里没有成员，不知道删的是哪个，只能丢弃
+// zset：老版本key是key|score，value是成员，现在key是key|member，value是score；score末尾同样被截断，按剩下的部分解析
+func migrateRecordKey(dataType DataType, record *checkRecord) (bool, error) {
+	lr := record.lr
+	if !legacyRecordKey(dataType, lr) {
+		return true, nil
+	}
+	switch dataType {
+	case Hash:
+		key, field, _ := utils.DecodeLegacyHashKey(lr.Key)
+		lr.Key = utils.EncodeHashKey(key, field)
+	case Set:
+		if lr.Type == bitcask.TypeDelete {
+			logger.Warnf("[migrate] drop set delete record without member, fid: [%v], offset: [%v], key: [%q]", record.fileID, record.offset, lr.Key)
+			return false, nil
+		}
+		hash := utils.NewMurmur128()
+		if err := hash.Write(lr.Value); err != nil {
+			return false, err
+		}
+		lr.Key = utils.EncodeSetKey(lr.Key, hash.EncodeSum128())
+	case ZSet:
+		key, scoreBuf, _ := utils.DecodeLegacyHashKey(lr.Key)
+		score, err := utils.StrToFloat64(string(scoreBuf))
+		if err != nil {
+			score = 0
+		}
+		logger.Warnf("[migrate] zset score was truncated by the old key encoding, fid: [%v], offset: [%v], key: [%q], member: [%q], score: [%q] -> [%v]",
+			record.fileID, record.offset, key, lr.Value, scoreBuf, score)
+		lr.Key, lr.Value = utils.EncodeZSetKey(key, lr.Value), []byte(utils.Float64ToStr(score))
+	}
+	return true, nil
+}
@@ -0,0 +1,206 @@
+package sdb
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"sdb/bitcask"
+	"sdb/options"
+	"sdb/utils"
+)
+
+// 按老版本的格式写日志文件：没有文件头，record从offset 0开始，后面是预分配的0
+func writeV1LogFile(t *testing.T, opts options.Options, fType bitcask.FileType, fID uint32, records ...*bitcask.LogRecord) {
+	buf := make([]byte, 0, opts.LogFileSizeThreshold)
+	for _, record := range records {
+		recordBuf, _ := bitcask.EncodeRecord(record)
+		buf = append(buf, recordBuf...)
+	}
+	buf = append(buf, make([]byte, int(opts.LogFileSizeThreshold)-len(buf))...)
+	name, _ := bitcask.LogFileName(opts.DBPath, fID, fType)
+	assert.Nil(t, os.WriteFile(name, buf, 0644))
+}
+
+func TestMigrate(t *testing.T) {
+	pwd, _ := os.Getwd()
+	opts := options.NewDefaultOptions(filepath.Join(pwd, "test/migrate"))
+	opts.LogFileSizeThreshold = 4 << 10
+	opts.LogFileMergeInterval = 0
+	opts.CountBufferSize = 1024
+	assert.Nil(t, os.MkdirAll(opts.DBPath, os.ModePerm))
+	defer func() {
+		_ = os.RemoveAll(opts.DBPath)
+	}()
+
+	writeCount := 20
+	var records []*bitcask.LogRecord
+	for i := 0; i < writeCount; i++ {
+		records = append(records, &bitcask.LogRecord{Key: getTestKey(i), Value: getTestValue(i)})
+	}
+	writeV1LogFile(t, opts, bitcask.Str, 0, records...)
+	// 第二个文件覆盖和删除第一个文件中的数据
+	writeV1LogFile(t, opts, bitcask.Str, 1,
+		&bitcask.LogRecord{Key: getTestKey(0), Value: []byte("new")},
+		&bitcask.LogRecord{Key: getTestKey(1), Type: bitcask.TypeDelete},
+	)
+	writeV1LogFile(t, opts, bitcask.Hash, 0,
+		&bitcask.LogRecord{Key: utils.EncodeHashKey([]byte("hash"), []byte("f1")), Value: []byte("v1")},
+	)
+
+	assertValues := func(db *SDB) {
+		val, err := db.Get(getTestKey(0))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("new"), val)
+		_, err = db.Get(getTestKey(1))
+		assert.Equal(t, ErrKeyNotFound, err)
+		for i := 2; i < writeCount; i++ {
+			val, err := db.Get(getTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, getTestValue(i), val)
+		}
+		val, err = db.Get([]byte("after"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v1 file"), val)
+		val, err = db.HGet([]byte("hash"), []byte("f1"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v1"), val)
+	}
+
+	// 不升级也能打开老版本的目录，v1的活跃文件继续按v1写
+	db, err := OpenDB(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, bitcask.LogFileV1, db.activeFiles[String].Header.Version)
+	assert.Nil(t, db.Set([]byte("after"), []byte("v1 file")))
+	assertValues(db)
+	assert.Nil(t, db.CloseDB())
+
+	migrated, err := Migrate(opts.DBPath, nil)
+	assert.Nil(t, err)
+	assert.Len(t, migrated, 3)
+	for _, name := range migrated {
+		buf, err := os.ReadFile(filepath.Join(opts.DBPath, name))
+		assert.Nil(t, err)
+		header, _, err := bitcask.DecodeLogFileHeader(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, bitcask.CurrentLogFileVersion, header.Version)
+	}
+	report, err := Check(opts.DBPath, false, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Problems)
+
+	// 已经是新版本的文件不再处理
+	migrated, err = Migrate(opts.DBPath, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, migrated)
+
+	db, err = OpenDB(opts)
+	assert.Nil(t, err)
+	assertValues(db)
+	assert.Nil(t, db.CloseDB())
+
+	t.Run("corrupted", func(t *testing.T) {
+		opts := opts
+		opts.DBPath = filepath.Join(pwd, "test/migrate-corrupted")
+		assert.Nil(t, os.MkdirAll(opts.DBPath, os.ModePerm))
+		defer func() {
+			_ = os.RemoveAll(opts.DBPath)
+		}()
+		writeV1LogFile(t, opts, bitcask.Str, 0, records...)
+		name, _ := bitcask.LogFileName(opts.DBPath, 0, bitcask.Str)
+		buf, err := os.ReadFile(name)
+		assert.Nil(t, err)
+		buf[10] ^= 0xff
+		assert.Nil(t, os.WriteFile(name, buf, 0644))
+
+		_, err = Migrate(opts.DBPath, nil)
+		assert.Equal(t, ErrCorruptLogFile, err)
+	})
+
+	t.Run("unfinished merge", func(t *testing.T) {
+		opts := opts
+		opts.DBPath = filepath.Join(pwd, "test/migrate-merge")
+		assert.Nil(t, os.MkdirAll(opts.DBPath, os.ModePerm))
+		defer func() {
+			_ = os.RemoveAll(opts.DBPath)
+		}()
+		db := &SDB{opts: opts}
+		assert.Nil(t, os.WriteFile(db.mergeMarkerName(String), nil, 0644))
+
+		_, err := Migrate(opts.DBPath, nil)
+		assert.Equal(t, ErrUnfinishedMerge, err)
+	})
+}
+
+// 老版本的hash、zset key编码：没给header分配空间，field末尾被截断
+func legacyEncodeHashKey(key, field []byte) []byte {
+	header := make([]byte, utils.MaxHashKeyHeader)
+	var index int
+	index += binary.PutVarint(header[index:], int64(len(key)))
+	index += binary.PutVarint(header[index:], int64(len(field)))
+	buf := make([]byte, len(key)+len(field))
+	copy(buf[:index], header)
+	copy(buf[index:], key)
+	copy(buf[index+len(key):], field)
+	return buf
+}
+
+// 老版本写的hash、set、zset record打开时报错，升级时转换成现在的编码
+func TestMigrate_LegacyKeys(t *testing.T) {
+	pwd, _ := os.Getwd()
+	opts := options.NewDefaultOptions(filepath.Join(pwd, "test/migrate-legacy"))
+	opts.LogFileSizeThreshold = 4 << 10
+	opts.LogFileMergeInterval = 0
+	opts.CountBufferSize = 1024
+	assert.Nil(t, os.MkdirAll(opts.DBPath, os.ModePerm))
+	defer func() {
+		_ = os.RemoveAll(opts.DBPath)
+	}()
+
+	hashKey, setKey, zsetKey := []byte("hash"), []byte("set"), []byte("zset")
+	writeV1LogFile(t, opts, bitcask.Hash, 0,
+		&bitcask.LogRecord{Key: legacyEncodeHashKey(hashKey, []byte("first-field")), Value: []byte("v1")},
+		&bitcask.LogRecord{Key: legacyEncodeHashKey(hashKey, []byte("second-field")), Value: []byte("v2")},
+		&bitcask.LogRecord{Key: legacyEncodeHashKey(hashKey, []byte("second-field")), Type: bitcask.TypeDelete},
+	)
+	// 老版本的set record：key是集合的key，value是成员，删除记录没有成员
+	writeV1LogFile(t, opts, bitcask.Set, 0,
+		&bitcask.LogRecord{Key: setKey, Value: []byte("m1")},
+		&bitcask.LogRecord{Key: setKey, Value: []byte("m2")},
+		&bitcask.LogRecord{Key: setKey, Type: bitcask.TypeDelete},
+	)
+	// 老版本的zset record：key是key|score，value是成员
+	writeV1LogFile(t, opts, bitcask.ZSet, 0,
+		&bitcask.LogRecord{Key: legacyEncodeHashKey(zsetKey, []byte("12.5")), Value: []byte("m1")},
+	)
+
+	_, err := OpenDB(opts)
+	assert.Equal(t, ErrLegacyRecordKey, err)
+
+	migrated, err := Migrate(opts.DBPath, nil)
+	assert.Nil(t, err)
+	assert.Len(t, migrated, 3)
+	report, err := Check(opts.DBPath, false, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Problems)
+
+	db, err := OpenDB(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db.CloseDB()
+	}()
+	// field末尾丢掉了header大小（这里是2）的字节，和老版本重启后的索引一样
+	val, err := db.HGet(hashKey, []byte("first-fie"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+	val, err = db.HGet(hashKey, []byte("second-fie"))
+	assert.Nil(t, err)
+	assert.Nil(t, val)
+	assert.True(t, db.SIsMember(setKey, []byte("m1")))
+	assert.True(t, db.SIsMember(setKey, []byte("m2")))
+	ok, score := db.ZScore(zsetKey, []byte("m1"))
+	assert.True(t, ok)
+	assert.Equal(t, float64(12), score)
+}
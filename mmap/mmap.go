@@ -18,3 +18,9 @@ func MUnmap(b []byte) error {
 func MSync(b []byte) error {
 	return msync(b)
 }
+
+// MRemap 调整映射的大小，映射的地址可能会变，之前返回的内存不能再用
+// 扩大映射前文件要先扩展到size，否则访问超出文件的部分会SIGBUS
+func MRemap(fd *os.File, b []byte, size int64) ([]byte, error) {
+	return mremap(fd, b, size)
+}
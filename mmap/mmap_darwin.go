@@ -24,3 +24,11 @@ func munmap(b []byte) error {
 func msync(b []byte) error {
 	return unix.Msync(b, unix.MS_SYNC)
 }
+
+// darwin没有mremap，先解除映射再重新映射
+func mremap(fd *os.File, b []byte, size int64) ([]byte, error) {
+	if err := munmap(b); err != nil {
+		return nil, err
+	}
+	return mmap(fd, true, size)
+}
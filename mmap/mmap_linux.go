@@ -8,20 +8,20 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func Mmap(file *os.File, writable bool, size int) ([]byte, error) {
+func mmap(file *os.File, writable bool, size int64) ([]byte, error) {
 	mType := unix.PROT_READ // 映射可读区
 	if writable {           // 映射可写区
 		mType |= unix.PROT_WRITE
 	}
 	// MAP_SHARED指定了进程对内存区域的修改会影响到映射文件。
-	return unix.Mmap(int(file.Fd()), 0, size, mType, unix.MAP_SHARED)
+	return unix.Mmap(int(file.Fd()), 0, int(size), mType, unix.MAP_SHARED)
 }
 
 // Munmap 释放由mmap创建的这段内存空间
 // int munmap(void *start, size_t length);
 // 前者是内存映射的起始地址,后者是内存映射的长度 ;
 // munmap函数成功返回0.失败返回-1并设置errno
-func Munmap(data []byte) error {
+func munmap(data []byte) error {
 	if len(data) == 0 || len(data) != cap(data) {
 		return unix.EINVAL
 	}
@@ -39,11 +39,15 @@ func Munmap(data []byte) error {
 
 // Msync 把在该内存段的某个部分或者整段中的修改写回到被映射的文件中（或者从被映射文件里读出）。
 // int msync(void* addr, size_t len, int flags);
-func Msync(b []byte) error {
+func msync(b []byte) error {
 	// MS_SYNC采用同步写方式
 	return unix.Msync(b, unix.MS_SYNC)
 }
 
+func mremap(_ *os.File, data []byte, size int64) ([]byte, error) {
+	return Mremap(data, int(size))
+}
+
 // Mremap 扩大/缩小现有内存映射，flags参数还可以控制是否需要页对齐
 // 成功，返回一个指向新虚拟内存区域的指针。
 // 失败，返回MAP_FAILED。
@@ -21,8 +21,63 @@ const (
 	FileIO IOType = iota
 	// MMap Memory Map.
 	MMap
+	// BufferedIO 标准IO加用户态写缓冲，小value追加写少很多系统调用，进程崩溃会丢失缓冲中的数据
+	BufferedIO
+	// DirectIO 用O_DIRECT读写，不经过page cache，不会和其他服务抢缓存，读写都要按块对齐，单次读写更慢
+	DirectIO
 )
 
+// CompressionType value压缩方式
+type CompressionType int8
+
+const (
+	// NoCompression 不压缩
+	NoCompression CompressionType = iota
+	// FlateCompression 标准库compress/flate
+	FlateCompression
+)
+
+// SyncMode 刷盘策略的类型
+type SyncMode int8
+
+const (
+	// SyncModeNever 写操作不主动刷盘，交给操作系统
+	SyncModeNever SyncMode = iota
+	// SyncModeAlways 每次写操作之后刷盘
+	SyncModeAlways
+	// SyncModeInterval 后台协程定时刷盘
+	SyncModeInterval
+	// SyncModeBytes 活跃文件每写入一定的字节数刷盘
+	SyncModeBytes
+)
+
+// SyncPolicy 刷盘策略，用SyncNever、SyncAlways、SyncEveryInterval、SyncEveryNBytes设置
+type SyncPolicy struct {
+	Mode     SyncMode
+	Interval time.Duration // SyncModeInterval的刷盘间隔
+	Bytes    int64         // SyncModeBytes每个活跃文件写多少字节刷一次盘
+}
+
+var (
+	// SyncNever 不主动刷盘，进程崩溃不丢数据，机器掉电可能丢还在page cache中的写入
+	SyncNever = SyncPolicy{Mode: SyncModeNever}
+	// SyncAlways 每次写操作返回前数据都已经刷盘，最安全也最慢，并发的写操作组提交，一次刷盘持久化一批
+	SyncAlways = SyncPolicy{Mode: SyncModeAlways}
+)
+
+// SyncEveryInterval 后台每隔d刷一次所有活跃文件和count file，掉电最多丢d时间内的写入，类似redis的appendfsync everysec
+func SyncEveryInterval(d time.Duration) SyncPolicy {
+	return SyncPolicy{Mode: SyncModeInterval, Interval: d}
+}
+
+// SyncEveryNBytes 每个活跃文件写入n字节刷一次盘，掉电每种数据类型最多丢n字节的写入
+func SyncEveryNBytes(n int64) SyncPolicy {
+	return SyncPolicy{Mode: SyncModeBytes, Bytes: n}
+}
+
+// KeyProvider 按key id返回密钥，用于轮换密钥之后读取用老密钥加密的文件
+type KeyProvider func(keyID uint32) ([]byte, error)
+
 // Options for opening a db.
 type Options struct {
 	// 数据文件路径
@@ -34,20 +89,53 @@ type Options struct {
 	// IO方式
 	IoType IOType
 
-	// 写操作是否立刻刷盘
+	// 写操作是否立刻刷盘，true等同于SyncPolicy设置为SyncAlways
 	Sync bool
 
+	// 刷盘策略，默认SyncNever
+	SyncPolicy SyncPolicy
+
+	// 后台刷盘出错时的回调，nil时只打日志
+	OnSyncError func(err error)
+
 	// merge操作间隔时间
 	LogFileMergeInterval time.Duration
 
 	// 存储空间达到阈值的文件将会加入merge列表，从占用率从大到小进行merge
 	LogFileMergeRatio float64
 
-	// 每个文件的最大大小
+	// 每个文件的最大大小，修改后只对新建的文件生效，已有的文件还按建立时的大小
 	LogFileSizeThreshold int64
 
 	// 向countFile发送的channel缓冲大小
 	CountBufferSize int
+
+	// BitCaskMode下缓存读过的value占用的字节数上限，热点key不用每次读文件，0表示不缓存
+	ValueCacheSize int64
+
+	// 非活跃的日志文件和blob文件只读，读的时候才打开，同时打开的个数超过它时关闭最久没读过的，小于等于0不限制
+	MaxOpenFiles int
+
+	// 启动时活跃文件尾部写坏的record（断电时写了一半）是否截断丢弃，false时拒绝打开
+	RecoverTornWrite bool
+
+	// value压缩方式，只影响之后写入的record，已经写入的record可以通过merge按新的设置重写
+	Compression CompressionType
+
+	// 小于这个大小的value不压缩，压缩收益太小
+	CompressMinSize int
+
+	// 不小于这个大小的value单独写到blob文件，日志文件中只保存指针，0表示不分离；zset的value是分值，不分离
+	BlobThreshold int
+
+	// 静态加密的密钥，AES-128/192/256，为空表示新文件不加密
+	EncryptionKey []byte
+
+	// EncryptionKey的id，写在文件头中，不能是0；轮换密钥时换一个新的id
+	EncryptionKeyID uint32
+
+	// 读取用其他密钥加密的文件时按key id获取密钥，只设置它不设置EncryptionKey时，新文件用EncryptionKeyID对应的密钥加密
+	KeyProvider KeyProvider
 }
 
 func NewDefaultOptions(path string) Options {
@@ -56,9 +144,14 @@ func NewDefaultOptions(path string) Options {
 		StoreMode:            BitCaskMode,
 		IoType:               FileIO,
 		Sync:                 false,
+		SyncPolicy:           SyncNever,
 		LogFileMergeInterval: time.Hour * 8,
 		LogFileMergeRatio:    0.5,
 		LogFileSizeThreshold: 512 << 20,
 		CountBufferSize:      8 << 20,
+		MaxOpenFiles:         512,
+		RecoverTornWrite:     true,
+		Compression:          NoCompression,
+		CompressMinSize:      256,
 	}
 }
@@ -3,6 +3,7 @@ package sdb
 import (
 	"sdb/art"
 	"sdb/bitcask"
+	"sdb/utils"
 )
 
 // set和list区别：最大的不同就是List是可以重复的。而Set是不能重复的。
@@ -18,13 +19,15 @@ import (
 // key->[sum1->keyDir1|sum2->keyDir2]
 // 这样O(1)查找效率，空间换时间
 // 缺点：查找插入删除都需要hash运算，不过与读写磁盘相比影响不大
+// 文件中record的key是key和sum编码生成的setKey，value是mem，删除时写setKey的删除记录
+// 这样启动时只根据record的key就能重建每个key的ar树
 
 // SAdd 将指定的成员添加到存储在 key 的集合中。
 // 已经是该集合成员的指定成员将被忽略。
 // 如果key不存在，则在添加指定成员之前创建一个新集合。
-func (db *SDB) SAdd(key []byte, members ...[]byte) error {
+func (db *SDB) SAdd(key []byte, members ...[]byte) (err error) {
 	db.setIndex.mu.Lock()
-	defer db.setIndex.mu.Unlock()
+	defer db.unlockAndSync(Set, &err)
 
 	if db.setIndex.trees[string(key)] == nil {
 		db.setIndex.trees[string(key)] = art.NewART()
@@ -36,14 +39,17 @@ func (db *SDB) SAdd(key []byte, members ...[]byte) error {
 			continue
 		}
 		// 对mem算一个hash值，内存放hash值，value放磁盘
-		if err := db.setIndex.murmurhash.Write(mem); err != nil {
+		sum, err := db.setMemberSum(mem)
+		if err != nil {
 			return err
 		}
-		sum := db.setIndex.murmurhash.EncodeSum128()
-		db.setIndex.murmurhash.Reset()
+		// 已经是集合成员，忽略
+		if db.setIndex.idxTree.Get(sum) != nil {
+			continue
+		}
 
 		record := &bitcask.LogRecord{
-			Key:   key,
+			Key:   utils.EncodeSetKey(key, sum),
 			Value: mem,
 		}
 		valuePos, err := db.writeLogRecord(record, Set)
@@ -59,9 +65,9 @@ func (db *SDB) SAdd(key []byte, members ...[]byte) error {
 }
 
 // SPop 从 key 处的设置值存储中删除并返回一个或多个随机成员。
-func (db *SDB) SPop(key []byte, count uint) ([][]byte, error) {
+func (db *SDB) SPop(key []byte, count uint) (members [][]byte, err error) {
 	db.setIndex.mu.Lock()
-	defer db.setIndex.mu.Unlock()
+	defer db.unlockAndSync(Set, &err)
 	if db.setIndex.trees[string(key)] == nil {
 		return nil, nil
 	}
@@ -91,22 +97,116 @@ func (db *SDB) SPop(key []byte, count uint) ([][]byte, error) {
 	return values, nil
 }
 
+// SRem 从 key 处的集合中删除指定的成员，不是集合成员的忽略。
+func (db *SDB) SRem(key []byte, members ...[]byte) (err error) {
+	db.setIndex.mu.Lock()
+	defer db.unlockAndSync(Set, &err)
+
+	if db.setIndex.trees[string(key)] == nil {
+		return nil
+	}
+	for _, mem := range members {
+		if err := db.sremInternal(key, mem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SIsMember 判断 member 是否是 key 处的集合的成员。
+func (db *SDB) SIsMember(key, member []byte) bool {
+	db.setIndex.mu.RLock()
+	defer db.setIndex.mu.RUnlock()
+
+	tree := db.setIndex.trees[string(key)]
+	if tree == nil {
+		return false
+	}
+	// 读锁下可能有多个协程并发，不能用共享的murmurhash
+	murmurhash := utils.NewMurmur128()
+	if err := murmurhash.Write(member); err != nil {
+		return false
+	}
+	return tree.Get(murmurhash.EncodeSum128()) != nil
+}
+
+// SMembers 返回 key 处的集合的所有成员。
+func (db *SDB) SMembers(key []byte) ([][]byte, error) {
+	// 要切换idxTree，加写锁
+	db.setIndex.mu.Lock()
+	defer db.setIndex.mu.Unlock()
+
+	if db.setIndex.trees[string(key)] == nil {
+		return nil, nil
+	}
+	db.setIndex.idxTree = db.setIndex.trees[string(key)]
+
+	var values [][]byte
+	it := db.setIndex.idxTree.Iterator()
+	for it.HasNext() {
+		node, _ := it.Next()
+		if node == nil {
+			continue
+		}
+		val, err := db.getVal(node.Key(), Set)
+		if err != nil && err != ErrKeyNotFound {
+			return nil, err
+		}
+		if err == nil {
+			values = append(values, val)
+		}
+	}
+	return values, nil
+}
+
+// SCard 返回 key 处的集合的成员个数。
+func (db *SDB) SCard(key []byte) int {
+	db.setIndex.mu.RLock()
+	defer db.setIndex.mu.RUnlock()
+
+	if db.setIndex.trees[string(key)] == nil {
+		return 0
+	}
+	return db.setIndex.trees[string(key)].Size()
+}
+
 func (db *SDB) sremInternal(key []byte, member []byte) error {
+	if db.setIndex.trees[string(key)] == nil {
+		return nil
+	}
 	db.setIndex.idxTree = db.setIndex.trees[string(key)]
 
-	if err := db.setIndex.murmurhash.Write(member); err != nil {
+	sum, err := db.setMemberSum(member)
+	if err != nil {
 		return err
 	}
-	sum := db.setIndex.murmurhash.EncodeSum128()
-	db.setIndex.murmurhash.Reset()
+	// 不是集合成员，不需要写删除记录
+	if db.setIndex.idxTree.Get(sum) == nil {
+		return nil
+	}
 
-	entry := &bitcask.LogRecord{Key: key, Type: bitcask.TypeDelete}
+	entry := &bitcask.LogRecord{Key: utils.EncodeSetKey(key, sum), Type: bitcask.TypeDelete}
 	keyDir, err := db.writeLogRecord(entry, Set)
 	if err != nil {
 		return err
 	}
 
-	err = db.deleteIndexTree(sum, keyDir, Set)
-
+	if err = db.deleteIndexTree(sum, keyDir, Set); err != nil {
+		return err
+	}
+	// 集合空了，释放这个key的索引树
+	if db.setIndex.idxTree.Size() == 0 {
+		delete(db.setIndex.trees, string(key))
+	}
 	return nil
 }
+
+// 计算集合成员的hash值，内存中用hash值代替成员本身
+func (db *SDB) setMemberSum(member []byte) ([]byte, error) {
+	if err := db.setIndex.murmurhash.Write(member); err != nil {
+		return nil, err
+	}
+	sum := db.setIndex.murmurhash.EncodeSum128()
+	db.setIndex.murmurhash.Reset()
+	return sum, nil
+}
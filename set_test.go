@@ -0,0 +1,100 @@
+package sdb
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"sdb/options"
+)
+
+func TestSDB_Set(t *testing.T) {
+	t.Run("Standard Io", func(t *testing.T) {
+		testSDBSet(t, options.FileIO, options.BitCaskMode)
+	})
+
+	t.Run("MMap IO", func(t *testing.T) {
+		testSDBSet(t, options.MMap, options.BitCaskMode)
+	})
+
+	t.Run("Memory Mode", func(t *testing.T) {
+		testSDBSet(t, options.FileIO, options.MemoryMode)
+	})
+}
+
+func testSDBSet(t *testing.T, ioType options.IOType, mode options.StoreMode) {
+	pwd, _ := os.Getwd()
+	path := filepath.Join(pwd, "test/set")
+	opts := options.NewDefaultOptions(path)
+	opts.IoType = ioType
+	opts.StoreMode = mode
+	db, err := OpenDB(opts)
+	assert.Nil(t, err)
+	defer func() {
+		clearDB(db)
+	}()
+
+	key := []byte("set")
+	assert.Nil(t, db.SAdd(key, []byte("a"), []byte("b"), []byte("c"), []byte("d")))
+	// 重复添加忽略
+	assert.Nil(t, db.SAdd(key, []byte("a"), nil))
+	assert.Equal(t, 4, db.SCard(key))
+	assert.True(t, db.SIsMember(key, []byte("a")))
+	assert.False(t, db.SIsMember(key, []byte("e")))
+	assert.False(t, db.SIsMember([]byte("not-exist"), []byte("a")))
+
+	assert.Nil(t, db.SRem(key, []byte("b"), []byte("not-member")))
+	assert.False(t, db.SIsMember(key, []byte("b")))
+	assert.Equal(t, 3, db.SCard(key))
+	assertSetMembers(t, db, key, "a", "c", "d")
+
+	popped, err := db.SPop(key, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(popped))
+	assert.False(t, db.SIsMember(key, popped[0]))
+	assert.Equal(t, 2, db.SCard(key))
+	members, err := db.SMembers(key)
+	assert.Nil(t, err)
+
+	// 删除后再添加
+	assert.Nil(t, db.SAdd([]byte("set-2"), []byte("x")))
+	assert.Nil(t, db.SRem([]byte("set-2"), []byte("x")))
+	assert.Nil(t, db.SAdd([]byte("set-2"), []byte("x")))
+	assert.Nil(t, db.SRem([]byte("set-3"), []byte("x")))
+
+	// 重启后集合完全一致，分别从快照和日志文件恢复
+	for _, removeSnapshot := range []bool{false, true} {
+		assert.Nil(t, db.CloseDB())
+		if removeSnapshot {
+			assert.Nil(t, os.Remove(filepath.Join(path, indexSnapshotFileName)))
+		}
+		db, err = OpenDB(opts)
+		assert.Nil(t, err)
+
+		assertSetMembers(t, db, key, bytesToStrings(members)...)
+		assert.Equal(t, 2, db.SCard(key))
+		assert.False(t, db.SIsMember(key, []byte("b")))
+		assert.False(t, db.SIsMember(key, popped[0]))
+		assertSetMembers(t, db, []byte("set-2"), "x")
+		assert.Equal(t, 0, db.SCard([]byte("set-3")))
+	}
+}
+
+func assertSetMembers(t *testing.T, db *SDB, key []byte, want ...string) {
+	members, err := db.SMembers(key)
+	assert.Nil(t, err)
+	got := bytesToStrings(members)
+	sort.Strings(got)
+	sort.Strings(want)
+	assert.Equal(t, want, got)
+}
+
+func bytesToStrings(values [][]byte) []string {
+	var res []string
+	for _, val := range values {
+		res = append(res, string(val))
+	}
+	return res
+}
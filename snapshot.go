@@ -0,0 +1,432 @@
+package sdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"sdb/art"
+	"sdb/bitcask"
+	"sdb/ioselector"
+	"sdb/logger"
+	"sdb/utils"
+)
+
+// 索引快照：CloseDB时把内存中五种索引dump到快照文件，下次OpenDB直接加载快照，
+// 只需要重放快照之后写入的日志，不用从头读所有日志文件
+// 快照文件中每条记录复用LogRecord的编码格式，type字段表示记录种类：
+// +--------+---------+---------+-----+--------+
+// | header | entry 1 | entry 2 | ... | footer |
+// +--------+---------+---------+-----+--------+
+// header: key是magic，value是版本号、存储模式以及每种数据类型的活跃文件id和写offset
+// entry:  key是 data_type | tree_key+key，value是编码后的keyDir
+// member: 有序集合的成员，key是 key+score，value是member
+// footer: value是之前所有字节的crc32
+
+const (
+	// 2: keyDir中加了blob指针
+	snapshotVersion byte = 2
+
+	// 每攒够这么多字节写一次文件
+	snapshotBufferSize = 4 << 20
+)
+
+const (
+	snapshotHeader bitcask.RecordType = iota
+	snapshotEntry
+	snapshotZSetMember
+	snapshotFooter
+)
+
+var (
+	snapshotMagic = []byte("SDB_INDEX_SNAPSHOT")
+
+	// ErrInvalidSnapshot 快照文件损坏或者和当前数据文件不匹配
+	ErrInvalidSnapshot = errors.New("invalid index snapshot")
+)
+
+// snapshotPos 快照时每种数据类型活跃文件写到的位置，启动时从这个位置开始重放日志
+type snapshotPos struct {
+	fileID uint32
+	offset int64
+}
+
+// 快照写入器，攒够一批再通过dumpState写文件
+type snapshotWriter struct {
+	selector ioselector.IOSelector
+	buf      []byte
+	offset   int64
+	crc      uint32
+}
+
+func (w *snapshotWriter) append(lr *bitcask.LogRecord) error {
+	buf, _ := bitcask.EncodeRecord(lr)
+	w.crc = crc32.Update(w.crc, crc32.IEEETable, buf)
+	w.buf = append(w.buf, buf...)
+	if len(w.buf) >= snapshotBufferSize {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *snapshotWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	n, err := w.selector.Write(w.buf, w.offset)
+	if err != nil {
+		return err
+	}
+	w.offset += int64(n)
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// dumpIndexSnapshot 把内存中的索引dump到快照文件，先写临时文件再rename
+// 快照中的key是明文，开启加密时不生成，之前的快照也删掉
+func (db *SDB) dumpIndexSnapshot() (err error) {
+	if db.keyring != nil {
+		db.removeIndexSnapshot()
+		return nil
+	}
+	// 加锁顺序和读写操作一致：先加索引锁，再加db锁
+	for _, mu := range db.indexLocks() {
+		mu.RLock()
+		defer mu.RUnlock()
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	name := filepath.Join(db.opts.DBPath, indexSnapshotFileName)
+	tmpName := name + snapshotTmpSuffix
+	if db.dumpState, err = ioselector.NewStandardIOSelector(tmpName, snapshotBufferSize); err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := db.dumpState.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		db.dumpState = nil
+		if err != nil {
+			_ = os.Remove(tmpName)
+			return
+		}
+		if err = os.Rename(tmpName, name); err == nil {
+			err = db.syncDBPath()
+		}
+	}()
+
+	w := &snapshotWriter{selector: db.dumpState}
+	if err = w.append(&bitcask.LogRecord{Key: snapshotMagic, Value: db.encodeSnapshotHeader(), Type: snapshotHeader}); err != nil {
+		return
+	}
+
+	// String只有一棵索引树
+	if err = dumpIndexTree(w, String, nil, db.strIndex.idxTree); err != nil {
+		return
+	}
+	// 其他类型一个key对应一棵索引树
+	treesMap := map[DataType]map[string]*art.AdaptiveRadixTree{
+		List: db.listIndex.trees,
+		Hash: db.hashIndex.trees,
+		Set:  db.setIndex.trees,
+		ZSet: db.zsetIndex.trees,
+	}
+	for dataType := List; dataType < logFileTypeNum; dataType++ {
+		for treeKey, tree := range treesMap[dataType] {
+			if err = dumpIndexTree(w, dataType, []byte(treeKey), tree); err != nil {
+				return
+			}
+		}
+	}
+
+	// 有序集合的跳表
+	members := make(chan *bitcask.LogRecord, 1024)
+	go func() {
+		db.zsetIndex.indexes.IterateAndSend(members, utils.EncodeZSetKey)
+		close(members)
+	}()
+	for member := range members {
+		member.Type = snapshotZSetMember
+		if err == nil {
+			err = w.append(member)
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	footer := make([]byte, 4)
+	binary.LittleEndian.PutUint32(footer, w.crc)
+	if err = w.append(&bitcask.LogRecord{Value: footer, Type: snapshotFooter}); err != nil {
+		return
+	}
+	if err = w.flush(); err != nil {
+		return
+	}
+	return db.dumpState.Sync()
+}
+
+func dumpIndexTree(w *snapshotWriter, dataType DataType, treeKey []byte, tree *art.AdaptiveRadixTree) error {
+	if tree == nil {
+		return nil
+	}
+	it := tree.Iterator()
+	for it.HasNext() {
+		node, _ := it.Next()
+		if node == nil {
+			continue
+		}
+		kd, _ := node.Value().(*keyDir)
+		if kd == nil {
+			continue
+		}
+		key := append([]byte{byte(dataType)}, utils.EncodeHashKey(treeKey, node.Key())...)
+		if err := w.append(&bitcask.LogRecord{Key: key, Value: encodeKeyDir(kd), Type: snapshotEntry}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 快照header：version | store_mode | 每种数据类型 [has_file | file_id | offset]
+func (db *SDB) encodeSnapshotHeader() []byte {
+	buf := make([]byte, 2+logFileTypeNum*(1+binary.MaxVarintLen32+binary.MaxVarintLen64))
+	buf[0] = snapshotVersion
+	buf[1] = byte(db.opts.StoreMode)
+	index := 2
+	for dataType := String; dataType < logFileTypeNum; dataType++ {
+		activeFile := db.activeFiles[dataType]
+		if activeFile == nil {
+			index++
+			continue
+		}
+		buf[index] = 1
+		index++
+		index += binary.PutUvarint(buf[index:], uint64(activeFile.FileID))
+		index += binary.PutVarint(buf[index:], atomic.LoadInt64(&activeFile.WriteOffSet))
+	}
+	return buf[:index]
+}
+
+func (db *SDB) decodeSnapshotHeader(buf []byte) (map[DataType]*snapshotPos, error) {
+	if len(buf) < 2 || buf[0] != snapshotVersion || buf[1] != byte(db.opts.StoreMode) {
+		return nil, ErrInvalidSnapshot
+	}
+	positions := make(map[DataType]*snapshotPos)
+	index := 2
+	for dataType := String; dataType < logFileTypeNum; dataType++ {
+		if index >= len(buf) {
+			return nil, ErrInvalidSnapshot
+		}
+		hasFile := buf[index] == 1
+		index++
+		if !hasFile {
+			continue
+		}
+		fileID, n := binary.Uvarint(buf[index:])
+		if n <= 0 {
+			return nil, ErrInvalidSnapshot
+		}
+		index += n
+		offset, n := binary.Varint(buf[index:])
+		if n <= 0 {
+			return nil, ErrInvalidSnapshot
+		}
+		index += n
+		positions[dataType] = &snapshotPos{fileID: uint32(fileID), offset: offset}
+	}
+	return positions, nil
+}
+
+// loadIndexSnapshot 加载索引快照，返回每种数据类型需要开始重放日志的位置
+// 快照不存在、损坏或者和当前数据文件不匹配时返回nil，需要从日志文件重建全部索引
+func (db *SDB) loadIndexSnapshot() map[DataType]*snapshotPos {
+	name := filepath.Join(db.opts.DBPath, indexSnapshotFileName)
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warnf("read index snapshot err: [%v]", err)
+		}
+		return nil
+	}
+
+	positions, err := db.loadIndexSnapshotFromBuf(buf)
+	if err != nil {
+		logger.Warnf("load index snapshot err, rebuild index from log files: [%v]", err)
+		// 可能已经加载了一部分，全部重置
+		db.strIndex, db.listIndex, db.hashIndex = newStrIndex(), newListIndex(), newHashIndex()
+		db.setIndex, db.zsetIndex = newSetIndex(), newZSetIndex()
+		return nil
+	}
+	return positions
+}
+
+func (db *SDB) loadIndexSnapshotFromBuf(buf []byte) (map[DataType]*snapshotPos, error) {
+	header, offset, err := bitcask.DecodeRecord(buf)
+	if err != nil || header.Type != snapshotHeader || string(header.Key) != string(snapshotMagic) {
+		return nil, ErrInvalidSnapshot
+	}
+	positions, err := db.decodeSnapshotHeader(header.Value)
+	if err != nil {
+		return nil, err
+	}
+	// 快照记录的活跃文件必须还在，否则说明快照之后数据文件发生了变化
+	for dataType, pos := range positions {
+		if !containsFileID(db.fileIDMap[dataType], pos.fileID) {
+			return nil, ErrInvalidSnapshot
+		}
+	}
+
+	crc := crc32.ChecksumIEEE(buf[:offset])
+	for {
+		lr, size, err := bitcask.DecodeRecord(buf[offset:])
+		if err != nil {
+			return nil, ErrInvalidSnapshot
+		}
+		switch lr.Type {
+		case snapshotEntry:
+			err = db.loadSnapshotEntry(lr)
+		case snapshotZSetMember:
+			err = db.loadSnapshotZSetMember(lr)
+		case snapshotFooter:
+			if len(lr.Value) != 4 || binary.LittleEndian.Uint32(lr.Value) != crc {
+				return nil, ErrInvalidSnapshot
+			}
+			return positions, nil
+		default:
+			err = ErrInvalidSnapshot
+		}
+		if err != nil {
+			return nil, err
+		}
+		crc = crc32.Update(crc, crc32.IEEETable, buf[offset:offset+size])
+		offset += size
+	}
+}
+
+func (db *SDB) loadSnapshotEntry(lr *bitcask.LogRecord) error {
+	if len(lr.Key) == 0 {
+		return ErrInvalidSnapshot
+	}
+	kd, err := decodeKeyDir(lr.Value)
+	if err != nil {
+		return err
+	}
+	treeKey, key := utils.DecodeHashKey(lr.Key[1:])
+	// 索引树里的key要和日志文件的buf区分开，拷贝一份
+	key = append([]byte{}, key...)
+
+	var trees map[string]*art.AdaptiveRadixTree
+	switch DataType(lr.Key[0]) {
+	case String:
+		db.strIndex.idxTree.Put(key, kd)
+		return nil
+	case List:
+		trees = db.listIndex.trees
+	case Hash:
+		trees = db.hashIndex.trees
+	case Set:
+		trees = db.setIndex.trees
+	case ZSet:
+		trees = db.zsetIndex.trees
+	default:
+		return ErrInvalidSnapshot
+	}
+	if trees[string(treeKey)] == nil {
+		trees[string(treeKey)] = art.NewART()
+	}
+	trees[string(treeKey)].Put(key, kd)
+	return nil
+}
+
+func (db *SDB) loadSnapshotZSetMember(lr *bitcask.LogRecord) error {
+	key, scoreBuf := utils.DecodeZSetKey(lr.Key)
+	score, err := utils.StrToFloat64(string(scoreBuf))
+	if err != nil {
+		return ErrInvalidSnapshot
+	}
+	db.zsetIndex.indexes.ZAdd(string(key), score, string(lr.Value))
+	return nil
+}
+
+// 删除索引快照，数据文件发生快照无法感知的变化时（比如merge删除了文件）需要调用
+func (db *SDB) removeIndexSnapshot() {
+	name := filepath.Join(db.opts.DBPath, indexSnapshotFileName)
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		logger.Errorf("remove index snapshot err: [%v]", err)
+	}
+}
+
+// keyDir编码：file_id | record_size | record_offset | expired_at | has_blob | [blob指针] | value
+func encodeKeyDir(kd *keyDir) []byte {
+	buf := make([]byte, binary.MaxVarintLen32+binary.MaxVarintLen64*3+1, binary.MaxVarintLen32*2+binary.MaxVarintLen64*5+1+len(kd.value))
+	var index int
+	index += binary.PutUvarint(buf[index:], uint64(kd.fileID))
+	index += binary.PutVarint(buf[index:], int64(kd.recordSize))
+	index += binary.PutVarint(buf[index:], kd.recordOffset)
+	index += binary.PutVarint(buf[index:], kd.expiredAt)
+	buf = buf[:index+1]
+	if kd.blob != nil {
+		buf[index] = 1
+		buf = append(buf, bitcask.EncodeBlobPointer(kd.blob)...)
+	}
+	return append(buf, kd.value...)
+}
+
+func decodeKeyDir(buf []byte) (*keyDir, error) {
+	var index int
+	fileID, n := binary.Uvarint(buf[index:])
+	if n <= 0 {
+		return nil, ErrInvalidSnapshot
+	}
+	index += n
+	recordSize, n := binary.Varint(buf[index:])
+	if n <= 0 {
+		return nil, ErrInvalidSnapshot
+	}
+	index += n
+	recordOffset, n := binary.Varint(buf[index:])
+	if n <= 0 {
+		return nil, ErrInvalidSnapshot
+	}
+	index += n
+	expiredAt, n := binary.Varint(buf[index:])
+	if n <= 0 || index+n >= len(buf) {
+		return nil, ErrInvalidSnapshot
+	}
+	index += n
+
+	kd := &keyDir{
+		fileID:       uint32(fileID),
+		recordSize:   int(recordSize),
+		recordOffset: recordOffset,
+		expiredAt:    expiredAt,
+	}
+	hasBlob := buf[index]
+	index++
+	if hasBlob == 1 {
+		blob, n, err := bitcask.DecodeBlobPointer(buf[index:])
+		if err != nil {
+			return nil, ErrInvalidSnapshot
+		}
+		kd.blob = blob
+		index += n
+	}
+	if index < len(buf) {
+		kd.value = append([]byte{}, buf[index:]...)
+	}
+	return kd, nil
+}
+
+func containsFileID(fIDs []uint32, fID uint32) bool {
+	for _, id := range fIDs {
+		if id == fID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package sdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"sdb/options"
+)
+
+func TestSDB_IndexSnapshot(t *testing.T) {
+	t.Run("Standard Io", func(t *testing.T) {
+		testIndexSnapshot(t, options.FileIO, options.BitCaskMode)
+	})
+
+	t.Run("MMap IO", func(t *testing.T) {
+		testIndexSnapshot(t, options.MMap, options.BitCaskMode)
+	})
+
+	t.Run("Memory Mode", func(t *testing.T) {
+		testIndexSnapshot(t, options.FileIO, options.MemoryMode)
+	})
+}
+
+func testIndexSnapshot(t *testing.T, ioType options.IOType, mode options.StoreMode) {
+	pwd, _ := os.Getwd()
+	path := filepath.Join(pwd, "test/snapshot")
+	opts := options.NewDefaultOptions(path)
+	opts.IoType = ioType
+	opts.StoreMode = mode
+	opts.LogFileSizeThreshold = 4 << 10
+	db, err := OpenDB(opts)
+	assert.Nil(t, err)
+	defer func() {
+		clearDB(db)
+	}()
+
+	writeCount := 200
+	for i := 0; i < writeCount; i++ {
+		assert.Nil(t, db.Set(getTestKey(i), getTestValue(i)))
+		assert.Nil(t, db.HSet([]byte("hash"), getTestKey(i), getTestValue(i)))
+	}
+	assert.Nil(t, db.RPush([]byte("list"), []byte("a"), []byte("b")))
+	assert.Nil(t, db.CloseDB())
+
+	snapshotName := filepath.Join(path, indexSnapshotFileName)
+	_, err = os.Stat(snapshotName)
+	assert.Nil(t, err)
+
+	// 正常重启，从快照加载索引
+	db, err = OpenDB(opts)
+	assert.Nil(t, err)
+	assertSnapshotData(t, db, writeCount)
+	val, err := db.LPop([]byte("list"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a"), val)
+
+	// 快照之后写入的日志需要重放，模拟进程崩溃：不调用CloseDB，不会重新dump快照
+	assert.Nil(t, db.Set(getTestKey(writeCount), getTestValue(writeCount)))
+	assert.Nil(t, db.Delete(getTestKey(0)))
+	assert.Nil(t, db.Sync())
+	crashDB(db)
+
+	db, err = OpenDB(opts)
+	assert.Nil(t, err)
+	_, err = db.Get(getTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err = db.Get(getTestKey(writeCount))
+	assert.Nil(t, err)
+	assert.Equal(t, getTestValue(writeCount), val)
+	assert.Nil(t, db.CloseDB())
+
+	// 快照损坏，从日志文件重建索引
+	buf, _ := os.ReadFile(snapshotName)
+	buf[len(buf)/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(snapshotName, buf, 0644))
+	db, err = OpenDB(opts)
+	assert.Nil(t, err)
+	assertSnapshotData(t, db, writeCount)
+	_, err = db.Get(getTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func assertSnapshotData(t *testing.T, db *SDB, writeCount int) {
+	for i := 1; i < writeCount; i++ {
+		val, err := db.Get(getTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, getTestValue(i), val)
+
+		val, err = db.HGet([]byte("hash"), getTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, getTestValue(i), val)
+	}
+}
+
+// 模拟进程崩溃，只释放文件锁和文件句柄，不dump快照
+func crashDB(db *SDB) {
+	_ = db.fileLock.Release()
+	for _, activeFile := range db.activeFiles {
+		_ = activeFile.Close()
+	}
+	for _, immutableFiles := range db.immutableFiles {
+		for _, file := range immutableFiles {
+			_ = file.Close()
+		}
+	}
+	_ = db.closeManifest()
+	for _, cf := range db.countFiles {
+		cf.Once.Do(func() {
+			close(cf.CountRcv)
+		})
+	}
+}
+
+func getTestKey(i int) []byte {
+	return []byte(fmt.Sprintf("sdb-test-key-%09d", i))
+}
+
+func getTestValue(i int) []byte {
+	return []byte(fmt.Sprintf("sdb-test-value-%09d", i))
+}
@@ -5,8 +5,6 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
-	"strconv"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -35,38 +33,108 @@ func OpenDB(opts options.Options) (*SDB, error) {
 	if err != nil {
 		return nil, err
 	}
+	keyring, err := newKeyring(opts)
+	if err != nil {
+		_ = fileLock.Release()
+		return nil, err
+	}
+	syncPolicy, err := newSyncPolicy(opts)
+	if err != nil {
+		_ = fileLock.Release()
+		return nil, err
+	}
 
 	db := &SDB{
 		opts: opts,
 
 		activeFiles:    make(map[DataType]*bitcask.LogFile),
 		immutableFiles: make(map[DataType]immutableFiles),
+		fileCache:      bitcask.NewFileCache(opts.MaxOpenFiles),
+		valueCache:     newValueCache(opts.ValueCacheSize),
 
 		fileLock:  fileLock,
+		keyring:   keyring,
 		strIndex:  newStrIndex(),
 		listIndex: newListIndex(),
 		hashIndex: newHashIndex(),
 		setIndex:  newSetIndex(),
 		zsetIndex: newZSetIndex(),
+
+		syncPolicy: syncPolicy,
 	}
+	// 打开失败时关闭已经打开的文件，释放文件锁，调用方才能接着对目录执行Migrate、Check
+	var opened bool
+	defer func() {
+		if !opened {
+			db.closeFiles()
+		}
+	}()
 
 	if err := db.initCountFiles(); err != nil {
 		return nil, err
 	}
 
+	if err := db.loadManifest(); err != nil {
+		return nil, err
+	}
+
+	// 上次崩溃时没有完成的merge，先完成或者回滚，再加载日志文件
+	if err := db.recoverMerge(); err != nil {
+		return nil, err
+	}
+
+	if err := db.openManifest(); err != nil {
+		return nil, err
+	}
+
 	if err := db.initLogFiles(); err != nil {
 		return nil, err
 	}
 
+	if err := db.initBlobFiles(); err != nil {
+		return nil, err
+	}
+
 	if err := db.initIndexFromLogFiles(); err != nil {
 		return nil, err
 	}
 
+	// 换了密钥之后，活跃文件还是老密钥加密的，转成非活跃文件，新数据写到用新密钥加密的文件
+	if err := db.rotateStaleActiveFiles(); err != nil {
+		return nil, err
+	}
+
+	// 定时刷盘策略在后台刷盘
+	db.startBackgroundSync()
+
 	// 定期进行merge
 	go db.regularLogFileMerge()
+	opened = true
 	return db, nil
 }
 
+// 按设置的密钥和KeyProvider生成keyring，都没有设置时返回nil，不加密
+func newKeyring(opts options.Options) (*bitcask.Keyring, error) {
+	if opts.EncryptionKey == nil && opts.KeyProvider == nil {
+		return nil, nil
+	}
+	if opts.EncryptionKeyID == 0 {
+		return nil, ErrInvalidEncryptionKeyID
+	}
+	return &bitcask.Keyring{
+		KeyID: opts.EncryptionKeyID,
+		Lookup: func(keyID uint32) ([]byte, error) {
+			if keyID == opts.EncryptionKeyID && opts.EncryptionKey != nil {
+				return opts.EncryptionKey, nil
+			}
+			if opts.KeyProvider != nil {
+				return opts.KeyProvider(keyID)
+			}
+			return nil, bitcask.ErrEncryptionKeyNotFound
+		},
+	}, nil
+}
+
 func (db *SDB) initCountFiles() error {
 	countFilePath := filepath.Join(db.opts.DBPath, count.CountFilePath)
 	if !utils.PathExist(countFilePath) {
@@ -79,7 +147,7 @@ func (db *SDB) initCountFiles() error {
 	countFiles := make(map[DataType]*count.CountFile)
 	for i := String; i < logFileTypeNum; i++ {
 		name := bitcask.FileNameMap[bitcask.FileType(i)] + count.CountFileName
-		hf, err := count.NewCountFile(countFilePath, name, db.opts.CountBufferSize)
+		hf, err := count.NewEncryptedCountFile(countFilePath, name, db.opts.CountBufferSize, db.keyring)
 		if err != nil {
 			return err
 		}
@@ -93,23 +161,11 @@ func (db *SDB) initCountFiles() error {
 func (db *SDB) initLogFiles() error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	// 读sdb目录下的所有文件
-	dirEntries, err := os.ReadDir(db.opts.DBPath)
-	if err != nil {
-		return err
-	}
-
-	// 根据数据类型对文件分类
+	// 有效的日志文件以MANIFEST为准
 	fileIDMap := make(map[DataType][]uint32)
-	for _, file := range dirEntries {
-		if strings.HasPrefix(file.Name(), bitcask.FilePrefix) {
-			splitNames := strings.Split(file.Name(), ".")
-			fID, err := strconv.Atoi(splitNames[2])
-			if err != nil {
-				return err
-			}
-			typ := DataType(bitcask.FileTypesMap[splitNames[1]])
-			fileIDMap[typ] = append(fileIDMap[typ], uint32(fID))
+	for dataType := String; dataType < logFileTypeNum; dataType++ {
+		if fIDs := db.liveFileIDs(dataType); len(fIDs) > 0 {
+			fileIDMap[dataType] = fIDs
 		}
 	}
 	db.fileIDMap = fileIDMap
@@ -130,16 +186,22 @@ func (db *SDB) initLogFiles() error {
 		// 分配给活跃和非活跃文件map
 		for i, fID := range fIDs {
 			fType, IOType := bitcask.FileType(dataType), bitcask.IOType(db.opts.IoType)
-			lf, err := bitcask.OpenLogFile(db.opts.DBPath, fID, db.opts.LogFileSizeThreshold, fType, IOType)
-			if err != nil {
-				return err
+			// 非活跃文件只读，读的时候才打开
+			if i < len(fIDs)-1 {
+				lf, err := bitcask.OpenReadOnlyLogFile(db.opts.DBPath, fID, fType, IOType, db.keyring, db.fileCache)
+				if err != nil {
+					return err
+				}
+				db.immutableFiles[dataType][fID] = lf
+				continue
 			}
 			// latest one is active log file.
-			if i == len(fIDs)-1 {
-				db.activeFiles[dataType] = lf
-			} else {
-				db.immutableFiles[dataType][fID] = lf
+			capacity := db.fileCapacity(db.countFiles[dataType], fID)
+			lf, err := bitcask.OpenEncryptedLogFile(db.opts.DBPath, fID, capacity, fType, IOType, db.keyring)
+			if err != nil {
+				return err
 			}
+			db.activeFiles[dataType] = lf
 		}
 	}
 	return nil
@@ -147,11 +209,20 @@ func (db *SDB) initLogFiles() error {
 
 // 根据日志文件构建索引树
 func (db *SDB) initIndexFromLogFiles() error {
+	// 有索引快照的话先加载快照，只需要重放快照之后的日志
+	positions := db.loadIndexSnapshot()
+
+	errs := make([]error, logFileTypeNum)
 	iterateAndHandle := func(dataType DataType, wg *sync.WaitGroup) {
 		defer wg.Done()
 
+		pos := positions[dataType]
 		fIDs := db.fileIDMap[dataType]
 		for i, fID := range fIDs { // fIDs已经有序
+			// 快照之前的文件已经包含在快照中
+			if pos != nil && fID < pos.fileID {
+				continue
+			}
 			var logfile *bitcask.LogFile
 			if i == len(fIDs)-1 {
 				logfile = db.activeFiles[dataType]
@@ -162,14 +233,43 @@ func (db *SDB) initIndexFromLogFiles() error {
 				logger.Fatalf("log file is nil, failed to open db")
 			}
 
-			var offset int64
+			isActive := i == len(fIDs)-1
+			// 非活跃文件优先从hint文件构建索引，不用读value
+			if !isActive && db.hintFileEnabled(dataType, logfile) && db.loadIndexFromHintFile(dataType, fID) {
+				continue
+			}
+
+			offset := logfile.DataOffset
+			var hints []*bitcask.HintRecord
+			// 快照时的活跃文件只需要重放快照之后写入的部分
+			if isActive && pos != nil && fID == pos.fileID {
+				offset = pos.offset
+			}
 			for {
 				record, recordSize, err := logfile.ReadLogRecord(offset)
 				if err != nil {
 					if err == io.EOF || err == bitcask.ErrEndOfRecord {
 						break
 					}
-					logger.Fatalf("read log entry from file err, failed to open db")
+					// 活跃文件尾部写了一半的record，截断到最后一条完整的record；后面还有完整record的是中间损坏了，不能截断
+					if isActive && db.opts.RecoverTornWrite {
+						dropped, truncateErr := logfile.TruncateTail(offset)
+						if truncateErr == bitcask.ErrRecordAfterTail {
+							logger.Errorf("corrupted record in the middle of active log file, dataType: [%v], fid: [%v], offset: [%v], err: [%v]", dataType, fID, offset, err)
+							errs[dataType] = ErrCorruptLogFile
+							return
+						}
+						if truncateErr != nil {
+							errs[dataType] = truncateErr
+							return
+						}
+						logger.Warnf("truncate torn write in active log file, dataType: [%v], fid: [%v], offset: [%v], dropped bytes: [%v], err: [%v]",
+							dataType, fID, offset, dropped, err)
+						break
+					}
+					logger.Errorf("read log entry from file err, dataType: [%v], fid: [%v], offset: [%v], err: [%v]", dataType, fID, offset, err)
+					errs[dataType] = ErrCorruptLogFile
+					return
 				}
 				keyDir := &keyDir{
 					fileID:       fID,
@@ -177,12 +277,39 @@ func (db *SDB) initIndexFromLogFiles() error {
 					recordSize:   int(recordSize),
 					expiredAt:    record.ExpiredAt,
 				}
-				db.buildIndex(dataType, record, keyDir)
+				// 老版本编码的key不能跳过，否则升级之后这些数据就悄悄丢了，要先用sdb-migrate转换
+				if legacyRecordKey(dataType, record) {
+					logger.Errorf("record key in the old encoding, run sdb-migrate first, dataType: [%v], fid: [%v], offset: [%v], key: [%q]", dataType, fID, offset, record.Key)
+					errs[dataType] = ErrLegacyRecordKey
+					return
+				}
+				// 指针record的value不是真正的value，内存模式也不缓存，读的时候去blob文件读
+				indexRecord := record
+				if record.Type&bitcask.TypeBlob != 0 {
+					if keyDir.blob, _, err = bitcask.DecodeBlobPointer(record.Value); err != nil {
+						logger.Errorf("decode blob pointer err, dataType: [%v], fid: [%v], offset: [%v], err: [%v]", dataType, fID, offset, err)
+						errs[dataType] = ErrCorruptLogFile
+						return
+					}
+					indexRecord = &bitcask.LogRecord{Key: record.Key, ExpiredAt: record.ExpiredAt, Type: record.Type}
+				}
+				db.buildIndex(dataType, indexRecord, keyDir)
+				if !isActive && db.hintFileEnabled(dataType, logfile) {
+					hints = append(hints, newHintRecord(record, offset, recordSize))
+				}
 				offset += recordSize
 			}
 			// 设置活跃文件的写offset
-			if i == len(fIDs)-1 {
+			if isActive {
 				atomic.StoreInt64(&logfile.WriteOffSet, offset)
+				continue
+			}
+			if !db.hintFileEnabled(dataType, logfile) {
+				continue
+			}
+			// 非活跃文件没有hint文件或者hint文件损坏，补写一个，下次启动就不用全量读了
+			if err := bitcask.WriteHintFile(db.opts.DBPath, fID, bitcask.FileType(dataType), hints); err != nil {
+				logger.Errorf("write hint file err, dataType: [%v], fid: [%v], err: [%v]", dataType, fID, err)
 			}
 		}
 	}
@@ -193,12 +320,50 @@ func (db *SDB) initIndexFromLogFiles() error {
 		go iterateAndHandle(DataType(i), wg)
 	}
 	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// 从hint文件构建fID对应日志文件的索引，hint文件不存在或者损坏返回false，需要全量读日志文件
+func (db *SDB) loadIndexFromHintFile(dataType DataType, fID uint32) bool {
+	// 先完整读出并校验，再构建索引，防止损坏的hint文件构建出一半的索引
+	hints, err := bitcask.ReadHintFile(db.opts.DBPath, fID, bitcask.FileType(dataType))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warnf("read hint file err, dataType: [%v], fid: [%v], err: [%v]", dataType, fID, err)
+		}
+		return false
+	}
+	for _, hint := range hints {
+		record := &bitcask.LogRecord{
+			Key:       hint.Key,
+			ExpiredAt: hint.ExpiredAt,
+			Type:      hint.Type,
+		}
+		keyDir := &keyDir{
+			fileID:       fID,
+			recordOffset: hint.Offset,
+			recordSize:   int(hint.Size),
+			expiredAt:    hint.ExpiredAt,
+			blob:         hint.Blob,
+		}
+		db.buildIndex(dataType, record, keyDir)
+	}
+	return true
+}
+
 // key --> keyDir
 // key --> file_id | record_size | record_offset | t_stamp
 func (db *SDB) buildIndex(dataType DataType, record *bitcask.LogRecord, keyDir *keyDir) {
+	// 损坏了但crc正确的key解码会越界，跳过这条record，sdb-check会报告出来
+	if !validRecordKey(dataType, record) {
+		logger.Warnf("build index err, dataType: [%v], undecodable key: [%q]", dataType, record.Key)
+		return
+	}
 	switch dataType {
 	case String:
 		db.buildStrIndex(record, keyDir)
@@ -206,9 +371,40 @@ func (db *SDB) buildIndex(dataType DataType, record *bitcask.LogRecord, keyDir *
 		db.buildListIndex(record, keyDir)
 	case Hash:
 		db.buildHashIndex(record, keyDir)
+	case Set:
+		db.buildSetIndex(record, keyDir)
+	case ZSet:
+		db.buildZSetIndex(record, keyDir)
 	}
 }
 
+// 检查record的key能不能按数据类型解码，list的元素key是seq|key，hash、set、zset的key都按EncodeHashKey编码
+func validRecordKey(dataType DataType, record *bitcask.LogRecord) bool {
+	switch dataType {
+	case List:
+		return record.Type == bitcask.TypeListSeq || len(record.Key) >= 4
+	case Hash, Set, ZSet:
+		return utils.ValidHashKey(record.Key)
+	}
+	return true
+}
+
+// 老版本写的hash、set、zset record：hash、zset的key是没给header分配空间的编码，set的key是集合的key本身，
+// 这些record能用sdb-migrate转换成现在的编码
+func legacyRecordKey(dataType DataType, record *bitcask.LogRecord) bool {
+	if validRecordKey(dataType, record) {
+		return false
+	}
+	switch dataType {
+	case Hash, ZSet:
+		_, _, ok := utils.DecodeLegacyHashKey(record.Key)
+		return ok
+	case Set:
+		return true
+	}
+	return false
+}
+
 func (db *SDB) buildStrIndex(record *bitcask.LogRecord, keyDir *keyDir) {
 	strKey := record.Key
 	// 过期或者删除了，删除索引
@@ -256,7 +452,10 @@ func (db *SDB) buildHashIndex(record *bitcask.LogRecord, keyDir *keyDir) {
 	db.hashIndex.idxTree = db.hashIndex.trees[string(TreeKey)]
 
 	if record.Type == bitcask.TypeDelete || (record.ExpiredAt != 0 && record.ExpiredAt < time.Now().Unix()) {
-		db.hashIndex.idxTree.Delete(record.Key)
+		db.hashIndex.idxTree.Delete(field)
+		if db.hashIndex.idxTree.Size() == 0 {
+			delete(db.hashIndex.trees, string(TreeKey))
+		}
 		return
 	}
 
@@ -266,3 +465,62 @@ func (db *SDB) buildHashIndex(record *bitcask.LogRecord, keyDir *keyDir) {
 
 	db.hashIndex.idxTree.Put(field, keyDir)
 }
+
+// key对应ar树，成员的hash值sum对应每个ar树的索引
+func (db *SDB) buildSetIndex(record *bitcask.LogRecord, keyDir *keyDir) {
+	treeKey, sum := utils.DecodeSetKey(record.Key)
+	if db.setIndex.trees[string(treeKey)] == nil {
+		db.setIndex.trees[string(treeKey)] = art.NewART()
+	}
+	db.setIndex.idxTree = db.setIndex.trees[string(treeKey)]
+
+	if record.Type == bitcask.TypeDelete || (record.ExpiredAt != 0 && record.ExpiredAt < time.Now().Unix()) {
+		db.setIndex.idxTree.Delete(sum)
+		if db.setIndex.idxTree.Size() == 0 {
+			delete(db.setIndex.trees, string(treeKey))
+		}
+		return
+	}
+
+	if db.opts.StoreMode == options.MemoryMode {
+		keyDir.value = record.Value
+	}
+
+	db.setIndex.idxTree.Put(sum, keyDir)
+}
+
+// key对应ar树和跳表，ar树中是成员的hash值sum，跳表中是成员和分值
+func (db *SDB) buildZSetIndex(record *bitcask.LogRecord, keyDir *keyDir) {
+	treeKey, member := utils.DecodeZSetKey(record.Key)
+	sum, err := db.zsetMemberSum(member)
+	if err != nil {
+		logger.Warnf("build zset index err, key: [%s], err: [%v]", treeKey, err)
+		return
+	}
+	if db.zsetIndex.trees[string(treeKey)] == nil {
+		db.zsetIndex.trees[string(treeKey)] = art.NewART()
+	}
+	db.zsetIndex.idxTree = db.zsetIndex.trees[string(treeKey)]
+
+	if record.Type == bitcask.TypeDelete || (record.ExpiredAt != 0 && record.ExpiredAt < time.Now().Unix()) {
+		db.zsetIndex.idxTree.Delete(sum)
+		db.zsetIndex.indexes.ZRem(string(treeKey), string(member))
+		if db.zsetIndex.idxTree.Size() == 0 {
+			db.zsetIndex.indexes.ZClear(string(treeKey))
+			delete(db.zsetIndex.trees, string(treeKey))
+		}
+		return
+	}
+
+	score, err := utils.StrToFloat64(string(record.Value))
+	if err != nil {
+		logger.Warnf("build zset index err, invalid score: [%s], err: [%v]", record.Value, err)
+		return
+	}
+	if db.opts.StoreMode == options.MemoryMode {
+		keyDir.value = record.Value
+	}
+
+	db.zsetIndex.idxTree.Put(sum, keyDir)
+	db.zsetIndex.indexes.ZAdd(string(treeKey), score, string(member))
+}
@@ -0,0 +1,467 @@
+package sdb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"sdb/bitcask"
+	"sdb/options"
+	"sdb/utils"
+)
+
+func TestOpenDB_HintFile(t *testing.T) {
+	t.Run("Standard Io", func(t *testing.T) {
+		testOpenDBHintFile(t, options.FileIO)
+	})
+
+	t.Run("MMap IO", func(t *testing.T) {
+		testOpenDBHintFile(t, options.MMap)
+	})
+
+	t.Run("Buffered IO", func(t *testing.T) {
+		testOpenDBHintFile(t, options.BufferedIO)
+	})
+
+	t.Run("Direct IO", func(t *testing.T) {
+		testOpenDBHintFile(t, options.DirectIO)
+	})
+}
+
+func testOpenDBHintFile(t *testing.T, ioType options.IOType) {
+	pwd, _ := os.Getwd()
+	path := filepath.Join(pwd, "test/hint")
+	opts := options.NewDefaultOptions(path)
+	opts.IoType = ioType
+	opts.LogFileSizeThreshold = 4 << 10
+	db, err := OpenDB(opts)
+	assert.Nil(t, err)
+	defer func() {
+		clearDB(db)
+	}()
+
+	writeCount := 500
+	for i := 0; i < writeCount; i++ {
+		err := db.Set([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("val-%d", i)))
+		assert.Nil(t, err)
+	}
+	// 删除的key重启后不能出现
+	assert.Nil(t, db.Delete([]byte("key-0")))
+	assert.Nil(t, db.CloseDB())
+
+	// 每个非活跃文件都有hint文件，并且截掉了后面没用到的空间
+	fIDs := sortedFileIDs(db, String)
+	assert.True(t, len(fIDs) > 1)
+	for _, fID := range fIDs[:len(fIDs)-1] {
+		name, _ := bitcask.HintFileName(path, fID, bitcask.Str)
+		_, err := os.Stat(name)
+		assert.Nil(t, err)
+		name, _ = bitcask.LogFileName(path, fID, bitcask.Str)
+		stat, err := os.Stat(name)
+		assert.Nil(t, err)
+		assert.Equal(t, db.immutableFiles[String][fID].WriteOffSet, stat.Size())
+	}
+
+	// 删除索引快照，启动时从hint文件构建索引
+	assert.Nil(t, os.Remove(filepath.Join(path, indexSnapshotFileName)))
+
+	// 破坏一个hint文件，启动时退化为全量读日志文件
+	name, _ := bitcask.HintFileName(path, fIDs[0], bitcask.Str)
+	buf, _ := os.ReadFile(name)
+	buf[len(buf)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(name, buf, 0644))
+
+	db, err = OpenDB(opts)
+	assert.Nil(t, err)
+	_, err = db.Get([]byte("key-0"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	for i := 1; i < writeCount; i++ {
+		val, err := db.Get([]byte(fmt.Sprintf("key-%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("val-%d", i)), val)
+	}
+
+	// 损坏的hint文件已经重新生成
+	_, err = bitcask.ReadHintFile(path, fIDs[0], bitcask.Str)
+	assert.Nil(t, err)
+}
+
+func TestOpenDB_HintFileMemoryMode(t *testing.T) {
+	pwd, _ := os.Getwd()
+	path := filepath.Join(pwd, "test/hint-memory")
+	opts := options.NewDefaultOptions(path)
+	opts.StoreMode = options.MemoryMode
+	opts.LogFileSizeThreshold = 4 << 10
+	db, err := OpenDB(opts)
+	assert.Nil(t, err)
+	defer func() {
+		clearDB(db)
+	}()
+
+	writeCount := 500
+	for i := 0; i < writeCount; i++ {
+		err := db.Set([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("val-%d", i)))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.CloseDB())
+
+	// 内存模式不写hint文件
+	fIDs := sortedFileIDs(db, String)
+	assert.True(t, len(fIDs) > 1)
+	for _, fID := range fIDs {
+		name, _ := bitcask.HintFileName(path, fID, bitcask.Str)
+		_, err := os.Stat(name)
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	// 重启后也不会补写hint文件
+	assert.Nil(t, os.Remove(filepath.Join(path, indexSnapshotFileName)))
+	db, err = OpenDB(opts)
+	assert.Nil(t, err)
+	for i := 0; i < writeCount; i++ {
+		val, err := db.Get([]byte(fmt.Sprintf("key-%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("val-%d", i)), val)
+	}
+	for _, fID := range fIDs {
+		name, _ := bitcask.HintFileName(path, fID, bitcask.Str)
+		_, err := os.Stat(name)
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+// 获取某个数据类型的所有日志文件id，从小到大有序
+func sortedFileIDs(db *SDB, dataType DataType) []uint32 {
+	var fIDs []uint32
+	for fID := range db.immutableFiles[dataType] {
+		fIDs = append(fIDs, fID)
+	}
+	fIDs = append(fIDs, db.activeFiles[dataType].FileID)
+	sort.Slice(fIDs, func(i, j int) bool { return fIDs[i] < fIDs[j] })
+	return fIDs
+}
+
+func TestOpenDB_GrowActiveFile(t *testing.T) {
+	bigValue := func(i int) []byte {
+		return bytes.Repeat(getTestValue(i), 40)
+	}
+	for _, ioType := range []options.IOType{options.FileIO, options.MMap, options.BufferedIO, options.DirectIO} {
+		pwd, _ := os.Getwd()
+		opts := options.NewDefaultOptions(filepath.Join(pwd, "test/grow"))
+		opts.IoType = ioType
+		opts.CountBufferSize = 1024
+		db, err := OpenDB(opts)
+		assert.Nil(t, err)
+
+		activeSize := func() int64 {
+			name, _ := bitcask.LogFileName(opts.DBPath, db.activeFiles[String].FileID, bitcask.Str)
+			stat, err := os.Stat(name)
+			assert.Nil(t, err)
+			return stat.Size()
+		}
+		// 几乎为空的库不会按阈值预分配文件
+		assert.Nil(t, db.Set(getTestKey(0), bigValue(0)))
+		assert.Less(t, activeSize(), opts.LogFileSizeThreshold)
+
+		// 写超过一次分配的大小，文件按需扩展，崩溃后重启能找到数据的末尾
+		writeCount := 1500
+		for i := 1; i < writeCount; i++ {
+			assert.Nil(t, db.Set(getTestKey(i), bigValue(i)))
+		}
+		offset := db.activeFiles[String].WriteOffSet
+		assert.Greater(t, offset, int64(1<<20))
+		assert.Greater(t, activeSize(), offset)
+		assert.Less(t, activeSize(), opts.LogFileSizeThreshold)
+		db.waitHintFiles()
+		crashDB(db)
+
+		db, err = OpenDB(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, offset, db.activeFiles[String].WriteOffSet)
+		for i := 0; i < writeCount; i++ {
+			val, err := db.Get(getTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, bigValue(i), val)
+		}
+		clearDB(db)
+	}
+}
+
+func TestOpenDB_ChangeThreshold(t *testing.T) {
+	for _, ioType := range []options.IOType{options.FileIO, options.MMap, options.BufferedIO, options.DirectIO} {
+		pwd, _ := os.Getwd()
+		opts := options.NewDefaultOptions(filepath.Join(pwd, "test/threshold"))
+		opts.IoType = ioType
+		opts.CountBufferSize = 1024
+		opts.LogFileSizeThreshold = 8 << 10
+		db, err := OpenDB(opts)
+		assert.Nil(t, err)
+
+		fileSizes := func(db *SDB) map[uint32]int64 {
+			sizes := make(map[uint32]int64)
+			for fID := range db.immutableFiles[String] {
+				name, _ := bitcask.LogFileName(opts.DBPath, fID, bitcask.Str)
+				stat, err := os.Stat(name)
+				assert.Nil(t, err)
+				sizes[fID] = stat.Size()
+			}
+			return sizes
+		}
+		writeCount := 0
+		write := func(db *SDB, n int) {
+			for i := 0; i < n; i++ {
+				assert.Nil(t, db.Set(getTestKey(writeCount), getTestValue(writeCount)))
+				writeCount++
+			}
+		}
+		assertValues := func(db *SDB) {
+			for i := 0; i < writeCount; i++ {
+				val, err := db.Get(getTestKey(i))
+				assert.Nil(t, err)
+				assert.Equal(t, getTestValue(i), val)
+			}
+		}
+		write(db, 300)
+		activeFID := db.activeFiles[String].FileID
+		assert.Nil(t, db.CloseDB())
+
+		// 调小阈值，老的活跃文件还按原来的容量写，新文件用新的阈值
+		opts.LogFileSizeThreshold = 4 << 10
+		db, err = OpenDB(opts)
+		assert.Nil(t, err)
+		assertValues(db)
+		assert.Equal(t, int64(8<<10), db.activeFiles[String].Capacity)
+		for db.activeFiles[String].FileID < activeFID+2 {
+			write(db, 10)
+		}
+		assert.Equal(t, int64(4<<10), db.activeFiles[String].Capacity)
+		assert.Equal(t, int64(4<<10), db.immutableFiles[String][activeFID+1].Capacity)
+		assertValues(db)
+		sizes := fileSizes(db)
+		assert.Nil(t, db.CloseDB())
+
+		// 调大阈值，老文件不会被撑大，读写照常
+		opts.LogFileSizeThreshold = 64 << 10
+		db, err = OpenDB(opts)
+		assert.Nil(t, err)
+		assertValues(db)
+		assert.Equal(t, sizes, fileSizes(db))
+		assert.Equal(t, int64(4<<10), db.activeFiles[String].Capacity)
+		write(db, 100)
+		assertValues(db)
+		clearDB(db)
+	}
+}
+
+func TestOpenDB_TornWrite(t *testing.T) {
+	writeCount := 300
+	// 写入数据后模拟崩溃，返回活跃文件id和写到的位置
+	prepare := func(t *testing.T, dir string) (options.Options, uint32, int64) {
+		db, opts := openMergeTestDB(t, dir)
+		for i := 0; i < writeCount; i++ {
+			assert.Nil(t, db.Set(getTestKey(i), getTestValue(i)))
+		}
+		activeFile := db.activeFiles[String]
+		db.waitHintFiles()
+		crashDB(db)
+		return opts, activeFile.FileID, activeFile.WriteOffSet
+	}
+	// 在fID对应的文件offset处写入buf
+	writeAt := func(t *testing.T, opts options.Options, fID uint32, offset int64, buf []byte) {
+		name, _ := bitcask.LogFileName(opts.DBPath, fID, bitcask.Str)
+		file, err := os.OpenFile(name, os.O_WRONLY, 0644)
+		assert.Nil(t, err)
+		_, err = file.WriteAt(buf, offset)
+		assert.Nil(t, err)
+		assert.Nil(t, file.Close())
+	}
+	tornRecord, size := bitcask.EncodeRecordV2(&bitcask.LogRecord{Key: []byte("torn"), Value: []byte("torn-value")})
+	tornRecord = tornRecord[:size-3]
+
+	t.Run("recover", func(t *testing.T) {
+		opts, fID, offset := prepare(t, "test/torn-recover")
+		defer func() {
+			_ = os.RemoveAll(opts.DBPath)
+		}()
+		writeAt(t, opts, fID, offset, tornRecord)
+
+		db, err := OpenDB(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, offset, db.activeFiles[String].WriteOffSet)
+		for i := 0; i < writeCount; i++ {
+			val, err := db.Get(getTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, getTestValue(i), val)
+		}
+		_, err = db.Get([]byte("torn"))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		// 截断之后继续写，重启后能读到
+		assert.Nil(t, db.Set([]byte("after"), []byte("torn")))
+		db.waitHintFiles()
+		crashDB(db)
+		db, err = OpenDB(opts)
+		assert.Nil(t, err)
+		val, err := db.Get([]byte("after"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("torn"), val)
+		assert.Nil(t, db.CloseDB())
+	})
+
+	t.Run("corrupted in the middle", func(t *testing.T) {
+		opts, fID, _ := prepare(t, "test/torn-middle")
+		defer func() {
+			_ = os.RemoveAll(opts.DBPath)
+		}()
+		// 活跃文件第一条record损坏，后面的record都是完整的，不能当成尾部写了一半清零
+		writeAt(t, opts, fID, bitcask.LogFileHeaderSize+10, []byte{0xff})
+		name, _ := bitcask.LogFileName(opts.DBPath, fID, bitcask.Str)
+		before, err := os.ReadFile(name)
+		assert.Nil(t, err)
+
+		_, err = OpenDB(opts)
+		assert.Equal(t, ErrCorruptLogFile, err)
+		after, err := os.ReadFile(name)
+		assert.Nil(t, err)
+		assert.Equal(t, before, after)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		opts, fID, offset := prepare(t, "test/torn-disabled")
+		defer func() {
+			_ = os.RemoveAll(opts.DBPath)
+		}()
+		writeAt(t, opts, fID, offset, tornRecord)
+
+		opts.RecoverTornWrite = false
+		_, err := OpenDB(opts)
+		assert.Equal(t, ErrCorruptLogFile, err)
+	})
+
+	t.Run("immutable file", func(t *testing.T) {
+		opts, _, _ := prepare(t, "test/torn-immutable")
+		defer func() {
+			_ = os.RemoveAll(opts.DBPath)
+		}()
+		// 非活跃文件中间损坏不能恢复，删除hint文件让启动时读日志文件
+		assert.Nil(t, bitcask.RemoveHintFile(opts.DBPath, 0, bitcask.Str))
+		writeAt(t, opts, 0, bitcask.LogFileHeaderSize+10, []byte{0xff})
+
+		_, err := OpenDB(opts)
+		assert.Equal(t, ErrCorruptLogFile, err)
+	})
+}
+
+func TestOpenDB_MaxOpenFiles(t *testing.T) {
+	bigValue := func(i int) []byte {
+		return bytes.Repeat(getTestValue(i), 50)
+	}
+	for _, ioType := range []options.IOType{options.FileIO, options.MMap, options.BufferedIO, options.DirectIO} {
+		pwd, _ := os.Getwd()
+		opts := options.NewDefaultOptions(filepath.Join(pwd, "test/max-open"))
+		opts.IoType = ioType
+		opts.CountBufferSize = 1024
+		opts.LogFileSizeThreshold = 4 << 10
+		opts.BlobThreshold = 1024
+		opts.MaxOpenFiles = 2
+		db, err := OpenDB(opts)
+		assert.Nil(t, err)
+
+		writeCount := 200
+		for i := 0; i < writeCount; i++ {
+			assert.Nil(t, db.Set(getTestKey(i), getTestValue(i)))
+			assert.Nil(t, db.HSet([]byte("hash"), getTestKey(i), bigValue(i)))
+		}
+		// 非活跃文件转为只读，读的时候才打开，打开的文件数不超过上限
+		assert.Greater(t, len(db.immutableFiles[String]), opts.MaxOpenFiles)
+		assertValues := func(db *SDB) {
+			wg := new(sync.WaitGroup)
+			for g := 0; g < 4; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for i := g; i < writeCount; i += 4 {
+						val, err := db.Get(getTestKey(i))
+						assert.Nil(t, err)
+						assert.Equal(t, getTestValue(i), val)
+					}
+				}(g)
+			}
+			wg.Wait()
+			// HGet在读锁下切换hashIndex.idxTree，不能并发读同一个hash
+			for i := 0; i < writeCount; i++ {
+				val, err := db.HGet([]byte("hash"), getTestKey(i))
+				assert.Nil(t, err)
+				assert.Equal(t, bigValue(i), val)
+			}
+			assert.LessOrEqual(t, db.fileCache.Len(), opts.MaxOpenFiles)
+		}
+		db.waitHintFiles()
+		assertValues(db)
+
+		// 重启之后非活跃文件也是按需打开
+		db = reopenDB(t, db, opts, false)
+		assert.Equal(t, 0, db.fileCache.Len())
+		assertValues(db)
+
+		// merge读写非活跃文件，删除的文件从cache中移除
+		for i := 0; i < writeCount/2; i++ {
+			assert.Nil(t, db.Set(getTestKey(i), getTestValue(i)))
+		}
+		fID := waitMergeCandidate(t, db, String)
+		assert.Nil(t, db.MergeSpecificLogFile(String, int(fID), 0))
+		assertValues(db)
+		clearDB(db)
+	}
+}
+
+// 老版本编码的key启动时报错，不会悄悄跳过；损坏的key跳过，不会panic
+func TestOpenDB_UndecodableKey(t *testing.T) {
+	// 老版本的set record：key是集合的key，value是成员；其他的是长度不对的key
+	records := map[DataType][]byte{
+		List: {1, 2},
+		Hash: {0x10, 0x02, 'h'},
+		Set:  []byte("set"),
+		ZSet: append(utils.EncodeZSetKey([]byte("zset"), []byte("m2")), 'x'),
+	}
+	for dataType, key := range records {
+		t.Run(fmt.Sprintf("dataType %v", dataType), func(t *testing.T) {
+			db, opts := openMergeTestDB(t, "test/undecodable-key")
+			defer func() {
+				_ = os.RemoveAll(opts.DBPath)
+			}()
+			assert.Nil(t, db.SAdd([]byte("set"), []byte("m1")))
+			assert.Nil(t, db.ZAdd([]byte("zset"), 1, []byte("m1")))
+			assert.Nil(t, db.HSet([]byte("hash"), []byte("f1"), []byte("v1")))
+			assert.Nil(t, db.RPush([]byte("list"), []byte("a")))
+			_, err := db.writeLogRecord(&bitcask.LogRecord{Key: key, Value: []byte("m2")}, dataType)
+			assert.Nil(t, err)
+			assert.Nil(t, db.CloseDB())
+
+			// 索引快照是正常打开的db写的，不会包含这样的record，删掉快照从日志文件重建索引
+			assert.Nil(t, os.Remove(filepath.Join(opts.DBPath, indexSnapshotFileName)))
+			db, err = OpenDB(opts)
+			if dataType == Set {
+				assert.Equal(t, ErrLegacyRecordKey, err)
+				return
+			}
+			assert.Nil(t, err)
+			defer clearDB(db)
+			assert.True(t, db.SIsMember([]byte("set"), []byte("m1")))
+			ok, score := db.ZScore([]byte("zset"), []byte("m1"))
+			assert.True(t, ok)
+			assert.Equal(t, float64(1), score)
+			value, err := db.HGet([]byte("hash"), []byte("f1"))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("v1"), value)
+			value, err = db.LPop([]byte("list"))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("a"), value)
+		})
+	}
+}
@@ -8,9 +8,9 @@ import (
 )
 
 // Set 设置key的value
-func (db *SDB) Set(key, value []byte) error {
+func (db *SDB) Set(key, value []byte) (err error) {
 	db.strIndex.mu.Lock()
-	defer db.strIndex.mu.Unlock()
+	defer db.unlockAndSync(String, &err)
 
 	// 构造record
 	record := &bitcask.LogRecord{
@@ -28,9 +28,9 @@ func (db *SDB) Set(key, value []byte) error {
 }
 
 // SetEX 带过期时间的设置key的value
-func (db *SDB) SetEX(key, value []byte, duration time.Duration) error {
+func (db *SDB) SetEX(key, value []byte, duration time.Duration) (err error) {
 	db.strIndex.mu.Lock()
-	defer db.strIndex.mu.Unlock()
+	defer db.unlockAndSync(String, &err)
 
 	// 构造record
 	record := &bitcask.LogRecord{
@@ -49,12 +49,12 @@ func (db *SDB) SetEX(key, value []byte, duration time.Duration) error {
 }
 
 // SetNX 如果不存在设置一个key的value，如果存在返回nil
-func (db *SDB) SetNX(key, value []byte) error {
+func (db *SDB) SetNX(key, value []byte) (err error) {
 	db.strIndex.mu.Lock()
-	defer db.strIndex.mu.Unlock()
+	defer db.unlockAndSync(String, &err)
 
 	// GET
-	_, err := db.getVal(key, String)
+	_, err = db.getVal(key, String)
 
 	// 其他错误
 	if err != nil && !errors.Is(err, ErrKeyNotFound) {
@@ -87,6 +87,15 @@ func (db *SDB) Get(key []byte) ([]byte, error) {
 	return db.getVal(key, String)
 }
 
+// GetView 获取key的value，IoType是MMap时不拷贝，直接返回只读映射的内存，大value也没有分配和GC的开销
+// 返回的value不能修改，用完必须调用release，之前文件不会被关闭、淘汰或者被merge删除；
+// value还在活跃文件中、或者不是MMap方式时返回拷贝出来的value；CloseDB之前要释放所有的view
+func (db *SDB) GetView(key []byte) (value []byte, release func(), err error) {
+	db.strIndex.mu.RLock()
+	defer db.strIndex.mu.RUnlock()
+	return db.getValView(key, String)
+}
+
 // MGet 批量获取key的value
 func (db *SDB) MGet(keys [][]byte) ([][]byte, error) {
 	db.strIndex.mu.RLock()
@@ -107,9 +116,9 @@ func (db *SDB) MGet(keys [][]byte) ([][]byte, error) {
 }
 
 // Delete 追加写的方式删除
-func (db *SDB) Delete(key []byte) error {
+func (db *SDB) Delete(key []byte) (err error) {
 	db.strIndex.mu.Lock()
-	defer db.strIndex.mu.Unlock()
+	defer db.unlockAndSync(String, &err)
 
 	record := &bitcask.LogRecord{
 		Key:  key,
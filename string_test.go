@@ -1,12 +1,15 @@
 package sdb
 
 import (
+	"bytes"
+	"fmt"
 	"os"
 	"path/filepath"
 	"reflect"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"sdb/bitcask"
 	"sdb/logger"
 	"sdb/options"
 )
@@ -136,3 +139,107 @@ func clearDB(db *SDB) {
 		}
 	}
 }
+
+func TestSDB_GetView(t *testing.T) {
+	for _, ioType := range []options.IOType{options.FileIO, options.MMap} {
+		t.Run(fmt.Sprint(ioType), func(t *testing.T) {
+			testGetView(t, ioType)
+		})
+	}
+}
+
+func testGetView(t *testing.T, ioType options.IOType) {
+	pwd, _ := os.Getwd()
+	opts := options.NewDefaultOptions(filepath.Join(pwd, "test/get-view"))
+	opts.IoType = ioType
+	opts.LogFileSizeThreshold = 4 << 10
+	opts.LogFileMergeInterval = 0
+	opts.CountBufferSize = 1024
+	opts.BlobThreshold = 1024
+	opts.MaxOpenFiles = 1
+	db, err := OpenDB(opts)
+	assert.Nil(t, err)
+	defer clearDB(db)
+
+	bigValue := func(i, version int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("big-%04d-%04d;", i, version)), 100)
+	}
+	writeCount := 100
+	writeAll := func(version int) {
+		for i := 0; i < writeCount; i++ {
+			assert.Nil(t, db.Set(getTestKey(i), getTestValue(i+version)))
+		}
+		for i := 0; i < 10; i++ {
+			assert.Nil(t, db.Set([]byte(fmt.Sprintf("big-%d", i)), bigValue(i, version)))
+		}
+	}
+	writeAll(0)
+
+	// 非活跃文件中的value、blob中的value、活跃文件中的value都能读到
+	for i := 0; i < writeCount; i++ {
+		val, release, err := db.GetView(getTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, getTestValue(i), val)
+		release()
+	}
+	val, release, err := db.GetView([]byte("big-9"))
+	assert.Nil(t, err)
+	assert.Equal(t, bigValue(9, 0), val)
+	release()
+	_, _, err = db.GetView([]byte("missing"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 拿着view的时候覆盖、merge，view一直有效，release之后文件才删除
+	fID := db.strIndex.idxTree.Get(getTestKey(0)).(*keyDir).fileID
+	logName, _ := bitcask.LogFileName(opts.DBPath, fID, bitcask.Str)
+	smallView, releaseSmall, err := db.GetView(getTestKey(0))
+	assert.Nil(t, err)
+	bigView, releaseBig, err := db.GetView([]byte("big-0"))
+	assert.Nil(t, err)
+	blobFiles := func() []string {
+		names, err := filepath.Glob(filepath.Join(opts.DBPath, bitcask.BlobFilePrefix+"string.*"))
+		assert.Nil(t, err)
+		return names
+	}
+	oldBlobFiles := blobFiles()
+	var oldBlobIDs []uint32
+	for fID := range db.blobFiles[String].immutableFiles {
+		oldBlobIDs = append(oldBlobIDs, fID)
+	}
+	assert.Equal(t, len(oldBlobFiles)-1, len(oldBlobIDs))
+
+	writeAll(1)
+	waitMergeFile(t, db, String, fID)
+	assert.Nil(t, db.MergeSpecificLogFile(String, int(fID), 0))
+	waitBlobMergeFiles(t, db, String, oldBlobIDs)
+	assert.Nil(t, db.MergeBlobFiles(String, 0.5))
+	assert.Equal(t, getTestValue(0), smallView)
+	assert.Equal(t, bigValue(0, 0), bigView)
+	// 其他文件的读不会把pin住的文件淘汰
+	for i := 0; i < writeCount; i++ {
+		val, err := db.Get(getTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, getTestValue(i+1), val)
+	}
+	assert.Equal(t, getTestValue(0), smallView)
+	assert.Equal(t, bigValue(0, 0), bigView)
+
+	_, err = os.Stat(logName)
+	// mmap方式的view指向文件，release之前不删除；其他方式是拷贝出来的，merge完就删了
+	assert.Equal(t, ioType == options.MMap, err == nil)
+	_, err = os.Stat(oldBlobFiles[0])
+	assert.Equal(t, ioType == options.MMap, err == nil)
+	releaseSmall()
+	releaseBig()
+	_, err = os.Stat(logName)
+	assert.True(t, os.IsNotExist(err))
+	for _, name := range oldBlobFiles[:len(oldBlobFiles)-1] {
+		_, err = os.Stat(name)
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	val, release, err = db.GetView([]byte("big-0"))
+	assert.Nil(t, err)
+	assert.Equal(t, bigValue(0, 1), val)
+	release()
+}
@@ -5,6 +5,9 @@ import "encoding/binary"
 const MaxHashKeyHeader = 10
 
 //EncodeHashKey key size|field size|key|field
+// 之前的版本buf只按key和field的大小分配，没算header，写进日志文件的key会丢掉field末尾header大小的字节，
+// 重启后重建的索引里是截断的field，field比header短时编码直接panic；现在按header+key+field分配。
+// 老版本写的key长度和header对不上，ValidHashKey返回false，OpenDB报错，用sdb-migrate按DecodeLegacyHashKey转换
 func EncodeHashKey(key, field []byte) []byte {
 	kSize := len(key)
 	fSize := len(field)
@@ -17,7 +20,7 @@ func EncodeHashKey(key, field []byte) []byte {
 
 	hashKeySize := kSize + fSize
 	if hashKeySize > 0 {
-		buf := make([]byte, hashKeySize)
+		buf := make([]byte, index+hashKeySize)
 		copy(buf[:index], header)
 		copy(buf[index:], key)
 		copy(buf[index+kSize:], field)
@@ -35,3 +38,32 @@ func DecodeHashKey(key []byte) ([]byte, []byte) {
 	sep := index + int(keySize)
 	return key[index:sep], key[sep:]
 }
+
+// ValidHashKey 检查key是不是EncodeHashKey编码出来的，DecodeHashKey不检查，坏的key会越界
+// set和zset的key也是同样的编码
+func ValidHashKey(key []byte) bool {
+	kSize, n := binary.Varint(key)
+	if n <= 0 || kSize < 0 {
+		return false
+	}
+	fSize, m := binary.Varint(key[n:])
+	if m <= 0 || fSize < 0 {
+		return false
+	}
+	return int64(n+m)+kSize+fSize == int64(len(key))
+}
+
+// DecodeLegacyHashKey 解码老版本EncodeHashKey、EncodeZSetKey编码的key，长度是key+field，
+// field末尾header大小的字节已经丢了，返回的是截断的field，不是老版本编码的返回false
+func DecodeLegacyHashKey(key []byte) ([]byte, []byte, bool) {
+	kSize, n := binary.Varint(key)
+	if n <= 0 || kSize < 0 {
+		return nil, nil, false
+	}
+	fSize, m := binary.Varint(key[n:])
+	if m <= 0 || fSize < int64(n+m) || kSize+fSize != int64(len(key)) {
+		return nil, nil, false
+	}
+	sep := int64(n+m) + kSize
+	return key[n+m : sep], key[sep:], true
+}
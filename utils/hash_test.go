@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeHashKey(t *testing.T) {
+	tests := []struct {
+		key, field []byte
+	}{
+		{key: []byte("hash"), field: []byte("field")},
+		// field比header短，老版本的编码会panic
+		{key: []byte("hash"), field: []byte("f")},
+		{key: []byte("hash"), field: nil},
+		{key: nil, field: []byte("field")},
+		// 大小超过一个字节的varint
+		{key: bytes.Repeat([]byte("k"), 300), field: bytes.Repeat([]byte("f"), 70000)},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d-%d", len(tt.key), len(tt.field)), func(t *testing.T) {
+			for _, encode := range []func(key, field []byte) []byte{EncodeHashKey, EncodeZSetKey, EncodeSetKey} {
+				buf := encode(tt.key, tt.field)
+				assert.True(t, ValidHashKey(buf))
+				for _, decode := range []func(buf []byte) ([]byte, []byte){DecodeHashKey, DecodeZSetKey, DecodeSetKey} {
+					key, field := decode(buf)
+					assert.Equal(t, string(tt.key), string(key))
+					assert.Equal(t, string(tt.field), string(field))
+				}
+			}
+		})
+	}
+}
+
+// 老版本的编码没给header分配空间，field末尾被截断，这样的key不能按现在的编码解码
+func TestValidHashKey_Legacy(t *testing.T) {
+	legacyEncode := func(key, field []byte) []byte {
+		header := make([]byte, MaxHashKeyHeader)
+		var index int
+		index += binary.PutVarint(header[index:], int64(len(key)))
+		index += binary.PutVarint(header[index:], int64(len(field)))
+		buf := make([]byte, len(key)+len(field))
+		copy(buf[:index], header)
+		copy(buf[index:], key)
+		copy(buf[index+len(key):], field)
+		return buf
+	}
+	assert.False(t, ValidHashKey(legacyEncode([]byte("hash"), []byte("field"))))
+	assert.False(t, ValidHashKey(legacyEncode([]byte("zset"), []byte("member"))))
+	assert.False(t, ValidHashKey(nil))
+	assert.False(t, ValidHashKey([]byte{0x01}))
+
+	// 老版本的key能解出key和截断的field
+	key, field, ok := DecodeLegacyHashKey(legacyEncode([]byte("hash"), []byte("field")))
+	assert.True(t, ok)
+	assert.Equal(t, "hash", string(key))
+	assert.Equal(t, "fie", string(field))
+	key, field, ok = DecodeLegacyHashKey(legacyEncode(bytes.Repeat([]byte("k"), 300), bytes.Repeat([]byte("f"), 70000)))
+	assert.True(t, ok)
+	assert.Equal(t, 300, len(key))
+	assert.Equal(t, 70000-5, len(field))
+	// 现在的编码和坏的key都不是老版本的编码
+	for _, buf := range [][]byte{EncodeHashKey([]byte("hash"), []byte("field")), nil, {0x01}, {0x10, 0x02, 'h'}} {
+		_, _, ok = DecodeLegacyHashKey(buf)
+		assert.False(t, ok)
+	}
+}
@@ -0,0 +1,11 @@
+package utils
+
+// EncodeSetKey key size|sum size|key|sum
+// set的record key由集合的key和成员的hash值sum组成，启动时只靠key就能重建索引
+func EncodeSetKey(key, sum []byte) []byte {
+	return EncodeHashKey(key, sum)
+}
+
+func DecodeSetKey(key []byte) ([]byte, []byte) {
+	return DecodeHashKey(key)
+}
@@ -4,7 +4,7 @@ import "encoding/binary"
 
 const MaxZSetKeyHeader = 10
 
-//EncodeZSetKey key size|field size|key|field
+//EncodeZSetKey key size|field size|key|field，和EncodeHashKey的编码一样，老版本同样少分配了header的大小
 func EncodeZSetKey(key, field []byte) []byte {
 	kSize := len(key)
 	fSize := len(field)
@@ -17,7 +17,7 @@ func EncodeZSetKey(key, field []byte) []byte {
 
 	hashKeySize := kSize + fSize
 	if hashKeySize > 0 {
-		buf := make([]byte, hashKeySize)
+		buf := make([]byte, index+hashKeySize)
 		copy(buf[:index], header)
 		copy(buf[index:], key)
 		copy(buf[index+kSize:], field)
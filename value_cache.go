@@ -0,0 +1,146 @@
+package sdb
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// value缓存：BitCaskMode下读过的value按 数据类型|file_id|offset 缓存，热点key不用每次读文件
+// 日志文件是追加写的，一个位置上的record不会变，更新、merge之后索引指向新的位置，老的缓存自然不会再命中，按LRU淘汰
+const (
+	valueCacheShards = 16
+	// 每个缓存项除了value之外的内存开销，按这个大小计入容量
+	valueCacheEntryOverhead = 64
+)
+
+type (
+	valueCache struct {
+		shards [valueCacheShards]*valueCacheShard
+		hits   uint64
+		misses uint64
+	}
+
+	// 分片减少锁竞争，每个分片单独按LRU淘汰
+	valueCacheShard struct {
+		mu       sync.Mutex
+		capacity int64
+		size     int64
+		lru      *list.List // front是最近读过的
+		items    map[valueCacheKey]*list.Element
+	}
+
+	valueCacheKey struct {
+		dataType DataType
+		fileID   uint32
+		offset   int64
+	}
+
+	valueCacheEntry struct {
+		key   valueCacheKey
+		value []byte
+	}
+
+	// CacheStats value缓存的统计
+	CacheStats struct {
+		Hits    uint64 // 命中次数
+		Misses  uint64 // 没命中、从文件读的次数
+		Entries int    // 缓存的value个数
+		Bytes   int64  // 缓存占用的字节数
+	}
+)
+
+// 容量小于等于0时不缓存，返回nil
+func newValueCache(capacity int64) *valueCache {
+	if capacity <= 0 {
+		return nil
+	}
+	c := &valueCache{}
+	for i := range c.shards {
+		c.shards[i] = &valueCacheShard{
+			capacity: capacity / valueCacheShards,
+			lru:      list.New(),
+			items:    make(map[valueCacheKey]*list.Element),
+		}
+	}
+	return c
+}
+
+func (c *valueCache) shard(key valueCacheKey) *valueCacheShard {
+	h := (uint64(key.offset) ^ uint64(key.fileID)<<32 ^ uint64(key.dataType)) * 0x9e3779b97f4a7c15
+	return c.shards[h>>60]
+}
+
+// get 返回的value和缓存共用，不能修改，返回给调用方之前要拷贝一份
+func (c *valueCache) get(dataType DataType, fileID uint32, offset int64) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	key := valueCacheKey{dataType: dataType, fileID: fileID, offset: offset}
+	s := c.shard(key)
+	s.mu.Lock()
+	elem, ok := s.items[key]
+	if ok {
+		s.lru.MoveToFront(elem)
+	}
+	s.mu.Unlock()
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&c.hits, 1)
+	return elem.Value.(*valueCacheEntry).value, true
+}
+
+// put 缓存value的拷贝，调用方之后修改value不影响缓存，超过分片容量的value不缓存
+func (c *valueCache) put(dataType DataType, fileID uint32, offset int64, value []byte) {
+	if c == nil {
+		return
+	}
+	key := valueCacheKey{dataType: dataType, fileID: fileID, offset: offset}
+	s := c.shard(key)
+	size := int64(len(value)) + valueCacheEntryOverhead
+	if size > s.capacity {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.items[key]; ok {
+		return
+	}
+	s.items[key] = s.lru.PushFront(&valueCacheEntry{key: key, value: append([]byte(nil), value...)})
+	s.size += size
+	for s.size > s.capacity {
+		entry := s.lru.Remove(s.lru.Back()).(*valueCacheEntry)
+		delete(s.items, entry.key)
+		s.size -= int64(len(entry.value)) + valueCacheEntryOverhead
+	}
+}
+
+func (c *valueCache) stats() CacheStats {
+	var stats CacheStats
+	if c == nil {
+		return stats
+	}
+	stats.Hits, stats.Misses = atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+	for _, s := range c.shards {
+		s.mu.Lock()
+		stats.Entries += s.lru.Len()
+		stats.Bytes += s.size
+		s.mu.Unlock()
+	}
+	return stats
+}
+
+// HitRate 命中率，没有读过时是0
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// CacheStats value缓存的命中情况，没有开启缓存时都是0
+func (db *SDB) CacheStats() CacheStats {
+	return db.valueCache.stats()
+}
@@ -0,0 +1,141 @@
+package sdb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"sdb/options"
+)
+
+func TestValueCache(t *testing.T) {
+	assert.Nil(t, newValueCache(0))
+	var disabled *valueCache
+	disabled.put(String, 1, 0, []byte("value"))
+	_, ok := disabled.get(String, 1, 0)
+	assert.False(t, ok)
+	assert.Equal(t, CacheStats{}, disabled.stats())
+
+	// 每个分片放得下两个100字节的value
+	c := newValueCache(valueCacheShards * 2 * (100 + valueCacheEntryOverhead))
+	value := bytes.Repeat([]byte("v"), 100)
+	key := valueCacheKey{dataType: Hash, fileID: 3, offset: 100}
+	// 找到和key在同一个分片的其他位置
+	var sameShard []int64
+	for offset := int64(200); len(sameShard) < 2; offset++ {
+		if c.shard(valueCacheKey{dataType: Hash, fileID: 3, offset: offset}) == c.shard(key) {
+			sameShard = append(sameShard, offset)
+		}
+	}
+
+	_, ok = c.get(Hash, 3, 100)
+	assert.False(t, ok)
+	c.put(Hash, 3, 100, value)
+	// 缓存的是拷贝，put之后修改value不影响缓存
+	value[0] = 'x'
+	got, ok := c.get(Hash, 3, 100)
+	assert.True(t, ok)
+	assert.Equal(t, bytes.Repeat([]byte("v"), 100), got)
+	value[0] = 'v'
+	// 数据类型、文件、offset不同都是不同的缓存项
+	_, ok = c.get(String, 3, 100)
+	assert.False(t, ok)
+	_, ok = c.get(Hash, 4, 100)
+	assert.False(t, ok)
+
+	// 超出分片容量时淘汰最久没读过的
+	c.put(Hash, 3, sameShard[0], value)
+	_, ok = c.get(Hash, 3, 100)
+	assert.True(t, ok)
+	c.put(Hash, 3, sameShard[1], value)
+	_, ok = c.get(Hash, 3, sameShard[0])
+	assert.False(t, ok)
+	_, ok = c.get(Hash, 3, 100)
+	assert.True(t, ok)
+	// 超过分片容量的value不缓存
+	c.put(Hash, 5, 0, bytes.Repeat([]byte("v"), 1000))
+	_, ok = c.get(Hash, 5, 0)
+	assert.False(t, ok)
+
+	stats := c.stats()
+	assert.Equal(t, uint64(3), stats.Hits)
+	assert.Equal(t, uint64(5), stats.Misses)
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, int64(2*(100+valueCacheEntryOverhead)), stats.Bytes)
+	assert.InDelta(t, 3.0/8, stats.HitRate(), 1e-9)
+}
+
+func TestSDB_ValueCache(t *testing.T) {
+	pwd, _ := os.Getwd()
+	opts := options.NewDefaultOptions(filepath.Join(pwd, "test/value-cache"))
+	opts.LogFileSizeThreshold = 4 << 10
+	opts.LogFileMergeInterval = 0
+	opts.CountBufferSize = 1024
+	opts.BlobThreshold = 1024
+	opts.ValueCacheSize = 1 << 20
+	db, err := OpenDB(opts)
+	assert.Nil(t, err)
+	defer func() {
+		clearDB(db)
+	}()
+
+	bigValue := func(i, version int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("big-%04d-%04d;", i, version)), 100)
+	}
+	writeCount := 100
+	for i := 0; i < writeCount; i++ {
+		assert.Nil(t, db.Set(getTestKey(i), getTestValue(i)))
+		assert.Nil(t, db.HSet([]byte("hash"), getTestKey(i), bigValue(i, 0)))
+	}
+	assertValues := func(version int) {
+		for i := 0; i < writeCount; i++ {
+			val, err := db.Get(getTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, getTestValue(i+version), val)
+			val, err = db.HGet([]byte("hash"), getTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, bigValue(i, version), val)
+		}
+	}
+	// 第一次从文件读，第二次命中缓存，blob中的value也缓存
+	assertValues(0)
+	stats := db.CacheStats()
+	assert.Equal(t, uint64(0), stats.Hits)
+	assert.Equal(t, uint64(2*writeCount), stats.Misses)
+	assertValues(0)
+	stats = db.CacheStats()
+	assert.Equal(t, uint64(2*writeCount), stats.Hits)
+	assert.Equal(t, 2*writeCount, stats.Entries)
+	assert.Equal(t, 0.5, stats.HitRate())
+
+	// 修改Get返回的value不影响之后的读
+	for i := 0; i < 2; i++ {
+		val, err := db.Get(getTestKey(0))
+		assert.Nil(t, err)
+		assert.Equal(t, getTestValue(0), val)
+		val[0] = 'X'
+	}
+	assert.Equal(t, uint64(2*writeCount+2), db.CacheStats().Hits)
+
+	// 更新之后位置变了，不会读到缓存中的旧值
+	for i := 0; i < writeCount; i++ {
+		assert.Nil(t, db.Set(getTestKey(i), getTestValue(i+1)))
+		assert.Nil(t, db.HSet([]byte("hash"), getTestKey(i), bigValue(i, 1)))
+	}
+	assertValues(1)
+	_, err = db.Get([]byte("missing"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// merge之后也一样
+	fID := waitMergeCandidate(t, db, String)
+	assert.Nil(t, db.MergeSpecificLogFile(String, int(fID), 0))
+	fID = waitMergeCandidate(t, db, Hash)
+	assert.Nil(t, db.MergeSpecificLogFile(Hash, int(fID), 0))
+	assertValues(1)
+	assert.Nil(t, db.Delete(getTestKey(0)))
+	_, err = db.Get(getTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
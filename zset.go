@@ -6,30 +6,167 @@ import (
 	"sdb/utils"
 )
 
+// zset结构，有序集合
+// key->member1:score1|member2:score2|...
+// 内存中有两种索引：
+// 1.和set一样，一个key一棵ar树，member的hash值sum->keyDir，用来判断member是否存在以及merge时判断record是否有效
+// 2.zset.SortedSet跳表，member和score都在内存中，用来查询分值、排名、范围
+// 文件中record的key是key和member编码生成的zsetKey，value是score，删除时写zsetKey的删除记录
+// 这样启动时顺序读日志就能重建ar树和跳表
+
 // ZAdd 设置指定key的有序集合的member的score
-func (db *SDB) ZAdd(key []byte, score float64, value []byte) error {
+func (db *SDB) ZAdd(key []byte, score float64, value []byte) (err error) {
 	db.zsetIndex.mu.Lock()
-	defer db.zsetIndex.mu.Unlock()
+	defer db.unlockAndSync(ZSet, &err)
+
+	return db.zaddInternal(key, score, value)
+}
+
+// ZScore 返回指定key的有序集合的member的score，member不存在ok为false
+func (db *SDB) ZScore(key, member []byte) (ok bool, score float64) {
+	db.zsetIndex.mu.RLock()
+	defer db.zsetIndex.mu.RUnlock()
+
+	return db.zsetIndex.indexes.ZScore(string(key), string(member))
+}
+
+// ZCard 返回指定key的有序集合的成员个数
+func (db *SDB) ZCard(key []byte) int {
+	db.zsetIndex.mu.RLock()
+	defer db.zsetIndex.mu.RUnlock()
+
+	return db.zsetIndex.indexes.ZCard(string(key))
+}
+
+// ZRank 返回member按score从小到大的排名，从0开始，member不存在返回-1
+func (db *SDB) ZRank(key, member []byte) int64 {
+	db.zsetIndex.mu.RLock()
+	defer db.zsetIndex.mu.RUnlock()
+
+	return db.zsetIndex.indexes.ZRank(string(key), string(member))
+}
+
+// ZRevRank 返回member按score从大到小的排名，从0开始，member不存在返回-1
+func (db *SDB) ZRevRank(key, member []byte) int64 {
+	db.zsetIndex.mu.RLock()
+	defer db.zsetIndex.mu.RUnlock()
+
+	return db.zsetIndex.indexes.ZRevRank(string(key), string(member))
+}
+
+// ZRange 返回按score从小到大排名在[start, stop]之间的member，负数表示倒数
+func (db *SDB) ZRange(key []byte, start, stop int) [][]byte {
+	db.zsetIndex.mu.RLock()
+	defer db.zsetIndex.mu.RUnlock()
 
-	if err := db.zsetIndex.murmurhash.Write(value); err != nil {
+	return membersToBytes(db.zsetIndex.indexes.ZRange(string(key), start, stop))
+}
+
+// ZRevRange 返回按score从大到小排名在[start, stop]之间的member，负数表示倒数
+func (db *SDB) ZRevRange(key []byte, start, stop int) [][]byte {
+	db.zsetIndex.mu.RLock()
+	defer db.zsetIndex.mu.RUnlock()
+
+	return membersToBytes(db.zsetIndex.indexes.ZRevRange(string(key), start, stop))
+}
+
+// ZRem 删除指定key的有序集合的member，member不存在忽略
+func (db *SDB) ZRem(key, member []byte) (err error) {
+	db.zsetIndex.mu.Lock()
+	defer db.unlockAndSync(ZSet, &err)
+
+	if ok, _ := db.zsetIndex.indexes.ZScore(string(key), string(member)); !ok {
+		return nil
+	}
+	sum, err := db.zsetMemberSum(member)
+	if err != nil {
+		return err
+	}
+	db.zsetIndex.idxTree = db.zsetIndex.trees[string(key)]
+
+	record := &bitcask.LogRecord{Key: utils.EncodeZSetKey(key, member), Type: bitcask.TypeDelete}
+	keyDir, err := db.writeLogRecord(record, ZSet)
+	if err != nil {
+		return err
+	}
+	if db.zsetIndex.idxTree != nil {
+		if err = db.deleteIndexTree(sum, keyDir, ZSet); err != nil {
+			return err
+		}
+	}
+	db.zsetIndex.indexes.ZRem(string(key), string(member))
+
+	// 有序集合空了，释放这个key的索引
+	if db.zsetIndex.indexes.ZCard(string(key)) == 0 {
+		db.zsetIndex.indexes.ZClear(string(key))
+		delete(db.zsetIndex.trees, string(key))
+	}
+	return nil
+}
+
+// ZIncrBy 给指定key的有序集合的member的score加上increment，member不存在视为0，返回新的score
+func (db *SDB) ZIncrBy(key []byte, increment float64, member []byte) (score float64, err error) {
+	db.zsetIndex.mu.Lock()
+	defer db.unlockAndSync(ZSet, &err)
+
+	if ok, score := db.zsetIndex.indexes.ZScore(string(key), string(member)); ok {
+		increment += score
+	}
+	if err := db.zaddInternal(key, increment, member); err != nil {
+		return 0, err
+	}
+	return increment, nil
+}
+
+func (db *SDB) zaddInternal(key []byte, score float64, member []byte) error {
+	// 分值没变，不需要写文件
+	if ok, oldScore := db.zsetIndex.indexes.ZScore(string(key), string(member)); ok && oldScore == score {
+		return nil
+	}
+
+	sum, err := db.zsetMemberSum(member)
+	if err != nil {
 		return err
 	}
-	sum := db.zsetIndex.murmurhash.EncodeSum128()
-	db.zsetIndex.murmurhash.Reset()
 	if db.zsetIndex.trees[string(key)] == nil {
 		db.zsetIndex.trees[string(key)] = art.NewART()
 	}
 	db.zsetIndex.idxTree = db.zsetIndex.trees[string(key)]
 
+	// key+member作为key，score作为value
 	scoreBuf := []byte(utils.Float64ToStr(score))
-	zsetKey := utils.EncodeZSetKey(key, scoreBuf)
-
-	// key+score作为key
-	record := &bitcask.LogRecord{Key: zsetKey, Value: value}
+	record := &bitcask.LogRecord{Key: utils.EncodeZSetKey(key, member), Value: scoreBuf}
 	keyDir, err := db.writeLogRecord(record, ZSet)
 	if err != nil {
 		return err
 	}
 
-	return db.updateIndexTree(&bitcask.LogRecord{Key: sum, Value: value}, keyDir, true, ZSet)
+	if err = db.updateIndexTree(&bitcask.LogRecord{Key: sum, Value: scoreBuf}, keyDir, true, ZSet); err != nil {
+		return err
+	}
+	db.zsetIndex.indexes.ZAdd(string(key), score, string(member))
+	return nil
+}
+
+// 计算有序集合成员的hash值
+func (db *SDB) zsetMemberSum(member []byte) ([]byte, error) {
+	if err := db.zsetIndex.murmurhash.Write(member); err != nil {
+		return nil, err
+	}
+	sum := db.zsetIndex.murmurhash.EncodeSum128()
+	db.zsetIndex.murmurhash.Reset()
+	return sum, nil
+}
+
+func membersToBytes(members []interface{}) [][]byte {
+	if len(members) == 0 {
+		return nil
+	}
+	values := make([][]byte, 0, len(members))
+	for _, member := range members {
+		if m, ok := member.(string); ok {
+			values = append(values, []byte(m))
+		}
+	}
+	return values
 }
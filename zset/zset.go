@@ -156,13 +156,12 @@ func (skl *skipList) sklInsert(score float64, member string) *sklNode {
 		}
 
 		if p.level[i] != nil {
-			nextNode := p.level[i].forward
-			for nextNode != nil && //在该层进行循环遍历
-				(nextNode.score < score || //新的分值比当前遍历节点的后后置节点分值大，后移
-					(nextNode.score == score && nextNode.member < member)) { //分值一样按字典序
+			for p.level[i].forward != nil && //在该层进行循环遍历
+				(p.level[i].forward.score < score || //新的分值比当前遍历节点的后后置节点分值大，后移
+					(p.level[i].forward.score == score && p.level[i].forward.member < member)) { //分值一样按字典序
 				//跨度累加
 				rank[i] += p.level[i].span //加上这个的跨度
-				p = nextNode
+				p = p.level[i].forward
 			}
 			//找到了要插到后面的节点
 		}
@@ -240,11 +239,10 @@ func (skl *skipList) sklDelete(score float64, member string) {
 	p := skl.head
 
 	for i := skl.level - 1; i >= 0; i-- {
-		nextNode := p.level[i].forward
-		for nextNode != nil &&
-			(nextNode.score < score ||
-				(nextNode.score == score && nextNode.member < member)) {
-			p = nextNode
+		for p.level[i].forward != nil &&
+			(p.level[i].forward.score < score ||
+				(p.level[i].forward.score == score && p.level[i].forward.member < member)) {
+			p = p.level[i].forward
 		}
 		update[i] = p //转折点
 	}
@@ -403,7 +401,7 @@ func (z *SortedSet) ZRevGetByRank(key string, rank int) (val []interface{}) {
 
 // ZScoreRange 返回指定分数范围的元素（成员和分数）（从小到大）
 func (z *SortedSet) ZScoreRange(key string, min, max float64) (val []interface{}) {
-	if !z.exist(key) || min > max {
+	if !z.exist(key) || min > max || z.record[key].skl.length == 0 {
 		return
 	}
 
@@ -440,7 +438,7 @@ func (z *SortedSet) ZScoreRange(key string, min, max float64) (val []interface{}
 
 // ZRevScoreRange 返回指定分数范围的元素（成员和分数）（从大到小）
 func (z *SortedSet) ZRevScoreRange(key string, max, min float64) (val []interface{}) {
-	if !z.exist(key) || max < min {
+	if !z.exist(key) || max < min || z.record[key].skl.length == 0 {
 		return
 	}
 
@@ -462,7 +460,7 @@ func (z *SortedSet) ZRevScoreRange(key string, max, min float64) (val []interfac
 		}
 	}
 
-	for p != nil {
+	for p != nil && p != item.head { //头节点不是成员
 		if p.score < min {
 			break
 		}
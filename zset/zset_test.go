@@ -0,0 +1,84 @@
+package zset
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func initSortedSet() *SortedSet {
+	z := New()
+	z.ZAdd("key", 3, "c")
+	z.ZAdd("key", 1, "a")
+	z.ZAdd("key", 2, "b")
+	z.ZAdd("key", 5, "e")
+	z.ZAdd("key", 4, "d")
+	return z
+}
+
+func TestSortedSet_ZAdd(t *testing.T) {
+	z := initSortedSet()
+	assert.Equal(t, 5, z.ZCard("key"))
+	assert.Equal(t, []interface{}{"a", "b", "c", "d", "e"}, z.ZRange("key", 0, -1))
+
+	// 更新分值后重新排序
+	z.ZAdd("key", 0, "e")
+	assert.Equal(t, 5, z.ZCard("key"))
+	assert.Equal(t, []interface{}{"e", "a", "b", "c", "d"}, z.ZRange("key", 0, -1))
+
+	// 分值相同按字典序
+	z.ZAdd("key", 1, "aa")
+	assert.Equal(t, []interface{}{"e", "a", "aa", "b", "c", "d"}, z.ZRange("key", 0, -1))
+}
+
+func TestSortedSet_ZRank(t *testing.T) {
+	z := initSortedSet()
+	assert.Equal(t, int64(0), z.ZRank("key", "a"))
+	assert.Equal(t, int64(4), z.ZRank("key", "e"))
+	assert.Equal(t, int64(0), z.ZRevRank("key", "e"))
+	assert.Equal(t, int64(4), z.ZRevRank("key", "a"))
+	assert.Equal(t, int64(-1), z.ZRank("key", "not-exist"))
+	assert.Equal(t, int64(-1), z.ZRank("not-exist", "a"))
+}
+
+func TestSortedSet_ZRem(t *testing.T) {
+	z := initSortedSet()
+	assert.True(t, z.ZRem("key", "c"))
+	assert.False(t, z.ZRem("key", "c"))
+	assert.Equal(t, 4, z.ZCard("key"))
+	assert.Equal(t, []interface{}{"a", "b", "d", "e"}, z.ZRange("key", 0, -1))
+	assert.Equal(t, int64(2), z.ZRank("key", "d"))
+
+	ok, _ := z.ZScore("key", "c")
+	assert.False(t, ok)
+}
+
+func TestSortedSet_ZRange(t *testing.T) {
+	z := initSortedSet()
+	assert.Equal(t, []interface{}{"b", "c"}, z.ZRange("key", 1, 2))
+	assert.Equal(t, []interface{}{"e", "d"}, z.ZRevRange("key", 0, 1))
+	assert.Equal(t, []interface{}{"a", float64(1), "b", float64(2)}, z.ZRangeWithScores("key", 0, 1))
+	assert.Nil(t, z.ZRange("key", 5, 6))
+	assert.Nil(t, z.ZRange("not-exist", 0, -1))
+}
+
+func TestSortedSet_ZScoreRange(t *testing.T) {
+	z := initSortedSet()
+	assert.Equal(t, []interface{}{"b", float64(2), "c", float64(3)}, z.ZScoreRange("key", 2, 3))
+	assert.Equal(t, []interface{}{"c", float64(3), "b", float64(2)}, z.ZRevScoreRange("key", 3, 2))
+	assert.Nil(t, z.ZRevScoreRange("key", 0.5, 0))
+
+	z.ZAdd("key", -5, "neg")
+	assert.Nil(t, z.ZRevScoreRange("key", -6, -10))
+	assert.Equal(t, []interface{}{"neg", float64(-5)}, z.ZScoreRange("key", -10, 0))
+}
+
+func TestSortedSet_ZIncrBy(t *testing.T) {
+	z := initSortedSet()
+	assert.Equal(t, float64(10), z.ZIncrBy("key", 9, "a"))
+	assert.Equal(t, int64(4), z.ZRank("key", "a"))
+	assert.Equal(t, float64(1), z.ZIncrBy("key", 1, "f"))
+	ok, score := z.ZScore("key", "f")
+	assert.True(t, ok)
+	assert.Equal(t, float64(1), score)
+}
@@ -0,0 +1,106 @@
+package sdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"sdb/options"
+)
+
+func TestSDB_ZSet(t *testing.T) {
+	t.Run("Standard Io", func(t *testing.T) {
+		testSDBZSet(t, options.FileIO, options.BitCaskMode)
+	})
+
+	t.Run("MMap IO", func(t *testing.T) {
+		testSDBZSet(t, options.MMap, options.BitCaskMode)
+	})
+
+	t.Run("Memory Mode", func(t *testing.T) {
+		testSDBZSet(t, options.FileIO, options.MemoryMode)
+	})
+}
+
+func testSDBZSet(t *testing.T, ioType options.IOType, mode options.StoreMode) {
+	pwd, _ := os.Getwd()
+	path := filepath.Join(pwd, "test/zset")
+	opts := options.NewDefaultOptions(path)
+	opts.IoType = ioType
+	opts.StoreMode = mode
+	opts.LogFileSizeThreshold = 4 << 10
+	db, err := OpenDB(opts)
+	assert.Nil(t, err)
+	defer func() {
+		clearDB(db)
+	}()
+
+	key := []byte("leaderboard")
+	assert.Nil(t, db.ZAdd(key, 30, []byte("c")))
+	assert.Nil(t, db.ZAdd(key, 10, []byte("a")))
+	assert.Nil(t, db.ZAdd(key, 20, []byte("b")))
+	assert.Nil(t, db.ZAdd(key, 40, []byte("d")))
+	assert.Equal(t, 4, db.ZCard(key))
+
+	ok, score := db.ZScore(key, []byte("b"))
+	assert.True(t, ok)
+	assert.Equal(t, float64(20), score)
+	ok, _ = db.ZScore(key, []byte("not-exist"))
+	assert.False(t, ok)
+
+	assert.Equal(t, int64(1), db.ZRank(key, []byte("b")))
+	assert.Equal(t, int64(0), db.ZRevRank(key, []byte("d")))
+	assert.Equal(t, int64(-1), db.ZRank(key, []byte("not-exist")))
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}, db.ZRange(key, 0, -1))
+	assert.Equal(t, [][]byte{[]byte("d"), []byte("c")}, db.ZRevRange(key, 0, 1))
+	assert.Nil(t, db.ZRange([]byte("not-exist"), 0, -1))
+
+	newScore, err := db.ZIncrBy(key, 25, []byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, float64(35), newScore)
+	assert.Equal(t, int64(2), db.ZRank(key, []byte("a")))
+	newScore, err = db.ZIncrBy(key, 5, []byte("e"))
+	assert.Nil(t, err)
+	assert.Equal(t, float64(5), newScore)
+
+	assert.Nil(t, db.ZRem(key, []byte("c")))
+	assert.Nil(t, db.ZRem(key, []byte("not-exist")))
+	assert.Equal(t, 4, db.ZCard(key))
+
+	// 清空的有序集合
+	assert.Nil(t, db.ZAdd([]byte("empty"), 1, []byte("x")))
+	assert.Nil(t, db.ZRem([]byte("empty"), []byte("x")))
+	assert.Equal(t, 0, db.ZCard([]byte("empty")))
+
+	// 写多个文件
+	writeCount := 200
+	for i := 0; i < writeCount; i++ {
+		assert.Nil(t, db.ZAdd([]byte("many"), float64(i), []byte(fmt.Sprintf("member-%d", i))))
+	}
+	assert.True(t, len(db.immutableFiles[ZSet]) > 0)
+
+	want := [][]byte{[]byte("e"), []byte("b"), []byte("a"), []byte("d")}
+	assert.Equal(t, want, db.ZRange(key, 0, -1))
+
+	// 重启后有序集合完全一致，分别从快照和日志文件恢复
+	for _, removeSnapshot := range []bool{false, true} {
+		assert.Nil(t, db.CloseDB())
+		if removeSnapshot {
+			assert.Nil(t, os.Remove(filepath.Join(path, indexSnapshotFileName)))
+		}
+		db, err = OpenDB(opts)
+		assert.Nil(t, err)
+
+		assert.Equal(t, want, db.ZRange(key, 0, -1))
+		ok, score = db.ZScore(key, []byte("a"))
+		assert.True(t, ok)
+		assert.Equal(t, float64(35), score)
+		ok, _ = db.ZScore(key, []byte("c"))
+		assert.False(t, ok)
+		assert.Equal(t, 0, db.ZCard([]byte("empty")))
+		assert.Equal(t, writeCount, db.ZCard([]byte("many")))
+		assert.Equal(t, int64(writeCount-1), db.ZRank([]byte("many"), []byte(fmt.Sprintf("member-%d", writeCount-1))))
+	}
+}